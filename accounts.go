@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Accounts are optional: a visitor can attach an email address and receive a
+// magic login link. Opening the link on any device shows a confirm page, and
+// confirming switches that browser to the account's visitor ID. Only the
+// browser that asked for the link brings its progress along, so the reserved
+// tag, highscores and ratings follow them there. Sending mail needs
+// SMTP_ADDR; without it the account endpoints are disabled.
+var (
+	smtpAddr     = os.Getenv("SMTP_ADDR")
+	smtpFrom     = envString("SMTP_FROM", "terminal@currentcondition.tv")
+	smtpUser     = os.Getenv("SMTP_USER")
+	smtpPassword = secret("SMTP_PASSWORD")
+)
+
+const (
+	magicLinkTTL      = 15 * time.Minute
+	magicLinkInterval = time.Minute
+)
+
+// AccountResponse describes the current visitor's account, if any
+type AccountResponse struct {
+	Enabled bool   `json:"enabled"`
+	Email   string `json:"email,omitempty"`
+}
+
+// normalizeEmail validates an address and returns it lower-cased
+func normalizeEmail(s string) (string, bool) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(s))
+	if err != nil || len(addr.Address) > 254 || addr.Name != "" {
+		return "", false
+	}
+	return strings.ToLower(addr.Address), true
+}
+
+// hashToken is how secrets (login links, sessions, device keys, resume
+// tokens) are stored, so a leaked database doesn't leak them
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// getVisitorAccount returns the email of the account a visitor belongs to, or ""
+func getVisitorAccount(ctx context.Context, db *sql.DB, visitorID string) (string, error) {
+	var email string
+	err := db.QueryRowContext(ctx, `SELECT email FROM accounts WHERE visitor_id = ?`, visitorID).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return email, err
+}
+
+// createMagicLink stores a single-use login token for email, asked for by
+// visitorID, refusing to issue another within magicLinkInterval
+func createMagicLink(ctx context.Context, db *sql.DB, email, visitorID string, now time.Time) (string, bool, error) {
+	var recent int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM magic_links WHERE email = ? AND created_at > ?`,
+		email, now.Add(-magicLinkInterval).Unix()).Scan(&recent)
+	if err != nil || recent > 0 {
+		return "", false, err
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM magic_links WHERE expires_at < ?`, now.Unix()); err != nil {
+		return "", false, err
+	}
+	token := generateVisitorID()
+	_, err = db.ExecContext(ctx, `INSERT INTO magic_links (token_hash, email, visitor_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		hashToken(token), email, visitorID, now.Unix(), now.Add(magicLinkTTL).Unix())
+	return token, err == nil, err
+}
+
+// magicLinkEmail returns the email a token signs in to, without using it up,
+// or "" if it's invalid or expired
+func magicLinkEmail(ctx context.Context, db *sql.DB, token string, now time.Time) (string, error) {
+	var email string
+	err := db.QueryRowContext(ctx, `SELECT email FROM magic_links WHERE token_hash = ? AND expires_at >= ?`,
+		hashToken(token), now.Unix()).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return email, err
+}
+
+// redeemMagicLink consumes a token on behalf of visitorID and returns the
+// account's visitor ID. A new account adopts the visitor who asked for the
+// link, unless that visitor already belongs to another account. When the
+// asking visitor signs in to an existing account, its progress moves over
+// (see moveVisitorProgress), unless it has an account of its own; any other
+// browser opening the link just signs in, taking nothing with it.
+func redeemMagicLink(ctx context.Context, db *sql.DB, token, visitorID string, now time.Time) (string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var email, requester string
+	err = tx.QueryRowContext(ctx, `DELETE FROM magic_links WHERE token_hash = ? AND expires_at >= ? RETURNING email, visitor_id`,
+		hashToken(token), now.Unix()).Scan(&email, &requester)
+	if err == sql.ErrNoRows {
+		return "", errInvalidMagicLink
+	}
+	if err != nil {
+		return "", err
+	}
+	if requester == "" {
+		// Asked for before links recorded who asked; adopt nobody's progress
+		requester = generateVisitorID()
+	}
+
+	var linked bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM accounts WHERE visitor_id = ? AND email != ?)`,
+		requester, email).Scan(&linked)
+	if err != nil {
+		return "", err
+	}
+
+	var accountVisitor string
+	err = tx.QueryRowContext(ctx, `SELECT visitor_id FROM accounts WHERE email = ?`, email).Scan(&accountVisitor)
+	if err == sql.ErrNoRows {
+		if linked {
+			return "", errAccountConflict
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO accounts (email, visitor_id) VALUES (?, ?)`, email, requester); err != nil {
+			return "", err
+		}
+		return requester, tx.Commit()
+	}
+	if err != nil {
+		return "", err
+	}
+	if visitorID == requester && accountVisitor != visitorID && !linked {
+		if err := moveVisitorProgress(ctx, tx, visitorID, accountVisitor); err != nil {
+			return "", err
+		}
+	}
+	return accountVisitor, tx.Commit()
+}
+
+// moveVisitorProgress hands a visitor's tag, highscores, ratings, challenge
+// scores, puzzle results and preferences to the account's visitor. Where the
+// account already has its own (a tag, a rating for the same game, a puzzle
+// played the same day), the account's wins; if both have a tag, the visitor's
+// highscores are renamed to the account's tag and the visitor's tag is
+// released.
+func moveVisitorProgress(ctx context.Context, tx *sql.Tx, from, to string) error {
+	var fromTag, toTag sql.NullString
+	if err := tx.QueryRowContext(ctx, `SELECT name FROM nicknames WHERE visitor_id = ?`, from).Scan(&fromTag); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err := tx.QueryRowContext(ctx, `SELECT name FROM nicknames WHERE visitor_id = ?`, to).Scan(&toTag); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	for _, query := range []string{
+		`UPDATE highscores SET visitor_id = ? WHERE visitor_id = ?`,
+		`UPDATE challenge_scores SET visitor_id = ? WHERE visitor_id = ?`,
+		`UPDATE OR IGNORE ratings SET visitor_id = ? WHERE visitor_id = ?`,
+		`UPDATE OR IGNORE puzzle_results SET visitor_id = ? WHERE visitor_id = ?`,
+		`UPDATE OR IGNORE puzzle_guesses SET visitor_id = ? WHERE visitor_id = ?`,
+		`UPDATE OR IGNORE visitor_prefs SET visitor_id = ? WHERE visitor_id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, query, to, from); err != nil {
+			return err
+		}
+	}
+
+	if !fromTag.Valid || fromTag.String == toTag.String {
+		return nil
+	}
+	if !toTag.Valid {
+		_, err := tx.ExecContext(ctx, `UPDATE nicknames SET visitor_id = ? WHERE visitor_id = ?`, to, from)
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE highscores SET name = ? WHERE visitor_id = ? AND name = ?`,
+		toTag.String, to, fromTag.String); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE challenge_scores SET name = ? WHERE visitor_id = ? AND name = ?`,
+		toTag.String, to, fromTag.String); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM nicknames WHERE visitor_id = ?`, from)
+	return err
+}
+
+var errAccountConflict = fmt.Errorf("visitor already belongs to another account")
+var errInvalidMagicLink = fmt.Errorf("magic link invalid or expired")
+
+// sendMagicLink mails the login link
+func sendMagicLink(email, link string) error {
+	host := smtpAddr
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	var auth smtp.Auth
+	if smtpUser != "" {
+		auth = smtp.PlainAuth("", smtpUser, smtpPassword, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Your Current Condition login link\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n"+
+		"Open this link to sign in on this device (valid for %d minutes):\r\n\r\n%s\r\n\r\n"+
+		"If you didn't ask for it, ignore this email.\r\n",
+		smtpFrom, email, int(magicLinkTTL.Minutes()), link)
+	return smtp.SendMail(smtpAddr, auth, smtpFrom, []string{email}, []byte(msg))
+}
+
+// handleAccount reports (GET), requests a magic link for (POST) or detaches
+// (DELETE) the current visitor's account
+func handleAccount(w http.ResponseWriter, r *http.Request) {
+	visitorID := visitorIDFromRequest(w, r)
+	site := tenantFor(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		email := ""
+		if smtpAddr != "" {
+			var err error
+			if email, err = getVisitorAccount(r.Context(), site.db, visitorID); err != nil {
+				log.Printf("Error getting account: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AccountResponse{Enabled: smtpAddr != "", Email: email})
+
+	case http.MethodPost:
+		if smtpAddr == "" {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Email string `json:"email"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		email, ok := normalizeEmail(req.Email)
+		if !ok {
+			http.Error(w, "Invalid email", http.StatusBadRequest)
+			return
+		}
+		token, ok, err := createMagicLink(r.Context(), site.db, email, visitorID, time.Now())
+		if err != nil {
+			log.Printf("Error creating magic link: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Link already sent, try again in a minute", http.StatusTooManyRequests)
+			return
+		}
+		link := site.url + "/api/account/verify?token=" + token
+		go func() {
+			if err := sendMagicLink(email, link); err != nil {
+				log.Printf("Error sending magic link: %v", err)
+			}
+		}()
+		w.WriteHeader(http.StatusAccepted)
+
+	case http.MethodDelete:
+		if _, err := site.db.ExecContext(r.Context(), `DELETE FROM accounts WHERE visitor_id = ?`, visitorID); err != nil {
+			log.Printf("Error deleting account: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// verifyPage asks before a magic link signs the browser in, so neither a
+// link scanner prefetching it nor someone else's link opened by mistake can
+var verifyPage = template.Must(template.New("verify").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width">
+<title>Current Condition sign in</title></head>
+<body style="background:#000;color:#33ff33;font-family:monospace;padding:2em">
+<form method="post" action="/api/account/verify">
+<p>SIGN THIS BROWSER IN AS {{.Email}}?</p>
+<input type="hidden" name="token" value="{{.Token}}">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<button type="submit">SIGN IN</button>
+</form>
+</body></html>
+`))
+
+// handleAccountVerify shows the confirm page for a magic link (GET) and signs
+// this browser in once it's confirmed (POST)
+func handleAccountVerify(w http.ResponseWriter, r *http.Request) {
+	if smtpAddr == "" {
+		http.NotFound(w, r)
+		return
+	}
+	site := tenantFor(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		token := r.URL.Query().Get("token")
+		email, err := magicLinkEmail(r.Context(), site.db, token, time.Now())
+		if err != nil {
+			log.Printf("Error checking magic link: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if email == "" {
+			http.Error(w, "This link is invalid or has expired", http.StatusGone)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		verifyPage.Execute(w, struct{ Email, Token, CSRF string }{email, token, csrfTokenFromRequest(w, r)})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	if err := r.ParseForm(); err != nil || !csrfValid(r, r.PostFormValue("csrf")) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+	visitorID := generateVisitorID()
+	if cookie, err := r.Cookie("visitor_id"); err == nil {
+		visitorID = cookie.Value
+	}
+	accountVisitor, err := redeemMagicLink(r.Context(), site.db, r.PostFormValue("token"), visitorID, time.Now())
+	if err == errInvalidMagicLink {
+		http.Error(w, "This link is invalid or has expired", http.StatusGone)
+		return
+	}
+	if err == errAccountConflict {
+		http.Error(w, "The browser that asked for this link is signed in to another account, sign out there first", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error redeeming magic link: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if accountVisitor != visitorID {
+		// Highscores may have been renamed to the account's tag
+		for _, game := range []string{"SNAKE", "TETRIS", "ASTEROIDS", "PONG"} {
+			highscoreCache.remove(highscoreCacheKey(site, game))
+		}
+	}
+	setVisitorCookie(w, accountVisitor)
+	csrfTokenFromRequest(w, r)
+	touchVisitor(r.Context(), site.db, accountVisitor)
+	http.Redirect(w, r, "/?account=linked", http.StatusSeeOther)
+}
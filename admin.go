@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Admin endpoints are disabled unless ADMIN_TOKEN or GitHub login is set up
+var adminToken = secret("ADMIN_TOKEN")
+
+// adminRole orders what an admin may do: viewers can read the admin API,
+// moderators can also act on visitors and highscores, and admins can change
+// configuration and data
+type adminRole int
+
+const (
+	roleNone adminRole = iota
+	roleViewer
+	roleModerator
+	roleAdmin
+)
+
+var roleNames = map[adminRole]string{roleViewer: "viewer", roleModerator: "moderator", roleAdmin: "admin"}
+
+func (r adminRole) String() string {
+	return roleNames[r]
+}
+
+func parseRole(s string) (adminRole, bool) {
+	for role, name := range roleNames {
+		if strings.EqualFold(s, name) {
+			return role, true
+		}
+	}
+	return roleNone, false
+}
+
+// adminIdentity returns who is making an admin request and their role
+func adminIdentity(site *Tenant, r *http.Request) (string, adminRole) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if site.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(site.adminToken)) == 1 {
+		return "token", roleAdmin
+	}
+	if login := adminSessionLogin(site, r); login != "" {
+		return "github:" + login, site.githubUsers[strings.ToLower(login)]
+	}
+	return "", roleNone
+}
+
+// requireRole guards an admin handler: reading needs any role, anything else
+// needs at least role. Every request other than a read is written to the
+// audit log, whether or not it was allowed.
+func requireRole(role adminRole, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		site := tenantFor(r)
+		if site.adminToken == "" && !githubLoginEnabled(site) {
+			http.NotFound(w, r)
+			return
+		}
+		actor, have := adminIdentity(site, r)
+		if have == roleNone {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		need := role
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			need = roleViewer
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			defer func() { auditAdminAction(site, r, actor, have, sw.status) }()
+			w = sw
+		}
+		if have < need {
+			http.Error(w, "Forbidden: requires "+need.String(), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireAPIKeyOr lets a request carrying the site's LOCATIONS_API_KEY in
+// X-API-Key through, and guards everything else with requireRole
+func requireAPIKeyOr(role adminRole, next http.HandlerFunc) http.HandlerFunc {
+	guarded := requireRole(role, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		site := tenantFor(r)
+		key := r.Header.Get("X-API-Key")
+		if site.apiKey == "" || key == "" {
+			guarded(w, r)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(site.apiKey)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// auditAdminAction records a privileged request
+func auditAdminAction(site *Tenant, r *http.Request, actor string, role adminRole, status int) {
+	log.Printf("Admin %s (%s) %s %s -> %d", actor, role, r.Method, r.URL.RequestURI(), status)
+	_, err := site.db.ExecContext(r.Context(), `
+		INSERT INTO admin_audit (at, actor, role, method, path, status, ip) VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, time.Now().Unix(), actor, role.String(), r.Method, r.URL.RequestURI(), status, clientIP(r))
+	if err != nil {
+		log.Printf("Error writing admin audit log: %v", err)
+	}
+}
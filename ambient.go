@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Ambient replay plays recorded cursor sessions back as "ghost" cursors
+// when the site is quiet. Enable with AMBIENT_REPLAY=1. Each site records
+// and replays its own sessions, and only records visitors who opted in with
+// POST /api/replay {"share":true}; the choice applies from their next
+// connection.
+var (
+	ambientReplay   = os.Getenv("AMBIENT_REPLAY") == "1"
+	ambientMaxUsers = envInt("AMBIENT_MAX_USERS", 1)
+)
+
+const (
+	recordingInterval  = 50 * time.Millisecond
+	recordingMaxFrames = 2000
+	recordingMinFrames = 20
+	recordingsKept     = 50
+)
+
+// CursorFrame is one sampled cursor position in a recording
+type CursorFrame struct {
+	OffsetMs int64   `json:"t"`
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Zone     string  `json:"zone,omitempty"`
+}
+
+// CursorRecording samples a client's cursor movement for later playback
+type CursorRecording struct {
+	started time.Time
+	last    time.Time
+	frames  []CursorFrame
+}
+
+// add samples a position, throttled to recordingInterval
+func (rec *CursorRecording) add(pos *CursorPosition) {
+	now := time.Now()
+	if rec.started.IsZero() {
+		rec.started = now
+	}
+	if len(rec.frames) >= recordingMaxFrames || now.Sub(rec.last) < recordingInterval {
+		return
+	}
+	rec.last = now
+	// Only the movement is kept, never the visitor's location label
+	rec.frames = append(rec.frames, CursorFrame{
+		OffsetMs: now.Sub(rec.started).Milliseconds(),
+		X:        pos.X,
+		Y:        pos.Y,
+		Zone:     pos.Zone,
+	})
+}
+
+// loadReplayOptIn reports whether a visitor agreed to have their cursor
+// recorded for ambient replay
+func loadReplayOptIn(ctx context.Context, db *sql.DB, visitorID string) bool {
+	var share bool
+	err := db.QueryRowContext(ctx, `SELECT share_replay FROM visitor_prefs WHERE visitor_id = ?`, visitorID).Scan(&share)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error loading replay preference: %v", err)
+	}
+	return share
+}
+
+// ReplayResponse is returned by /api/replay
+type ReplayResponse struct {
+	Share bool `json:"share"`
+}
+
+// handleReplay shows (GET) or sets (POST {"share":true}) whether the
+// visitor's cursor may be recorded for ambient replay
+func handleReplay(w http.ResponseWriter, r *http.Request) {
+	visitorID := visitorIDFromRequest(w, r)
+	site := tenantFor(r)
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req ReplayResponse
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		_, err := site.db.ExecContext(r.Context(), `
+			INSERT INTO visitor_prefs (visitor_id, share_replay, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT(visitor_id) DO UPDATE SET share_replay = excluded.share_replay, updated_at = excluded.updated_at
+		`, visitorID, req.Share)
+		if err != nil {
+			log.Printf("Error saving replay preference: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ReplayResponse{Share: loadReplayOptIn(r.Context(), site.db, visitorID)})
+}
+
+// saveCursorRecording stores a finished session and trims old ones
+func saveCursorRecording(db *sql.DB, frames []CursorFrame) {
+	if len(frames) < recordingMinFrames {
+		return
+	}
+	data, _ := json.Marshal(frames)
+	duration := frames[len(frames)-1].OffsetMs
+	if _, err := db.Exec(`INSERT INTO cursor_recordings (frames, duration_ms) VALUES (?, ?)`, string(data), duration); err != nil {
+		log.Printf("Error saving cursor recording: %v", err)
+		return
+	}
+	_, err := db.Exec(`
+		DELETE FROM cursor_recordings WHERE id NOT IN (
+			SELECT id FROM cursor_recordings ORDER BY id DESC LIMIT ?
+		)
+	`, recordingsKept)
+	if err != nil {
+		log.Printf("Error trimming cursor recordings: %v", err)
+	}
+}
+
+// randomCursorRecording picks a stored session to replay
+func randomCursorRecording(db *sql.DB) (int64, []CursorFrame, error) {
+	var id int64
+	var data string
+	err := db.QueryRow(`SELECT id, frames FROM cursor_recordings ORDER BY RANDOM() LIMIT 1`).Scan(&id, &data)
+	if err != nil {
+		return 0, nil, err
+	}
+	var frames []CursorFrame
+	err = json.Unmarshal([]byte(data), &frames)
+	return id, frames, err
+}
+
+// activeUsers returns the number of connected (non-waiting) visitors
+func (h *Hub) activeUsers() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.users()
+}
+
+// runAmbientReplay replays a recorded session whenever few real users are around
+func (h *Hub) runAmbientReplay() {
+	for {
+		time.Sleep(10 * time.Second)
+
+		n := h.activeUsers()
+		if n == 0 || n > ambientMaxUsers {
+			continue
+		}
+		id, frames, err := randomCursorRecording(h.db)
+		if err != nil {
+			continue
+		}
+		h.playCursorRecording(id, frames)
+	}
+}
+
+// playCursorRecording sends a recording as ghost cursor moves, stopping early if the site gets busy
+func (h *Hub) playCursorRecording(id int64, frames []CursorFrame) {
+	ghostID := "ghost-" + strconv.FormatInt(id, 10)
+	start := time.Now()
+	defer func() {
+		data, _ := json.Marshal(CursorMessage{Type: "leave", ID: ghostID, Ghost: true})
+		h.broadcastToOthers("", data)
+	}()
+
+	for _, f := range frames {
+		time.Sleep(time.Until(start.Add(time.Duration(f.OffsetMs) * time.Millisecond)))
+		if n := h.activeUsers(); n == 0 || n > ambientMaxUsers {
+			return
+		}
+		data, _ := json.Marshal(CursorMessage{
+			Type:     "move",
+			ID:       ghostID,
+			Position: &CursorPosition{X: f.X, Y: f.Y, Zone: f.Zone},
+			Ghost:    true,
+		})
+		h.broadcastToOthers("", data)
+	}
+}
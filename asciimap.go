@@ -0,0 +1,189 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// /api/map/ascii renders the visitor map as text for terminals and the CRT
+// fallback: an equirectangular world with land from a coarse built-in
+// outline and visitor locations marked on top. ?ansi=1 adds colour.
+
+// Coarse coastlines as (lng, lat) rings; good enough at terminal resolution
+var landOutlines = [][][2]float64{
+	// North America
+	{{-168, 66}, {-162, 70}, {-156, 71}, {-140, 70}, {-128, 70}, {-115, 68}, {-95, 72}, {-82, 73}, {-75, 68},
+		{-62, 60}, {-55, 52}, {-66, 45}, {-70, 42}, {-76, 38}, {-76, 35}, {-81, 31}, {-80, 25}, {-84, 30},
+		{-90, 29}, {-97, 27}, {-97, 22}, {-90, 21}, {-87, 21}, {-88, 16}, {-83, 15}, {-83, 10}, {-78, 8},
+		{-80, 7}, {-86, 11}, {-92, 14}, {-96, 16}, {-105, 20}, {-106, 23}, {-112, 29}, {-115, 31}, {-117, 33},
+		{-121, 35}, {-124, 40}, {-124, 47}, {-128, 51}, {-135, 57}, {-142, 60}, {-152, 59}, {-158, 57},
+		{-165, 55}, {-162, 59}, {-166, 62}},
+	// Arctic archipelago
+	{{-120, 74}, {-80, 74}, {-62, 82}, {-90, 82}, {-120, 78}},
+	// Greenland
+	{{-73, 78}, {-60, 82}, {-30, 83}, {-20, 80}, {-20, 70}, {-30, 68}, {-42, 60}, {-50, 64}, {-55, 70}, {-60, 76}},
+	// Iceland
+	{{-24, 64}, {-14, 64}, {-14, 66}, {-22, 66}},
+	// Cuba
+	{{-85, 22}, {-74, 20}, {-78, 22}},
+	// South America
+	{{-77, 8}, {-72, 12}, {-62, 11}, {-52, 5}, {-50, 0}, {-35, -5}, {-39, -13}, {-41, -22}, {-48, -26},
+		{-53, -34}, {-58, -38}, {-63, -41}, {-65, -45}, {-68, -50}, {-69, -55}, {-74, -52}, {-73, -45},
+		{-72, -35}, {-71, -28}, {-70, -18}, {-76, -14}, {-81, -6}, {-80, -1}, {-78, 2}},
+	// Africa
+	{{-17, 15}, {-17, 21}, {-13, 28}, {-10, 30}, {-6, 36}, {10, 37}, {11, 33}, {20, 31}, {32, 31}, {34, 28},
+		{39, 18}, {43, 12}, {51, 12}, {48, 5}, {40, -3}, {40, -10}, {35, -20}, {35, -25}, {32, -29}, {27, -34},
+		{20, -35}, {18, -32}, {15, -27}, {12, -18}, {13, -9}, {9, -1}, {9, 4}, {4, 6}, {-4, 5}, {-8, 4}, {-13, 8}},
+	// Madagascar
+	{{44, -25}, {47, -25}, {50, -15}, {49, -12}, {44, -16}},
+	// Eurasia
+	{{-9, 37}, {-9, 43}, {-1, 46}, {-5, 48}, {2, 51}, {8, 54}, {8, 57}, {10, 59}, {5, 62}, {14, 68}, {25, 71},
+		{40, 68}, {44, 67}, {60, 70}, {70, 73}, {80, 73}, {100, 78}, {113, 74}, {130, 72}, {140, 72}, {160, 70},
+		{180, 69}, {180, 65}, {170, 60}, {163, 56}, {157, 51}, {155, 57}, {143, 59}, {135, 55}, {140, 48},
+		{132, 43}, {129, 35}, {126, 35}, {125, 39}, {121, 39}, {122, 31}, {120, 26}, {114, 22}, {108, 21},
+		{106, 18}, {109, 12}, {105, 9}, {100, 13}, {100, 7}, {103, 1}, {100, 6}, {98, 8}, {98, 16}, {94, 17},
+		{92, 22}, {88, 22}, {86, 20}, {80, 15}, {80, 10}, {77, 8}, {73, 16}, {72, 21}, {67, 24}, {57, 25},
+		{59, 22}, {52, 17}, {45, 13}, {43, 13}, {39, 20}, {35, 28}, {34, 31}, {35, 36}, {30, 36}, {27, 37},
+		{26, 40}, {23, 36}, {20, 40}, {19, 42}, {13, 45}, {16, 40}, {16, 38}, {12, 42}, {10, 44}, {8, 44},
+		{3, 43}, {3, 42}, {0, 39}, {-2, 37}, {-6, 36}},
+	// Chukotka, across the antimeridian
+	{{-180, 65}, {-172, 64}, {-170, 66}, {-180, 69}},
+	// Great Britain and Ireland
+	{{-5, 50}, {1, 51}, {2, 53}, {-2, 56}, {-2, 58}, {-5, 59}, {-6, 56}, {-5, 55}, {-3, 54}, {-5, 52}},
+	{{-10, 52}, {-6, 52}, {-6, 55}, {-8, 55}, {-10, 54}},
+	// Japan
+	{{130, 31}, {135, 34}, {140, 35}, {141, 41}, {145, 44}, {142, 45}, {140, 42}, {136, 37}, {131, 34}},
+	// Philippines, Borneo, Sumatra, Java, New Guinea
+	{{120, 18}, {122, 18}, {126, 7}, {122, 7}, {120, 14}},
+	{{109, -2}, {110, 2}, {116, 7}, {119, 5}, {118, 1}, {116, -4}, {110, -3}},
+	{{95, 5}, {98, 4}, {106, -6}, {102, -5}},
+	{{105, -7}, {114, -8}, {114, -7}, {106, -6}},
+	{{131, -1}, {141, -3}, {150, -10}, {141, -9}, {138, -8}, {132, -4}},
+	// Australia
+	{{114, -22}, {114, -34}, {118, -35}, {124, -33}, {131, -31}, {138, -35}, {141, -38}, {147, -38}, {150, -37},
+		{153, -30}, {153, -25}, {146, -19}, {142, -11}, {141, -17}, {136, -12}, {131, -11}, {125, -14}, {122, -18}},
+	// New Zealand
+	{{172, -34}, {175, -37}, {178, -38}, {175, -42}, {172, -44}, {167, -46}, {168, -44}, {174, -40}},
+	// Antarctica
+	{{-180, -90}, {180, -90}, {180, -70}, {-180, -70}},
+}
+
+// isLand reports whether a point falls inside one of the land outlines
+func isLand(lat, lng float64) bool {
+	for _, ring := range landOutlines {
+		inside := false
+		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+			xi, yi := ring[i][0], ring[i][1]
+			xj, yj := ring[j][0], ring[j][1]
+			if (yi > lat) != (yj > lat) && lng < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+				inside = !inside
+			}
+		}
+		if inside {
+			return true
+		}
+	}
+	return false
+}
+
+// Map glyphs: sea, land, and visitor markers by count
+const (
+	asciiSea  = ' '
+	asciiLand = ':'
+)
+
+func visitorGlyph(n int) byte {
+	switch {
+	case n >= 10:
+		return '@'
+	case n > 1:
+		return 'O'
+	default:
+		return 'o'
+	}
+}
+
+// renderASCIIMap draws a width x height map with the given visitor locations
+func renderASCIIMap(locations []Location, width, height int, ansi bool) string {
+	counts := make([]int, width*height)
+	for _, loc := range locations {
+		x := int((loc.Lng + 180) / 360 * float64(width))
+		y := int((90 - loc.Lat) / 180 * float64(height))
+		if x >= width {
+			x = width - 1
+		}
+		if y >= height {
+			y = height - 1
+		}
+		if x >= 0 && y >= 0 {
+			counts[y*width+x]++
+		}
+	}
+
+	var sb strings.Builder
+	for y := 0; y < height; y++ {
+		lat := 90 - (float64(y)+0.5)*180/float64(height)
+		style := ""
+		for x := 0; x < width; x++ {
+			lng := -180 + (float64(x)+0.5)*360/float64(width)
+			glyph, next := byte(asciiSea), ""
+			if n := counts[y*width+x]; n > 0 {
+				glyph, next = visitorGlyph(n), "\x1b[1;92m"
+			} else if isLand(lat, lng) {
+				glyph, next = asciiLand, "\x1b[32m"
+			}
+			if ansi && next != style {
+				if next == "" {
+					sb.WriteString("\x1b[0m")
+				} else {
+					sb.WriteString(next)
+				}
+				style = next
+			}
+			sb.WriteByte(glyph)
+		}
+		if ansi && style != "" {
+			sb.WriteString("\x1b[0m")
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// queryDimension reads a size parameter, clamped to [min, max]
+func queryDimension(r *http.Request, name string, def, min, max int) int {
+	v, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil {
+		return def
+	}
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func handleGetASCIIMap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	width := queryDimension(r, "w", 80, 20, 300)
+	height := queryDimension(r, "h", 24, 8, 150)
+	ansi := r.URL.Query().Get("ansi") == "1"
+
+	locations, err := getLocationsFromDB(r.Context(), tenantFor(r).readDB)
+	if err != nil {
+		log.Printf("Error getting locations: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(renderASCIIMap(locations, width, height, ansi)))
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KpReading is one observed or forecast planetary K-index value
+type KpReading struct {
+	Time     string  `json:"time"`
+	Kp       float64 `json:"kp"`
+	Observed bool    `json:"observed"`
+}
+
+// AuroraResponse is returned by /api/aurora
+type AuroraResponse struct {
+	Kp         float64     `json:"kp"`
+	KpTime     string      `json:"kpTime"`
+	MaxKp24h   float64     `json:"maxKp24h"`
+	Storm      string      `json:"storm,omitempty"`
+	Forecast   []KpReading `json:"forecast"`
+	Visibility string      `json:"visibility,omitempty"`
+	MagLat     *float64    `json:"magneticLatitude,omitempty"`
+	// Chance of aurora overhead from the OVATION oval, in percent
+	Chance   *int   `json:"auroraChance,omitempty"`
+	OvalTime string `json:"ovalTime,omitempty"`
+}
+
+// AuroraAlert is broadcast when the observed Kp rises past AURORA_ALERT_KP
+type AuroraAlert struct {
+	Kp    float64 `json:"kp"`
+	Time  string  `json:"time"`
+	Storm string  `json:"storm,omitempty"`
+}
+
+// auroraOval is the OVATION nowcast: the chance of aurora overhead, in
+// percent, on a 1° grid indexed by longitude (0-359) and latitude + 90
+type auroraOval struct {
+	forecastTime string
+	chance       [360][181]uint8
+}
+
+const auroraAlertInterval = 15 * time.Minute
+
+var (
+	kpCache   = newTTLCache[[]KpReading](15 * time.Minute)
+	ovalCache = newTTLCache[*auroraOval](15 * time.Minute)
+)
+
+// Geomagnetic north pole used for the dipole latitude approximation
+const (
+	geomagPoleLat = 80.7
+	geomagPoleLng = -72.7
+)
+
+// parseSWPCTable reads SWPC JSON products, which come either as a header row
+// followed by value rows, or as a list of objects
+func parseSWPCTable(raw []json.RawMessage) []map[string]string {
+	var rows []map[string]string
+	var header []string
+	for _, r := range raw {
+		var arr []interface{}
+		if err := json.Unmarshal(r, &arr); err == nil {
+			if header == nil {
+				for _, h := range arr {
+					header = append(header, strings.ToLower(fmt.Sprint(h)))
+				}
+				continue
+			}
+			row := make(map[string]string)
+			for i, v := range arr {
+				if i < len(header) && v != nil {
+					row[header[i]] = fmt.Sprint(v)
+				}
+			}
+			rows = append(rows, row)
+			continue
+		}
+		var obj map[string]interface{}
+		if err := json.Unmarshal(r, &obj); err == nil {
+			row := make(map[string]string)
+			for k, v := range obj {
+				if v != nil {
+					row[strings.ToLower(k)] = fmt.Sprint(v)
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+func fetchKp() ([]KpReading, error) {
+	var raw []json.RawMessage
+	if err := fetchJSON("https://services.swpc.noaa.gov/products/noaa-planetary-k-index-forecast.json", &raw); err != nil {
+		return nil, err
+	}
+
+	var readings []KpReading
+	for _, row := range parseSWPCTable(raw) {
+		kp, err := strconv.ParseFloat(row["kp"], 64)
+		if err != nil {
+			continue
+		}
+		readings = append(readings, KpReading{
+			Time:     row["time_tag"],
+			Kp:       kp,
+			Observed: row["observed"] == "observed" || row["observed"] == "estimated",
+		})
+	}
+	if len(readings) == 0 {
+		return nil, fmt.Errorf("no Kp readings")
+	}
+	return readings, nil
+}
+
+func fetchAuroraOval() (*auroraOval, error) {
+	var raw struct {
+		ForecastTime string       `json:"Forecast Time"`
+		Coordinates  [][3]float64 `json:"coordinates"`
+	}
+	if err := fetchJSON("https://services.swpc.noaa.gov/json/ovation_aurora_latest.json", &raw); err != nil {
+		return nil, err
+	}
+	if len(raw.Coordinates) == 0 {
+		return nil, fmt.Errorf("no aurora oval points")
+	}
+	oval := &auroraOval{forecastTime: raw.ForecastTime}
+	for _, c := range raw.Coordinates {
+		lng, lat := int(c[0]), int(c[1])+90
+		if lng < 0 || lng >= 360 || lat < 0 || lat > 180 {
+			continue
+		}
+		oval.chance[lng][lat] = uint8(math.Max(0, math.Min(100, c[2])))
+	}
+	return oval, nil
+}
+
+// at returns the chance of aurora at the grid point nearest a location
+func (o *auroraOval) at(lat, lng float64) int {
+	x := (int(math.Round(lng))%360 + 360) % 360
+	y := int(math.Round(lat)) + 90
+	return int(o.chance[x][y])
+}
+
+// latestKp returns the most recent observed reading
+func latestKp(readings []KpReading) (KpReading, bool) {
+	for i := len(readings) - 1; i >= 0; i-- {
+		if readings[i].Observed {
+			return readings[i], true
+		}
+	}
+	return KpReading{}, false
+}
+
+// stormScale maps Kp to the NOAA G-scale
+func stormScale(kp float64) string {
+	if kp < 5 {
+		return ""
+	}
+	return "G" + strconv.Itoa(int(math.Min(kp, 9))-4)
+}
+
+// magneticLatitude approximates geomagnetic latitude with a tilted dipole
+func magneticLatitude(lat, lng float64) float64 {
+	rad := math.Pi / 180
+	s := math.Sin(lat*rad)*math.Sin(geomagPoleLat*rad) +
+		math.Cos(lat*rad)*math.Cos(geomagPoleLat*rad)*math.Cos((lng-geomagPoleLng)*rad)
+	return math.Asin(s) / rad
+}
+
+// auroraVisibility estimates whether the auroral oval reaches a magnetic latitude at a given Kp
+func auroraVisibility(magLat, kp float64) string {
+	// The oval's equatorward edge moves roughly 2° south per Kp step
+	boundary := 66 - 2*kp
+	switch {
+	case math.Abs(magLat) >= boundary:
+		return "LIKELY"
+	case math.Abs(magLat) >= boundary-5:
+		return "POSSIBLE"
+	default:
+		return "UNLIKELY"
+	}
+}
+
+func handleGetAurora(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	readings, err := kpCache.get("kp", fetchKp)
+	if err != nil {
+		log.Printf("Error fetching Kp index: %v", err)
+		http.Error(w, "Upstream error", http.StatusBadGateway)
+		return
+	}
+
+	// Latest observation, and the highest Kp expected over the next day
+	var resp AuroraResponse
+	now := time.Now().UTC().Format("2006-01-02 15:04:05")
+	until := time.Now().UTC().Add(24 * time.Hour).Format("2006-01-02 15:04:05")
+	for _, k := range readings {
+		if k.Observed {
+			resp.Kp = k.Kp
+			resp.KpTime = k.Time
+		}
+		if !k.Observed && k.Time >= now[:13] && k.Time <= until {
+			resp.Forecast = append(resp.Forecast, k)
+			resp.MaxKp24h = math.Max(resp.MaxKp24h, k.Kp)
+		}
+	}
+	resp.MaxKp24h = math.Max(resp.MaxKp24h, resp.Kp)
+	resp.Storm = stormScale(resp.MaxKp24h)
+	if resp.Forecast == nil {
+		resp.Forecast = []KpReading{}
+	}
+
+	if r.URL.Query().Get("lat") != "" {
+		lat, lng, ok := parseLatLng(r)
+		if !ok {
+			http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+			return
+		}
+		magLat := math.Round(magneticLatitude(lat, lng)*10) / 10
+		resp.MagLat = &magLat
+		resp.Visibility = auroraVisibility(magLat, resp.MaxKp24h)
+
+		// The oval is a nice-to-have; Kp alone still gives a visibility
+		if oval, err := ovalCache.get("oval", fetchAuroraOval); err != nil {
+			log.Printf("Error fetching aurora oval: %v", err)
+		} else {
+			chance := oval.at(lat, lng)
+			resp.Chance = &chance
+			resp.OvalTime = oval.forecastTime
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// runAuroraAlerts broadcasts an "aurora" message to every site each time the
+// observed Kp rises above threshold. It arms again once Kp drops back.
+func runAuroraAlerts(threshold float64) {
+	above, first := false, true
+	for {
+		if !jobLeader.isLeader() {
+			// Don't alert for a storm already under way if we take over later
+			first = true
+			time.Sleep(time.Minute)
+			continue
+		}
+		readings, err := kpCache.get("kp", fetchKp)
+		if err != nil {
+			log.Printf("Error fetching Kp index: %v", err)
+		} else if k, ok := latestKp(readings); ok {
+			crossed := k.Kp > threshold && !above
+			above = k.Kp > threshold
+			if crossed && !first {
+				alert := AuroraAlert{Kp: k.Kp, Time: k.Time, Storm: stormScale(k.Kp)}
+				data, _ := json.Marshal(CursorMessage{Type: "aurora", Aurora: &alert})
+				for _, h := range allHubs() {
+					h.broadcastToOthers("", data)
+					h.logEvent("aurora", "", data)
+				}
+				log.Printf("Aurora alert: Kp %.2f at %s", k.Kp, k.Time)
+			}
+			first = false
+		}
+		time.Sleep(auroraAlertInterval)
+	}
+}
+
+// auroraAlertKp returns the AURORA_ALERT_KP setting, or 0 when alerts are off
+func auroraAlertKp() float64 {
+	kp, _ := strconv.ParseFloat(os.Getenv("AURORA_ALERT_KP"), 64)
+	return kp
+}
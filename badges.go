@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Badges in the shields.io endpoint format
+// (https://shields.io/badges/endpoint-badge), e.g.
+// https://img.shields.io/endpoint?url=https://currentcondition.tv/api/badge/visitors.json
+
+// ShieldsBadge is a shields.io endpoint response
+type ShieldsBadge struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Label         string `json:"label"`
+	Message       string `json:"message"`
+	Color         string `json:"color"`
+	CacheSeconds  int    `json:"cacheSeconds,omitempty"`
+	IsError       bool   `json:"isError,omitempty"`
+}
+
+func writeBadge(w http.ResponseWriter, badge ShieldsBadge) {
+	badge.SchemaVersion = 1
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if badge.CacheSeconds > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", badge.CacheSeconds))
+	}
+	json.NewEncoder(w).Encode(badge)
+}
+
+func handleVisitorsBadge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h := tenantFor(r).hub
+	h.mutex.RLock()
+	online := h.users()
+	h.mutex.RUnlock()
+
+	color := "lightgrey"
+	if online > 0 {
+		color = "brightgreen"
+	}
+	writeBadge(w, ShieldsBadge{Label: "visitors", Message: fmt.Sprintf("%d online", online), Color: color, CacheSeconds: 60})
+}
+
+func handleHighscoreBadge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scores, err := cachedHighscores(r.Context(), tenantFor(r), "SNAKE")
+	if err != nil {
+		log.Printf("Error getting highscores: %v", err)
+		writeBadge(w, ShieldsBadge{Label: "SNAKE record", Message: "unavailable", Color: "red", IsError: true})
+		return
+	}
+	badge := ShieldsBadge{Label: "SNAKE record", Message: "none yet", Color: "lightgrey", CacheSeconds: 300}
+	if len(scores) > 0 && scores[0].Score > 0 {
+		badge.Message = fmt.Sprintf("%d by %s", scores[0].Score, scores[0].Name)
+		badge.Color = "brightgreen"
+	}
+	writeBadge(w, badge)
+}
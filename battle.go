@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Battle mode pits two players against each other in real time. A client
+// sends {"type":"battle_join","battle":{"game":"TETRIS"}} and is paired with
+// the next player waiting for the same game. During the match each
+// "battle_lines" event (lines cleared by one piece) is checked against the
+// game's rules and turned into garbage lines for the opponent; "battle_lose"
+// (topping out) or disconnecting ends the match, and the result is kept in
+// the matches table.
+
+// BattleEvent is the payload of battle messages
+type BattleEvent struct {
+	Match    string `json:"match,omitempty"`
+	Game     string `json:"game,omitempty"`
+	Opponent string `json:"opponent,omitempty"`
+	Lines    int    `json:"lines,omitempty"`
+	Winner   string `json:"winner,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	// Tournament the match belongs to, if any
+	Tournament int64 `json:"tournament,omitempty"`
+}
+
+// battleRules describes what a game's players may send each other
+type battleRules struct {
+	// Most lines one event may report
+	maxLines int
+	// Least time between two events from a player
+	minInterval time.Duration
+	// Garbage lines sent to the opponent for n cleared lines
+	garbage func(n int) int
+}
+
+var battleGames = map[string]battleRules{
+	"TETRIS": {
+		maxLines:    4,
+		minInterval: 250 * time.Millisecond,
+		garbage:     func(n int) int { return []int{0, 0, 1, 2, 4}[n] },
+	},
+}
+
+// Messages handled by handleBattle
+var battleMessages = map[string]bool{"battle_join": true, "battle_leave": true, "battle_lines": true, "battle_lose": true}
+
+// battleMatch is a match in progress
+type battleMatch struct {
+	id        string
+	game      string
+	players   [2]*Client
+	lines     [2]int
+	lastEvent [2]time.Time
+	startedAt time.Time
+	// Bracket match this is, for tournament games
+	tournament *tournamentSlot
+}
+
+// battleState tracks matchmaking and matches for a hub (guarded by the hub mutex)
+type battleState struct {
+	// Client waiting for an opponent, by game
+	waiting map[string]*Client
+	// Match each playing client is in
+	matches map[string]*battleMatch
+	// Bracket matches whose result is being saved
+	finishing map[tournamentSlot]bool
+}
+
+func newBattleState() battleState {
+	return battleState{
+		waiting:   make(map[string]*Client),
+		matches:   make(map[string]*battleMatch),
+		finishing: make(map[tournamentSlot]bool),
+	}
+}
+
+// MatchResult is a finished match
+type MatchResult struct {
+	ID        string
+	Game      string
+	Winner    string
+	Loser     string
+	Reason    string
+	StartedAt time.Time
+	EndedAt   time.Time
+}
+
+// handleBattle handles the battle protocol messages from c
+func (c *Client) handleBattle(msg CursorMessage) {
+	h := c.hub
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	ev := msg.Battle
+	if ev == nil {
+		ev = &BattleEvent{}
+	}
+	switch msg.Type {
+	case "battle_join":
+		game := strings.ToUpper(ev.Game)
+		if _, ok := battleGames[game]; !ok {
+			h.sendTo(c.ID, CursorMessage{Type: "battle_error", Battle: &BattleEvent{Reason: "unknown_game"}})
+			return
+		}
+		if h.battles.matches[c.ID] != nil {
+			h.sendTo(c.ID, CursorMessage{Type: "battle_error", Battle: &BattleEvent{Reason: "in_match"}})
+			return
+		}
+		h.leaveBattleQueue(c.ID)
+		opponent := h.battles.waiting[game]
+		if opponent == nil {
+			h.battles.waiting[game] = c
+			h.sendTo(c.ID, CursorMessage{Type: "battle_waiting", Battle: &BattleEvent{Game: game}})
+			return
+		}
+		delete(h.battles.waiting, game)
+		h.startMatch(game, opponent, c, nil)
+
+	case "battle_leave":
+		h.leaveBattleQueue(c.ID)
+
+	case "battle_lines":
+		m := h.battles.matches[c.ID]
+		if m == nil {
+			return
+		}
+		rules := battleGames[m.game]
+		me := m.seat(c)
+		now := time.Now()
+		if ev.Lines < 1 || ev.Lines > rules.maxLines || now.Sub(m.lastEvent[me]) < rules.minInterval {
+			h.sendTo(c.ID, CursorMessage{Type: "battle_error", Battle: &BattleEvent{Match: m.id, Reason: "rate_limited"}})
+			return
+		}
+		m.lastEvent[me] = now
+		m.lines[me] += ev.Lines
+		if garbage := rules.garbage(ev.Lines); garbage > 0 {
+			h.sendTo(m.players[1-me].ID, CursorMessage{Type: "battle_garbage", Battle: &BattleEvent{Match: m.id, Lines: garbage}})
+		}
+
+	case "battle_lose":
+		if m := h.battles.matches[c.ID]; m != nil {
+			h.endMatch(m, m.players[1-m.seat(c)], "topped_out")
+		}
+	}
+}
+
+func (m *battleMatch) seat(c *Client) int {
+	if m.players[0] == c {
+		return 0
+	}
+	return 1
+}
+
+// leaveBattleQueue stops id waiting for an opponent; it must be called with the hub mutex held
+func (h *Hub) leaveBattleQueue(id string) {
+	for game, c := range h.battles.waiting {
+		if c.ID == id {
+			delete(h.battles.waiting, game)
+		}
+	}
+}
+
+// startMatch pairs two clients, for a tournament bracket match if slot is
+// set; it must be called with the hub mutex held
+func (h *Hub) startMatch(game string, a, b *Client, slot *tournamentSlot) *battleMatch {
+	m := &battleMatch{id: generateVisitorID()[:16], game: game, players: [2]*Client{a, b}, startedAt: time.Now(), tournament: slot}
+	h.battles.matches[a.ID] = m
+	h.battles.matches[b.ID] = m
+	var tournament int64
+	if slot != nil {
+		tournament = slot.tournament
+	}
+	h.sendTo(a.ID, CursorMessage{Type: "battle_start", Battle: &BattleEvent{Match: m.id, Game: game, Opponent: b.ID, Tournament: tournament}})
+	h.sendTo(b.ID, CursorMessage{Type: "battle_start", Battle: &BattleEvent{Match: m.id, Game: game, Opponent: a.ID, Tournament: tournament}})
+	return m
+}
+
+// endMatch declares winner, tells both players and records the result; it
+// must be called with the hub mutex held
+func (h *Hub) endMatch(m *battleMatch, winner *Client, reason string) {
+	loser := m.players[1-m.seat(winner)]
+	delete(h.battles.matches, winner.ID)
+	delete(h.battles.matches, loser.ID)
+	end := CursorMessage{Type: "battle_end", Battle: &BattleEvent{Match: m.id, Game: m.game, Winner: winner.ID, Reason: reason}}
+	h.sendTo(winner.ID, end)
+	h.sendTo(loser.ID, end)
+
+	result := MatchResult{
+		ID:        m.id,
+		Game:      m.game,
+		Winner:    winner.visitorID,
+		Loser:     loser.visitorID,
+		Reason:    reason,
+		StartedAt: m.startedAt,
+		EndedAt:   time.Now(),
+	}
+	// Playing yourself in two tabs doesn't count
+	if result.Winner == result.Loser {
+		return
+	}
+	slot := m.tournament
+	if slot != nil {
+		h.battles.finishing[*slot] = true
+	}
+	go func() {
+		if err := recordMatch(context.Background(), h.db, result); err != nil {
+			log.Printf("Error recording match: %v", err)
+		}
+		if slot == nil {
+			return
+		}
+		if err := recordBracketResult(context.Background(), h.db, *slot, result.Winner); err != nil {
+			log.Printf("Error recording tournament result: %v", err)
+		}
+		h.mutex.Lock()
+		delete(h.battles.finishing, *slot)
+		h.mutex.Unlock()
+	}()
+}
+
+// dropBattles forfeits id's match and takes it out of matchmaking; it must be
+// called with the hub mutex held
+func (h *Hub) dropBattles(id string) {
+	h.leaveBattleQueue(id)
+	if m := h.battles.matches[id]; m != nil {
+		for _, p := range m.players {
+			if p.ID != id {
+				h.endMatch(m, p, "disconnect")
+			}
+		}
+	}
+}
+
+// recordMatch saves a finished match and updates the players' ratings
+func recordMatch(ctx context.Context, db *sql.DB, m MatchResult) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO matches (id, game, winner_id, loser_id, reason, started_at, ended_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, m.ID, m.Game, m.Winner, m.Loser, m.Reason, m.StartedAt.Unix(), m.EndedAt.Unix())
+	if err != nil {
+		return err
+	}
+	if err := updateRatings(ctx, tx, m); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// VersusEntry is a player on the versus leaderboard
+type VersusEntry struct {
+	Name   string `json:"name"`
+	Wins   int    `json:"wins"`
+	Losses int    `json:"losses"`
+}
+
+// getVersusLeaderboard ranks players with a nickname by wins
+func getVersusLeaderboard(ctx context.Context, db *sql.DB, game string, limit int) ([]VersusEntry, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT visitor, SUM(win), SUM(loss) FROM (
+			SELECT winner_id AS visitor, 1 AS win, 0 AS loss FROM matches WHERE game = ?
+			UNION ALL
+			SELECT loser_id, 0, 1 FROM matches WHERE game = ?
+		)
+		WHERE visitor != ''
+		GROUP BY visitor
+		ORDER BY SUM(win) DESC, SUM(loss) ASC
+	`, game, game)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []VersusEntry{}
+	for rows.Next() && len(entries) < limit {
+		var visitorID string
+		var e VersusEntry
+		if err := rows.Scan(&visitorID, &e.Wins, &e.Losses); err != nil {
+			return nil, err
+		}
+		// Only players who reserved a name are listed; visitor IDs stay private
+		if e.Name, err = getVisitorNickname(ctx, db, visitorID); err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(e.Name) == "" {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func handleVersusLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	game := strings.ToUpper(r.URL.Query().Get("game"))
+	if game == "" {
+		game = "TETRIS"
+	}
+	if _, ok := battleGames[game]; !ok {
+		http.Error(w, "Invalid game", http.StatusBadRequest)
+		return
+	}
+	entries, err := getVersusLeaderboard(r.Context(), tenantFor(r).readDB, game, 10)
+	if err != nil {
+		log.Printf("Error getting versus leaderboard: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
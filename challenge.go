@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The daily challenge gives every game a seed and a couple of modifiers that
+// are the same for everyone on a UTC day, so all players get the same SNAKE
+// layout. Challenge scores go on their own leaderboard, which starts empty
+// again at UTC midnight.
+
+// Modifiers a game's challenge can draw from
+var challengeModifiers = map[string][]string{
+	"SNAKE":     {"fast", "obstacles", "wrap", "double_points"},
+	"TETRIS":    {"fast", "no_preview", "garbage_start"},
+	"ASTEROIDS": {"more_rocks", "fast_rocks", "no_thrust"},
+	"PONG":      {"fast_ball", "small_paddle"},
+}
+
+// Challenge is one game's challenge for a day
+type Challenge struct {
+	Game      string   `json:"game"`
+	Date      string   `json:"date"`
+	Seed      uint32   `json:"seed"`
+	Modifiers []string `json:"modifiers"`
+	ResetsAt  int64    `json:"resetsAt"`
+}
+
+// challengeDay is the UTC date a challenge belongs to
+func challengeDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// dailyChallenge derives a game's challenge for the day of t
+func dailyChallenge(game string, t time.Time) Challenge {
+	day := challengeDay(t)
+	h := fnv.New32a()
+	h.Write([]byte(day + "/" + game))
+	seed := h.Sum32()
+
+	// One or two modifiers, picked by the seed
+	rng := rand.New(rand.NewSource(int64(seed)))
+	options := challengeModifiers[game]
+	picked := rng.Perm(len(options))[:1+rng.Intn(2)]
+	modifiers := make([]string, len(picked))
+	for i, p := range picked {
+		modifiers[i] = options[p]
+	}
+
+	midnight, _ := time.Parse("2006-01-02", day)
+	return Challenge{Game: game, Date: day, Seed: seed, Modifiers: modifiers, ResetsAt: midnight.Add(24 * time.Hour).Unix()}
+}
+
+func handleChallengeToday(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	// Cache until midnight so everyone flips over together
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(time.Until(time.Unix(dailyChallenge("SNAKE", now).ResetsAt, 0)).Seconds())))
+	w.Header().Set("Content-Type", "application/json")
+
+	if game := strings.ToUpper(r.URL.Query().Get("game")); game != "" {
+		if challengeModifiers[game] == nil {
+			http.Error(w, "Invalid game", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(dailyChallenge(game, now))
+		return
+	}
+	challenges := make(map[string]Challenge)
+	for game := range challengeModifiers {
+		challenges[game] = dailyChallenge(game, now)
+	}
+	json.NewEncoder(w).Encode(challenges)
+}
+
+// getChallengeScores returns a day's best challenge scores for a game
+func getChallengeScores(ctx context.Context, db *sql.DB, day, game string) ([]Highscore, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT name, score, COALESCE(country, '') FROM challenge_scores
+		WHERE day = ? AND game = ?
+		ORDER BY score DESC, created_at ASC
+		LIMIT 10
+	`, day, game)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	scores := []Highscore{}
+	for rows.Next() {
+		h := Highscore{Game: game}
+		if err := rows.Scan(&h.Name, &h.Score, &h.Country); err != nil {
+			return nil, err
+		}
+		scores = append(scores, h)
+	}
+	return scores, rows.Err()
+}
+
+// handleChallengeScores lists today's challenge leaderboard (GET) or submits
+// a score for today's seed (POST)
+func handleChallengeScores(w http.ResponseWriter, r *http.Request) {
+	site := tenantFor(r)
+	now := time.Now()
+
+	switch r.Method {
+	case http.MethodGet:
+		game := strings.ToUpper(r.URL.Query().Get("game"))
+		if challengeModifiers[game] == nil {
+			http.Error(w, "Invalid game", http.StatusBadRequest)
+			return
+		}
+		scores, err := getChallengeScores(r.Context(), site.readDB, challengeDay(now), game)
+		if err != nil {
+			log.Printf("Error getting challenge scores: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(scores)
+
+	case http.MethodPost:
+		var req struct {
+			Game    string `json:"game"`
+			Name    string `json:"name"`
+			Score   int    `json:"score"`
+			Seed    uint32 `json:"seed"`
+			Country string `json:"country"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		game := strings.ToUpper(req.Game)
+		if challengeModifiers[game] == nil {
+			http.Error(w, "Invalid game", http.StatusBadRequest)
+			return
+		}
+		if req.Score < 0 {
+			http.Error(w, "Invalid score", http.StatusBadRequest)
+			return
+		}
+		// A game started before midnight doesn't count towards the new day
+		challenge := dailyChallenge(game, now)
+		if req.Seed != challenge.Seed {
+			http.Error(w, "Challenge expired", http.StatusConflict)
+			return
+		}
+		score := req.Score
+		if score > 999999 {
+			score = 999999
+		}
+
+		// Without initials, fall back to the visitor's reserved nickname
+		visitorID := visitorIDFromRequest(w, r)
+		if strings.TrimSpace(req.Name) == "" {
+			req.Name, _ = getVisitorNickname(r.Context(), site.db, visitorID)
+		}
+		if strings.TrimSpace(req.Name) == "" {
+			req.Name = "???"
+		}
+		name := sanitizeName(req.Name)
+		owner, err := getNicknameOwner(r.Context(), site.db, name)
+		if err != nil {
+			log.Printf("Error checking nickname: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if owner != "" && owner != visitorID {
+			http.Error(w, "Name reserved", http.StatusConflict)
+			return
+		}
+		if owner != "" {
+			go useNickname(context.WithoutCancel(r.Context()), site.db, owner)
+		}
+		country := r.Header.Get("CF-IPCountry")
+		if normalizeCountry(country) == "" {
+			country = req.Country
+		}
+
+		_, err = site.db.ExecContext(r.Context(), `
+			INSERT INTO challenge_scores (day, game, name, score, country, visitor_id) VALUES (?, ?, ?, ?, ?, ?)
+		`, challenge.Date, game, name, score, normalizeCountry(country), visitorID)
+		if err != nil {
+			log.Printf("Error saving challenge score: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		scores, err := getChallengeScores(r.Context(), site.db, challenge.Date, game)
+		if err != nil {
+			log.Printf("Error getting challenge scores: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(scores)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Once an hour the leader prunes what the site databases only keep for a
+// while: activity rollups, sessions, hub events, idle visitors, unused
+// nicknames and spent idempotency keys. Each site's database is visited once
+// per run.
+
+const cleanupInterval = time.Hour
+
+// runCleanup prunes every site's database on the hour; only the leader does
+func runCleanup() {
+	for {
+		// Wake up on the hour
+		now := time.Now()
+		next := now.Truncate(cleanupInterval).Add(cleanupInterval)
+		time.Sleep(next.Sub(now))
+
+		if !jobLeader.isLeader() {
+			continue
+		}
+		for _, h := range allHubs() {
+			cleanupSite(h.db, next)
+		}
+	}
+}
+
+// cleanupSite prunes one site's database
+func cleanupSite(db *sql.DB, now time.Time) {
+	if _, err := db.Exec(`DELETE FROM metrics_rollup WHERE minute < ?`, now.Add(-activityRetention).Unix()); err != nil {
+		log.Printf("Error pruning activity rollups: %v", err)
+	}
+	if _, err := db.Exec(`DELETE FROM visitor_sessions WHERE started_at < ?`, now.Add(-sessionRetention).Unix()); err != nil {
+		log.Printf("Error pruning sessions: %v", err)
+	}
+	if err := pruneHubEvents(db, now); err != nil {
+		log.Printf("Error pruning event log: %v", err)
+	}
+	if n, err := purgeStaleVisitors(db, now); err != nil {
+		log.Printf("Error purging idle visitors: %v", err)
+	} else if n > 0 {
+		log.Printf("Purged %d idle visitors", n)
+	}
+	if n, err := expireNicknames(db, now); err != nil {
+		log.Printf("Error expiring nicknames: %v", err)
+	} else if n > 0 {
+		log.Printf("Released %d unused nicknames", n)
+	}
+	if err := pruneIdempotencyKeys(db, now); err != nil {
+		log.Printf("Error pruning idempotency keys: %v", err)
+	}
+}
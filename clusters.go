@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Visitor locations are clustered per zoom level the way supercluster does it:
+// points are projected to Web Mercator and, from the deepest zoom up, merged
+// with everything within clusterRadius pixels into weighted centroids. The
+// index is rebuilt in the background after locations change, at most every
+// clusterRebuildInterval, and stale results are served meanwhile.
+
+const (
+	clusterMaxZoom         = 16
+	clusterRadius          = 40.0
+	clusterExtent          = 256.0
+	clusterRebuildInterval = 30 * time.Second
+)
+
+// Cluster is a group of visitor locations (Count 1 for a single point)
+type Cluster struct {
+	Lat   float64 `json:"lat"`
+	Lng   float64 `json:"lng"`
+	Count int     `json:"count"`
+}
+
+// clusterIndex holds the clusters of one site per zoom level
+type clusterIndex struct {
+	mu         sync.RWMutex
+	zooms      [][]Cluster
+	dirty      bool
+	rebuilding bool
+	builtAt    time.Time
+}
+
+func newClusterIndex() *clusterIndex {
+	return &clusterIndex{dirty: true}
+}
+
+// invalidate marks the index out of date after locations changed
+func (ci *clusterIndex) invalidate() {
+	ci.mu.Lock()
+	ci.dirty = true
+	ci.mu.Unlock()
+}
+
+// mercX and mercY project to [0, 1] Web Mercator coordinates
+func mercX(lng float64) float64 {
+	return lng/360 + 0.5
+}
+
+func mercY(lat float64) float64 {
+	sin := math.Sin(lat * math.Pi / 180)
+	y := 0.5 - 0.25*math.Log((1+sin)/(1-sin))/math.Pi
+	return math.Max(0, math.Min(1, y))
+}
+
+func unmercLat(y float64) float64 {
+	return 360*math.Atan(math.Exp((180-y*360)*math.Pi/180))/math.Pi - 90
+}
+
+// clusterPoint is a point or cluster in projected coordinates while building
+type clusterPoint struct {
+	x, y  float64
+	count int
+}
+
+// buildClusters computes clusters for every zoom from clusterMaxZoom+1 (raw points) down to 0
+func buildClusters(locations []Location) [][]Cluster {
+	points := make([]clusterPoint, len(locations))
+	for i, loc := range locations {
+		points[i] = clusterPoint{x: mercX(loc.Lng), y: mercY(loc.Lat), count: 1}
+	}
+
+	zooms := make([][]Cluster, clusterMaxZoom+2)
+	zooms[clusterMaxZoom+1] = toClusters(points)
+	for z := clusterMaxZoom; z >= 0; z-- {
+		points = clusterZoom(points, clusterRadius/(clusterExtent*math.Pow(2, float64(z))))
+		zooms[z] = toClusters(points)
+	}
+	return zooms
+}
+
+// clusterZoom greedily merges each point with its unmerged neighbours within r
+func clusterZoom(points []clusterPoint, r float64) []clusterPoint {
+	type cell struct{ x, y int }
+	grid := make(map[cell][]int)
+	for i, p := range points {
+		c := cell{int(p.x / r), int(p.y / r)}
+		grid[c] = append(grid[c], i)
+	}
+
+	merged := make([]bool, len(points))
+	var out []clusterPoint
+	for i, p := range points {
+		if merged[i] {
+			continue
+		}
+		merged[i] = true
+		wx, wy, count := p.x*float64(p.count), p.y*float64(p.count), p.count
+		cx, cy := int(p.x/r), int(p.y/r)
+		for dx := -1; dx <= 1; dx++ {
+			for dy := -1; dy <= 1; dy++ {
+				for _, j := range grid[cell{cx + dx, cy + dy}] {
+					q := points[j]
+					if merged[j] || (q.x-p.x)*(q.x-p.x)+(q.y-p.y)*(q.y-p.y) > r*r {
+						continue
+					}
+					merged[j] = true
+					wx += q.x * float64(q.count)
+					wy += q.y * float64(q.count)
+					count += q.count
+				}
+			}
+		}
+		out = append(out, clusterPoint{x: wx / float64(count), y: wy / float64(count), count: count})
+	}
+	return out
+}
+
+func toClusters(points []clusterPoint) []Cluster {
+	clusters := make([]Cluster, len(points))
+	for i, p := range points {
+		clusters[i] = Cluster{
+			Lat:   math.Round(unmercLat(p.y)*1e4) / 1e4,
+			Lng:   math.Round((p.x-0.5)*360*1e4) / 1e4,
+			Count: p.count,
+		}
+	}
+	return clusters
+}
+
+// clustersAt returns the clusters for a zoom, building the index on first use and
+// refreshing it in the background when it is out of date
+func (ci *clusterIndex) clustersAt(site *Tenant, zoom int) ([]Cluster, error) {
+	ci.mu.Lock()
+	if ci.zooms == nil {
+		ci.mu.Unlock()
+		if err := ci.rebuild(site); err != nil {
+			return nil, err
+		}
+		ci.mu.Lock()
+	} else if ci.dirty && !ci.rebuilding && time.Since(ci.builtAt) >= clusterRebuildInterval {
+		ci.rebuilding = true
+		go func() {
+			if err := ci.rebuild(site); err != nil {
+				log.Printf("Error rebuilding location clusters: %v", err)
+			}
+			ci.mu.Lock()
+			ci.rebuilding = false
+			ci.mu.Unlock()
+		}()
+	}
+	defer ci.mu.Unlock()
+	return ci.zooms[zoom], nil
+}
+
+func (ci *clusterIndex) rebuild(site *Tenant) error {
+	ci.mu.Lock()
+	ci.dirty = false
+	ci.mu.Unlock()
+
+	locations, err := getLocationsFromDB(context.Background(), site.readDB)
+	if err != nil {
+		ci.invalidate()
+		return err
+	}
+	zooms := buildClusters(locations)
+
+	ci.mu.Lock()
+	ci.zooms = zooms
+	ci.builtAt = time.Now()
+	ci.mu.Unlock()
+	return nil
+}
+
+// BBox is a lng/lat bounding box; MinLng > MaxLng means it crosses the antimeridian
+type BBox struct {
+	MinLng, MinLat, MaxLng, MaxLat float64
+}
+
+// parseBBox reads "minLng,minLat,maxLng,maxLat"
+func parseBBox(s string) (BBox, bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return BBox{}, false
+	}
+	var v [4]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || math.IsNaN(f) {
+			return BBox{}, false
+		}
+		v[i] = f
+	}
+	b := BBox{MinLng: v[0], MinLat: v[1], MaxLng: v[2], MaxLat: v[3]}
+	if b.MinLat > b.MaxLat || b.MinLat < -90 || b.MaxLat > 90 ||
+		b.MinLng < -180 || b.MinLng > 180 || b.MaxLng < -180 || b.MaxLng > 180 {
+		return BBox{}, false
+	}
+	return b, true
+}
+
+// contains reports whether the box includes a point
+func (b BBox) contains(lat, lng float64) bool {
+	if lat < b.MinLat || lat > b.MaxLat {
+		return false
+	}
+	if b.MinLng <= b.MaxLng {
+		return lng >= b.MinLng && lng <= b.MaxLng
+	}
+	return lng >= b.MinLng || lng <= b.MaxLng
+}
+
+func handleGetLocationClusters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	zoom, err := strconv.Atoi(r.URL.Query().Get("zoom"))
+	if err != nil || zoom < 0 {
+		http.Error(w, "Invalid zoom", http.StatusBadRequest)
+		return
+	}
+	if zoom > clusterMaxZoom+1 {
+		zoom = clusterMaxZoom + 1
+	}
+	bbox := BBox{MinLng: -180, MinLat: -90, MaxLng: 180, MaxLat: 90}
+	if s := r.URL.Query().Get("bbox"); s != "" {
+		var ok bool
+		if bbox, ok = parseBBox(s); !ok {
+			http.Error(w, "Invalid bbox", http.StatusBadRequest)
+			return
+		}
+	}
+
+	site := tenantFor(r)
+	clusters, err := site.clusters.clustersAt(site, zoom)
+	if err != nil {
+		log.Printf("Error clustering locations: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	visible := []Cluster{}
+	for _, c := range clusters {
+		if bbox.contains(c.Lat, c.Lng) {
+			visible = append(visible, c)
+		}
+	}
+
+	if wantsMsgpack(w, r) {
+		if err := writeMsgpack(w, visible); err != nil {
+			log.Printf("Error writing clusters: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(visible)
+}
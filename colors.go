@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Each client gets a cursor colour from the CRT palette when it joins,
+// preferring the visitor's saved colour and otherwise one nobody connected is
+// using. {"type":"color","color":"#rrggbb"} picks (and saves) another palette
+// colour. The palette can be replaced with CURSOR_PALETTE.
+
+var defaultCursorPalette = []string{
+	"#00ff00", "#00ffff", "#ff00ff", "#ffff00",
+	"#ff6600", "#00ff66", "#6600ff", "#ff0066",
+}
+
+var cursorPalette = parseCursorPalette(os.Getenv("CURSOR_PALETTE"))
+
+var hexColor = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+func parseCursorPalette(spec string) []string {
+	var palette []string
+	for _, c := range strings.Split(spec, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if hexColor.MatchString(c) {
+			palette = append(palette, c)
+		} else if c != "" {
+			log.Printf("Ignoring cursor palette colour %q: not #rrggbb", c)
+		}
+	}
+	if len(palette) == 0 {
+		return defaultCursorPalette
+	}
+	return palette
+}
+
+func inCursorPalette(color string) bool {
+	for _, c := range cursorPalette {
+		if c == color {
+			return true
+		}
+	}
+	return false
+}
+
+// pickColor chooses the preferred colour if it's free, else the least used
+// palette colour; it must be called with the hub mutex held
+func (h *Hub) pickColor(preferred string) string {
+	used := make(map[string]int)
+	for _, c := range h.clients {
+		if c.color != "" {
+			used[c.color]++
+		}
+	}
+	if inCursorPalette(preferred) && used[preferred] == 0 {
+		return preferred
+	}
+	best := cursorPalette[0]
+	for _, c := range cursorPalette {
+		if used[c] < used[best] {
+			best = c
+		}
+	}
+	return best
+}
+
+// loadPreferredColor returns a visitor's saved cursor colour, if any
+func loadPreferredColor(ctx context.Context, db *sql.DB, visitorID string) string {
+	var color string
+	err := db.QueryRowContext(ctx, `SELECT color FROM visitor_prefs WHERE visitor_id = ?`, visitorID).Scan(&color)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error loading cursor colour: %v", err)
+	}
+	return color
+}
+
+func savePreferredColor(db *sql.DB, visitorID, color string) error {
+	_, err := db.Exec(`
+		INSERT INTO visitor_prefs (visitor_id, color, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(visitor_id) DO UPDATE SET color = excluded.color, updated_at = excluded.updated_at
+	`, visitorID, color)
+	return err
+}
+
+// setColor switches c to another palette colour and tells everyone
+func (c *Client) setColor(color string) {
+	color = strings.ToLower(color)
+	if !inCursorPalette(color) {
+		return
+	}
+	h := c.hub
+	h.mutex.Lock()
+	c.color = color
+	h.mutex.Unlock()
+
+	if c.visitorID != "" {
+		go func() {
+			if err := savePreferredColor(h.db, c.visitorID, color); err != nil {
+				log.Printf("Error saving cursor colour: %v", err)
+			}
+		}()
+	}
+	data, _ := json.Marshal(CursorMessage{Type: "color", ID: c.ID, Color: color})
+	h.broadcastToOthers("", data)
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Connect protocol (connectrpc.com) endpoints for proto/currentcondition/v1/terminal.proto.
+// Unary calls take the JSON (application/json) or protobuf (application/proto)
+// codec; WatchPings is a server stream (application/connect+json or
+// application/connect+proto). gRPC and gRPC-Web clients aren't served.
+
+const connectPrefix = "/currentcondition.v1.TerminalService/"
+
+// Largest request message accepted, and how many streams a site serves at a
+// time
+const (
+	connectMaxRequest = 64 << 10
+	maxConnectStreams = 100
+)
+
+// connectError is a Connect error with its wire code
+type connectError struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// HTTP statuses for Connect error codes
+var connectStatus = map[string]int{
+	"invalid_argument":   http.StatusBadRequest,
+	"not_found":          http.StatusNotFound,
+	"unimplemented":      http.StatusNotFound,
+	"resource_exhausted": http.StatusTooManyRequests,
+	"internal":           http.StatusInternalServerError,
+	"unavailable":        http.StatusServiceUnavailable,
+}
+
+// connectRequest is a request message, decoded by whichever codec it came in
+type connectRequest struct {
+	json  map[string]json.RawMessage
+	proto protoFields
+}
+
+func decodeConnectRequest(body []byte, binaryCodec bool) (connectRequest, error) {
+	var req connectRequest
+	var err error
+	if binaryCodec {
+		req.proto, err = parseProto(body)
+		return req, err
+	}
+	if len(body) == 0 {
+		body = []byte("{}")
+	}
+	err = json.Unmarshal(body, &req.json)
+	return req, err
+}
+
+// str reads a string field by number (protobuf) or name (JSON)
+func (r connectRequest) str(num int, name string) (string, error) {
+	if r.proto != nil {
+		return string(r.proto[num].b), nil
+	}
+	var s string
+	if raw, ok := r.json[name]; ok {
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	}
+	return s, nil
+}
+
+// timestamp reads a google.protobuf.Timestamp field, or nil if it's unset
+func (r connectRequest) timestamp(num int, name string) (*time.Time, error) {
+	if r.proto != nil {
+		return r.proto.timestamp(num)
+	}
+	raw, ok := r.json[name]
+	if !ok || string(raw) == "null" {
+		return nil, nil
+	}
+	var t time.Time
+	if err := json.Unmarshal(raw, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+type connectMethod func(ctx context.Context, site *Tenant, req connectRequest) (protoMessage, *connectError)
+
+var errConnectInvalid = &connectError{Code: "invalid_argument", Message: "invalid request"}
+var errConnectInternal = &connectError{Code: "internal"}
+
+// Response messages; their JSON matches the REST API's
+
+type connectHighscores struct {
+	Highscores []Highscore `json:"highscores"`
+}
+
+type connectLocations struct {
+	Locations []Location `json:"locations"`
+}
+
+// connectPing is a ping as WatchPings streams it, without the sender's IP
+type connectPing struct {
+	Lat       float64 `json:"lat"`
+	Lng       float64 `json:"lng"`
+	Location  string  `json:"location,omitempty"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+func (s StatsResponse) marshalProto(p *protoWriter) {
+	p.varint(1, int64(s.CurrentUsers))
+	p.message(2, s.Peak)
+}
+
+func (r PeakRecord) marshalProto(p *protoWriter) {
+	p.varint(1, int64(r.Users))
+	p.varint(2, r.At)
+}
+
+func (h Highscore) marshalProto(p *protoWriter) {
+	p.varint(1, int64(h.ID))
+	p.str(2, h.Game)
+	p.str(3, h.Name)
+	p.varint(4, int64(h.Score))
+	p.str(5, h.Country)
+	p.str(6, h.Flag)
+}
+
+func (h connectHighscores) marshalProto(p *protoWriter) {
+	for _, s := range h.Highscores {
+		p.message(1, s)
+	}
+}
+
+func (l Location) marshalProto(p *protoWriter) {
+	p.double(1, l.Lat)
+	p.double(2, l.Lng)
+	p.timestamp(3, l.Timestamp)
+	p.varint(4, int64(l.VisitorCount))
+}
+
+func (l connectLocations) marshalProto(p *protoWriter) {
+	for _, loc := range l.Locations {
+		p.message(1, loc)
+	}
+}
+
+func (a ActivityPoint) marshalProto(p *protoWriter) {
+	p.varint(1, a.Time)
+	p.varint(2, int64(a.Users))
+	p.varint(3, int64(a.Messages))
+}
+
+func (a ActivityResponse) marshalProto(p *protoWriter) {
+	p.str(1, a.Range)
+	p.varint(2, a.Step)
+	for _, point := range a.Points {
+		p.message(3, point)
+	}
+}
+
+func (c connectPing) marshalProto(p *protoWriter) {
+	p.double(1, c.Lat)
+	p.double(2, c.Lng)
+	p.str(3, c.Location)
+	p.varint(4, c.Timestamp)
+}
+
+var connectMethods = map[string]connectMethod{
+	"GetStats": func(ctx context.Context, site *Tenant, req connectRequest) (protoMessage, *connectError) {
+		site.hub.mutex.RLock()
+		defer site.hub.mutex.RUnlock()
+		return StatsResponse{CurrentUsers: len(site.hub.clients), Peak: site.hub.peak}, nil
+	},
+	"ListHighscores": func(ctx context.Context, site *Tenant, req connectRequest) (protoMessage, *connectError) {
+		game, err := req.str(1, "game")
+		if err != nil {
+			return nil, errConnectInvalid
+		}
+		game = strings.ToUpper(game)
+		validGames := map[string]bool{"SNAKE": true, "TETRIS": true, "ASTEROIDS": true, "PONG": true}
+		if !validGames[game] {
+			return nil, &connectError{Code: "invalid_argument", Message: "invalid game"}
+		}
+		scores, err := cachedHighscores(ctx, site, game)
+		if err != nil {
+			log.Printf("Error getting highscores: %v", err)
+			return nil, errConnectInternal
+		}
+		return connectHighscores{Highscores: scores}, nil
+	},
+	"ListLocations": func(ctx context.Context, site *Tenant, req connectRequest) (protoMessage, *connectError) {
+		asOf, err := req.timestamp(1, "asOf")
+		if err != nil {
+			return nil, errConnectInvalid
+		}
+		var locations []Location
+		if asOf != nil {
+			locations, err = getLocationsAsOf(ctx, site.readDB, asOf.UTC())
+		} else {
+			locations, err = getLocationsFromDB(ctx, site.readDB)
+		}
+		if err != nil {
+			log.Printf("Error getting locations: %v", err)
+			return nil, errConnectInternal
+		}
+		if locations == nil {
+			locations = []Location{}
+		}
+		return connectLocations{Locations: locations}, nil
+	},
+	"GetActivity": func(ctx context.Context, site *Tenant, req connectRequest) (protoMessage, *connectError) {
+		rangeParam, err := req.str(1, "range")
+		if err != nil {
+			return nil, errConnectInvalid
+		}
+		if rangeParam == "" {
+			rangeParam = "24h"
+		}
+		span, err := parseRange(rangeParam)
+		if err != nil || span < time.Minute || span > activityRetention {
+			return nil, &connectError{Code: "invalid_argument", Message: "invalid range"}
+		}
+		step := activityStep(span)
+		points, err := getActivity(ctx, site.readDB, time.Now().Add(-span), step)
+		if err != nil {
+			log.Printf("Error getting activity: %v", err)
+			return nil, errConnectInternal
+		}
+		return ActivityResponse{Range: rangeParam, Step: step, Points: points}, nil
+	},
+}
+
+// connectStreams are the server-streaming methods; send returns false once
+// the client has gone
+type connectStream func(ctx context.Context, site *Tenant, req connectRequest, send func(protoMessage) bool) *connectError
+
+var connectStreams = map[string]connectStream{
+	"WatchPings": func(ctx context.Context, site *Tenant, req connectRequest, send func(protoMessage) bool) *connectError {
+		events, stop, ok := site.hub.subscribe(maxConnectStreams)
+		if !ok {
+			return &connectError{Code: "resource_exhausted", Message: "too many streams"}
+		}
+		defer stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case ev := <-events:
+				var msg CursorMessage
+				if ev.Type != "ping" || json.Unmarshal(ev.Data, &msg) != nil || msg.Ping == nil {
+					continue
+				}
+				ping := connectPing{Lat: msg.Ping.Lat, Lng: msg.Ping.Lng, Location: msg.Ping.Location, Timestamp: msg.Ping.Timestamp}
+				if !send(ping) {
+					return nil
+				}
+			}
+		}
+	},
+}
+
+func writeConnectError(w http.ResponseWriter, cerr *connectError) {
+	status, ok := connectStatus[cerr.Code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(cerr)
+}
+
+func handleConnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, connectPrefix)
+	mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	if stream, ok := connectStreams[name]; ok {
+		serveConnectStream(w, r, stream, mediaType)
+		return
+	}
+
+	var binaryCodec bool
+	switch mediaType {
+	case "application/json":
+	case "application/proto":
+		binaryCodec = true
+	default:
+		w.Header().Set("Accept-Post", "application/json, application/proto")
+		http.Error(w, "Unsupported codec", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	method, ok := connectMethods[name]
+	if !ok {
+		writeConnectError(w, &connectError{Code: "unimplemented", Message: "unknown method"})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, connectMaxRequest))
+	if err != nil {
+		writeConnectError(w, errConnectInvalid)
+		return
+	}
+	req, err := decodeConnectRequest(body, binaryCodec)
+	if err != nil {
+		writeConnectError(w, errConnectInvalid)
+		return
+	}
+
+	result, cerr := method(r.Context(), tenantFor(r), req)
+	if cerr != nil {
+		writeConnectError(w, cerr)
+		return
+	}
+	if binaryCodec {
+		w.Header().Set("Content-Type", "application/proto")
+		w.Write(marshalProto(result))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Envelope flag of the message that ends a Connect stream
+const connectFlagEndStream = 0x02
+
+// writeEnvelope writes one length-prefixed message of a Connect stream
+func writeEnvelope(w io.Writer, flags byte, data []byte) error {
+	header := make([]byte, 5, 5+len(data))
+	header[0] = flags
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+	_, err := w.Write(append(header, data...))
+	return err
+}
+
+// serveConnectStream runs a server-streaming method. The request is a single
+// enveloped message; each response message is enveloped in the request's
+// codec, and the stream ends with a JSON end-stream message carrying any error.
+func serveConnectStream(w http.ResponseWriter, r *http.Request, stream connectStream, mediaType string) {
+	var binaryCodec bool
+	switch mediaType {
+	case "application/connect+json":
+	case "application/connect+proto":
+		binaryCodec = true
+	default:
+		w.Header().Set("Accept-Post", "application/connect+json, application/connect+proto")
+		http.Error(w, "Unsupported codec", http.StatusUnsupportedMediaType)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	end := func(cerr *connectError) {
+		var trailer struct {
+			Error *connectError `json:"error,omitempty"`
+		}
+		trailer.Error = cerr
+		data, _ := json.Marshal(trailer)
+		writeEnvelope(w, connectFlagEndStream, data)
+		flusher.Flush()
+	}
+
+	var header [5]byte
+	if _, err := io.ReadFull(r.Body, header[:]); err != nil {
+		end(errConnectInvalid)
+		return
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if header[0] != 0 || size > connectMaxRequest {
+		end(errConnectInvalid)
+		return
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r.Body, body); err != nil {
+		end(errConnectInvalid)
+		return
+	}
+	req, err := decodeConnectRequest(body, binaryCodec)
+	if err != nil {
+		end(errConnectInvalid)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	cerr := stream(r.Context(), tenantFor(r), req, func(m protoMessage) bool {
+		var data []byte
+		if binaryCodec {
+			data = marshalProto(m)
+		} else {
+			data, _ = json.Marshal(m)
+		}
+		if writeEnvelope(w, 0, data) != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	})
+	end(cerr)
+}
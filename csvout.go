@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Read endpoints answer with CSV instead of JSON for ?format=csv or an
+// Accept header asking for text/csv, for pulling data into spreadsheets.
+
+// Rows written between flushes of a CSV response
+const csvFlushEvery = 500
+
+// wantsCSV reports whether the client asked for CSV. Responses vary on
+// Accept either way, so caches keep the two formats apart.
+func wantsCSV(w http.ResponseWriter, r *http.Request) bool {
+	varyOnAccept(w)
+	return acceptsCSV(r)
+}
+
+// acceptsCSV is wantsCSV without touching the response
+func acceptsCSV(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return strings.EqualFold(format, "csv")
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(accept, ";")
+		if strings.EqualFold(strings.TrimSpace(mediaType), "text/csv") {
+			return true
+		}
+	}
+	return false
+}
+
+// varyOnAccept adds Accept to the Vary header once
+func varyOnAccept(w http.ResponseWriter) {
+	for _, v := range w.Header().Values("Vary") {
+		if strings.EqualFold(v, "Accept") {
+			return
+		}
+	}
+	w.Header().Add("Vary", "Accept")
+}
+
+// csvResponse streams CSV rows to the client
+type csvResponse struct {
+	w    *csv.Writer
+	rows int
+}
+
+// newCSVResponse starts a CSV download named filename with a header row
+func newCSVResponse(w http.ResponseWriter, filename string, header ...string) *csvResponse {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c := &csvResponse{w: csv.NewWriter(w)}
+	c.w.Write(header)
+	return c
+}
+
+// row writes one record, flushing to the client every csvFlushEvery rows
+func (c *csvResponse) row(fields ...string) error {
+	if err := c.w.Write(fields); err != nil {
+		return err
+	}
+	c.rows++
+	if c.rows%csvFlushEvery == 0 {
+		c.w.Flush()
+		return c.w.Error()
+	}
+	return nil
+}
+
+func (c *csvResponse) close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// csvText neutralises user-supplied text that a spreadsheet would run as a formula
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func csvInt(n int) string { return strconv.Itoa(n) }
+
+func csvFloat(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+
+// writeCSVMetrics writes a JSON-shaped value as metric,value rows, naming
+// nested fields with dotted paths (e.g. peak.users, distribution.0.count)
+func writeCSVMetrics(w http.ResponseWriter, filename string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var tree interface{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return err
+	}
+	out := newCSVResponse(w, filename, "metric", "value")
+	var walk func(prefix string, node interface{}) error
+	walk = func(prefix string, node interface{}) error {
+		switch node := node.(type) {
+		case map[string]interface{}:
+			keys := make([]string, 0, len(node))
+			for k := range node {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if err := walk(strings.TrimPrefix(prefix+"."+k, "."), node[k]); err != nil {
+					return err
+				}
+			}
+			return nil
+		case []interface{}:
+			for i, item := range node {
+				if err := walk(prefix+"."+strconv.Itoa(i), item); err != nil {
+					return err
+				}
+			}
+			return nil
+		case float64:
+			return out.row(prefix, csvFloat(node))
+		case string:
+			return out.row(prefix, csvText(node))
+		case bool:
+			return out.row(prefix, strconv.FormatBool(node))
+		default:
+			return out.row(prefix, "")
+		}
+	}
+	if err := walk("", tree); err != nil {
+		return err
+	}
+	return out.close()
+}
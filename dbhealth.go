@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Every database is checked periodically. When a check fails with an error
+// that a fresh file handle could fix (corruption, I/O, stuck locks), the
+// pool's connections are dropped so the next query reopens the file.
+// /readyz reports the results so a load balancer can take the instance out.
+const (
+	dbHealthInterval = 15 * time.Second
+	dbHealthTimeout  = 3 * time.Second
+	dbMaxIdleConns   = 2
+)
+
+// DBHealth is the result of the latest check of one database
+type DBHealth struct {
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	CheckedAt int64  `json:"checkedAt"`
+	Failures  int    `json:"consecutiveFailures,omitempty"`
+	Reopens   int    `json:"reopens,omitempty"`
+}
+
+// dbMonitor checks one database handle
+type dbMonitor struct {
+	name   string
+	db     *sql.DB
+	mu     sync.RWMutex
+	health DBHealth
+}
+
+var dbMonitors []*dbMonitor
+
+// checkDB pings the pool and reads the schema, which touches the file itself
+func checkDB(db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbHealthTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return err
+	}
+	var n int
+	return db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master`).Scan(&n)
+}
+
+// needsReopen reports whether an error may go away with a fresh connection
+func needsReopen(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var serr sqlite3.Error
+	if !errors.As(err, &serr) {
+		return false
+	}
+	switch serr.Code {
+	case sqlite3.ErrCorrupt, sqlite3.ErrNotADB, sqlite3.ErrIoErr, sqlite3.ErrCantOpen,
+		sqlite3.ErrBusy, sqlite3.ErrLocked:
+		return true
+	}
+	return false
+}
+
+// reopenDB closes pooled connections so the next query opens the file again
+func reopenDB(db *sql.DB) {
+	db.SetMaxIdleConns(0)
+	db.SetMaxIdleConns(dbMaxIdleConns)
+}
+
+func (m *dbMonitor) check() {
+	err := checkDB(m.db)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.health.CheckedAt = time.Now().Unix()
+	if err == nil {
+		if !m.health.OK && m.health.Failures > 0 {
+			log.Printf("Database %s recovered", m.name)
+			pendingWrites.retryNow()
+		}
+		m.health.OK = true
+		m.health.Error = ""
+		m.health.Failures = 0
+		return
+	}
+
+	m.health.OK = false
+	m.health.Error = err.Error()
+	m.health.Failures++
+	log.Printf("Database %s health check failed (%d in a row): %v", m.name, m.health.Failures, err)
+	if needsReopen(err) {
+		reopenDB(m.db)
+		m.health.Reopens++
+	}
+}
+
+func (m *dbMonitor) run() {
+	for {
+		time.Sleep(dbHealthInterval)
+		m.check()
+	}
+}
+
+// startDBMonitors checks every site's databases once, then keeps checking in the background
+func startDBMonitors() {
+	for _, t := range append([]*Tenant{defaultTenant}, tenantList...) {
+		dbMonitors = append(dbMonitors, &dbMonitor{name: t.Name, db: t.db})
+		if t.readDB != t.db {
+			dbMonitors = append(dbMonitors, &dbMonitor{name: t.Name + "-read", db: t.readDB})
+		}
+	}
+	for _, m := range dbMonitors {
+		m.check()
+		go m.run()
+	}
+}
+
+// handleReadyz reports whether every database is reachable
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	databases := make(map[string]DBHealth, len(dbMonitors))
+	for _, m := range dbMonitors {
+		m.mu.RLock()
+		health := m.health
+		m.mu.RUnlock()
+		databases[m.name] = health
+		if !health.OK {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ready":     status == http.StatusOK,
+		"databases": databases,
+	})
+}
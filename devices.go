@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Kiosk installations register themselves as devices: POST
+// /api/devices/register with the site's KIOSK_TOKEN returns a device ID and
+// key. The kiosk then opens the page with ?device=<id>&key=<key>, which ties
+// its websocket to the device and sends a heartbeat with the screen
+// resolution and kiosk version every few minutes. Admins list devices at
+// /admin/devices and send them commands (reload, switch panel, show an
+// announcement) through their websockets at /admin/devices/command.
+
+// Device commands
+const (
+	deviceReload   = "reload"
+	devicePanel    = "panel"
+	deviceAnnounce = "announce"
+)
+
+const (
+	maxDeviceName       = 40
+	maxDeviceInfo       = 40
+	maxAnnouncement     = 280
+	maxAnnounceTime     = 3600
+	defaultAnnounceTime = 30
+)
+
+// Device is a registered kiosk
+type Device struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	RegisteredAt int64  `json:"registeredAt"`
+	LastSeen     int64  `json:"lastSeen"`
+	Resolution   string `json:"resolution,omitempty"`
+	Version      string `json:"version,omitempty"`
+	IP           string `json:"ip,omitempty"`
+	Online       bool   `json:"online"`
+}
+
+// DeviceCommand is sent to a kiosk as a "device" message
+type DeviceCommand struct {
+	Action  string `json:"action"`
+	Panel   string `json:"panel,omitempty"`
+	Message string `json:"message,omitempty"`
+	Seconds int    `json:"seconds,omitempty"`
+}
+
+// DeviceCommandResult says which devices a command reached
+type DeviceCommandResult struct {
+	Sent    []string `json:"sent"`
+	Offline []string `json:"offline"`
+}
+
+// authenticateDevice checks a device key and returns whether it matches
+func authenticateDevice(ctx context.Context, db *sql.DB, id, key string) (bool, error) {
+	if id == "" || key == "" {
+		return false, nil
+	}
+	var keyHash string
+	err := db.QueryRowContext(ctx, `SELECT key_hash FROM devices WHERE id = ?`, id).Scan(&keyHash)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(keyHash), []byte(hashToken(key))) == 1, nil
+}
+
+// touchDevice records a heartbeat; empty resolution or version keep the old value
+func touchDevice(ctx context.Context, db *sql.DB, id, resolution, version, ip string) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE devices SET last_seen = ?, ip = ?,
+			resolution = CASE WHEN ? = '' THEN resolution ELSE ? END,
+			version = CASE WHEN ? = '' THEN version ELSE ? END
+		WHERE id = ?
+	`, time.Now().Unix(), ip, resolution, resolution, version, version, id)
+	return err
+}
+
+// getDevices lists registered devices, marking those with a websocket open
+func (h *Hub) getDevices(ctx context.Context) ([]Device, error) {
+	rows, err := h.db.QueryContext(ctx, `
+		SELECT id, name, registered_at, last_seen, resolution, version, ip FROM devices ORDER BY name, id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var d Device
+		if err := rows.Scan(&d.ID, &d.Name, &d.RegisteredAt, &d.LastSeen, &d.Resolution, &d.Version, &d.IP); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	online := h.onlineDevices()
+	for i := range devices {
+		devices[i].Online = online[devices[i].ID]
+	}
+	return devices, nil
+}
+
+// onlineDevices returns the devices with at least one admitted client
+func (h *Hub) onlineDevices() map[string]bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	online := make(map[string]bool)
+	for _, c := range h.clients {
+		if c.device != "" {
+			online[c.device] = true
+		}
+	}
+	return online
+}
+
+// forgetDevice stops treating a removed device's open connections as the device
+func (h *Hub) forgetDevice(id string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, c := range h.clients {
+		if c.device == id {
+			c.device = ""
+		}
+	}
+}
+
+// sendDeviceCommand sends a command to the given devices, or to every
+// connected device if ids is empty
+func (h *Hub) sendDeviceCommand(ids []string, cmd DeviceCommand) DeviceCommandResult {
+	data, _ := json.Marshal(CursorMessage{Type: "device", Device: &cmd})
+	want := make(map[string]bool)
+	for _, id := range ids {
+		want[id] = true
+	}
+
+	h.mutex.RLock()
+	reached := make(map[string]bool)
+	for id, c := range h.clients {
+		if c.device == "" || len(want) > 0 && !want[c.device] {
+			continue
+		}
+		if h.sendFrameTo(id, data) {
+			reached[c.device] = true
+		}
+	}
+	h.mutex.RUnlock()
+
+	result := DeviceCommandResult{Sent: []string{}, Offline: []string{}}
+	for device := range reached {
+		result.Sent = append(result.Sent, device)
+	}
+	for _, id := range ids {
+		if !reached[id] {
+			result.Offline = append(result.Offline, id)
+		}
+	}
+	return result
+}
+
+// handleRegisterDevice registers a kiosk that knows the site's KIOSK_TOKEN
+func handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	site := tenantFor(r)
+	if site.kioskToken == "" {
+		http.Error(w, "Device registration disabled", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Token      string `json:"token"`
+		Name       string `json:"name"`
+		Resolution string `json:"resolution"`
+		Version    string `json:"version"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(site.kioskToken)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, key := generateVisitorID()[:12], generateVisitorID()
+	name := cleanTextLine(req.Name, maxDeviceName)
+	if name == "" {
+		name = "kiosk-" + id[:6]
+	}
+	now := time.Now().Unix()
+	_, err := site.db.ExecContext(r.Context(), `
+		INSERT INTO devices (id, name, key_hash, registered_at, last_seen, resolution, version, ip) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, id, name, hashToken(key), now, now, cleanTextLine(req.Resolution, maxDeviceInfo), cleanTextLine(req.Version, maxDeviceInfo), clientIP(r))
+	if err != nil {
+		log.Printf("Error registering device: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Device registered: %s (%s)", id, name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+		Key  string `json:"key"`
+	}{id, name, key})
+}
+
+// handleDeviceHeartbeat records that a device is alive and what it's running
+func handleDeviceHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		ID         string `json:"id"`
+		Key        string `json:"key"`
+		Resolution string `json:"resolution"`
+		Version    string `json:"version"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	site := tenantFor(r)
+	ok, err := authenticateDevice(r.Context(), site.db, req.ID, req.Key)
+	if err != nil {
+		log.Printf("Error checking device: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Unknown device", http.StatusUnauthorized)
+		return
+	}
+	if err := touchDevice(r.Context(), site.db, req.ID, cleanTextLine(req.Resolution, maxDeviceInfo), cleanTextLine(req.Version, maxDeviceInfo), clientIP(r)); err != nil {
+		log.Printf("Error recording device heartbeat: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDevices lists devices (GET) or removes one (DELETE ?id=)
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+	hub := tenantFor(r).hub
+
+	switch r.Method {
+	case http.MethodGet:
+		devices, err := hub.getDevices(r.Context())
+		if err != nil {
+			log.Printf("Error listing devices: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(devices)
+	case http.MethodDelete:
+		res, err := hub.db.ExecContext(r.Context(), `DELETE FROM devices WHERE id = ?`, r.URL.Query().Get("id"))
+		if err != nil {
+			log.Printf("Error removing device: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		hub.forgetDevice(r.URL.Query().Get("id"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDeviceCommand sends a command to some devices, or all connected ones
+func handleDeviceCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Devices []string `json:"devices"`
+		DeviceCommand
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	cmd := DeviceCommand{Action: req.Action}
+	switch req.Action {
+	case deviceReload:
+	case devicePanel:
+		if !panelNamePattern.MatchString(req.Panel) {
+			http.Error(w, "Invalid panel", http.StatusBadRequest)
+			return
+		}
+		cmd.Panel = req.Panel
+	case deviceAnnounce:
+		cmd.Message = cleanTextLine(req.Message, maxAnnouncement)
+		if cmd.Message == "" {
+			http.Error(w, "Missing message", http.StatusBadRequest)
+			return
+		}
+		cmd.Seconds = req.Seconds
+		if cmd.Seconds <= 0 || cmd.Seconds > maxAnnounceTime {
+			cmd.Seconds = defaultAnnounceTime
+		}
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	result := tenantFor(r).hub.sendDeviceCommand(req.Devices, cmd)
+	log.Printf("Device command %s sent to %d devices", cmd.Action, len(result.Sent))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// deviceForRequest returns the device a websocket request authenticates as,
+// from ?device= and ?key=, or "" for an ordinary visitor
+func deviceForRequest(r *http.Request, site *Tenant) string {
+	q := r.URL.Query()
+	id, key := q.Get("device"), q.Get("key")
+	if id == "" {
+		return ""
+	}
+	ok, err := authenticateDevice(r.Context(), site.db, id, key)
+	if err != nil {
+		log.Printf("Error checking device: %v", err)
+		return ""
+	}
+	if !ok {
+		log.Printf("Unknown device %q connecting from %s", id, clientIP(r))
+		return ""
+	}
+	if err := touchDevice(r.Context(), site.db, id, "", "", clientIP(r)); err != nil {
+		log.Printf("Error recording device heartbeat: %v", err)
+	}
+	return id
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// GET /api/stats/distances reports how spread out visitors are: the two
+// visitor locations farthest apart, and how far visitors are from the site's
+// home base (DEFAULT_LOCATION) on average and in total ("visitor kilometres"),
+// plus the geographic midpoint of all visitors. Every visitor counted at a
+// location counts once.
+
+// Locations beyond this many (the least visited first) are left out of the
+// farthest pair search, which compares every pair
+const maxFarthestPairScan = 20000
+
+// GeoPoint is a labelled point on the map
+type GeoPoint struct {
+	Lat   float64 `json:"lat"`
+	Lng   float64 `json:"lng"`
+	Place string  `json:"place,omitempty"`
+}
+
+// VisitorPair is two visitor locations and the distance between them
+type VisitorPair struct {
+	A  GeoPoint `json:"a"`
+	B  GeoPoint `json:"b"`
+	Km float64  `json:"km"`
+}
+
+// DistanceStats is the response of /api/stats/distances
+type DistanceStats struct {
+	Home          GeoPoint     `json:"home"`
+	Visitors      int          `json:"visitors"`
+	AverageHomeKm float64      `json:"averageHomeKm"`
+	VisitorKm     float64      `json:"visitorKm"`
+	Farthest      *VisitorPair `json:"farthestPair,omitempty"`
+	Midpoint      *GeoPoint    `json:"midpoint,omitempty"`
+}
+
+var distanceStatsCache = newTTLCache[DistanceStats](5 * time.Minute)
+
+// getDistanceStats works out distance stats for every stored location
+func getDistanceStats(ctx context.Context, db *sql.DB, home GeoPoint) (DistanceStats, error) {
+	stats := DistanceStats{Home: home}
+	rows, err := db.QueryContext(ctx, `SELECT lat, lng, visitor_count FROM locations ORDER BY visitor_count DESC, id`)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	var points []GeoPoint
+	var sum unitVector
+	for rows.Next() {
+		var p GeoPoint
+		var count int
+		if err := rows.Scan(&p.Lat, &p.Lng, &count); err != nil {
+			return stats, err
+		}
+		stats.Visitors += count
+		stats.VisitorKm += float64(count) * haversineKm(home.Lat, home.Lng, p.Lat, p.Lng)
+		v := toUnitVector(p.Lat, p.Lng)
+		sum = unitVector{sum.x + float64(count)*v.x, sum.y + float64(count)*v.y, sum.z + float64(count)*v.z}
+		if len(points) < maxFarthestPairScan {
+			points = append(points, p)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return stats, err
+	}
+	if stats.Visitors > 0 {
+		stats.AverageHomeKm = stats.VisitorKm / float64(stats.Visitors)
+		// Visitors spread evenly around the globe have no midpoint
+		if sum.dot(sum) > 1e-12*float64(stats.Visitors*stats.Visitors) {
+			lat, lng := sum.latLng()
+			stats.Midpoint = &GeoPoint{Lat: lat, Lng: lng}
+		}
+	}
+	stats.Farthest = farthestPair(points)
+	return stats, nil
+}
+
+// farthestPair returns the two points farthest apart, or nil for fewer than two
+func farthestPair(points []GeoPoint) *VisitorPair {
+	if len(points) < 2 {
+		return nil
+	}
+	vecs := make([]unitVector, len(points))
+	for i, p := range points {
+		vecs[i] = toUnitVector(p.Lat, p.Lng)
+	}
+	bestI, bestJ, best := 0, 1, vecs[0].dot(vecs[1])
+	for i := range vecs {
+		for j := i + 1; j < len(vecs); j++ {
+			if d := vecs[i].dot(vecs[j]); d < best {
+				bestI, bestJ, best = i, j, d
+			}
+		}
+	}
+	a, b := points[bestI], points[bestJ]
+	return &VisitorPair{A: a, B: b, Km: haversineKm(a.Lat, a.Lng, b.Lat, b.Lng)}
+}
+
+// siteDistanceStats returns the (cached) distance stats of a site
+func siteDistanceStats(ctx context.Context, site *Tenant) (DistanceStats, error) {
+	return distanceStatsCache.get(site.Name, func() (DistanceStats, error) {
+		return getDistanceStats(ctx, site.readDB, site.hub.home)
+	})
+}
+
+func handleGetDistanceStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := siteDistanceStats(r.Context(), tenantFor(r))
+	if err != nil {
+		log.Printf("Error getting distance stats: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if wantsCSV(w, r) {
+		writeCSVMetrics(w, "distances.csv", stats)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
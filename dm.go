@@ -0,0 +1,80 @@
+package main
+
+import "time"
+
+// Direct messages go to a single client: {"type":"dm","target":<id>,"text":...}
+// arrives as {"type":"dm","id":<sender>,"text":...}. A client can stop
+// receiving them from someone with {"type":"block","target":<id>} (and undo it
+// with "unblock"). Undeliverable or rate-limited messages are answered with
+// "dm_error". DMs are private, so they are never logged or replayed.
+
+const (
+	maxDMLength = 500
+	dmBurst     = 10
+	dmWindow    = 10 * time.Second
+)
+
+// allowDM reports whether c may send another DM now (called from readPump)
+func (c *Client) allowDM() bool {
+	return allowBurst(&c.dmTimes, dmBurst, dmWindow)
+}
+
+// allowBurst records an event in times and reports whether it is within
+// burst events per window
+func allowBurst(times *[]time.Time, burst int, window time.Duration) bool {
+	now := time.Now()
+	recent := (*times)[:0]
+	for _, t := range *times {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	*times = recent
+	if len(recent) >= burst {
+		return false
+	}
+	*times = append(*times, now)
+	return true
+}
+
+// handleDM routes a direct message, block or unblock from c
+func (c *Client) handleDM(msg CursorMessage) {
+	h := c.hub
+	switch msg.Type {
+	case "block", "unblock":
+		if msg.Target == "" || msg.Target == c.ID {
+			return
+		}
+		h.mutex.Lock()
+		if msg.Type == "block" {
+			if h.blocks[c.ID] == nil {
+				h.blocks[c.ID] = make(map[string]bool)
+			}
+			h.blocks[c.ID][msg.Target] = true
+		} else {
+			delete(h.blocks[c.ID], msg.Target)
+		}
+		h.mutex.Unlock()
+
+	case "dm":
+		text := cleanTextLine(msg.Text, maxDMLength)
+		if text == "" || msg.Target == c.ID {
+			return
+		}
+		if !c.allowDM() {
+			h.mutex.Lock()
+			h.sendTo(c.ID, CursorMessage{Type: "dm_error", Target: msg.Target, Reason: "rate_limited", RetryAfter: int(dmWindow.Seconds())})
+			h.mutex.Unlock()
+			return
+		}
+
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		// Blocked senders can't tell a block from someone who left
+		delivered := !h.blocks[msg.Target][c.ID] &&
+			h.sendTo(msg.Target, CursorMessage{Type: "dm", ID: c.ID, Text: text})
+		if !delivered {
+			h.sendTo(c.ID, CursorMessage{Type: "dm_error", Target: msg.Target, Reason: "unavailable"})
+		}
+	}
+}
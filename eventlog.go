@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Every hub event worth keeping (joins, leaves, pings, records and
+// announcements) is appended to the hub_events table with a sequence number.
+// Cursor moves are too chatty to log; ambient recordings cover those.
+// At startup the hub rebuilds its recent pings and announcements from the log.
+// Events older than eventRetention are pruned hourly, except the latest
+// maintenance event, which the rebuild still needs, and pings, which
+// /api/pings serves in full (see pings.go). Old pings only lose the IP.
+
+// HubEvent is one entry in a hub's append-only event log
+type HubEvent struct {
+	Seq      int64           `json:"seq"`
+	Type     string          `json:"type"`
+	ClientID string          `json:"clientId,omitempty"`
+	Data     json.RawMessage `json:"data"`
+	Time     int64           `json:"time"`
+}
+
+// Events are written in batches so the hub never waits on the database
+const (
+	eventLogBuffer   = 1024
+	eventLogInterval = time.Second
+)
+
+const eventRetention = 90 * 24 * time.Hour
+
+// logEvent queues an event (the broadcast message) for the event log
+func (h *Hub) logEvent(eventType, clientID string, data []byte) {
+	ev := HubEvent{Type: eventType, ClientID: clientID, Data: data, Time: time.Now().Unix()}
+	select {
+	case h.events <- ev:
+	default:
+		log.Printf("Event log queue full, dropping %s event", eventType)
+	}
+
+	h.tapsMu.Lock()
+	for tap := range h.taps {
+		select {
+		case tap <- ev:
+		default:
+		}
+	}
+	h.tapsMu.Unlock()
+}
+
+// subscribe returns a channel that gets each event as it is logged, and a
+// function to stop; it reports false once max listeners are open. Slow
+// listeners miss events rather than hold up the hub.
+func (h *Hub) subscribe(max int) (<-chan HubEvent, func(), bool) {
+	h.tapsMu.Lock()
+	defer h.tapsMu.Unlock()
+	if len(h.taps) >= max {
+		return nil, nil, false
+	}
+	tap := make(chan HubEvent, 64)
+	h.taps[tap] = true
+	return tap, func() {
+		h.tapsMu.Lock()
+		delete(h.taps, tap)
+		h.tapsMu.Unlock()
+	}, true
+}
+
+// runEventLog appends queued events until stopEventLog is called
+func (h *Hub) runEventLog() {
+	ticker := time.NewTicker(eventLogInterval)
+	defer ticker.Stop()
+	defer close(h.eventsDone)
+
+	var batch []HubEvent
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := h.appendEvents(batch); err != nil {
+			log.Printf("Error writing event log: %v", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case ev := <-h.events:
+			batch = append(batch, ev)
+			if len(batch) >= 100 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-h.eventsStop:
+			for {
+				select {
+				case ev := <-h.events:
+					batch = append(batch, ev)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// stopEventLog writes out pending events and waits for the writer to finish
+func (h *Hub) stopEventLog() {
+	close(h.eventsStop)
+	<-h.eventsDone
+}
+
+func (h *Hub) appendEvents(events []HubEvent) (err error) {
+	ctx, s := startSpan(context.Background(), "hub.eventlog.append", spanKindInternal)
+	s.setAttr("hub.events", len(events))
+	defer func() { s.end(err) }()
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO hub_events (type, client_id, data, created_at) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, ev := range events {
+		if _, err := stmt.Exec(ev.Type, ev.ClientID, string(ev.Data), ev.Time); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// pruneHubEvents deletes events past eventRetention, other than pings
+func pruneHubEvents(db *sql.DB, now time.Time) error {
+	cutoff := now.Add(-eventRetention).Unix()
+	_, err := db.Exec(`
+		DELETE FROM hub_events
+		WHERE created_at < ?
+		  AND type != 'ping'
+		  AND seq != (SELECT COALESCE(MAX(seq), 0) FROM hub_events WHERE type = 'maintenance')
+	`, cutoff)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		UPDATE hub_events SET data = json_remove(data, '$.ping.ip')
+		WHERE type = 'ping' AND created_at < ? AND json_extract(data, '$.ping.ip') IS NOT NULL
+	`, cutoff)
+	return err
+}
+
+// getHubEvents reads events after a sequence number, oldest first
+func (h *Hub) getHubEvents(ctx context.Context, after int64, limit int) ([]HubEvent, error) {
+	rows, err := h.db.QueryContext(ctx, `
+		SELECT seq, type, client_id, data, created_at FROM hub_events
+		WHERE seq > ? ORDER BY seq LIMIT ?
+	`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []HubEvent{}
+	for rows.Next() {
+		var ev HubEvent
+		var data string
+		if err := rows.Scan(&ev.Seq, &ev.Type, &ev.ClientID, &data, &ev.Time); err != nil {
+			return nil, err
+		}
+		ev.Data = json.RawMessage(data)
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// lastHubEvents decodes the most recent events of one type, oldest first
+func (h *Hub) lastHubEvents(eventType string, n int) ([]CursorMessage, error) {
+	rows, err := h.db.Query(`
+		SELECT data FROM (
+			SELECT seq, data FROM hub_events WHERE type = ? ORDER BY seq DESC LIMIT ?
+		) ORDER BY seq
+	`, eventType, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []CursorMessage
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var msg CursorMessage
+		if json.Unmarshal([]byte(data), &msg) == nil {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, rows.Err()
+}
+
+// rebuildFromEventLog restores recent pings, webhook announcements and
+// maintenance mode
+func (h *Hub) rebuildFromEventLog() error {
+	pings, err := h.lastHubEvents("ping", 10)
+	if err != nil {
+		return err
+	}
+	h.mutex.Lock()
+	h.recentPings = h.recentPings[:0]
+	for _, msg := range pings {
+		if msg.Ping != nil {
+			h.recentPings = append(h.recentPings, *msg.Ping)
+		}
+	}
+	h.mutex.Unlock()
+
+	last, err := h.lastHubEvents("maintenance", 1)
+	if err != nil {
+		return err
+	}
+	if len(last) == 1 && last[0].Maintenance != nil && last[0].Maintenance.Enabled {
+		h.mutex.Lock()
+		h.maintenance = *last[0].Maintenance
+		h.mutex.Unlock()
+		log.Printf("Restored maintenance mode from event log")
+	}
+
+	announcements, err := h.lastHubEvents("external", maxRecentEvents)
+	if err != nil {
+		return err
+	}
+	h.mutex.Lock()
+	h.external = h.external[:0]
+	for _, msg := range announcements {
+		if msg.Event != nil {
+			h.external = append(h.external, *msg.Event)
+		}
+	}
+	h.mutex.Unlock()
+
+	return nil
+}
+
+// handleGetEventLog pages through the site's event log (admin only)
+func handleGetEventLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	after, _ := strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	events, err := tenantFor(r).hub.getHubEvents(r.Context(), after, limit)
+	if err != nil {
+		log.Printf("Error reading event log: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// EXPERIMENTS lists A/B tests as name=variant|variant pairs, e.g.
+// "scanlines=on|off,palette=amber|green|white". Visitors are bucketed by a
+// hash of their visitor ID, so they always see the same variant.
+
+// Experiment is one A/B test and its variants
+type Experiment struct {
+	Name     string
+	Variants []string
+}
+
+var experiments = parseExperiments(os.Getenv("EXPERIMENTS"))
+
+func parseExperiments(spec string) []Experiment {
+	var list []Experiment
+	for _, entry := range strings.Split(spec, ",") {
+		name, variants, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || name == "" {
+			continue
+		}
+		e := Experiment{Name: name}
+		for _, v := range strings.Split(variants, "|") {
+			if v = strings.TrimSpace(v); v != "" {
+				e.Variants = append(e.Variants, v)
+			}
+		}
+		if len(e.Variants) < 2 {
+			log.Printf("Ignoring experiment %q: needs at least two variants", name)
+			continue
+		}
+		list = append(list, e)
+	}
+	return list
+}
+
+func findExperiment(name string) (Experiment, bool) {
+	for _, e := range experiments {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return Experiment{}, false
+}
+
+// assign deterministically picks a visitor's variant
+func (e Experiment) assign(visitorID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + ":" + visitorID))
+	return e.Variants[h.Sum32()%uint32(len(e.Variants))]
+}
+
+// logExposure records the first time a visitor saw an experiment
+func logExposure(ctx context.Context, db *sql.DB, experiment, visitorID, variant string) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO experiment_exposures (experiment, visitor_id, variant) VALUES (?, ?, ?)
+	`, experiment, visitorID, variant)
+	return err
+}
+
+// handleGetExperiments returns (and logs exposure to) the visitor's variants
+func handleGetExperiments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	site := tenantFor(r)
+	visitorID := visitorIDFromRequest(w, r)
+	assignments := make(map[string]string, len(experiments))
+	for _, e := range experiments {
+		variant := e.assign(visitorID)
+		assignments[e.Name] = variant
+		if err := logExposure(r.Context(), site.db, e.Name, visitorID, variant); err != nil {
+			log.Printf("Error logging exposure: %v", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assignments)
+}
+
+// VariantMetrics compares engagement for one variant
+type VariantMetrics struct {
+	Variant            string  `json:"variant"`
+	Visitors           int     `json:"visitors"`
+	Sessions           int     `json:"sessions"`
+	AvgSessionSecs     float64 `json:"avgSessionSeconds"`
+	PingsPerVisitor    float64 `json:"pingsPerVisitor"`
+	SessionsPerVisitor float64 `json:"sessionsPerVisitor"`
+}
+
+// getExperimentMetrics aggregates sessions started after each visitor's exposure
+func getExperimentMetrics(ctx context.Context, db *sql.DB, e Experiment) ([]VariantMetrics, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT x.variant,
+			COUNT(DISTINCT x.visitor_id),
+			COUNT(s.id),
+			COALESCE(AVG(s.duration_s), 0),
+			COALESCE(SUM(s.pings), 0)
+		FROM experiment_exposures x
+		LEFT JOIN visitor_sessions s
+			ON s.visitor_id = x.visitor_id AND s.started_at >= CAST(strftime('%s', x.exposed_at) AS INTEGER)
+		WHERE x.experiment = ?
+		GROUP BY x.variant
+	`, e.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byVariant := make(map[string]VariantMetrics)
+	for rows.Next() {
+		var m VariantMetrics
+		var pings int
+		if err := rows.Scan(&m.Variant, &m.Visitors, &m.Sessions, &m.AvgSessionSecs, &pings); err != nil {
+			return nil, err
+		}
+		if m.Visitors > 0 {
+			m.PingsPerVisitor = float64(pings) / float64(m.Visitors)
+			m.SessionsPerVisitor = float64(m.Sessions) / float64(m.Visitors)
+		}
+		byVariant[m.Variant] = m
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Report every configured variant, in configuration order
+	metrics := make([]VariantMetrics, 0, len(e.Variants))
+	for _, v := range e.Variants {
+		m := byVariant[v]
+		m.Variant = v
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// handleExperimentResults compares variants of every (or one) experiment
+func handleExperimentResults(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	selected := experiments
+	if name := r.URL.Query().Get("name"); name != "" {
+		e, ok := findExperiment(name)
+		if !ok {
+			http.Error(w, "Unknown experiment", http.StatusNotFound)
+			return
+		}
+		selected = []Experiment{e}
+	}
+
+	site := tenantFor(r)
+	results := make(map[string][]VariantMetrics, len(selected))
+	for _, e := range selected {
+		metrics, err := getExperimentMetrics(r.Context(), site.db, e)
+		if err != nil {
+			log.Printf("Error getting experiment metrics: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		results[e.Name] = metrics
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ExportedLocation is one row of the locations export
+type ExportedLocation struct {
+	ID           int64     `json:"id"`
+	Lat          float64   `json:"lat"`
+	Lng          float64   `json:"lng"`
+	VisitorCount int       `json:"visitorCount"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// Rows written between flushes of an export stream
+const exportFlushEvery = 500
+
+// handleExportLocations streams every location as newline-delimited JSON.
+// Rows go straight from the database cursor to the connection, so a slow
+// reader holds the query back instead of the export piling up in memory.
+func handleExportLocations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := tenantFor(r).readDB.QueryContext(r.Context(), `
+		SELECT id, lat, lng, visitor_count, created_at FROM locations ORDER BY id
+	`)
+	if err != nil {
+		log.Printf("Error exporting locations: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="locations.ndjson"`)
+	enc := json.NewEncoder(w)
+	sent := 0
+	for rows.Next() {
+		var loc ExportedLocation
+		if err := rows.Scan(&loc.ID, &loc.Lat, &loc.Lng, &loc.VisitorCount, &loc.CreatedAt); err != nil {
+			log.Printf("Error reading exported location: %v", err)
+			return
+		}
+		// A failed write means the client went away
+		if err := enc.Encode(loc); err != nil {
+			return
+		}
+		sent++
+		if sent%exportFlushEvery == 0 {
+			flusher.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error exporting locations: %v", err)
+	}
+	flusher.Flush()
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Public URL of the site, used for links in feeds and cards
+var siteURL = envString("SITE_URL", "https://currentcondition.tv")
+
+// FeedItem is one entry of the site activity feed
+type FeedItem struct {
+	ID      string
+	Title   string
+	Summary string
+	Updated time.Time
+}
+
+// Notable pings are the farthest from the site's home base each day, over
+// the last feedPingDays days
+const (
+	feedPingDays = 14
+	feedPingScan = 5000
+)
+
+// getFeedItems collects a site's new highscore records, notable pings,
+// visitor records, map growth and tournament winners, newest first
+func getFeedItems(ctx context.Context, site *Tenant, limit int) ([]FeedItem, error) {
+	var items []FeedItem
+	db, hub := site.readDB, site.hub
+
+	// Scores that beat the best one before them for their game
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, game, name, score, created_at, previous FROM (
+			SELECT h.id, h.game, h.name, h.score, h.created_at,
+				COALESCE((SELECT MAX(p.score) FROM highscores p WHERE p.game = h.game AND p.id < h.id), 0) AS previous
+			FROM highscores h
+			WHERE h.score > 0
+		)
+		WHERE score > previous
+		ORDER BY created_at DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id, score, previous int
+		var game, name string
+		var created time.Time
+		if err := rows.Scan(&id, &game, &name, &score, &created, &previous); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		summary := fmt.Sprintf("%s set the first %s record with %d points.", name, game, score)
+		if previous > 0 {
+			summary = fmt.Sprintf("%s beat the %s record of %d with %d points.", name, game, previous, score)
+		}
+		items = append(items, FeedItem{
+			ID:      fmt.Sprintf("highscore-%d", id),
+			Title:   fmt.Sprintf("NEW %s RECORD: %s %d", game, name, score),
+			Summary: summary,
+			Updated: created,
+		})
+	}
+	rows.Close()
+
+	pings, err := notablePings(ctx, site, time.Now().AddDate(0, 0, -feedPingDays))
+	if err != nil {
+		return nil, err
+	}
+	items = append(items, pings...)
+
+	// New places on the map, one entry per day
+	rows, err = db.QueryContext(ctx, `
+		SELECT date(created_at) AS day, COUNT(*) FROM locations
+		WHERE created_at >= date('now', '-14 days')
+		GROUP BY day
+		ORDER BY day DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var day string
+		var count int
+		if err := rows.Scan(&day, &count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t, _ := time.Parse("2006-01-02", day)
+		items = append(items, FeedItem{
+			ID:      "places-" + day,
+			Title:   fmt.Sprintf("%d NEW PLACES ON THE MAP", count),
+			Summary: fmt.Sprintf("Visitors from %d new places showed up on %s.", count, day),
+			Updated: t.Add(24*time.Hour - time.Second),
+		})
+	}
+	rows.Close()
+
+	// Tournament winners
+	rows, err = db.QueryContext(ctx, `
+		SELECT id, name, game, winner_id, finished_at FROM tournaments
+		WHERE status = 'finished'
+		ORDER BY finished_at DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id, finished int64
+		var name, game, winner string
+		if err := rows.Scan(&id, &name, &game, &winner, &finished); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		champion := playerName(ctx, db, winner)
+		items = append(items, FeedItem{
+			ID:      fmt.Sprintf("tournament-%d", id),
+			Title:   fmt.Sprintf("%s TOURNAMENT WON BY %s", strings.ToUpper(name), champion),
+			Summary: fmt.Sprintf("%s won the %s tournament %q.", champion, game, name),
+			Updated: time.Unix(finished, 0).UTC(),
+		})
+	}
+	rows.Close()
+
+	hub.mutex.RLock()
+	peak := hub.peak
+	hub.mutex.RUnlock()
+	if peak.Users > 0 {
+		items = append(items, FeedItem{
+			ID:      fmt.Sprintf("record-%d", peak.At),
+			Title:   fmt.Sprintf("NEW RECORD: %d VISITORS ONLINE", peak.Users),
+			Summary: fmt.Sprintf("%d people were on the terminal at the same time.", peak.Users),
+			Updated: time.Unix(peak.At, 0).UTC(),
+		})
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Updated.After(items[j].Updated) })
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
+
+// notablePings returns the farthest ping from the home base on each day since
+func notablePings(ctx context.Context, site *Tenant, since time.Time) ([]FeedItem, error) {
+	home := site.hub.home
+	rows, err := site.readDB.QueryContext(ctx, `
+		SELECT seq, data, created_at FROM hub_events
+		WHERE type = 'ping'
+		ORDER BY seq DESC
+		LIMIT ?
+	`, feedPingScan)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type farthest struct {
+		seq  int64
+		ping PingData
+		km   float64
+		at   int64
+	}
+	byDay := make(map[string]farthest)
+	for rows.Next() {
+		var seq, at int64
+		var data string
+		if err := rows.Scan(&seq, &data, &at); err != nil {
+			return nil, err
+		}
+		if at < since.Unix() {
+			break
+		}
+		var msg CursorMessage
+		if json.Unmarshal([]byte(data), &msg) != nil || msg.Ping == nil || (msg.Ping.Lat == 0 && msg.Ping.Lng == 0) {
+			continue
+		}
+		km := haversineKm(home.Lat, home.Lng, msg.Ping.Lat, msg.Ping.Lng)
+		day := time.Unix(at, 0).UTC().Format("2006-01-02")
+		if best, ok := byDay[day]; !ok || km > best.km {
+			byDay[day] = farthest{seq: seq, ping: *msg.Ping, km: km, at: at}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var items []FeedItem
+	for day, f := range byDay {
+		place := f.ping.Location
+		if place == "" {
+			place = fmt.Sprintf("%.2f, %.2f", f.ping.Lat, f.ping.Lng)
+		}
+		items = append(items, FeedItem{
+			ID:      fmt.Sprintf("ping-%d", f.seq),
+			Title:   fmt.Sprintf("LONGEST PING ON %s: %s", day, strings.ToUpper(place)),
+			Summary: fmt.Sprintf("A visitor in %s pinged the terminal from %.0f km away.", place, f.km),
+			Updated: time.Unix(f.at, 0).UTC(),
+		})
+	}
+	return items, nil
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Updated string   `xml:"updated"`
+	Summary string   `xml:"summary"`
+	Link    atomLink `xml:"link"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	GUID        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+	Description string `xml:"description"`
+	Link        string `xml:"link"`
+}
+
+// handleFeed serves the activity feed at /feed.xml, as Atom or, with
+// ?format=rss, as RSS
+func handleFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	site := tenantFor(r)
+	items, err := getFeedItems(r.Context(), site, 30)
+	if err != nil {
+		log.Printf("Error building feed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var feed interface{}
+	if r.URL.Query().Get("format") == "rss" {
+		ch := rssChannel{Title: "Current Condition", Link: site.url, Description: "Activity and records from the CRT weather terminal"}
+		for _, it := range items {
+			ch.Items = append(ch.Items, rssItem{
+				Title:       it.Title,
+				GUID:        site.url + "/#" + it.ID,
+				PubDate:     it.Updated.Format(time.RFC1123Z),
+				Description: it.Summary,
+				Link:        site.url,
+			})
+		}
+		feed = rssFeed{Version: "2.0", Channel: ch}
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	} else {
+		updated := time.Now().UTC()
+		if len(items) > 0 {
+			updated = items[0].Updated
+		}
+		af := atomFeed{Title: "Current Condition", ID: site.url + "/", Updated: updated.Format(time.RFC3339), Link: atomLink{Href: site.url}}
+		for _, it := range items {
+			af.Entries = append(af.Entries, atomEntry{
+				Title:   it.Title,
+				ID:      site.url + "/#" + it.ID,
+				Updated: it.Updated.Format(time.RFC3339),
+				Summary: it.Summary,
+				Link:    atomLink{Href: site.url},
+			})
+		}
+		feed = af
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	}
+
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(feed)
+}
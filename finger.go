@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// With FINGER_ADDR set (usually ":79"), `finger weather@host` prints the
+// teletype bulletin for DEFAULT_LOCATION ("lat,lng[,place]") followed by
+// visitor stats. `finger 52.52,13.40@host` works for any location.
+
+// Sessions served at a time, and the longest query line read
+const (
+	maxFingerSessions = 20
+	maxFingerLine     = 512
+)
+
+// fingerAddr returns the FINGER_ADDR setting, or "" when finger is off
+func fingerAddr() string {
+	return os.Getenv("FINGER_ADDR")
+}
+
+// runFinger answers finger queries on addr
+func runFinger(addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Finger listener failed: %v", err)
+		return
+	}
+	log.Printf("Finger responder on %s", addr)
+
+	sessions := make(chan struct{}, maxFingerSessions)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Finger accept error: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		select {
+		case sessions <- struct{}{}:
+			go func() {
+				defer func() { <-sessions }()
+				serveFinger(conn)
+			}()
+		default:
+			conn.Close()
+		}
+	}
+}
+
+func serveFinger(conn net.Conn) {
+	defer conn.Close()
+	defer func() {
+		if rec := recover(); rec != nil {
+			logPanic(rec, "finger="+conn.RemoteAddr().String())
+		}
+	}()
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	line, err := bufio.NewReader(io.LimitReader(conn, maxFingerLine)).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	// "/W" asks for verbose output, which is all we have anyway
+	user := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "/W"))
+	conn.Write([]byte(crlf(fingerResponse(user))))
+}
+
+// fingerResponse answers a finger query for user
+func fingerResponse(user string) string {
+	switch {
+	case user == "":
+		return "LOGIN     NAME\nweather   CURRENT CONDITIONS AND VISITOR STATS\n"
+	case strings.EqualFold(user, "weather"):
+		home := defaultTenant.hub.home
+		return fingerWeather(home.Lat, home.Lng, home.Place) + "\n" + visitorStatsText(defaultTenant)
+	case strings.Contains(user, ","):
+		return weatherBulletin(user)
+	case strings.Contains(user, "@"):
+		return "FORWARDING NOT SUPPORTED\n"
+	default:
+		return "NO SUCH USER: " + strings.ToUpper(user) + "\n"
+	}
+}
+
+func fingerWeather(lat, lng float64, place string) string {
+	f, err := getForecast(context.Background(), lat, lng)
+	if err != nil {
+		log.Printf("Error fetching forecast: %v", err)
+		return "WEATHER UNAVAILABLE\n"
+	}
+	return renderTeletype(f, place, lat, lng, teletypeFormat{}, time.Now())
+}
+
+// visitorStatsText summarizes who is on the terminal and how many places have visited
+func visitorStatsText(site *Tenant) string {
+	site.hub.mutex.RLock()
+	online, peak := len(site.hub.clients), site.hub.peak
+	site.hub.mutex.RUnlock()
+
+	var places int
+	if err := site.readDB.QueryRow(`SELECT COUNT(*) FROM locations`).Scan(&places); err != nil {
+		log.Printf("Error counting locations: %v", err)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "VISITORS ONLINE: %d\n", online)
+	if peak.Users > 0 {
+		fmt.Fprintf(&b, "RECORD: %d ON %s\n", peak.Users, strings.ToUpper(time.Unix(peak.At, 0).UTC().Format("Jan 2 2006")))
+	}
+	fmt.Fprintf(&b, "PLACES ON THE MAP: %d\n", places)
+	return b.String()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// Follow mode lets one visitor follow another's viewport. The follower sends
+// {"type":"follow_request","target":<id>}; the server relays it to the target,
+// which answers "follow_accept" or "follow_decline" with the requester as
+// target. While following, the target's "scroll" messages are forwarded to
+// its followers. Either side ends it with "unfollow".
+
+var followMessages = map[string]bool{
+	"follow_request": true,
+	"follow_accept":  true,
+	"follow_decline": true,
+	"unfollow":       true,
+	"scroll":         true,
+}
+
+// ScrollPosition is a client's viewport scroll offset
+type ScrollPosition struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// followState tracks requests and follows for a hub (guarded by the hub mutex)
+type followState struct {
+	// Pending requests, requester -> target
+	requests map[string]string
+	// Active follows, follower -> followed
+	following map[string]string
+	// Last scroll position per client
+	scroll map[string]*ScrollPosition
+}
+
+func newFollowState() followState {
+	return followState{
+		requests:  make(map[string]string),
+		following: make(map[string]string),
+		scroll:    make(map[string]*ScrollPosition),
+	}
+}
+
+// sendTo queues a message for one admitted client; it must be called with the hub mutex held
+func (h *Hub) sendTo(id string, msg CursorMessage) bool {
+	if h.clients[id] == nil {
+		return false
+	}
+	data, _ := json.Marshal(msg)
+	return h.sendFrameTo(id, data)
+}
+
+// sendFrameTo is sendTo for a message that's already encoded, so one frame
+// can go to several clients; it must be called with the hub mutex held
+func (h *Hub) sendFrameTo(id string, data []byte) bool {
+	client, ok := h.clients[id]
+	if !ok {
+		return false
+	}
+	return client.trySend(data)
+}
+
+// handleFollow handles the follow protocol messages from c
+func (c *Client) handleFollow(msg CursorMessage) {
+	h := c.hub
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	switch msg.Type {
+	case "follow_request":
+		if msg.Target == c.ID || h.clients[msg.Target] == nil {
+			h.sendTo(c.ID, CursorMessage{Type: "follow_decline", ID: msg.Target})
+			return
+		}
+		h.follows.requests[c.ID] = msg.Target
+		h.sendTo(msg.Target, CursorMessage{Type: "follow_request", ID: c.ID})
+
+	case "follow_accept", "follow_decline":
+		// Only the target of a pending request can answer it
+		if h.follows.requests[msg.Target] != c.ID {
+			return
+		}
+		delete(h.follows.requests, msg.Target)
+		if msg.Type == "follow_accept" {
+			h.follows.following[msg.Target] = c.ID
+			log.Printf("Client %s is following %s", msg.Target, c.ID)
+		}
+		h.sendTo(msg.Target, CursorMessage{Type: msg.Type, ID: c.ID, Scroll: h.follows.scroll[c.ID]})
+
+	case "unfollow":
+		// A follower stops following, or the followed client drops a follower
+		if followed, ok := h.follows.following[c.ID]; ok && (msg.Target == "" || msg.Target == followed) {
+			delete(h.follows.following, c.ID)
+			h.sendTo(followed, CursorMessage{Type: "unfollow", ID: c.ID})
+		} else if h.follows.following[msg.Target] == c.ID {
+			delete(h.follows.following, msg.Target)
+			h.sendTo(msg.Target, CursorMessage{Type: "unfollow", ID: c.ID})
+		}
+
+	case "scroll":
+		if msg.Scroll == nil {
+			return
+		}
+		h.follows.scroll[c.ID] = msg.Scroll
+		var data []byte
+		for follower, followed := range h.follows.following {
+			if followed == c.ID {
+				if data == nil {
+					data, _ = json.Marshal(CursorMessage{Type: "scroll", ID: c.ID, Scroll: msg.Scroll})
+				}
+				h.sendFrameTo(follower, data)
+			}
+		}
+	}
+}
+
+// dropFollows ends every request and follow involving id, telling the other
+// side; it must be called with the hub mutex held
+func (h *Hub) dropFollows(id string) {
+	delete(h.follows.requests, id)
+	delete(h.follows.scroll, id)
+	if followed, ok := h.follows.following[id]; ok {
+		delete(h.follows.following, id)
+		h.sendTo(followed, CursorMessage{Type: "unfollow", ID: id})
+	}
+	var data []byte
+	for follower, followed := range h.follows.following {
+		if followed == id {
+			delete(h.follows.following, follower)
+			if data == nil {
+				data, _ = json.Marshal(CursorMessage{Type: "unfollow", ID: id})
+			}
+			h.sendFrameTo(follower, data)
+		}
+	}
+	for requester, target := range h.follows.requests {
+		if target == id {
+			delete(h.follows.requests, requester)
+			h.sendTo(requester, CursorMessage{Type: "follow_decline", ID: id})
+		}
+	}
+}
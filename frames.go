@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// Frame encoding for the busiest broadcasts. json.Marshal on a CursorMessage
+// copies the whole struct to the heap and walks every field by reflection,
+// which was nearly all of the cost of a move broadcast. Moves are written by
+// hand into pooled buffers instead, and messages that only carry a small
+// number are encoded once and shared. Every frame is immutable once built,
+// so the same slice can sit in any number of Send channels.
+
+// frameBuffers holds scratch space for building frames
+var frameBuffers = sync.Pool{New: func() any {
+	b := make([]byte, 0, 256)
+	return &b
+}}
+
+// encodeMove returns the same bytes as json.Marshal of a move message
+func encodeMove(id string, pos *CursorPosition) []byte {
+	if !finitePosition(pos) {
+		// json.Marshal fails on these too; keep its behaviour
+		data, _ := json.Marshal(CursorMessage{Type: "move", ID: id, Position: pos})
+		return data
+	}
+
+	bp := frameBuffers.Get().(*[]byte)
+	b := append((*bp)[:0], `{"type":"move"`...)
+	if id != "" {
+		b = append(b, `,"id":`...)
+		b = appendJSONString(b, id)
+	}
+	b = append(b, `,"position":{"x":`...)
+	b = appendJSONFloat(b, pos.X)
+	b = append(b, `,"y":`...)
+	b = appendJSONFloat(b, pos.Y)
+	if pos.Location != "" {
+		b = append(b, `,"location":`...)
+		b = appendJSONString(b, pos.Location)
+	}
+	if pos.Zone != "" {
+		b = append(b, `,"zone":`...)
+		b = appendJSONString(b, pos.Zone)
+	}
+	for _, f := range []struct {
+		key string
+		v   float64
+	}{{`,"scrollX":`, pos.ScrollX}, {`,"scrollY":`, pos.ScrollY}, {`,"pageWidth":`, pos.PageWidth}, {`,"pageHeight":`, pos.PageHeight}} {
+		if f.v != 0 {
+			b = append(b, f.key...)
+			b = appendJSONFloat(b, f.v)
+		}
+	}
+	if n := pos.Normalized; n != nil {
+		b = append(b, `,"normalized":{"x":`...)
+		b = appendJSONFloat(b, n.X)
+		b = append(b, `,"y":`...)
+		b = appendJSONFloat(b, n.Y)
+		b = append(b, '}')
+	}
+	b = append(b, "}}"...)
+
+	// One copy per broadcast, however many clients it goes to
+	data := append([]byte(nil), b...)
+	*bp = b
+	frameBuffers.Put(bp)
+	return data
+}
+
+// finitePosition reports whether every number in pos can be encoded
+func finitePosition(pos *CursorPosition) bool {
+	vals := [...]float64{pos.X, pos.Y, pos.ScrollX, pos.ScrollY, pos.PageWidth, pos.PageHeight}
+	for _, v := range vals {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	if n := pos.Normalized; n != nil {
+		for _, v := range [...]float64{n.X, n.Y} {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// appendJSONFloat formats f the way encoding/json does
+func appendJSONFloat(b []byte, f float64) []byte {
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	b = strconv.AppendFloat(b, f, format, -1, 64)
+	if format == 'e' {
+		// Clean up e-09 to e-9
+		if n := len(b); n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return b
+}
+
+// appendJSONString quotes s the way encoding/json does. Client IDs, zones and
+// place names are almost always plain ASCII, so anything else is left to the
+// standard encoder.
+func appendJSONString(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c >= utf8.RuneSelf || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			quoted, _ := json.Marshal(s)
+			return append(b, quoted...)
+		}
+	}
+	b = append(b, '"')
+	b = append(b, s...)
+	return append(b, '"')
+}
+
+// Frames for numbers up to this are cached; anything larger is rare enough
+// to encode every time
+const maxCachedFrame = 1024
+
+// numberFrames caches frames that depend only on a small non-negative number,
+// such as a queue position
+type numberFrames struct {
+	mutex  sync.Mutex
+	frames [][]byte
+	encode func(n int) []byte
+}
+
+func (f *numberFrames) get(n int) []byte {
+	if n < 0 || n >= maxCachedFrame {
+		return f.encode(n)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if n >= len(f.frames) {
+		f.frames = append(f.frames, make([][]byte, n+1-len(f.frames))...)
+	}
+	if f.frames[n] == nil {
+		f.frames[n] = f.encode(n)
+	}
+	return f.frames[n]
+}
+
+var queueFrames = &numberFrames{encode: func(n int) []byte {
+	data, _ := json.Marshal(CursorMessage{Type: "queue", QueuePos: n})
+	return data
+}}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// The page is served straight from the working directory, so a deploy can
+// replace it under tabs and kiosks that stay open for weeks. The frontend
+// version is a short hash of the page; clients get it in init and reload if
+// it differs from the one they loaded with (after a restart). While running,
+// the server checks the file every assetCheckInterval and sends a "reload"
+// message with the new version to everyone when it changes.
+
+// Files that make up the frontend build
+var frontendAssets = []string{"index.html"}
+
+const assetCheckInterval = 30 * time.Second
+
+var frontend struct {
+	sync.RWMutex
+	version string
+	// Size and modification time of each asset when last hashed
+	stamps map[string]assetStamp
+}
+
+type assetStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// frontendVersion returns the version of the frontend being served, or ""
+// if the assets couldn't be read
+func frontendVersion() string {
+	frontend.RLock()
+	defer frontend.RUnlock()
+	return frontend.version
+}
+
+// assetStamps stats the frontend assets
+func assetStamps() (map[string]assetStamp, error) {
+	stamps := make(map[string]assetStamp)
+	for _, name := range frontendAssets {
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		stamps[name] = assetStamp{size: info.Size(), modTime: info.ModTime()}
+	}
+	return stamps, nil
+}
+
+// hashFrontendAssets hashes the contents of the frontend assets
+func hashFrontendAssets() (string, error) {
+	sum := sha256.New()
+	for _, name := range frontendAssets {
+		f, err := os.Open(name)
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(sum, name+"\x00")
+		_, err = io.Copy(sum, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(sum.Sum(nil))[:12], nil
+}
+
+// checkFrontendAssets rehashes the assets if they were touched and reports
+// the new version if their contents changed
+func checkFrontendAssets() (string, bool) {
+	stamps, err := assetStamps()
+	if err != nil {
+		log.Printf("Error checking frontend assets: %v", err)
+		return "", false
+	}
+	frontend.RLock()
+	same := len(stamps) == len(frontend.stamps)
+	for name, s := range stamps {
+		same = same && frontend.stamps[name] == s
+	}
+	old := frontend.version
+	frontend.RUnlock()
+	if same {
+		return "", false
+	}
+
+	version, err := hashFrontendAssets()
+	if err != nil {
+		log.Printf("Error hashing frontend assets: %v", err)
+		return "", false
+	}
+	frontend.Lock()
+	frontend.version, frontend.stamps = version, stamps
+	frontend.Unlock()
+	return version, old != "" && version != old
+}
+
+// watchFrontendAssets tells every client to reload when the page changes
+func watchFrontendAssets() {
+	ticker := time.NewTicker(assetCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		version, changed := checkFrontendAssets()
+		if !changed {
+			continue
+		}
+		log.Printf("Frontend changed to version %s, asking clients to reload", version)
+		data, _ := json.Marshal(CursorMessage{Type: "reload", Version: version})
+		for _, h := range allHubs() {
+			h.broadcastToOthers("", data)
+		}
+	}
+}
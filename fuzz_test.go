@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func FuzzCursorMessage(f *testing.F) {
+	for _, seed := range []string{
+		`{"type":"move","position":{"x":10,"y":20,"zone":"games","scrollX":5,"scrollY":9,"pageWidth":800,"pageHeight":600}}`,
+		`{"type":"move","position":{"x":1e300,"y":-1e300}}`,
+		`{"type":"ping","ping":{"ip":"x","location":"Town","lat":1,"lng":2}}`,
+		`{"type":"dm","to":"abc","text":"hi"}`,
+		`{"jsonrpc":"2.0","id":1,"method":"stats"}`,
+		`{"type":"move","position":` + strings.Repeat(`[`, 500) + strings.Repeat(`]`, 500) + `}`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		isRPC(data)
+		var msg CursorMessage
+		if json.Unmarshal(data, &msg) != nil {
+			return
+		}
+		if pos := msg.Position; pos != nil && validCursorPosition(pos) {
+			pos.Zone = sanitizeZone(pos.Zone)
+			normalizePosition(pos)
+			for _, v := range []float64{pos.X, pos.Y} {
+				if math.IsNaN(v) || v < 0 || v > maxPageSize {
+					t.Fatalf("position out of range after validation: %+v", pos)
+				}
+			}
+			if n := pos.Normalized; n != nil && (n.X < 0 || n.X > 1 || n.Y < 0 || n.Y > 1) {
+				t.Fatalf("normalized point out of range: %+v", n)
+			}
+		}
+		// Anything the hub echoes back must encode, or it would broadcast nothing
+		if _, err := json.Marshal(CursorMessage{Type: msg.Type, Position: msg.Position, Ping: msg.Ping}); err != nil {
+			t.Fatalf("accepted message doesn't re-encode: %v", err)
+		}
+	})
+}
+
+func FuzzEncodeMove(f *testing.F) {
+	f.Add("abc123", 10.0, 20.0, "Town", "games", 0.0, 0.5, 0.25, true)
+	f.Add("", 1e-7, 1e21, "<b>\u2028", "", 800.0, -0.0, 1e300, false)
+	f.Add("\xff\"", 0.1, 123456.789, "Zürich", "a&b", 5e-324, 0.0, 0.0, true)
+	f.Fuzz(func(t *testing.T, id string, x, y float64, location, zone string, scroll, nx, ny float64, normalized bool) {
+		pos := &CursorPosition{X: x, Y: y, Location: location, Zone: zone, ScrollX: scroll, PageHeight: scroll}
+		if normalized {
+			pos.Normalized = &NormalizedPoint{X: nx, Y: ny}
+		}
+		want, _ := json.Marshal(CursorMessage{Type: "move", ID: id, Position: pos})
+		if got := encodeMove(id, pos); !bytes.Equal(got, want) {
+			t.Fatalf("encodeMove = %s, json.Marshal = %s", got, want)
+		}
+	})
+}
+
+func FuzzSanitizeName(f *testing.F) {
+	for _, seed := range []string{"abc", "", "ab", "abcdef", "ÄÖÜ", "日本語", "a\xffb"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		got := sanitizeName(name)
+		if utf8.ValidString(name) && !utf8.ValidString(got) {
+			t.Fatalf("sanitizeName(%q) = %q, not valid UTF-8", name, got)
+		}
+		if utf8.RuneCountInString(got) != 3 {
+			t.Fatalf("sanitizeName(%q) = %q, want 3 characters", name, got)
+		}
+	})
+}
+
+func FuzzParseLocationImport(f *testing.F) {
+	for _, seed := range []string{
+		"lat,lng,visitors,created_at\n1,2,3,2024-01-01\n",
+		"1,2\n3,4,5\n",
+		`{"type":"FeatureCollection","features":[{"geometry":{"type":"Point","coordinates":[1,2]},"properties":{"visitors":3}}]}`,
+		"\xef\xbb\xbflatitude,longitude\n1,2\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parseLocationImport(bytes.NewReader(data))
+	})
+}
+
+func FuzzQueryParams(f *testing.F) {
+	for _, seed := range []string{"1,2,3,4", "-180,-90,180,90", "90m", "7d", "2024-01-01", "1700000000", ""} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		parseBBox(s)
+		parseRange(s)
+		parseAsOf(s)
+		parseImportTime(s)
+		sanitizeZone(s)
+	})
+}
+
+func FuzzDecodeJSONBody(f *testing.F) {
+	for _, seed := range []string{
+		`{"game":"SNAKE","name":"ABC","score":120,"country":"DE"}`,
+		`{"game":"SNAKE","name":"` + strings.Repeat("A", maxJSONBody) + `"}`,
+		strings.Repeat(`{"a":`, 20000),
+		`{"score":1e999}`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		var req struct {
+			Game    string `json:"game"`
+			Name    string `json:"name"`
+			Score   int    `json:"score"`
+			Country string `json:"country"`
+		}
+		r := httptest.NewRequest("POST", "/api/highscore", bytes.NewReader(body))
+		err := decodeJSONBody(httptest.NewRecorder(), r, &req)
+		if err == nil && len(req.Name)+len(req.Game)+len(req.Country) > maxJSONBody {
+			t.Fatalf("decoded %d bytes of strings from a body capped at %d", len(req.Name)+len(req.Game)+len(req.Country), maxJSONBody)
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import "math"
+
+// Great-circle helpers for visitor locations, stations and the like. Points
+// are degrees of latitude and longitude; distances are kilometres.
+
+const earthRadiusKm = 6371.0
+
+// haversineKm is the great-circle distance between two points
+func haversineKm(lat1, lng1, lat2, lng2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLng := (lng2 - lng1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// unitVector is a point on the unit sphere, for comparing many distances
+// without trigonometry in the inner loop
+type unitVector struct{ x, y, z float64 }
+
+func toUnitVector(lat, lng float64) unitVector {
+	toRad := math.Pi / 180
+	phi, lambda := lat*toRad, lng*toRad
+	return unitVector{math.Cos(phi) * math.Cos(lambda), math.Cos(phi) * math.Sin(lambda), math.Sin(phi)}
+}
+
+// dot is the cosine of the angle between two points; smaller is farther apart
+func (u unitVector) dot(v unitVector) float64 {
+	return u.x*v.x + u.y*v.y + u.z*v.z
+}
+
+// latLng turns a vector back into a point; it needn't be unit length, but
+// must not be zero
+func (u unitVector) latLng() (lat, lng float64) {
+	toDeg := 180 / math.Pi
+	return math.Atan2(u.z, math.Hypot(u.x, u.y)) * toDeg, math.Atan2(u.y, u.x) * toDeg
+}
+
+// antipode is the point on the opposite side of the Earth
+func antipode(lat, lng float64) (float64, float64) {
+	if lng > 0 {
+		return -lat, lng - 180
+	}
+	return -lat, lng + 180
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// GET /api/geo/fun?lat=&lng= returns trivia about a point for the ticker:
+// its antipode, how far away the newest visitor from somewhere else is, and
+// where the geographic midpoint of all visitors lies.
+
+// NewestVisitorFact is the most recently added location other than the asker's
+type NewestVisitorFact struct {
+	Lat       float64   `json:"lat"`
+	Lng       float64   `json:"lng"`
+	Km        float64   `json:"km"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// GeoFunFacts is the response of /api/geo/fun
+type GeoFunFacts struct {
+	Point         GeoPoint           `json:"point"`
+	Antipode      GeoPoint           `json:"antipode"`
+	NewestVisitor *NewestVisitorFact `json:"newestVisitor,omitempty"`
+	Midpoint      *GeoPoint          `json:"visitorMidpoint,omitempty"`
+	MidpointKm    float64            `json:"midpointKm,omitempty"`
+}
+
+// getNewestVisitor returns the newest location not at the given spot, or nil
+func getNewestVisitor(ctx context.Context, db *sql.DB, lat, lng float64) (*NewestVisitorFact, error) {
+	var v NewestVisitorFact
+	err := db.QueryRowContext(ctx, `
+		SELECT lat, lng, created_at FROM locations
+		WHERE NOT (lat_rounded = ? AND lng_rounded = ?)
+		ORDER BY created_at DESC, id DESC LIMIT 1
+	`, roundCoord(lat, 2), roundCoord(lng, 2)).Scan(&v.Lat, &v.Lng, &v.Timestamp)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.Km = haversineKm(lat, lng, v.Lat, v.Lng)
+	return &v, nil
+}
+
+func handleGetGeoFun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lat, lng, ok := parseLatLng(r)
+	if !ok {
+		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+		return
+	}
+
+	site := tenantFor(r)
+	facts := GeoFunFacts{Point: GeoPoint{Lat: lat, Lng: lng}}
+	aLat, aLng := antipode(lat, lng)
+	facts.Antipode = GeoPoint{Lat: roundCoord(aLat, 6), Lng: roundCoord(aLng, 6)}
+
+	var err error
+	facts.NewestVisitor, err = getNewestVisitor(r.Context(), site.readDB, lat, lng)
+	if err != nil {
+		log.Printf("Error getting newest visitor: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	stats, err := siteDistanceStats(r.Context(), site)
+	if err != nil {
+		log.Printf("Error getting distance stats: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if m := stats.Midpoint; m != nil {
+		facts.Midpoint = m
+		facts.MidpointKm = haversineKm(lat, lng, m.Lat, m.Lng)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	json.NewEncoder(w).Encode(facts)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// WeatherGlyph describes how a WMO weather code is drawn on the terminal
+type WeatherGlyph struct {
+	Code  int      `json:"code"`
+	Label string   `json:"label"`
+	Icon  string   `json:"icon"`
+	Glyph string   `json:"glyph"`
+	Art   []string `json:"art"`
+}
+
+// Five-line ASCII art per condition family, sized for the CRT panel
+var (
+	artClear = []string{
+		`    \   /    `,
+		`     .-.     `,
+		`  ― (   ) ―  `,
+		`     '-'     `,
+		`    /   \    `,
+	}
+	artNight = []string{
+		`     _.._    `,
+		`   .' .-'`+"`"+`   `,
+		`  /  /       `,
+		`  |  |       `,
+		`   \  '.___.'`,
+	}
+	artPartly = []string{
+		`   \  /      `,
+		` _ /"".-.    `,
+		`   \_(   ).  `,
+		`   /(___(__) `,
+		`             `,
+	}
+	artCloudy = []string{
+		`             `,
+		`     .--.    `,
+		`  .-(    ).  `,
+		` (___.__)__) `,
+		`             `,
+	}
+	artFog = []string{
+		`             `,
+		` _ - _ - _ - `,
+		`  _ - _ - _  `,
+		` _ - _ - _ - `,
+		`             `,
+	}
+	artRain = []string{
+		`     .-.     `,
+		`    (   ).   `,
+		`   (___(__)  `,
+		`    ' ' ' '  `,
+		`   ' ' ' '   `,
+	}
+	artSnow = []string{
+		`     .-.     `,
+		`    (   ).   `,
+		`   (___(__)  `,
+		`    *  *  *  `,
+		`   *  *  *   `,
+	}
+	artThunder = []string{
+		`     .-.     `,
+		`    (   ).   `,
+		`   (___(__)  `,
+		`    /_ /_    `,
+		`     /  /    `,
+	}
+)
+
+// weatherGlyphs maps WMO weather interpretation codes to their terminal glyphs
+var weatherGlyphs = map[int]WeatherGlyph{
+	0:  {Label: "CLEAR SKY", Icon: "☀️", Glyph: "*", Art: artClear},
+	1:  {Label: "MAINLY CLEAR", Icon: "🌤️", Glyph: "*", Art: artPartly},
+	2:  {Label: "PARTLY CLOUDY", Icon: "⛅", Glyph: "o", Art: artPartly},
+	3:  {Label: "OVERCAST", Icon: "☁️", Glyph: "O", Art: artCloudy},
+	45: {Label: "FOG", Icon: "🌫️", Glyph: "=", Art: artFog},
+	48: {Label: "DEPOSITING RIME FOG", Icon: "🌫️", Glyph: "=", Art: artFog},
+	51: {Label: "LIGHT DRIZZLE", Icon: "🌧️", Glyph: ",", Art: artRain},
+	53: {Label: "MODERATE DRIZZLE", Icon: "🌧️", Glyph: ",", Art: artRain},
+	55: {Label: "DENSE DRIZZLE", Icon: "🌧️", Glyph: ",", Art: artRain},
+	61: {Label: "LIGHT RAIN", Icon: "🌧️", Glyph: "'", Art: artRain},
+	63: {Label: "MODERATE RAIN", Icon: "🌧️", Glyph: "'", Art: artRain},
+	65: {Label: "HEAVY RAIN", Icon: "🌧️", Glyph: "\"", Art: artRain},
+	71: {Label: "LIGHT SNOW", Icon: "🌨️", Glyph: "*", Art: artSnow},
+	73: {Label: "MODERATE SNOW", Icon: "🌨️", Glyph: "*", Art: artSnow},
+	75: {Label: "HEAVY SNOW", Icon: "🌨️", Glyph: "#", Art: artSnow},
+	77: {Label: "SNOW GRAINS", Icon: "🌨️", Glyph: ".", Art: artSnow},
+	80: {Label: "LIGHT SHOWERS", Icon: "🌧️", Glyph: "'", Art: artRain},
+	81: {Label: "MODERATE SHOWERS", Icon: "🌧️", Glyph: "'", Art: artRain},
+	82: {Label: "VIOLENT SHOWERS", Icon: "🌧️", Glyph: "\"", Art: artRain},
+	85: {Label: "LIGHT SNOW SHOWERS", Icon: "🌨️", Glyph: "*", Art: artSnow},
+	86: {Label: "HEAVY SNOW SHOWERS", Icon: "🌨️", Glyph: "#", Art: artSnow},
+	95: {Label: "THUNDERSTORM", Icon: "⛈️", Glyph: "!", Art: artThunder},
+	96: {Label: "THUNDERSTORM WITH HAIL", Icon: "⛈️", Glyph: "!", Art: artThunder},
+	99: {Label: "SEVERE THUNDERSTORM", Icon: "⛈️", Glyph: "!", Art: artThunder},
+}
+
+// weatherGlyphFor returns the glyph for a WMO code; clear skies get a moon at night
+func weatherGlyphFor(code int, night bool) WeatherGlyph {
+	g, ok := weatherGlyphs[code]
+	if !ok {
+		return WeatherGlyph{Code: code, Label: "UNKNOWN CONDITIONS", Icon: "🌡️", Glyph: "?", Art: artCloudy}
+	}
+	g.Code = code
+	if night && code <= 1 {
+		g.Icon = "🌙"
+		g.Glyph = "("
+		g.Art = artNight
+	}
+	return g
+}
+
+// handleGetGlyphs returns one glyph with ?code= (and optional night=1), or the whole table
+func handleGetGlyphs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	night := r.URL.Query().Get("night") == "1"
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+
+	if codeParam := r.URL.Query().Get("code"); codeParam != "" {
+		code, err := strconv.Atoi(codeParam)
+		if err != nil {
+			http.Error(w, "Invalid code", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(weatherGlyphFor(code, night))
+		return
+	}
+
+	codes := make([]int, 0, len(weatherGlyphs))
+	for code := range weatherGlyphs {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	glyphs := make([]WeatherGlyph, 0, len(codes))
+	for _, code := range codes {
+		glyphs = append(glyphs, weatherGlyphFor(code, night))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(glyphs)
+}
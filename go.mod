@@ -2,4 +2,7 @@ module crt-weather
 
 go 1.22.2
 
-require github.com/mattn/go-sqlite3 v1.14.33 // indirect
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/mattn/go-sqlite3 v1.14.33
+)
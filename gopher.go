@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// With GOPHER_ADDR set (e.g. ":70"), a Gopher server publishes the text side
+// of the terminal: weather bulletins (a search for "lat,lng"), the activity
+// feed, highscores and the ASCII visitor map. Menus advertise GOPHER_HOST,
+// which defaults to the host of SITE_URL.
+
+// Sessions served at a time, and the longest selector line read
+const (
+	maxGopherSessions = 50
+	maxGopherLine     = 512
+)
+
+// gopherAddr returns the GOPHER_ADDR setting, or "" when Gopher is off
+func gopherAddr() string {
+	return os.Getenv("GOPHER_ADDR")
+}
+
+// gopherHostPort returns the host and port advertised in menu items
+func gopherHostPort(addr string) (string, string) {
+	host := os.Getenv("GOPHER_HOST")
+	if host == "" {
+		if u, err := url.Parse(siteURL); err == nil && u.Hostname() != "" {
+			host = u.Hostname()
+		} else {
+			host = "localhost"
+		}
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil || port == "" {
+		port = "70"
+	}
+	return host, port
+}
+
+// runGopher accepts Gopher requests on addr
+func runGopher(addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Gopher listener failed: %v", err)
+		return
+	}
+	log.Printf("Gopher server on %s", addr)
+	host, port := gopherHostPort(addr)
+
+	sessions := make(chan struct{}, maxGopherSessions)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Gopher accept error: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		select {
+		case sessions <- struct{}{}:
+			go func() {
+				defer func() { <-sessions }()
+				serveGopher(conn, host, port)
+			}()
+		default:
+			conn.Close()
+		}
+	}
+}
+
+func serveGopher(conn net.Conn, host, port string) {
+	defer conn.Close()
+	defer func() {
+		if rec := recover(); rec != nil {
+			logPanic(rec, "gopher="+conn.RemoteAddr().String())
+		}
+	}()
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	line, err := bufio.NewReader(io.LimitReader(conn, maxGopherLine)).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	selector, query, _ := strings.Cut(strings.TrimRight(line, "\r\n"), "\t")
+
+	out := bufio.NewWriter(conn)
+	defer out.Flush()
+	site := defaultTenant
+
+	switch selector {
+	case "", "/":
+		out.WriteString(gopherMenu(host, port))
+	case "/weather":
+		if query == "" {
+			query = "0,0"
+		}
+		out.WriteString(gopherText(weatherBulletin(query)))
+	case "/activity":
+		out.WriteString(gopherText(activityText(site)))
+	case "/highscores":
+		out.WriteString(gopherText(highscoresText(site)))
+	case "/map":
+		locations, err := getLocationsFromDB(context.Background(), site.readDB)
+		if err != nil {
+			log.Printf("Error getting locations: %v", err)
+			out.WriteString(gopherText("MAP UNAVAILABLE\n"))
+			return
+		}
+		out.WriteString(gopherText(renderASCIIMap(locations, 80, 24, false)))
+	default:
+		fmt.Fprintf(out, "3Not found\t\terror.host\t1\r\n.\r\n")
+	}
+}
+
+// gopherMenu renders the root gophermap
+func gopherMenu(host, port string) string {
+	var b strings.Builder
+	info := func(s string) { fmt.Fprintf(&b, "i%s\t\terror.host\t1\r\n", s) }
+	item := func(kind, name, selector string) {
+		fmt.Fprintf(&b, "%s%s\t%s\t%s\t%s\r\n", kind, name, selector, host, port)
+	}
+
+	info("CURRENTCONDITION.TV")
+	info(strings.ToUpper(time.Now().UTC().Format("15:04 MST Mon Jan 2 2006")))
+	info("")
+	item("7", "Weather bulletin (search: lat,lng)", "/weather")
+	item("0", "Site activity", "/activity")
+	item("0", "Highscores", "/highscores")
+	item("0", "Visitor map", "/map")
+	b.WriteString(".\r\n")
+	return b.String()
+}
+
+// gopherText terminates a text document, dot-stuffing lines that start with "."
+func gopherText(s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	for i, l := range lines {
+		if strings.HasPrefix(l, ".") {
+			lines[i] = "." + l
+		}
+	}
+	return strings.Join(lines, "\r\n") + "\r\n.\r\n"
+}
+
+// activityText lists the activity feed as plain text
+func activityText(site *Tenant) string {
+	items, err := getFeedItems(context.Background(), site, 20)
+	if err != nil {
+		log.Printf("Error getting feed items: %v", err)
+		return "ACTIVITY UNAVAILABLE\n"
+	}
+	var b strings.Builder
+	for _, item := range items {
+		fmt.Fprintf(&b, "%s  %s\n", item.Updated.UTC().Format("2006-01-02 15:04"), item.Title)
+		for _, l := range wrapTeletype(item.Summary) {
+			fmt.Fprintf(&b, "                  %s\n", l)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A small GraphQL endpoint so the frontend can fetch exactly what a panel
+// needs in one round trip. It supports queries with aliases, arguments and
+// variables; fragments, directives and mutations are not implemented.
+// Subscriptions bridge the hub: "subscription { events(types: ["ping"]) {
+// type ping { lat lng } } }" streams each logged hub event as a server-sent
+// "next" event, in the graphql-sse format.
+
+// gqlField is one field in a selection set
+type gqlField struct {
+	Alias     string
+	Name      string
+	Args      map[string]interface{}
+	Selection []gqlField
+}
+
+type gqlVariable struct{ name string }
+
+type gqlParser struct {
+	src string
+	pos int
+}
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// skip moves past whitespace, commas and comments, which GraphQL ignores
+func (p *gqlParser) skip() {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *gqlParser) peek() byte {
+	p.skip()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *gqlParser) expect(c byte) error {
+	if p.peek() != c {
+		return p.errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	p.skip()
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := rune(p.src[p.pos])
+		if c == '_' || unicode.IsLetter(c) || (p.pos > start && unicode.IsDigit(c)) {
+			p.pos++
+			continue
+		}
+		break
+	}
+	if start == p.pos {
+		return "", p.errorf("expected name")
+	}
+	return p.src[start:p.pos], nil
+}
+
+// document parses "{ ... }", "query Name($v: Type) { ... }" or the same with
+// "subscription", and returns the operation type with its selection
+func (p *gqlParser) document() (string, []gqlField, error) {
+	op := "query"
+	if p.peek() != '{' {
+		var err error
+		if op, err = p.name(); err != nil {
+			return "", nil, err
+		}
+		if op != "query" && op != "subscription" {
+			return "", nil, fmt.Errorf("only queries and subscriptions are supported")
+		}
+		if c := p.peek(); c != '{' && c != '(' {
+			if _, err := p.name(); err != nil {
+				return "", nil, err
+			}
+		}
+		// Variable types are not checked, so just skip the definitions
+		if p.peek() == '(' {
+			depth := 0
+			for p.pos < len(p.src) {
+				c := p.src[p.pos]
+				p.pos++
+				if c == '(' {
+					depth++
+				} else if c == ')' {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+		}
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return "", nil, err
+	}
+	if p.peek() != 0 {
+		return "", nil, fmt.Errorf("only a single operation is supported")
+	}
+	return op, sel, nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlField, error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	var fields []gqlField
+	for p.peek() != '}' {
+		if p.peek() == 0 {
+			return nil, p.errorf("unterminated selection set")
+		}
+		if p.peek() == '.' {
+			return nil, fmt.Errorf("fragments are not supported")
+		}
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	p.pos++
+	return fields, nil
+}
+
+func (p *gqlParser) field() (gqlField, error) {
+	var f gqlField
+	name, err := p.name()
+	if err != nil {
+		return f, err
+	}
+	f.Name, f.Alias = name, name
+	if p.peek() == ':' {
+		p.pos++
+		if f.Name, err = p.name(); err != nil {
+			return f, err
+		}
+	}
+	if p.peek() == '(' {
+		p.pos++
+		f.Args = make(map[string]interface{})
+		for p.peek() != ')' {
+			arg, err := p.name()
+			if err != nil {
+				return f, err
+			}
+			if err := p.expect(':'); err != nil {
+				return f, err
+			}
+			if f.Args[arg], err = p.value(); err != nil {
+				return f, err
+			}
+		}
+		p.pos++
+	}
+	if p.peek() == '{' {
+		if f.Selection, err = p.selectionSet(); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+func (p *gqlParser) value() (interface{}, error) {
+	switch c := p.peek(); {
+	case c == '$':
+		p.pos++
+		name, err := p.name()
+		return gqlVariable{name}, err
+	case c == '"':
+		p.pos++
+		var b strings.Builder
+		for p.pos < len(p.src) && p.src[p.pos] != '"' {
+			if p.src[p.pos] == '\\' && p.pos+1 < len(p.src) {
+				p.pos++
+			}
+			b.WriteByte(p.src[p.pos])
+			p.pos++
+		}
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("unterminated string")
+		}
+		p.pos++
+		return b.String(), nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+		return strconv.ParseFloat(p.src[start:p.pos], 64)
+	case c == '[':
+		p.pos++
+		var list []interface{}
+		for p.peek() != ']' {
+			if p.peek() == 0 {
+				return nil, p.errorf("unterminated list")
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		p.pos++
+		return list, nil
+	default:
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return name, nil // enum value
+	}
+}
+
+// gqlArgs gives resolvers typed access to arguments with variables substituted
+type gqlArgs map[string]interface{}
+
+func (a gqlArgs) str(name string) string {
+	s, _ := a[name].(string)
+	return s
+}
+
+func (a gqlArgs) num(name string) (float64, bool) {
+	n, ok := a[name].(float64)
+	return n, ok
+}
+
+func (a gqlArgs) boolean(name string) bool {
+	b, _ := a[name].(bool)
+	return b
+}
+
+type gqlResolver func(ctx context.Context, site *Tenant, args gqlArgs) (interface{}, error)
+
+var gqlQueryFields = map[string]gqlResolver{
+	"stats": func(ctx context.Context, site *Tenant, args gqlArgs) (interface{}, error) {
+		site.hub.mutex.RLock()
+		defer site.hub.mutex.RUnlock()
+		return StatsResponse{CurrentUsers: len(site.hub.clients), Peak: site.hub.peak}, nil
+	},
+	"zones": func(ctx context.Context, site *Tenant, args gqlArgs) (interface{}, error) {
+		var zones []map[string]interface{}
+		for name, count := range site.hub.countZones() {
+			zones = append(zones, map[string]interface{}{"name": name, "count": count})
+		}
+		return zones, nil
+	},
+	"highscores": func(ctx context.Context, site *Tenant, args gqlArgs) (interface{}, error) {
+		game := strings.ToUpper(args.str("game"))
+		validGames := map[string]bool{"SNAKE": true, "TETRIS": true, "ASTEROIDS": true, "PONG": true}
+		if !validGames[game] {
+			return nil, fmt.Errorf("invalid game")
+		}
+		return cachedHighscores(ctx, site, game)
+	},
+	"locations": func(ctx context.Context, site *Tenant, args gqlArgs) (interface{}, error) {
+		if asOf := args.str("asOf"); asOf != "" {
+			t, ok := parseAsOf(asOf)
+			if !ok {
+				return nil, fmt.Errorf("invalid asOf")
+			}
+			return getLocationsAsOf(ctx, site.readDB, t)
+		}
+		return getLocationsFromDB(ctx, site.readDB)
+	},
+	"activity": func(ctx context.Context, site *Tenant, args gqlArgs) (interface{}, error) {
+		rangeParam := args.str("range")
+		if rangeParam == "" {
+			rangeParam = "24h"
+		}
+		span, err := parseRange(rangeParam)
+		if err != nil || span < time.Minute || span > activityRetention {
+			return nil, fmt.Errorf("invalid range")
+		}
+		step := activityStep(span)
+		points, err := getActivity(ctx, site.readDB, time.Now().Add(-span), step)
+		if err != nil {
+			return nil, err
+		}
+		return ActivityResponse{Range: rangeParam, Step: step, Points: points}, nil
+	},
+	"weather": func(ctx context.Context, site *Tenant, args gqlArgs) (interface{}, error) {
+		lat, ok1 := args.num("lat")
+		lng, ok2 := args.num("lng")
+		if !ok1 || !ok2 || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+			return nil, fmt.Errorf("invalid coordinates")
+		}
+		return getForecast(ctx, lat, lng)
+	},
+	"glyph": func(ctx context.Context, site *Tenant, args gqlArgs) (interface{}, error) {
+		code, ok := args.num("code")
+		if !ok {
+			return nil, fmt.Errorf("code is required")
+		}
+		return weatherGlyphFor(int(code), args.boolean("night")), nil
+	},
+	"earthquakes": func(ctx context.Context, site *Tenant, args gqlArgs) (interface{}, error) {
+		period := args.str("range")
+		if period == "" {
+			period = "day"
+		}
+		if quakeFeeds[period] == "" {
+			return nil, fmt.Errorf("invalid range")
+		}
+		minMag, _ := args.num("minMag")
+		quakes, err := getEarthquakes(period)
+		if err != nil {
+			return nil, err
+		}
+		filtered := []Earthquake{}
+		for _, q := range quakes {
+			if q.Mag >= minMag {
+				filtered = append(filtered, q)
+			}
+		}
+		return filtered, nil
+	},
+}
+
+// resolveArgs substitutes variables into field arguments
+func resolveArgs(args map[string]interface{}, vars map[string]interface{}) gqlArgs {
+	out := make(gqlArgs, len(args))
+	for k, v := range args {
+		if ref, ok := v.(gqlVariable); ok {
+			v = vars[ref.name]
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// project picks the selected fields out of a JSON-shaped value
+func project(value interface{}, selection []gqlField, path string) (interface{}, error) {
+	if selection == nil {
+		if _, ok := value.(map[string]interface{}); ok {
+			return nil, fmt.Errorf("field %q must have a selection of subfields", path)
+		}
+		return value, nil
+	}
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			p, err := project(item, selection, path)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = p
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(selection))
+		for _, f := range selection {
+			if f.Name == "__typename" {
+				out[f.Alias] = strings.ToUpper(path[:1]) + path[1:]
+				continue
+			}
+			// Optional fields are left out of the JSON, so missing means null
+			child := v[f.Name]
+			p, err := project(child, f.Selection, f.Name)
+			if err != nil {
+				return nil, err
+			}
+			out[f.Alias] = p
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("field %q has no subfields", path)
+	}
+}
+
+func gqlError(err error) map[string]interface{} {
+	return map[string]interface{}{"errors": []map[string]string{{"message": err.Error()}}}
+}
+
+// executeGraphQL runs a query and returns the GraphQL response object
+func executeGraphQL(ctx context.Context, site *Tenant, fields []gqlField, vars map[string]interface{}) map[string]interface{} {
+
+	data := make(map[string]interface{})
+	var errs []map[string]interface{}
+	for _, f := range fields {
+		if f.Name == "__typename" {
+			data[f.Alias] = "Query"
+			continue
+		}
+		resolve, ok := gqlQueryFields[f.Name]
+		if !ok {
+			errs = append(errs, map[string]interface{}{"message": fmt.Sprintf("cannot query field %q on type \"Query\"", f.Name), "path": []string{f.Alias}})
+			data[f.Alias] = nil
+			continue
+		}
+
+		// Resolvers return the same structs as the REST API; go through JSON
+		// so field names match the REST responses
+		value, err := resolve(ctx, site, resolveArgs(f.Args, vars))
+		if err == nil {
+			var raw []byte
+			raw, err = json.Marshal(value)
+			if err == nil {
+				var generic interface{}
+				json.Unmarshal(raw, &generic)
+				value, err = project(generic, f.Selection, f.Name)
+			}
+		}
+		if err != nil {
+			errs = append(errs, map[string]interface{}{"message": err.Error(), "path": []string{f.Alias}})
+			data[f.Alias] = nil
+			continue
+		}
+		data[f.Alias] = value
+	}
+
+	resp := map[string]interface{}{"data": data}
+	if errs != nil {
+		resp["errors"] = errs
+	}
+	return resp
+}
+
+func handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Query     string                 `json:"query"`
+		Variables map[string]interface{} `json:"variables"`
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				http.Error(w, "Invalid variables", http.StatusBadRequest)
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if req.Query == "" {
+		http.Error(w, "Missing query", http.StatusBadRequest)
+		return
+	}
+
+	op, fields, err := (&gqlParser{src: req.Query}).document()
+	if err == nil && op == "subscription" {
+		serveGraphQLSubscription(w, r, tenantFor(r), fields, req.Variables)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		json.NewEncoder(w).Encode(gqlError(err))
+		return
+	}
+	json.NewEncoder(w).Encode(executeGraphQL(r.Context(), tenantFor(r), fields, req.Variables))
+}
+
+// Subscriptions open per site at a time, and how often an idle stream gets a
+// comment to keep proxies from closing it
+const (
+	maxGraphQLSubscriptions = 100
+	gqlKeepalive            = 30 * time.Second
+)
+
+// serveGraphQLSubscription streams hub events as server-sent events until the
+// client goes away. The only subscription field is events(types: [String]),
+// whose selection picks fields out of the hub message.
+func serveGraphQLSubscription(w http.ResponseWriter, r *http.Request, site *Tenant, fields []gqlField, vars map[string]interface{}) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if len(fields) != 1 || fields[0].Name != "events" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(gqlError(fmt.Errorf("subscriptions take a single events field")))
+		return
+	}
+	f := fields[0]
+	types := make(map[string]bool)
+	if list, ok := resolveArgs(f.Args, vars)["types"].([]interface{}); ok {
+		for _, t := range list {
+			if s, ok := t.(string); ok {
+				types[s] = true
+			}
+		}
+	}
+
+	events, stop, ok := site.hub.subscribe(maxGraphQLSubscriptions)
+	if !ok {
+		http.Error(w, "Too many subscriptions", http.StatusServiceUnavailable)
+		return
+	}
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(gqlKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+			flusher.Flush()
+		case ev := <-events:
+			if len(types) > 0 && !types[ev.Type] {
+				continue
+			}
+			var msg map[string]interface{}
+			if err := json.Unmarshal(ev.Data, &msg); err != nil {
+				continue
+			}
+			// Pings carry the sender's IP, which stays off the stream
+			if ping, ok := msg["ping"].(map[string]interface{}); ok {
+				delete(ping, "ip")
+			}
+			msg["time"] = float64(ev.Time)
+			value, err := project(msg, f.Selection, f.Name)
+			if err != nil {
+				writeSSE(w, "next", gqlError(err))
+				writeSSE(w, "complete", nil)
+				flusher.Flush()
+				return
+			}
+			writeSSE(w, "next", map[string]interface{}{"data": map[string]interface{}{f.Alias: value}})
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The guestbook takes one-line messages with POST /api/guestbook, at most one
+// per visitor (or IP) every guestbookInterval. Profanity is masked before an
+// entry is stored. Entries wait for a moderator at /admin/guestbook unless
+// GUESTBOOK_APPROVE=auto, and even then a masked entry still waits. Approved
+// entries are listed newest first by GET /api/guestbook and announced to
+// everyone on the terminal.
+
+const (
+	maxGuestbookName     = 24
+	maxGuestbookMessage  = 280
+	guestbookInterval    = 10 * time.Minute
+	defaultGuestbookPage = 20
+	maxGuestbookPage     = 100
+)
+
+// Entry statuses
+const (
+	guestbookPending  = "pending"
+	guestbookApproved = "approved"
+	guestbookRejected = "rejected"
+)
+
+// guestbookAutoApprove reports whether clean entries skip the moderation queue
+func guestbookAutoApprove() bool {
+	return strings.EqualFold(strings.TrimSpace(os.Getenv("GUESTBOOK_APPROVE")), "auto")
+}
+
+// Words masked in guestbook entries. Roots also match longer words that
+// start with them; exact words only match on their own, so "class" and
+// "cocktail" get through. GUESTBOOK_BLOCKLIST adds more exact words.
+var (
+	profanityRoots = []string{"fuck", "shit", "cunt", "bitch", "bastard", "wank", "twat", "slut", "whore", "faggot", "nigger", "retard"}
+	profanityWords = map[string]bool{
+		"ass": true, "asses": true, "asshole": true, "arse": true, "arsehole": true, "dick": true, "dicks": true,
+		"cock": true, "cocks": true, "piss": true, "pissed": true, "fag": true, "fags": true, "prick": true,
+	}
+)
+
+func init() {
+	for _, w := range strings.Split(os.Getenv("GUESTBOOK_BLOCKLIST"), ",") {
+		if w = strings.ToLower(strings.TrimSpace(w)); w != "" {
+			profanityWords[w] = true
+		}
+	}
+}
+
+// Digits and symbols commonly swapped in for letters
+var leetLetters = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s", "!", "i")
+
+// isProfane reports whether a word is on the list, seeing through leetspeak
+// and repeated letters
+func isProfane(word string) bool {
+	w := leetLetters.Replace(strings.ToLower(word))
+	w = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) {
+			return r
+		}
+		return -1
+	}, w)
+	if w == "" {
+		return false
+	}
+	var squeezed []rune
+	for _, r := range w {
+		if len(squeezed) == 0 || squeezed[len(squeezed)-1] != r {
+			squeezed = append(squeezed, r)
+		}
+	}
+	for _, candidate := range []string{w, string(squeezed)} {
+		if profanityWords[candidate] {
+			return true
+		}
+		for _, root := range profanityRoots {
+			if strings.HasPrefix(candidate, root) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maskProfanity stars out profane words and reports whether it found any
+func maskProfanity(text string) (string, bool) {
+	words := strings.Split(text, " ")
+	masked := false
+	for i, w := range words {
+		if isProfane(w) {
+			words[i] = strings.Repeat("*", len([]rune(w)))
+			masked = true
+		}
+	}
+	return strings.Join(words, " "), masked
+}
+
+// cleanTextLine makes a single printable line of at most max characters
+func cleanTextLine(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		// Format characters include zero-width spaces and bidi overrides
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, s)
+	s = strings.Join(strings.Fields(s), " ")
+	runes := []rune(s)
+	if len(runes) > max {
+		runes = runes[:max]
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+// GuestbookEntry is one signed guestbook entry
+type GuestbookEntry struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Message   string `json:"message"`
+	Country   string `json:"country,omitempty"`
+	Flag      string `json:"flag,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+
+	// For moderators only
+	Status   string `json:"status,omitempty"`
+	Filtered bool   `json:"filtered,omitempty"`
+}
+
+// GuestbookPage is returned by GET /api/guestbook; Before pages back to older entries
+type GuestbookPage struct {
+	Entries []GuestbookEntry `json:"entries"`
+	Before  int64            `json:"before,omitempty"`
+}
+
+// guestbookRetryAfter returns how long a visitor must wait before signing
+// again, or 0 if they can sign now
+func guestbookRetryAfter(ctx context.Context, db *sql.DB, visitorID, ip string, now time.Time) (time.Duration, error) {
+	var last sql.NullInt64
+	err := db.QueryRowContext(ctx, `
+		SELECT MAX(created_at) FROM guestbook WHERE visitor_id = ? OR ip = ?
+	`, visitorID, ip).Scan(&last)
+	if err != nil || !last.Valid {
+		return 0, err
+	}
+	wait := time.Unix(last.Int64, 0).Add(guestbookInterval).Sub(now)
+	if wait < 0 {
+		return 0, nil
+	}
+	return wait, nil
+}
+
+// getGuestbookEntry loads one entry by ID
+func getGuestbookEntry(ctx context.Context, db *sql.DB, id int64) (GuestbookEntry, error) {
+	var e GuestbookEntry
+	err := db.QueryRowContext(ctx, `
+		SELECT id, name, message, country, created_at, status, filtered FROM guestbook WHERE id = ?
+	`, id).Scan(&e.ID, &e.Name, &e.Message, &e.Country, &e.CreatedAt, &e.Status, &e.Filtered)
+	e.Flag = countryFlag(e.Country)
+	return e, err
+}
+
+// announceGuestbookEntry shows a newly approved entry to everyone on the terminal
+func (h *Hub) announceGuestbookEntry(e GuestbookEntry) {
+	e.Status, e.Filtered = "", false
+	data, _ := json.Marshal(CursorMessage{Type: "guestbook", Guestbook: &e})
+	h.broadcastToOthers("", data)
+	h.logEvent("guestbook", "", data)
+}
+
+// handleGuestbook lists approved entries (GET) or signs the guestbook (POST)
+func handleGuestbook(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		handleGetGuestbook(w, r)
+	case http.MethodPost:
+		handleSignGuestbook(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleGetGuestbook(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := defaultGuestbookPage
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if n > maxGuestbookPage {
+			n = maxGuestbookPage
+		}
+		limit = n
+	}
+	var before int64
+	if s := q.Get("before"); s != "" {
+		var err error
+		if before, err = strconv.ParseInt(s, 10, 64); err != nil || before < 1 {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+	}
+
+	query := `SELECT id, name, message, country, created_at FROM guestbook WHERE status = 'approved' ORDER BY id DESC LIMIT ?`
+	args := []interface{}{limit}
+	if before > 0 {
+		query = `SELECT id, name, message, country, created_at FROM guestbook WHERE status = 'approved' AND id < ? ORDER BY id DESC LIMIT ?`
+		args = []interface{}{before, limit}
+	}
+	rows, err := tenantFor(r).readDB.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		log.Printf("Error getting guestbook: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	page := GuestbookPage{Entries: []GuestbookEntry{}}
+	for rows.Next() {
+		var e GuestbookEntry
+		if err := rows.Scan(&e.ID, &e.Name, &e.Message, &e.Country, &e.CreatedAt); err != nil {
+			log.Printf("Error reading guestbook: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		e.Flag = countryFlag(e.Country)
+		page.Entries = append(page.Entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading guestbook: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// Only a full page may have older entries behind it
+	if len(page.Entries) == limit {
+		page.Before = page.Entries[len(page.Entries)-1].ID
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func handleSignGuestbook(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name    string `json:"name"`
+		Message string `json:"message"`
+		Country string `json:"country"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len([]rune(strings.TrimSpace(req.Message))) > maxGuestbookMessage {
+		http.Error(w, "Message too long", http.StatusBadRequest)
+		return
+	}
+	message := cleanTextLine(req.Message, maxGuestbookMessage)
+	if message == "" {
+		http.Error(w, "Message required", http.StatusBadRequest)
+		return
+	}
+
+	site := tenantFor(r)
+	visitorID := visitorIDFromRequest(w, r)
+	ip := clientIP(r)
+	site.hub.mutex.RLock()
+	muted := time.Now().Before(site.hub.muted[visitorID]) || time.Now().Before(site.hub.muted["ip:"+ip])
+	site.hub.mutex.RUnlock()
+	if muted {
+		http.Error(w, "Muted", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	wait, err := guestbookRetryAfter(r.Context(), site.db, visitorID, ip, now)
+	if err != nil {
+		log.Printf("Error checking guestbook rate limit: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "Already signed, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	// Without a name, fall back to the visitor's reserved nickname
+	name := cleanTextLine(req.Name, maxGuestbookName)
+	if name == "" {
+		name, _ = getVisitorNickname(r.Context(), site.db, visitorID)
+	}
+	if name == "" {
+		name = "ANONYMOUS"
+	}
+	name, maskedName := maskProfanity(name)
+	message, maskedMessage := maskProfanity(message)
+	filtered := maskedName || maskedMessage
+	country := r.Header.Get("CF-IPCountry")
+	if normalizeCountry(country) == "" {
+		country = req.Country
+	}
+
+	status := guestbookPending
+	if guestbookAutoApprove() && !filtered {
+		status = guestbookApproved
+	}
+	res, err := site.db.ExecContext(r.Context(), `
+		INSERT INTO guestbook (name, message, country, visitor_id, ip, status, filtered, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, name, message, normalizeCountry(country), visitorID, ip, status, filtered, now.Unix())
+	if err != nil {
+		log.Printf("Error saving guestbook entry: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	entry, err := getGuestbookEntry(r.Context(), site.db, id)
+	if err != nil {
+		log.Printf("Error loading guestbook entry: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if status == guestbookApproved {
+		go site.hub.announceGuestbookEntry(entry)
+	}
+
+	// The signer sees whether their entry is waiting, but not why
+	entry.Filtered = false
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// setGuestbookStatus changes an entry's status and returns the one it had
+func setGuestbookStatus(ctx context.Context, db *sql.DB, id int64, status string) (string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var previous string
+	if err := tx.QueryRowContext(ctx, `SELECT status FROM guestbook WHERE id = ?`, id).Scan(&previous); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE guestbook SET status = ? WHERE id = ?`, status, id); err != nil {
+		return "", err
+	}
+	return previous, tx.Commit()
+}
+
+// handleModerateGuestbook lists entries by status (GET, pending by default)
+// or approves or rejects one (POST {"id":1,"approve":true})
+func handleModerateGuestbook(w http.ResponseWriter, r *http.Request) {
+	site := tenantFor(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		status := r.URL.Query().Get("status")
+		if status == "" {
+			status = guestbookPending
+		}
+		if status != guestbookPending && status != guestbookApproved && status != guestbookRejected {
+			http.Error(w, "Invalid status", http.StatusBadRequest)
+			return
+		}
+		rows, err := site.db.QueryContext(r.Context(), `
+			SELECT id, name, message, country, created_at, status, filtered FROM guestbook
+			WHERE status = ? ORDER BY id LIMIT ?
+		`, status, maxGuestbookPage)
+		if err != nil {
+			log.Printf("Error getting guestbook queue: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		entries := []GuestbookEntry{}
+		for rows.Next() {
+			var e GuestbookEntry
+			if err := rows.Scan(&e.ID, &e.Name, &e.Message, &e.Country, &e.CreatedAt, &e.Status, &e.Filtered); err != nil {
+				log.Printf("Error reading guestbook queue: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			e.Flag = countryFlag(e.Country)
+			entries = append(entries, e)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+
+	case http.MethodPost:
+		var req struct {
+			ID      int64 `json:"id"`
+			Approve bool  `json:"approve"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		status := guestbookRejected
+		if req.Approve {
+			status = guestbookApproved
+		}
+		// Only announce entries going up for the first time
+		previous, err := setGuestbookStatus(r.Context(), site.db, req.ID, status)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("Error moderating guestbook entry: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if status == guestbookApproved && previous == guestbookPending {
+			if entry, err := getGuestbookEntry(r.Context(), site.db, req.ID); err == nil {
+				go site.hub.announceGuestbookEntry(entry)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Deploys hand the hubs over without dropping the site: the new process binds
+// the same address with SO_REUSEPORT (see listen_linux.go) while the old one
+// is still serving, then the old one gets SIGTERM. It stops accepting, so new
+// connections land on the new process, saves each hub's state and sends its
+// clients a "reconnect" message. The new process watches for that state and
+// picks it up:
+// recent pings and zones carry over, and reconnecting clients can resume
+// their old ID and cursor position with /ws?resume=<id>&token=<resumeToken>,
+// the secret they got in init. The state is also checkpointed every
+// stateCheckpointInterval so a crash loses little.
+//
+// The file holds visitors' pings, so by default it lives in the temp
+// directory rather than the working directory, which is served as static
+// files. Tenant hubs use the same name with "-<tenant>" before ".json".
+var hubStateFile = envString("HUB_STATE_FILE", filepath.Join(os.TempDir(), "crt-weather-hub-state.json"))
+
+// How long a handed-off client ID stays resumable
+const resumeWindow = 2 * time.Minute
+
+// How often a running process looks for a handoff, and checkpoints its own state
+const (
+	handoffPollInterval     = 500 * time.Millisecond
+	stateCheckpointInterval = 30 * time.Second
+)
+
+// HubState is the part of the hub that survives a restart
+type HubState struct {
+	SavedAt int64                      `json:"savedAt"`
+	PID     int                        `json:"pid"`
+	Pings   []PingData                 `json:"pings"`
+	Zones   map[string]int             `json:"zones,omitempty"`
+	Clients map[string]ResumableClient `json:"clients,omitempty"`
+}
+
+// ResumableClient is a handed-off client: its cursor and a hash of the
+// token it needs to resume
+type ResumableClient struct {
+	Position  *CursorPosition `json:"position,omitempty"`
+	TokenHash string          `json:"tokenHash"`
+}
+
+// checkpointFile is where the periodic checkpoints go, next to the handoff file
+func checkpointFile(path string) string {
+	return path + ".checkpoint"
+}
+
+// saveState writes the hub state for the next process
+func (h *Hub) saveState(path string) error {
+	h.mutex.RLock()
+	state := HubState{
+		SavedAt: time.Now().Unix(),
+		PID:     os.Getpid(),
+		Pings:   h.recentPings,
+		Zones:   h.zones,
+		Clients: make(map[string]ResumableClient),
+	}
+	for id, c := range h.clients {
+		if c.bot {
+			// The next process starts its own
+			continue
+		}
+		state.Clients[id] = ResumableClient{Position: c.Position, TokenHash: hashToken(c.resumeToken)}
+	}
+	data, err := json.Marshal(state)
+	h.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a crash never leaves half a file behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadState restores state saved by another process, then removes the file.
+// Pings the hub already has are kept after the restored ones.
+func (h *Hub) loadState(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state HubState
+	if err := json.Unmarshal(data, &state); err != nil {
+		os.Remove(path)
+		return err
+	}
+	if state.PID == os.Getpid() {
+		// Our own, waiting for the next process
+		return nil
+	}
+	os.Remove(path)
+	if time.Since(time.Unix(state.SavedAt, 0)) > resumeWindow {
+		return nil
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.recentPings = mergePings(state.Pings, h.recentPings)
+	if h.zones == nil {
+		h.zones = state.Zones
+	}
+	if h.resumable == nil || time.Now().After(h.resumableUntil) {
+		h.resumable = make(map[string]ResumableClient)
+	}
+	for id, c := range state.Clients {
+		h.resumable[id] = c
+	}
+	h.resumableUntil = time.Unix(state.SavedAt, 0).Add(resumeWindow)
+	log.Printf("Restored hub state from process %d: %d pings, %d resumable clients", state.PID, len(state.Pings), len(state.Clients))
+	return nil
+}
+
+// mergePings puts restored pings before the ones received since, without
+// duplicates, keeping the last 10
+func mergePings(restored, current []PingData) []PingData {
+	merged := append([]PingData{}, restored...)
+	for _, p := range current {
+		seen := false
+		for _, q := range restored {
+			seen = seen || p == q
+		}
+		if !seen {
+			merged = append(merged, p)
+		}
+	}
+	if len(merged) > 10 {
+		merged = merged[len(merged)-10:]
+	}
+	return merged
+}
+
+// restoreState picks up a handoff, or failing that the last checkpoint left
+// by a process that didn't get to hand off
+func (h *Hub) restoreState(path string) {
+	if _, err := os.Stat(path); err == nil {
+		if err := h.loadState(path); err != nil {
+			log.Printf("Failed to restore hub state: %v", err)
+		}
+		return
+	}
+	if err := h.loadState(checkpointFile(path)); err != nil {
+		log.Printf("Failed to restore hub checkpoint: %v", err)
+	}
+}
+
+// watchHandoff picks up the state of an older process that is handing off
+// to this one, and checkpoints this hub's state now and then
+func (h *Hub) watchHandoff(path string) {
+	poll := time.NewTicker(handoffPollInterval)
+	checkpoint := time.NewTicker(stateCheckpointInterval)
+	defer poll.Stop()
+	defer checkpoint.Stop()
+	for {
+		select {
+		case <-poll.C:
+			if err := h.loadState(path); err != nil {
+				log.Printf("Failed to take over hub state: %v", err)
+			}
+		case <-checkpoint.C:
+			if err := h.saveState(checkpointFile(path)); err != nil {
+				log.Printf("Failed to checkpoint hub state: %v", err)
+			}
+		}
+	}
+}
+
+// takeResumable claims a handed-off client ID with its resume token,
+// returning its last position
+func (h *Hub) takeResumable(id, token string) (*CursorPosition, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	c, ok := h.resumable[id]
+	if !ok || token == "" || time.Now().After(h.resumableUntil) {
+		return nil, false
+	}
+	if subtle.ConstantTimeCompare([]byte(c.TokenHash), []byte(hashToken(token))) != 1 {
+		return nil, false
+	}
+	if _, taken := h.clients[id]; taken {
+		return nil, false
+	}
+	delete(h.resumable, id)
+	return c.Position, true
+}
+
+// shutdown disconnects every client with a "reconnect" message, asking them
+// to come back after a short, jittered delay so they don't all hit the new
+// process at once
+func (h *Hub) shutdown() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for id, client := range h.clients {
+		delete(h.clients, id)
+		h.releaseIP(client)
+		retry := time.Duration(1000+mathrand.Intn(2000)) * time.Millisecond
+		h.reconnect(client, retry)
+	}
+	for _, client := range h.waiting {
+		client.waiting = false
+		h.releaseIP(client)
+		h.reconnect(client, time.Second)
+	}
+	h.waiting = nil
+}
+
+// reconnect is disconnect for a restart: the client gets a "reconnect"
+// message instead of "close", and the socket closes with closeRestarting
+func (h *Hub) reconnect(client *Client, retryAfter time.Duration) {
+	client.trySend(reconnectFrame(retryAfter))
+	client.setClose(closeRestarting, "restart")
+	client.closeSend()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Cursor positions are sampled at most once per client every few seconds,
+// snapped to a coarse grid and counted per page (the cursor's zone) and day.
+// Only the counts are stored, never who was where.
+const (
+	heatmapSampleInterval = 5 * time.Second
+	heatmapCellSize       = 50
+	heatmapMaxCoord       = 5000
+	heatmapFlushInterval  = time.Minute
+	heatmapRetentionDays  = 90
+)
+
+// heatCell is one grid cell of one page on one day
+type heatCell struct {
+	page string
+	x, y int
+	day  string
+}
+
+// heatmapBuffer accumulates samples between flushes
+type heatmapBuffer struct {
+	sync.Mutex
+	counts map[heatCell]int
+}
+
+// HeatmapPoint is one grid cell in the heatmap response; X and Y are the cell's top-left pixel
+type HeatmapPoint struct {
+	X     int `json:"x"`
+	Y     int `json:"y"`
+	Count int `json:"count"`
+}
+
+// HeatmapResponse is returned by /api/stats/cursor-heatmap
+type HeatmapResponse struct {
+	Page   string         `json:"page"`
+	Cell   int            `json:"cell"`
+	Days   int            `json:"days"`
+	Max    int            `json:"max"`
+	Points []HeatmapPoint `json:"points"`
+}
+
+// heatmapPage names the page a cursor is on
+func heatmapPage(pos *CursorPosition) string {
+	if pos.Zone == "" {
+		return "main"
+	}
+	return pos.Zone
+}
+
+// sampleHeatmap counts a cursor position if the client hasn't been sampled recently
+func (c *Client) sampleHeatmap(pos *CursorPosition) {
+	now := time.Now()
+	if now.Sub(c.lastHeatSample) < heatmapSampleInterval {
+		return
+	}
+	if pos.X < 0 || pos.Y < 0 || pos.X >= heatmapMaxCoord || pos.Y >= heatmapMaxCoord {
+		return
+	}
+	c.lastHeatSample = now
+
+	cell := heatCell{
+		page: heatmapPage(pos),
+		x:    int(pos.X) / heatmapCellSize * heatmapCellSize,
+		y:    int(pos.Y) / heatmapCellSize * heatmapCellSize,
+		day:  now.UTC().Format("2006-01-02"),
+	}
+	h := c.hub
+	h.heat.Lock()
+	h.heat.counts[cell]++
+	h.heat.Unlock()
+}
+
+// runHeatmapFlush periodically writes buffered samples to the database
+func (h *Hub) runHeatmapFlush() {
+	ticker := time.NewTicker(heatmapFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := h.flushHeatmap(); err != nil {
+			log.Printf("Error saving cursor heatmap: %v", err)
+		}
+	}
+}
+
+func (h *Hub) flushHeatmap() error {
+	h.heat.Lock()
+	counts := h.heat.counts
+	h.heat.counts = make(map[heatCell]int)
+	h.heat.Unlock()
+	if len(counts) == 0 {
+		return nil
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for cell, n := range counts {
+		_, err := tx.Exec(`
+			INSERT INTO cursor_heatmap (page, cell_x, cell_y, day, samples) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(page, cell_x, cell_y, day) DO UPDATE SET samples = samples + excluded.samples
+		`, cell.page, cell.x, cell.y, cell.day, n)
+		if err != nil {
+			return err
+		}
+	}
+	if jobLeader.isLeader() {
+		cutoff := time.Now().UTC().AddDate(0, 0, -heatmapRetentionDays).Format("2006-01-02")
+		if _, err := tx.Exec(`DELETE FROM cursor_heatmap WHERE day < ?`, cutoff); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func handleGetCursorHeatmap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page := r.URL.Query().Get("page")
+	if page == "" {
+		page = "main"
+	}
+	if sanitizeZone(page) != page {
+		http.Error(w, "Invalid page", http.StatusBadRequest)
+		return
+	}
+	days := 7
+	if d := r.URL.Query().Get("days"); d != "" {
+		n, err := strconv.Atoi(d)
+		if err != nil || n < 1 || n > heatmapRetentionDays {
+			http.Error(w, "Invalid days", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	since := time.Now().UTC().AddDate(0, 0, -(days - 1)).Format("2006-01-02")
+	rows, err := tenantFor(r).readDB.QueryContext(r.Context(), `
+		SELECT cell_x, cell_y, SUM(samples) FROM cursor_heatmap
+		WHERE page = ? AND day >= ?
+		GROUP BY cell_x, cell_y
+	`, page, since)
+	if err != nil {
+		log.Printf("Error getting cursor heatmap: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	resp := HeatmapResponse{Page: page, Cell: heatmapCellSize, Days: days, Points: []HeatmapPoint{}}
+	for rows.Next() {
+		var p HeatmapPoint
+		if err := rows.Scan(&p.X, &p.Y, &p.Count); err != nil {
+			log.Printf("Error reading cursor heatmap: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if p.Count > resp.Max {
+			resp.Max = p.Count
+		}
+		resp.Points = append(resp.Points, p)
+	}
+
+	if wantsCSV(w, r) {
+		out := newCSVResponse(w, "cursor-heatmap-"+page+".csv", "x", "y", "count")
+		for _, p := range resp.Points {
+			if err := out.row(csvInt(p.X), csvInt(p.Y), csvInt(p.Count)); err != nil {
+				return
+			}
+		}
+		out.close()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
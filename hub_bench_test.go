@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Hub broadcast benchmarks. Simulated clients are plain Send channels that the
+// benchmark empties itself every drainEvery broadcasts, so every message is
+// delivered and the numbers cover serialization, fan-out and the receiving
+// end of the channels, but not the network. Run with:
+//
+//	go test -run '^$' -bench Broadcast -benchmem
+//
+// Each reports messages delivered per second; allocs/op is per broadcast.
+
+var benchClientCounts = []int{10, 100, 1000}
+
+// Broadcasts between drains; half a Send buffer, so the hub never sees a
+// slow client
+const drainEvery = 128
+
+// benchHub is a hub with n simulated clients
+type benchHub struct {
+	hub       *Hub
+	sender    *Client
+	clients   []*Client
+	pending   int
+	delivered int
+}
+
+func newBenchHub(n int) *benchHub {
+	bh := &benchHub{hub: newHub(nil, 0, 0, 0)}
+	for i := 0; i < n; i++ {
+		c := &Client{ID: fmt.Sprintf("bench%04d", i), Send: make(chan []byte, 256), hub: bh.hub}
+		bh.hub.clients[c.ID] = c
+		bh.clients = append(bh.clients, c)
+	}
+	bh.sender = bh.clients[0]
+	return bh
+}
+
+// sent counts a broadcast and drains every client once enough are queued
+func (bh *benchHub) sent(includeSender bool) {
+	bh.pending++
+	if bh.pending < drainEvery {
+		return
+	}
+	bh.drain(includeSender)
+}
+
+// drain receives every pending message, waiting for the hub to finish fanning out
+func (bh *benchHub) drain(includeSender bool) {
+	for _, c := range bh.clients {
+		if c == bh.sender && !includeSender {
+			continue
+		}
+		for i := 0; i < bh.pending; i++ {
+			<-c.Send
+			bh.delivered++
+		}
+	}
+	bh.pending = 0
+}
+
+// moveMessage serializes a cursor move the way readPump does
+func moveMessage(id string, i int) []byte {
+	return encodeMove(id, &CursorPosition{X: float64(i % 1920), Y: float64(i % 1080), Normalized: &NormalizedPoint{X: 0.5, Y: 0.5}})
+}
+
+// benchmarkMove sends b.N moves through broadcastToOthers
+func benchmarkMove(b *testing.B, n int) {
+	bh := newBenchHub(n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		bh.hub.broadcastToOthers(bh.sender.ID, moveMessage(bh.sender.ID, i))
+		bh.sent(false)
+	}
+	bh.drain(false)
+	b.StopTimer()
+	b.ReportMetric(float64(bh.delivered)/time.Since(start).Seconds(), "msgs/s")
+}
+
+// BenchmarkBroadcastMove covers the move path: serialize, then send to everyone else
+func BenchmarkBroadcastMove(b *testing.B) {
+	for _, n := range benchClientCounts {
+		b.Run(strconv.Itoa(n)+"clients", func(b *testing.B) { benchmarkMove(b, n) })
+	}
+}
+
+// BenchmarkBroadcastAll covers messages sent to everyone through the hub's run loop
+func BenchmarkBroadcastAll(b *testing.B) {
+	for _, n := range benchClientCounts {
+		b.Run(strconv.Itoa(n)+"clients", func(b *testing.B) {
+			bh := newBenchHub(n)
+			go bh.hub.run()
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				bh.hub.broadcast <- moveMessage(bh.sender.ID, i)
+				bh.sent(true)
+			}
+			bh.drain(true)
+			b.StopTimer()
+			b.ReportMetric(float64(bh.delivered)/time.Since(start).Seconds(), "msgs/s")
+		})
+	}
+}
+
+// Allocations per broadcast must not grow with the number of clients: the
+// message is serialized once and the same bytes go to everyone. A move is
+// the frame itself plus the position moveMessage builds.
+const maxAllocsPerBroadcast = 4
+
+// TestBroadcastRegression is the CI gate for the benchmarks above. The
+// allocation budget is deterministic and always checked; set
+// BROADCAST_MIN_MSGS_PER_SEC to also fail below a throughput floor (for 100
+// clients) on a known machine.
+func TestBroadcastRegression(t *testing.T) {
+	for _, n := range benchClientCounts {
+		bh := newBenchHub(n)
+		i := 0
+		allocs := testing.AllocsPerRun(100, func() {
+			bh.hub.broadcastToOthers(bh.sender.ID, moveMessage(bh.sender.ID, i))
+			bh.sent(false)
+			i++
+		})
+		if allocs > maxAllocsPerBroadcast {
+			t.Errorf("%d clients: %.1f allocs per broadcast, budget is %d", n, allocs, maxAllocsPerBroadcast)
+		}
+	}
+
+	floor, _ := strconv.ParseFloat(os.Getenv("BROADCAST_MIN_MSGS_PER_SEC"), 64)
+	if floor <= 0 || testing.Short() {
+		return
+	}
+	res := testing.Benchmark(func(b *testing.B) { benchmarkMove(b, 100) })
+	if got := res.Extra["msgs/s"]; got < floor {
+		t.Errorf("100 clients: %.0f msgs/s, floor is %.0f", got, floor)
+	}
+}
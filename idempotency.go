@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Clients may send an Idempotency-Key header with a write so a network retry
+// doesn't save the same highscore twice. The first response for a key is
+// stored and replayed for any repeat by the same visitor within
+// idempotencyWindow. It sits in front of the captcha check, since a retry
+// carries the same single-use captcha token.
+
+const (
+	idempotencyWindow = 24 * time.Hour
+	maxIdempotencyKey = 128
+)
+
+// idempotencyRecorder keeps a copy of the response for replay
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *idempotencyRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idempotencyRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// withIdempotency replays the stored response for a repeated Idempotency-Key.
+// Requests without the header or a visitor cookie, and requests made while
+// the database is unavailable, go straight through.
+func withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method == http.MethodGet {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			http.Error(w, "Idempotency-Key too long", http.StatusBadRequest)
+			return
+		}
+		// Keys are only unique per visitor
+		cookie, err := r.Cookie("visitor_id")
+		if err != nil || cookie.Value == "" {
+			next(w, r)
+			return
+		}
+		db := tenantFor(r).db
+		key = cookie.Value + " " + r.URL.Path + " " + key
+
+		// Reserve the key; if it's taken, this is a replay
+		res, err := db.ExecContext(r.Context(), `
+			INSERT INTO idempotency_keys (key, created_at) VALUES (?, ?)
+			ON CONFLICT(key) DO NOTHING
+		`, key, time.Now().Unix())
+		if err != nil {
+			log.Printf("Error reserving idempotency key: %v", err)
+			next(w, r)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			replayIdempotent(w, r, db, key)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		// The response is out; record it even if the client has gone
+		ctx := context.WithoutCancel(r.Context())
+
+		// Let the client retry after a server error
+		if rec.status == 0 || rec.status >= 500 {
+			if _, err := db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE key = ?`, key); err != nil {
+				log.Printf("Error releasing idempotency key: %v", err)
+			}
+			return
+		}
+		_, err = db.ExecContext(ctx, `
+			UPDATE idempotency_keys SET status = ?, content_type = ?, body = ? WHERE key = ?
+		`, rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes(), key)
+		if err != nil {
+			log.Printf("Error saving idempotent response: %v", err)
+		}
+	}
+}
+
+// replayIdempotent writes the stored response for key
+func replayIdempotent(w http.ResponseWriter, r *http.Request, db *sql.DB, key string) {
+	var status int
+	var contentType string
+	var body []byte
+	err := db.QueryRowContext(r.Context(), `
+		SELECT status, content_type, body FROM idempotency_keys WHERE key = ?
+	`, key).Scan(&status, &contentType, &body)
+	if err != nil {
+		log.Printf("Error reading idempotent response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if status == 0 {
+		// The first request hasn't finished yet
+		http.Error(w, "Request in progress", http.StatusConflict)
+		return
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// pruneIdempotencyKeys forgets keys older than the replay window
+func pruneIdempotencyKeys(db *sql.DB, now time.Time) error {
+	_, err := db.Exec(`DELETE FROM idempotency_keys WHERE created_at < ?`, now.Add(-idempotencyWindow).Unix())
+	return err
+}
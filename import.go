@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImportedLocation is one historical visitor location from a legacy export
+type ImportedLocation struct {
+	Lat       float64
+	Lng       float64
+	Visitors  int
+	CreatedAt time.Time
+}
+
+// ImportResult summarizes a location import
+type ImportResult struct {
+	Added   int `json:"added"`
+	Merged  int `json:"merged"`
+	Skipped int `json:"skipped"`
+}
+
+// Cap on import uploads
+const maxImportSize = 32 << 20
+
+// parseLocationImport reads CSV or GeoJSON, sniffing the format from the content
+func parseLocationImport(r io.Reader) ([]ImportedLocation, int, error) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return nil, 0, err
+		}
+		if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' || b[0] == 0xEF || b[0] == 0xBB || b[0] == 0xBF {
+			br.ReadByte()
+			continue
+		}
+		if b[0] == '{' {
+			return parseGeoJSONLocations(br)
+		}
+		return parseCSVLocations(br)
+	}
+}
+
+// parseCSVLocations reads lat,lng[,visitors][,created_at] rows with an optional header
+func parseCSVLocations(r io.Reader) ([]ImportedLocation, int, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	cols := map[string]int{"lat": 0, "lng": 1, "visitors": 2, "created_at": 3}
+	var locations []ImportedLocation
+	skipped := 0
+	first := true
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// A header row names the columns
+		if first {
+			first = false
+			if _, err := strconv.ParseFloat(rec[0], 64); err != nil {
+				cols = map[string]int{}
+				for i, name := range rec {
+					switch strings.ToLower(strings.TrimSpace(name)) {
+					case "lat", "latitude":
+						cols["lat"] = i
+					case "lng", "lon", "long", "longitude":
+						cols["lng"] = i
+					case "visitors", "visitor_count", "count":
+						cols["visitors"] = i
+					case "created_at", "timestamp", "date", "first_seen":
+						cols["created_at"] = i
+					}
+				}
+				if _, ok := cols["lat"]; !ok {
+					return nil, 0, errors.New("CSV header has no lat column")
+				}
+				if _, ok := cols["lng"]; !ok {
+					return nil, 0, errors.New("CSV header has no lng column")
+				}
+				continue
+			}
+		}
+
+		field := func(name string) string {
+			if i, ok := cols[name]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		lat, err1 := strconv.ParseFloat(field("lat"), 64)
+		lng, err2 := strconv.ParseFloat(field("lng"), 64)
+		if err1 != nil || err2 != nil {
+			skipped++
+			continue
+		}
+		visitors, _ := strconv.Atoi(field("visitors"))
+		locations = append(locations, ImportedLocation{
+			Lat:       lat,
+			Lng:       lng,
+			Visitors:  visitors,
+			CreatedAt: parseImportTime(field("created_at")),
+		})
+	}
+	return locations, skipped, nil
+}
+
+// parseGeoJSONLocations reads Point features from a FeatureCollection
+func parseGeoJSONLocations(r io.Reader) ([]ImportedLocation, int, error) {
+	var fc struct {
+		Features []struct {
+			Geometry struct {
+				Type        string    `json:"type"`
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.NewDecoder(r).Decode(&fc); err != nil {
+		return nil, 0, err
+	}
+
+	var locations []ImportedLocation
+	skipped := 0
+	for _, f := range fc.Features {
+		if f.Geometry.Type != "Point" || len(f.Geometry.Coordinates) < 2 {
+			skipped++
+			continue
+		}
+		loc := ImportedLocation{Lng: f.Geometry.Coordinates[0], Lat: f.Geometry.Coordinates[1]}
+		for _, key := range []string{"visitors", "visitor_count", "count"} {
+			if n, ok := f.Properties[key].(float64); ok {
+				loc.Visitors = int(n)
+				break
+			}
+		}
+		for _, key := range []string{"created_at", "timestamp", "date"} {
+			if s, ok := f.Properties[key].(string); ok {
+				loc.CreatedAt = parseImportTime(s)
+				break
+			}
+		}
+		locations = append(locations, loc)
+	}
+	return locations, skipped, nil
+}
+
+// parseImportTime accepts RFC 3339, SQLite datetimes, plain dates and unix seconds
+func parseImportTime(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0).UTC()
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC()
+		}
+	}
+	return time.Time{}
+}
+
+// importLocations merges locations into the DB, deduping by rounded coordinates
+func importLocations(ctx context.Context, db *sql.DB, locations []ImportedLocation) (ImportResult, error) {
+	var result ImportResult
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	for _, loc := range locations {
+		outcome, err := importLocation(ctx, tx, loc)
+		if err != nil {
+			return result, err
+		}
+		result.count(outcome)
+	}
+
+	return result, tx.Commit()
+}
+
+// Outcomes of importing one location
+const (
+	importAdded   = "added"
+	importMerged  = "merged"
+	importSkipped = "skipped"
+)
+
+func (r *ImportResult) count(outcome string) {
+	switch outcome {
+	case importAdded:
+		r.Added++
+	case importMerged:
+		r.Merged++
+	default:
+		r.Skipped++
+	}
+}
+
+// validImportCoords reports whether a location is on the map; NaN slips
+// through range checks, so it is rejected explicitly
+func validImportCoords(lat, lng float64) bool {
+	if math.IsNaN(lat) || math.IsNaN(lng) || math.IsInf(lat, 0) || math.IsInf(lng, 0) {
+		return false
+	}
+	return lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180
+}
+
+// importLocation adds one location, or merges it into a known one
+func importLocation(ctx context.Context, tx *sql.Tx, loc ImportedLocation) (string, error) {
+	if !validImportCoords(loc.Lat, loc.Lng) {
+		return importSkipped, nil
+	}
+	if loc.Visitors < 1 {
+		loc.Visitors = 1
+	}
+	createdAt := loc.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now().UTC()
+	}
+	created := createdAt.Format("2006-01-02 15:04:05")
+	latRounded := roundCoord(loc.Lat, 2)
+	lngRounded := roundCoord(loc.Lng, 2)
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT OR IGNORE INTO locations (lat, lng, lat_rounded, lng_rounded, visitor_count, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, loc.Lat, loc.Lng, latRounded, lngRounded, loc.Visitors, created)
+	if err != nil {
+		return "", err
+	}
+	if err := recordLocationVisit(tx, latRounded, lngRounded, createdAt, loc.Visitors); err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return importAdded, nil
+	}
+
+	// Already known - merge counts and keep the earliest first visit
+	_, err = tx.ExecContext(ctx, `
+		UPDATE locations SET visitor_count = visitor_count + ?, created_at = MIN(created_at, ?)
+		WHERE lat_rounded = ? AND lng_rounded = ?
+	`, loc.Visitors, created, latRounded, lngRounded)
+	if err != nil {
+		return "", err
+	}
+	return importMerged, nil
+}
+
+// tooLarge reports whether reading a body failed on its http.MaxBytesReader limit
+func tooLarge(err error) bool {
+	var maxBytes *http.MaxBytesError
+	return errors.As(err, &maxBytes)
+}
+
+func handleImportLocations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		if tooLarge(err) {
+			http.Error(w, "Import too large (max 32 MB)", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	locations, skipped, err := parseLocationImport(bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, "Invalid import: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	site := tenantFor(r)
+	result, err := importLocations(r.Context(), site.db, locations)
+	if err != nil {
+		log.Printf("Error importing locations: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	result.Skipped += skipped
+	if result.Added+result.Merged > 0 {
+		site.clusters.invalidate()
+	}
+
+	log.Printf("Imported locations: %d added, %d merged, %d skipped", result.Added, result.Merged, result.Skipped)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Most locations accepted by one POST /api/locations/batch
+const maxBatchLocations = 1000
+
+// BatchLocationResult is the outcome for one submitted location
+type BatchLocationResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleBatchLocations imports a JSON list of locations, e.g. synced from
+// another site's visitor log, and reports what happened to each one
+func handleBatchLocations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Locations []struct {
+			Lat       *float64 `json:"lat"`
+			Lng       *float64 `json:"lng"`
+			Visitors  int      `json:"visitors"`
+			CreatedAt string   `json:"created_at"`
+		} `json:"locations"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportSize)).Decode(&req); err != nil {
+		if tooLarge(err) {
+			http.Error(w, "Batch too large (max 32 MB)", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(req.Locations) > maxBatchLocations {
+		http.Error(w, "Too many locations (max "+strconv.Itoa(maxBatchLocations)+")", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	site := tenantFor(r)
+	tx, err := site.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Printf("Error importing location batch: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var summary ImportResult
+	results := make([]BatchLocationResult, len(req.Locations))
+	for i, item := range req.Locations {
+		results[i] = BatchLocationResult{Index: i}
+		switch {
+		case item.Lat == nil || item.Lng == nil:
+			results[i].Status, results[i].Error = importSkipped, "missing coordinates"
+		case !validImportCoords(*item.Lat, *item.Lng):
+			results[i].Status, results[i].Error = importSkipped, "invalid coordinates"
+		case item.Visitors < 0:
+			results[i].Status, results[i].Error = importSkipped, "invalid visitors"
+		case item.CreatedAt != "" && parseImportTime(item.CreatedAt).IsZero():
+			results[i].Status, results[i].Error = importSkipped, "invalid created_at"
+		default:
+			results[i].Status, err = importLocation(r.Context(), tx, ImportedLocation{
+				Lat:       *item.Lat,
+				Lng:       *item.Lng,
+				Visitors:  item.Visitors,
+				CreatedAt: parseImportTime(item.CreatedAt),
+			})
+			if err != nil {
+				log.Printf("Error importing location batch: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		summary.count(results[i].Status)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error importing location batch: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if summary.Added+summary.Merged > 0 {
+		site.clusters.invalidate()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ImportResult
+		Results []BatchLocationResult `json:"results"`
+	}{summary, results})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// openInspectDB opens the database read-only: inspecting a live server must
+// not migrate or seed it, or create it if the path is wrong
+func openInspectDB(path string) (*sql.DB, error) {
+	dsn := "file:" + path + "?mode=ro"
+	if strings.HasPrefix(path, "file:") {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		dsn = path + sep + "mode=ro"
+	}
+	conn, err := sql.Open(sqlDriver(), dsn)
+	if err != nil {
+		return nil, err
+	}
+	// sql.Open is lazy; fail now on a missing file
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// runInspect prints a summary of the database for checking on a live server
+func runInspect(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	if info, err := os.Stat(dbPath); err == nil {
+		fmt.Fprintf(w, "Database:\t%s (%.1f KB)\n\n", dbPath, float64(info.Size())/1024)
+	}
+
+	// Row counts for every table
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		return err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	fmt.Fprintln(w, "TABLE\tROWS")
+	for _, table := range tables {
+		var count int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM "` + table + `"`).Scan(&count); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%d\n", table, count)
+	}
+
+	// Top highscores per game
+	fmt.Fprintln(w, "\nGAME\tNAME\tSCORE")
+	for _, game := range []string{"SNAKE", "TETRIS", "ASTEROIDS", "PONG"} {
+		scores, err := getHighscores(context.Background(), db, game)
+		if err != nil {
+			return err
+		}
+		for _, s := range scores {
+			fmt.Fprintf(w, "%s\t%s\t%d\n", s.Game, s.Name, s.Score)
+		}
+	}
+
+	// Most recent locations
+	rows, err = db.Query(`SELECT lat, lng, visitor_count, created_at FROM locations ORDER BY created_at DESC LIMIT 10`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	fmt.Fprintln(w, "\nLAT\tLNG\tVISITORS\tFIRST SEEN")
+	for rows.Next() {
+		var lat, lng float64
+		var count int
+		var created string
+		if err := rows.Scan(&lat, &lng, &count, &created); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%.2f\t%.2f\t%d\t%s\n", lat, lng, count, created)
+	}
+	return rows.Err()
+}
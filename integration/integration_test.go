@@ -0,0 +1,641 @@
+// Package integration boots the real server binary on a random port with a
+// throwaway database and drives it over HTTP and websockets, as a safety net
+// for hub refactors. Run with go test ./integration (skipped with -short).
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// server is one running instance of the binary
+type server struct {
+	base string // http://127.0.0.1:port
+	cmd  *exec.Cmd
+	logs *syncBuffer
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+var binary string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "crt-integration")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	binary = filepath.Join(dir, "server")
+	build := exec.Command("go", "build", "-o", binary, ".")
+	build.Dir = ".."
+	build.Stdout, build.Stderr = os.Stderr, os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "building server:", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// startServer runs the binary with a fresh database and stops it when the
+// test ends; env adds KEY=value settings
+func startServer(t *testing.T, env ...string) *server {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("integration tests boot the server; skipped with -short")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	tmp := t.TempDir()
+	s := &server{base: "http://" + addr, logs: &syncBuffer{}}
+	s.cmd = exec.Command(binary)
+	s.cmd.Dir = ".." // static files
+	s.cmd.Env = append(os.Environ(),
+		"LISTEN_ADDR="+addr,
+		"DB_PATH="+filepath.Join(tmp, "test.db"),
+		"HUB_STATE_FILE="+filepath.Join(tmp, "hub-state.json"),
+	)
+	s.cmd.Env = append(s.cmd.Env, env...)
+	s.cmd.Stdout, s.cmd.Stderr = s.logs, s.logs
+	if err := s.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.cmd.Process.Signal(syscall.SIGTERM)
+		done := make(chan struct{})
+		go func() { s.cmd.Wait(); close(done) }()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			s.cmd.Process.Kill()
+		}
+		if t.Failed() {
+			t.Logf("server log:\n%s", s.logs.String())
+		}
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(s.base + "/api/stats")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return s
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server didn't come up: %v\n%s", err, s.logs.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// message is the subset of the server's CursorMessage the tests look at
+type message struct {
+	Type      string          `json:"type"`
+	ID        string          `json:"id"`
+	UserCount int             `json:"userCount"`
+	Position  *position       `json:"position"`
+	Ping      *ping           `json:"ping"`
+	Pings     []ping          `json:"pings"`
+	Raw       json.RawMessage `json:"-"`
+}
+
+type position struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+type ping struct {
+	Location  string  `json:"location"`
+	Lat       float64 `json:"lat"`
+	Lng       float64 `json:"lng"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// client is a websocket connection whose messages are collected in order
+type client struct {
+	t    *testing.T
+	id   string
+	conn *websocket.Conn
+	msgs chan message
+	init message
+}
+
+func (s *server) connect(t *testing.T) *client {
+	t.Helper()
+	return s.connectHost(t, "")
+}
+
+// connectHost connects with a Host header, to reach a tenant's hub
+func (s *server) connectHost(t *testing.T, host string) *client {
+	t.Helper()
+	header := http.Header{}
+	if host != "" {
+		header.Set("Host", host)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(s.base, "http", "ws", 1)+"/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{t: t, conn: conn, msgs: make(chan message, 1024)}
+	go func() {
+		defer close(c.msgs)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var m message
+			if json.Unmarshal(data, &m) == nil {
+				m.Raw = data
+				c.msgs <- m
+			}
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	c.id = c.expect("id").ID
+	c.init = c.expect("init")
+	return c
+}
+
+func (c *client) send(v interface{}) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(v); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect waits for the next message of a type, skipping any others
+func (c *client) expect(msgType string) message {
+	c.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m, ok := <-c.msgs:
+			if !ok {
+				c.t.Fatalf("connection closed waiting for %q", msgType)
+			}
+			if m.Type == msgType {
+				return m
+			}
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for %q", msgType)
+		}
+	}
+}
+
+// countUpdate returns the user count a message updates clients to, or 0
+func countUpdate(m message) int {
+	switch m.Type {
+	case "join", "leave", "users":
+		return m.UserCount
+	}
+	return 0
+}
+
+// expectCount waits for a user count update of n, whichever message carries it
+func (c *client) expectCount(n int) {
+	c.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m, ok := <-c.msgs:
+			if !ok {
+				c.t.Fatalf("connection closed waiting for a user count of %d", n)
+			}
+			if countUpdate(m) == n {
+				return
+			}
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for a user count of %d", n)
+		}
+	}
+}
+
+// collect gathers messages of a type until nothing arrives for quiet
+func (c *client) collect(msgType string, quiet time.Duration) []message {
+	var got []message
+	for {
+		select {
+		case m, ok := <-c.msgs:
+			if !ok {
+				return got
+			}
+			if m.Type == msgType {
+				got = append(got, m)
+			}
+		case <-time.After(quiet):
+			return got
+		}
+	}
+}
+
+func TestJoinMoveLeave(t *testing.T) {
+	s := startServer(t)
+	a := s.connect(t)
+	b := s.connect(t)
+
+	join := a.expect("join")
+	if join.ID != b.id {
+		t.Fatalf("join = %+v, want id %s", join, b.id)
+	}
+	// The count rides on the join only if no update went out in the last second
+	if join.UserCount != 2 {
+		a.expectCount(2)
+	}
+
+	// Moves arrive at the other client in the order they were sent
+	const moves = 50
+	for i := 1; i <= moves; i++ {
+		a.send(map[string]interface{}{"type": "move", "position": map[string]float64{"x": float64(i), "y": 2 * float64(i)}})
+	}
+	got := b.collect("move", 500*time.Millisecond)
+	if len(got) != moves {
+		t.Fatalf("received %d moves, want %d", len(got), moves)
+	}
+	for i, m := range got {
+		if m.ID != a.id || m.Position == nil || m.Position.X != float64(i+1) || m.Position.Y != 2*float64(i+1) {
+			t.Fatalf("move %d = %s, want x=%d from %s", i, m.Raw, i+1, a.id)
+		}
+	}
+	if echoed := a.collect("move", 100*time.Millisecond); len(echoed) != 0 {
+		t.Fatalf("sender got %d of its own moves back", len(echoed))
+	}
+
+	b.conn.Close()
+	leave := a.expect("leave")
+	if leave.ID != b.id {
+		t.Fatalf("leave = %s, want id %s", leave.Raw, b.id)
+	}
+	if leave.UserCount != 1 {
+		a.expectCount(1)
+	}
+}
+
+func TestUserCountIsDebounced(t *testing.T) {
+	s := startServer(t)
+	watcher := s.connect(t)
+
+	const n = 10
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		s.connect(t)
+	}
+	elapsed := time.Since(start)
+
+	// Every join arrives, but the count goes out about once a second
+	var joins int
+	var counts []int
+	for {
+		select {
+		case m := <-watcher.msgs:
+			if m.Type == "join" {
+				joins++
+			}
+			if n := countUpdate(m); n > 0 {
+				counts = append(counts, n)
+			}
+			continue
+		case <-time.After(2 * time.Second):
+		}
+		break
+	}
+	if joins != n {
+		t.Fatalf("watcher saw %d joins, want %d", joins, n)
+	}
+	if len(counts) == 0 || counts[len(counts)-1] != n+1 {
+		t.Fatalf("user counts = %v, want the last to be %d", counts, n+1)
+	}
+	if max := int(elapsed/time.Second) + 2; len(counts) > max {
+		t.Fatalf("got %d user count updates in %v, want at most %d", len(counts), elapsed, max)
+	}
+}
+
+func TestPingReachesEveryone(t *testing.T) {
+	s := startServer(t)
+	const n = 5
+	clients := make([]*client, n)
+	for i := range clients {
+		clients[i] = s.connect(t)
+	}
+
+	clients[0].send(map[string]interface{}{"type": "ping", "ping": map[string]interface{}{"location": "Testville", "lat": 12.5, "lng": -3.25}})
+	for i, c := range clients {
+		pings := c.collect("ping", 300*time.Millisecond)
+		if len(pings) != 1 {
+			t.Fatalf("client %d got %d pings, want 1", i, len(pings))
+		}
+		p := pings[0]
+		if p.ID != clients[0].id || p.Ping == nil || p.Ping.Location != "Testville" || p.Ping.Timestamp == 0 {
+			t.Fatalf("client %d got %s", i, p.Raw)
+		}
+	}
+
+	// The ping lands in the persisted history once the event log flushes
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var page struct {
+			Pings []ping `json:"pings"`
+		}
+		getJSON(t, http.DefaultClient, s.base+"/api/pings", &page)
+		if len(page.Pings) == 1 && page.Pings[0].Location == "Testville" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ping history = %+v, want the Testville ping", page.Pings)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// A late joiner sees it among the recent pings
+	late := s.connect(t)
+	if len(late.init.Pings) != 1 || late.init.Pings[0].Location != "Testville" {
+		t.Fatalf("init pings = %+v, want the Testville ping", late.init.Pings)
+	}
+}
+
+func TestStatsCountsConnections(t *testing.T) {
+	s := startServer(t)
+	for i := 0; i < 3; i++ {
+		s.connect(t)
+	}
+	var stats struct {
+		CurrentUsers int `json:"currentUsers"`
+	}
+	getJSON(t, http.DefaultClient, s.base+"/api/stats", &stats)
+	if stats.CurrentUsers != 3 {
+		t.Fatalf("currentUsers = %d, want 3", stats.CurrentUsers)
+	}
+}
+
+func TestHighscoreAndLocationEndpoints(t *testing.T) {
+	s := startServer(t)
+	jar, _ := cookiejar.New(nil)
+	hc := &http.Client{Jar: jar}
+
+	// Loading the page hands out the CSRF cookie
+	resp, err := hc.Get(s.base + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	u, _ := url.Parse(s.base)
+	var token string
+	for _, c := range jar.Cookies(u) {
+		if c.Name == "csrf_token" {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		t.Fatal("no csrf_token cookie from /")
+	}
+
+	post := func(path, body, csrf string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("POST", s.base+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if csrf != "" {
+			req.Header.Set("X-CSRF-Token", csrf)
+		}
+		resp, err := hc.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp = post("/api/highscore", `{"game":"SNAKE","name":"ZED","score":4242}`, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("highscore without CSRF token: status %d, want 403", resp.StatusCode)
+	}
+
+	resp = post("/api/highscore", `{"game":"SNAKE","name":"ZED","score":4242}`, token)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("highscore: status %d", resp.StatusCode)
+	}
+	var scores []struct {
+		Name  string `json:"name"`
+		Score int    `json:"score"`
+	}
+	getJSON(t, hc, s.base+"/api/highscores?game=SNAKE", &scores)
+	if len(scores) == 0 || scores[0].Name != "ZED" || scores[0].Score != 4242 {
+		t.Fatalf("highscores = %+v, want ZED 4242 on top", scores)
+	}
+
+	resp = post("/api/location", `{"lat":48.1,"lng":11.6}`, token)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("location: status %d", resp.StatusCode)
+	}
+	var locations []struct {
+		Lat float64 `json:"lat"`
+		Lng float64 `json:"lng"`
+	}
+	getJSON(t, hc, s.base+"/api/locations", &locations)
+	found := false
+	for _, l := range locations {
+		if l.Lat == 48.1 && l.Lng == 11.6 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("locations = %+v, want 48.1,11.6", locations)
+	}
+}
+
+func getJSON(t *testing.T, hc *http.Client, url string, v interface{}) {
+	t.Helper()
+	resp, err := hc.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+}
+
+func TestInvalidMovesDropOnlyTheSender(t *testing.T) {
+	s := startServer(t)
+	const n = 8
+	clients := make([]*client, n)
+	for i := range clients {
+		clients[i] = s.connect(t)
+	}
+	bad := s.connect(t)
+
+	// Everyone else keeps moving while the bad client floods invalid positions
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *client) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				move := map[string]interface{}{"type": "move", "position": map[string]float64{"x": float64(i % 500), "y": 1}}
+				if c.conn.WriteJSON(move) != nil {
+					return
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}(c)
+	}
+	for i := 0; i < 25; i++ {
+		if bad.conn.WriteJSON(map[string]interface{}{"type": "move", "position": map[string]float64{"x": 1e12, "y": 1}}) != nil {
+			break
+		}
+	}
+
+	closed := bad.expect("close")
+	if !strings.Contains(string(closed.Raw), `"code":4003`) {
+		t.Fatalf("close = %s, want code 4003", closed.Raw)
+	}
+	for i, c := range clients {
+		if leave := c.expect("leave"); leave.ID != bad.id {
+			t.Fatalf("client %d saw %s leave, want %s", i, leave.ID, bad.id)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	// The server is still up and the others are still connected
+	var stats struct {
+		CurrentUsers int `json:"currentUsers"`
+	}
+	getJSON(t, http.DefaultClient, s.base+"/api/stats", &stats)
+	if stats.CurrentUsers != n {
+		t.Fatalf("currentUsers = %d, want %d", stats.CurrentUsers, n)
+	}
+}
+
+func TestRejectedUpgradeSaysWhyAndWhenToRetry(t *testing.T) {
+	s := startServer(t, "MAX_CONNECTIONS_PER_IP=1")
+	s.connect(t)
+
+	_, resp, err := websocket.DefaultDialer.Dial(strings.Replace(s.base, "http", "ws", 1)+"/ws", nil)
+	if err == nil {
+		t.Fatal("second connection from the same IP was let in")
+	}
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("response = %v, want 429", resp)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("headers = %v, want JSON with Retry-After", resp.Header)
+	}
+	var body struct {
+		Error      string `json:"error"`
+		Code       int    `json:"code"`
+		RetryAfter int    `json:"retry_after"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error != "ip_limit" || body.Code != 4001 || body.RetryAfter <= 0 {
+		t.Fatalf("body = %+v, want ip_limit, 4001 and a retry_after", body)
+	}
+}
+
+func TestFloodingAndBannedClientsGetCloseCodes(t *testing.T) {
+	s := startServer(t, "ADMIN_TOKEN=secret")
+
+	flooder := s.connect(t)
+	for i := 0; i < 400; i++ {
+		if flooder.conn.WriteJSON(map[string]interface{}{"type": "move", "position": map[string]float64{"x": float64(i), "y": 1}}) != nil {
+			break
+		}
+	}
+	closed := flooder.expect("close")
+	if raw := string(closed.Raw); !strings.Contains(raw, `"code":4006`) || !strings.Contains(raw, `"retryAfter":10`) {
+		t.Fatalf("close = %s, want code 4006 with retryAfter 10", raw)
+	}
+
+	victim := s.connect(t)
+	req, _ := http.NewRequest(http.MethodPost, s.base+"/admin/ban", strings.NewReader(`{"id":"`+victim.id+`","minutes":5}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("ban status = %d, want 204", resp.StatusCode)
+	}
+	if closed := victim.expect("close"); !strings.Contains(string(closed.Raw), `"code":4004`) {
+		t.Fatalf("close = %s, want code 4004", closed.Raw)
+	}
+
+	// Without a cookie the ban is on the IP, so nobody here gets back in
+	_, resp, err = websocket.DefaultDialer.Dial(strings.Replace(s.base, "http", "ws", 1)+"/ws", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("reconnect after ban: err = %v, response = %v, want 403", err, resp)
+	}
+}
+
+func TestShutdownHandsOffEveryHub(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	s := startServer(t, "TENANTS=alpha=alpha.test", "HUB_STATE_FILE="+stateFile)
+	main := s.connect(t)
+	alpha := s.connectHost(t, "alpha.test")
+
+	s.cmd.Process.Signal(syscall.SIGTERM)
+	for _, c := range []*client{main, alpha} {
+		m := c.expect("reconnect")
+		if !strings.Contains(string(m.Raw), `"code":1012`) || !strings.Contains(string(m.Raw), `"retryAfter"`) {
+			t.Errorf("reconnect hint = %s, want code 1012 and retryAfter", m.Raw)
+		}
+	}
+	for _, path := range []string{stateFile, filepath.Join(filepath.Dir(stateFile), "state-alpha.json")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("hub state not saved: %v", err)
+		}
+	}
+}
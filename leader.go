@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Several instances can share one database. Background jobs that poll
+// upstream APIs or prune shared tables should only run on one of them, so
+// instances compete for a lease row; the holder renews it well before it
+// expires and another instance takes over once it lapses.
+
+const leaderLeaseTTL = 30 * time.Second
+
+// leaderElector holds (or waits for) a named lease
+type leaderElector struct {
+	db     *sql.DB
+	name   string
+	id     string
+	leader atomic.Bool
+}
+
+// jobLeader decides which instance runs the scheduled jobs
+var jobLeader *leaderElector
+
+func newLeaderElector(db *sql.DB, name string) *leaderElector {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return &leaderElector{
+		db:   db,
+		name: name,
+		id:   fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b)),
+	}
+}
+
+// isLeader reports whether this instance currently holds the lease
+func (l *leaderElector) isLeader() bool {
+	return l.leader.Load()
+}
+
+// tryAcquire takes the lease if it is free or expired, or renews it if we hold it
+func (l *leaderElector) tryAcquire() (bool, error) {
+	now := time.Now()
+	res, err := l.db.Exec(`
+		INSERT INTO leader_leases (name, holder, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+		WHERE leader_leases.holder = excluded.holder OR leader_leases.expires_at < ?
+	`, l.name, l.id, now.Add(leaderLeaseTTL).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// run keeps competing for the lease until the process exits
+func (l *leaderElector) run() {
+	for {
+		ok, err := l.tryAcquire()
+		if err != nil {
+			log.Printf("Leader election error: %v", err)
+			// Without a renewal we can't be sure we still hold the lease
+			ok = false
+		}
+		if was := l.leader.Swap(ok); was != ok {
+			if ok {
+				log.Printf("Became leader for %s (%s)", l.name, l.id)
+			} else {
+				log.Printf("Lost leadership for %s", l.name)
+			}
+		}
+		time.Sleep(leaderLeaseTTL / 3)
+	}
+}
+
+// release gives up the lease so another instance can take over right away
+func (l *leaderElector) release() {
+	if !l.leader.Swap(false) {
+		return
+	}
+	if _, err := l.db.Exec(`DELETE FROM leader_leases WHERE name = ? AND holder = ?`, l.name, l.id); err != nil {
+		log.Printf("Error releasing leader lease: %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// With LIGHTNING_FEED set to one or more Blitzortung websocket URLs, strikes
+// are consumed in the background and kept in memory for an hour. Clients
+// that share their rough area ({"type":"area","area":{"lat":..,"lng":..}})
+// get a "lightning" warning when a strike lands near them.
+
+// LightningStrike is one detected strike
+type LightningStrike struct {
+	Lat      float64 `json:"lat"`
+	Lng      float64 `json:"lng"`
+	Time     int64   `json:"time"`
+	Distance float64 `json:"distanceKm"`
+}
+
+// Area is a client's approximate location
+type Area struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+const (
+	strikeRetention   = time.Hour
+	maxStrikes        = 100000
+	strikeWarnKm      = 30.0
+	strikeWarnBackoff = 5 * time.Minute
+)
+
+var recentStrikes struct {
+	sync.RWMutex
+	strikes []LightningStrike
+}
+
+// addStrike stores a strike, dropping those past retention
+func addStrike(s LightningStrike) {
+	recentStrikes.Lock()
+	defer recentStrikes.Unlock()
+
+	cutoff := time.Now().Add(-strikeRetention).Unix()
+	i := sort.Search(len(recentStrikes.strikes), func(i int) bool {
+		return recentStrikes.strikes[i].Time >= cutoff
+	})
+	if len(recentStrikes.strikes)-i >= maxStrikes {
+		i = len(recentStrikes.strikes) - maxStrikes + 1
+	}
+	recentStrikes.strikes = append(recentStrikes.strikes[i:], s)
+}
+
+// strikesNear returns strikes within radiusKm since the given time, newest first
+func strikesNear(lat, lng, radiusKm float64, since time.Time) []LightningStrike {
+	recentStrikes.RLock()
+	defer recentStrikes.RUnlock()
+
+	var near []LightningStrike
+	for i := len(recentStrikes.strikes) - 1; i >= 0; i-- {
+		s := recentStrikes.strikes[i]
+		if s.Time < since.Unix() {
+			break
+		}
+		if d := haversineKm(lat, lng, s.Lat, s.Lng); d <= radiusKm {
+			s.Distance = float64(int(d*10)) / 10
+			near = append(near, s)
+		}
+	}
+	return near
+}
+
+// decodeBlitzortung undoes the LZW-style compression of the Blitzortung feed
+func decodeBlitzortung(msg string) string {
+	chars := []rune(msg)
+	if len(chars) == 0 {
+		return ""
+	}
+	dict := make(map[rune]string)
+	c := string(chars[0])
+	prev := c
+	out := []string{c}
+	code := rune(256)
+	for _, ch := range chars[1:] {
+		var entry string
+		if ch < 256 {
+			entry = string(ch)
+		} else if d, ok := dict[ch]; ok {
+			entry = d
+		} else {
+			entry = prev + c
+		}
+		out = append(out, entry)
+		c = string([]rune(entry)[0])
+		dict[code] = prev + c
+		code++
+		prev = entry
+	}
+	return strings.Join(out, "")
+}
+
+// parseStrike reads a decoded feed message; times are in nanoseconds
+func parseStrike(data string) (LightningStrike, bool) {
+	var raw struct {
+		Time int64    `json:"time"`
+		Lat  *float64 `json:"lat"`
+		Lon  *float64 `json:"lon"`
+	}
+	if err := json.Unmarshal([]byte(data), &raw); err != nil || raw.Lat == nil || raw.Lon == nil {
+		return LightningStrike{}, false
+	}
+	if *raw.Lat < -90 || *raw.Lat > 90 || *raw.Lon < -180 || *raw.Lon > 180 {
+		return LightningStrike{}, false
+	}
+	return LightningStrike{Lat: *raw.Lat, Lng: *raw.Lon, Time: raw.Time / int64(time.Second)}, true
+}
+
+// runLightningFeed consumes the feed, cycling through the URLs and backing off on failure
+func runLightningFeed(urls []string) {
+	backoff := time.Second
+	for i := 0; ; i++ {
+		url := urls[i%len(urls)]
+		start := time.Now()
+		err := consumeLightningFeed(url)
+		log.Printf("Lightning feed %s disconnected: %v", url, err)
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		if backoff < 2*time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func consumeLightningFeed(url string) error {
+	dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	conn, _, err := dialer.Dial(url, http.Header{"User-Agent": {"currentcondition.tv"}})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Subscribe to the global stream
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"a":111}`)); err != nil {
+		return err
+	}
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		strike, ok := parseStrike(decodeBlitzortung(string(msg)))
+		if !ok {
+			continue
+		}
+		addStrike(strike)
+		for _, h := range allHubs() {
+			h.warnLightning(strike)
+		}
+	}
+}
+
+// warnLightning tells clients near a strike about it, at most once per strikeWarnBackoff
+func (h *Hub) warnLightning(s LightningStrike) {
+	now := time.Now()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, c := range h.clients {
+		if c.area == nil || now.Sub(c.lastLightningWarning) < strikeWarnBackoff {
+			continue
+		}
+		d := haversineKm(c.area.Lat, c.area.Lng, s.Lat, s.Lng)
+		if d > strikeWarnKm {
+			continue
+		}
+		warning := s
+		warning.Distance = float64(int(d*10)) / 10
+		data, _ := json.Marshal(CursorMessage{Type: "lightning", Lightning: &warning})
+		if c.trySend(data) {
+			c.lastLightningWarning = now
+		}
+	}
+}
+
+// setArea records the rough area a client shared, rounded to ~10km
+func (c *Client) setArea(area *Area) {
+	if area == nil || area.Lat < -90 || area.Lat > 90 || area.Lng < -180 || area.Lng > 180 {
+		return
+	}
+	rounded := &Area{Lat: roundCoord(area.Lat, 1), Lng: roundCoord(area.Lng, 1)}
+	c.hub.mutex.Lock()
+	c.area = rounded
+	c.hub.mutex.Unlock()
+}
+
+// lightningFeeds returns the LIGHTNING_FEED URLs
+func lightningFeeds() []string {
+	var urls []string
+	for _, u := range strings.Split(os.Getenv("LIGHTNING_FEED"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+func handleGetLightning(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lat, lng, ok := parseLatLng(r)
+	if !ok {
+		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+		return
+	}
+	radius, err := strconv.ParseFloat(r.URL.Query().Get("radius"), 64)
+	if err != nil || radius <= 0 {
+		radius = 100
+	}
+	if radius > 1000 {
+		radius = 1000
+	}
+
+	strikes := strikesNear(lat, lng, radius, time.Now().Add(-strikeRetention))
+	if strikes == nil {
+		strikes = []LightningStrike{}
+	}
+	if len(strikes) > 500 {
+		strikes = strikes[:500]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(strikes)
+}
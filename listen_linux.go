@@ -0,0 +1,31 @@
+//go:build linux && (386 || amd64 || arm || arm64 || ppc64le || riscv64 || s390x)
+
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// SO_REUSEPORT on these architectures; the frozen syscall package lacks it
+const soReusePort = 0xf
+
+// listen binds addr with SO_REUSEPORT, so a new process can start listening
+// on the same address before the old one lets go and no connection is
+// refused during a deploy
+func listen(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
@@ -0,0 +1,11 @@
+//go:build !(linux && (386 || amd64 || arm || arm64 || ppc64le || riscv64 || s390x))
+
+package main
+
+import "net"
+
+// listen binds addr; without SO_REUSEPORT a deploy has to stop the old
+// process before the new one can listen
+func listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
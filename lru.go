@@ -0,0 +1,139 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lruCache keeps the most recently used values in memory for up to ttl,
+// counting hits and misses. Every put or remove bumps the key's generation,
+// so a load that started before a write can't put back what it read.
+type lruCache[T any] struct {
+	sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List
+	entries  map[string]*list.Element
+	gens     map[string]uint64
+	// Bumped when gens is cleared, so loads in flight across it are dropped
+	epoch  uint64
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type lruEntry[T any] struct {
+	key     string
+	value   T
+	expires time.Time
+}
+
+// CacheStats reports how well a cache is doing
+type CacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	Size   int   `json:"size"`
+}
+
+func newLRUCache[T any](capacity int, ttl time.Duration) *lruCache[T] {
+	return &lruCache[T]{capacity: capacity, ttl: ttl, order: list.New(),
+		entries: make(map[string]*list.Element), gens: make(map[string]uint64)}
+}
+
+// get returns the cached value for key, calling load on a miss
+func (c *lruCache[T]) get(key string, load func() (T, error)) (T, error) {
+	c.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*lruEntry[T])
+		if time.Now().Before(e.expires) {
+			c.order.MoveToFront(el)
+			c.Unlock()
+			c.hits.Add(1)
+			return e.value, nil
+		}
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+	gen, epoch := c.gens[key], c.epoch
+	c.Unlock()
+	c.misses.Add(1)
+
+	value, err := load()
+	if err != nil {
+		return value, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	// Keep what was loaded only if nothing was written meanwhile
+	if c.gens[key] == gen && c.epoch == epoch {
+		c.store(key, value)
+	}
+	return value, nil
+}
+
+// put stores a value, evicting the least recently used entry when full
+func (c *lruCache[T]) put(key string, value T) {
+	c.Lock()
+	defer c.Unlock()
+	c.bump(key)
+	c.store(key, value)
+}
+
+// store adds or replaces an entry (the caller holds the lock)
+func (c *lruCache[T]) store(key string, value T) {
+	expires := time.Now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*lruEntry[T])
+		e.value, e.expires = value, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[T]{key: key, value: value, expires: expires})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[T]).key)
+	}
+}
+
+// bump starts a new generation for key (the caller holds the lock)
+func (c *lruCache[T]) bump(key string) {
+	// Generations outlive their entries; start over rather than grow forever
+	if len(c.gens) > 4*c.capacity {
+		c.gens = make(map[string]uint64)
+		c.epoch++
+	}
+	c.gens[key]++
+}
+
+// peek returns a cached value without counting a hit or refreshing it
+func (c *lruCache[T]) peek(key string) (T, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.entries[key]; ok {
+		if e := el.Value.(*lruEntry[T]); time.Now().Before(e.expires) {
+			return e.value, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// remove drops a key from the cache
+func (c *lruCache[T]) remove(key string) {
+	c.Lock()
+	defer c.Unlock()
+	c.bump(key)
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+func (c *lruCache[T]) stats() CacheStats {
+	c.Lock()
+	size := c.order.Len()
+	c.Unlock()
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Size: size}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaintenanceNotice describes scheduled downtime
+type MaintenanceNotice struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+	Until   int64  `json:"until,omitempty"`
+}
+
+// maintenanceNotice returns the hub's current notice
+func (h *Hub) maintenanceNotice() MaintenanceNotice {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.maintenance
+}
+
+// Last good JSON responses of API reads, served while in maintenance
+const readCacheSize = 512
+
+// Reads that are the same for every visitor, and so safe to replay to
+// anyone. Responses that depend on the visitor cookie (accounts, tags,
+// puzzle progress, theme choice) must never be added here.
+var cachedReads = map[string]bool{
+	"/api/locations":           true,
+	"/api/locations/clusters":  true,
+	"/api/pings":               true,
+	"/api/highscores":          true,
+	"/api/rankings":            true,
+	"/api/matches/leaderboard": true,
+	"/api/stats":               true,
+	"/api/stats/activity":      true,
+	"/api/stats/sessions":      true,
+	"/api/stats/distances":     true,
+	"/api/presence":            true,
+	"/api/owner/status":        true,
+	"/api/season":              true,
+	"/api/puzzle/stats":        true,
+	"/api/guestbook":           true,
+	"/api/stations":            true,
+}
+
+var readCache = struct {
+	sync.Mutex
+	entries map[string]cachedResponse
+}{entries: make(map[string]cachedResponse)}
+
+type cachedResponse struct {
+	contentType string
+	body        []byte
+}
+
+// responseRecorder copies a response while it is written to the client
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	// Only JSON is cached; don't buffer streams like the replay SSE
+	if strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *responseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// API endpoints that write despite being GETs (station uploads)
+var writeGETs = map[string]bool{"/api/pws/update": true}
+
+// readCacheKey identifies a cached read by site, negotiated format and URL.
+// Keying on the site rather than the Host header keeps made-up hosts from
+// filling the cache; the format keeps JSON from answering a request for
+// MessagePack or CSV, which vary on Accept.
+func readCacheKey(site *Tenant, r *http.Request) string {
+	format := "json"
+	if acceptsMsgpack(r) {
+		format = "msgpack"
+	} else if acceptsCSV(r) {
+		format = "csv"
+	}
+	return site.Name + " " + format + " " + r.URL.RequestURI()
+}
+
+// maintenanceGuard rejects API writes to a site in maintenance and answers
+// its public API reads from the last responses seen before it started
+func maintenanceGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		site := tenantFor(r)
+		notice := site.hub.maintenanceNotice()
+		key := readCacheKey(site, r)
+		isRead := (r.Method == http.MethodGet || r.Method == http.MethodHead) && !writeGETs[r.URL.Path]
+
+		if notice.Enabled && !isRead {
+			if wait := time.Until(time.Unix(notice.Until, 0)); notice.Until > 0 && wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "maintenance", "maintenance": notice})
+			return
+		}
+
+		if notice.Enabled {
+			readCache.Lock()
+			cached, ok := readCache.entries[key]
+			readCache.Unlock()
+			if ok {
+				w.Header().Set("Content-Type", cached.contentType)
+				w.Header().Set("Vary", "Accept")
+				w.Header().Set("X-Maintenance", "cached")
+				w.Write(cached.body)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !cachedReads[r.URL.Path] || r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		contentType := rec.Header().Get("Content-Type")
+		if rec.status != http.StatusOK || !strings.HasPrefix(contentType, "application/json") {
+			return
+		}
+		readCache.Lock()
+		if _, ok := readCache.entries[key]; !ok && len(readCache.entries) >= readCacheSize {
+			// Drop an arbitrary entry to stay bounded
+			for k := range readCache.entries {
+				delete(readCache.entries, k)
+				break
+			}
+		}
+		readCache.entries[key] = cachedResponse{contentType: contentType, body: rec.body.Bytes()}
+		readCache.Unlock()
+	})
+}
+
+// setMaintenance switches the hub's site in or out of maintenance and tells
+// its clients
+func (h *Hub) setMaintenance(notice MaintenanceNotice) {
+	h.mutex.Lock()
+	h.maintenance = notice
+	h.mutex.Unlock()
+
+	data, _ := json.Marshal(CursorMessage{Type: "maintenance", Maintenance: &notice})
+	h.broadcastToOthers("", data)
+	h.logEvent("maintenance", "", data)
+}
+
+// handleMaintenance shows (GET) or toggles (POST) maintenance mode for the
+// admin's own site
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	site := tenantFor(r)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Enabled bool   `json:"enabled"`
+			Message string `json:"message"`
+			Until   string `json:"until"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		notice := MaintenanceNotice{Enabled: req.Enabled, Message: cleanTextLine(req.Message, 200)}
+		if req.Until != "" {
+			until := parseImportTime(req.Until)
+			if until.IsZero() {
+				http.Error(w, "Invalid until", http.StatusBadRequest)
+				return
+			}
+			notice.Until = until.Unix()
+		}
+		if !notice.Enabled {
+			notice = MaintenanceNotice{}
+		}
+
+		site.hub.setMaintenance(notice)
+		log.Printf("Maintenance mode for site %q: %v", site.Name, notice.Enabled)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(site.hub.maintenanceNotice())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// TideEvent is a predicted high or low water
+type TideEvent struct {
+	Time   string  `json:"time"`
+	Height float64 `json:"height"`
+}
+
+// MarineResponse is returned by /api/tides
+type MarineResponse struct {
+	Coastal        bool       `json:"coastal"`
+	WaveHeight     *float64   `json:"waveHeight,omitempty"`
+	WaveDirection  *float64   `json:"waveDirection,omitempty"`
+	WavePeriod     *float64   `json:"wavePeriod,omitempty"`
+	SeaSurfaceTemp *float64   `json:"seaSurfaceTemp,omitempty"`
+	TideTrend      string     `json:"tideTrend,omitempty"`
+	NextHigh       *TideEvent `json:"nextHigh,omitempty"`
+	NextLow        *TideEvent `json:"nextLow,omitempty"`
+}
+
+var marineCache = newTTLCache[MarineResponse](30 * time.Minute)
+
+func fetchMarine(lat, lng float64) (MarineResponse, error) {
+	var result MarineResponse
+	var data struct {
+		Current struct {
+			Time           string   `json:"time"`
+			WaveHeight     *float64 `json:"wave_height"`
+			WaveDirection  *float64 `json:"wave_direction"`
+			WavePeriod     *float64 `json:"wave_period"`
+			SeaSurfaceTemp *float64 `json:"sea_surface_temperature"`
+		} `json:"current"`
+		Hourly struct {
+			Time     []string   `json:"time"`
+			SeaLevel []*float64 `json:"sea_level_height_msl"`
+		} `json:"hourly"`
+	}
+	err := fetchJSON(fmt.Sprintf(
+		"https://marine-api.open-meteo.com/v1/marine?latitude=%.4f&longitude=%.4f&current=wave_height,wave_direction,wave_period,sea_surface_temperature&hourly=sea_level_height_msl&forecast_days=2&timezone=auto",
+		lat, lng), &data)
+	if err != nil {
+		return result, err
+	}
+
+	// Inland locations come back with nothing but nulls
+	c := data.Current
+	result.WaveHeight = c.WaveHeight
+	result.WaveDirection = c.WaveDirection
+	result.WavePeriod = c.WavePeriod
+	result.SeaSurfaceTemp = c.SeaSurfaceTemp
+	result.Coastal = c.WaveHeight != nil || c.SeaSurfaceTemp != nil
+	if !result.Coastal {
+		return result, nil
+	}
+
+	// Find the current hour, then the next turning points of the sea level
+	times, levels := data.Hourly.Time, data.Hourly.SeaLevel
+	now := 0
+	for i, t := range times {
+		if t <= c.Time {
+			now = i
+		}
+	}
+	for i := now + 1; i+1 < len(levels) && i+1 < len(times); i++ {
+		prev, cur, next := levels[i-1], levels[i], levels[i+1]
+		if prev == nil || cur == nil || next == nil {
+			continue
+		}
+		if i == now+1 {
+			if *cur > *prev {
+				result.TideTrend = "RISING"
+			} else {
+				result.TideTrend = "FALLING"
+			}
+		}
+		if result.NextHigh == nil && *cur >= *prev && *cur > *next {
+			result.NextHigh = &TideEvent{Time: times[i], Height: *cur}
+		}
+		if result.NextLow == nil && *cur <= *prev && *cur < *next {
+			result.NextLow = &TideEvent{Time: times[i], Height: *cur}
+		}
+	}
+	return result, nil
+}
+
+func handleGetMarine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lat, lng, ok := parseLatLng(r)
+	if !ok {
+		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+		return
+	}
+
+	result, err := marineCache.get(coordKey(lat, lng), func() (MarineResponse, error) {
+		return fetchMarine(lat, lng)
+	})
+	if err != nil {
+		log.Printf("Error fetching marine data: %v", err)
+		http.Error(w, "Upstream error", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// The weather mascot drifts over to whoever connected last, as if to say
+// hello, and wanders back to the middle of the page when they've gone. It
+// moves in page fractions, like normalized visitor cursors, so it lands on
+// the same spot of the page on every screen. Enable it with NPCS=mascot.
+
+// How far the mascot moves per step and how close it stops to its target,
+// as fractions of the page
+const (
+	mascotSpeed    = 0.008
+	mascotDistance = 0.03
+)
+
+func init() {
+	registerNPC("mascot", func(h *Hub) NPC { return &mascot{hub: h, x: 0.5, y: 0.5} })
+}
+
+type mascot struct {
+	hub  *Hub
+	x, y float64
+}
+
+func (m *mascot) Name() string { return "mascot" }
+
+func (m *mascot) Step(now time.Time) *CursorPosition {
+	tx, ty := 0.5, 0.5
+	if target := m.hub.newestVisitorPosition(); target != nil {
+		tx, ty = target.X, target.Y
+	}
+	dx, dy := tx-m.x, ty-m.y
+	dist := math.Hypot(dx, dy)
+	if dist <= mascotDistance {
+		return nil
+	}
+	step := math.Min(dist-mascotDistance, mascotSpeed)
+	m.x += dx / dist * step
+	m.y += dy / dist * step
+	return &CursorPosition{
+		X:          math.Round(m.x * npcWidth),
+		Y:          math.Round(m.y * npcHeight),
+		Normalized: &NormalizedPoint{X: math.Round(m.x*1e4) / 1e4, Y: math.Round(m.y*1e4) / 1e4},
+	}
+}
+
+// newestVisitorPosition returns where the most recently connected visitor's
+// cursor is on the page, or nil if no visitor has moved yet. Cursors from
+// clients that don't send their page size are placed on the NPC screen.
+func (h *Hub) newestVisitorPosition() *NormalizedPoint {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	var newest *Client
+	for _, c := range h.clients {
+		if c.bot || c.Position == nil {
+			continue
+		}
+		if newest == nil || c.connectedAt.After(newest.connectedAt) {
+			newest = c
+		}
+	}
+	if newest == nil {
+		return nil
+	}
+	if p := newest.Position.Normalized; p != nil {
+		return &NormalizedPoint{X: p.X, Y: p.Y}
+	}
+	return &NormalizedPoint{
+		X: clampUnit(newest.Position.X / npcWidth),
+		Y: clampUnit(newest.Position.Y / npcHeight),
+	}
+}
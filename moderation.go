@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Moderators can delete highscores, mute or ban visitors and moderate the
+// guestbook (guestbook.go); admins can purge log tables. Muted visitors'
+// pings, DMs, typing indicators and guestbook entries are dropped. Banned
+// visitors are disconnected and can't reconnect until the ban runs out.
+
+// Message types a muted client may not send
+var mutedMessages = map[string]bool{"ping": true, "dm": true, "typing": true}
+
+// Tables that can be emptied from /admin/purge (never the audit log)
+var purgeableTables = map[string]bool{
+	"hub_events":           true,
+	"metrics_rollup":       true,
+	"visitor_sessions":     true,
+	"cursor_recordings":    true,
+	"cursor_heatmap":       true,
+	"weather_observations": true,
+	"station_readings":     true,
+}
+
+// muteKey identifies the visitor behind a client, by cookie or else by IP
+func (c *Client) muteKey() string {
+	if c.visitorID != "" {
+		return c.visitorID
+	}
+	return "ip:" + c.IP
+}
+
+// isMuted reports whether a moderator has muted this client's visitor
+func (c *Client) isMuted() bool {
+	c.hub.mutex.RLock()
+	defer c.hub.mutex.RUnlock()
+	return time.Now().Before(c.hub.muted[c.muteKey()])
+}
+
+// bannedFor returns how long a visitor (by cookie, if any) or IP is still banned
+func (h *Hub) bannedFor(visitorID, ip string) time.Duration {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	until := h.banned["ip:"+ip]
+	if visitorID != "" && h.banned[visitorID].After(until) {
+		until = h.banned[visitorID]
+	}
+	return time.Until(until)
+}
+
+// handleDeleteHighscore removes one highscore by ID
+func handleDeleteHighscore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	site := tenantFor(r)
+	var game string
+	err = site.db.QueryRowContext(r.Context(), `DELETE FROM highscores WHERE id = ? RETURNING game`, id).Scan(&game)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting highscore: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	highscoreCache.remove(highscoreCacheKey(site, game))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMute mutes the visitor behind a connected client for a number of
+// minutes (0 unmutes)
+func handleMute(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		ID      string `json:"id"`
+		Minutes int    `json:"minutes"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil || req.Minutes < 0 {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	h := tenantFor(r).hub
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	c, ok := h.clients[req.ID]
+	if !ok {
+		http.Error(w, "Client not connected", http.StatusNotFound)
+		return
+	}
+	if req.Minutes == 0 {
+		delete(h.muted, c.muteKey())
+	} else {
+		h.muted[c.muteKey()] = time.Now().Add(time.Duration(req.Minutes) * time.Minute)
+	}
+	// Forget expired mutes while we're here
+	for key, until := range h.muted {
+		if time.Now().After(until) {
+			delete(h.muted, key)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleBan bans the visitor behind a connected client for a number of
+// minutes (0 lifts the ban), disconnecting every connection they have open
+func handleBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		ID      string `json:"id"`
+		Minutes int    `json:"minutes"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil || req.Minutes < 0 {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	h := tenantFor(r).hub
+	h.mutex.Lock()
+	c, ok := h.clients[req.ID]
+	if !ok || c.bot {
+		h.mutex.Unlock()
+		http.Error(w, "Client not connected", http.StatusNotFound)
+		return
+	}
+	key := c.muteKey()
+	var dropped []*Client
+	if req.Minutes == 0 {
+		delete(h.banned, key)
+	} else {
+		h.banned[key] = time.Now().Add(time.Duration(req.Minutes) * time.Minute)
+		for _, other := range h.clients {
+			if other.muteKey() == key {
+				dropped = append(dropped, other)
+			}
+		}
+	}
+	// Forget expired bans while we're here
+	for k, until := range h.banned {
+		if time.Now().After(until) {
+			delete(h.banned, k)
+		}
+	}
+	h.mutex.Unlock()
+
+	for _, other := range dropped {
+		other.drop(closeBanned, "banned", time.Duration(req.Minutes)*time.Minute)
+	}
+	log.Printf("Banned %s for %d minutes (%d connections dropped)", key, req.Minutes, len(dropped))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePurge empties one of the purgeable log tables
+func handlePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Table string `json:"table"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil || !purgeableTables[req.Table] {
+		http.Error(w, "Invalid table", http.StatusBadRequest)
+		return
+	}
+	res, err := tenantFor(r).db.ExecContext(r.Context(), `DELETE FROM `+req.Table)
+	if err != nil {
+		log.Printf("Error purging %s: %v", req.Table, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	n, _ := res.RowsAffected()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"deleted": n})
+}
+
+// AuditEntry is one privileged admin request
+type AuditEntry struct {
+	At     int64  `json:"at"`
+	Actor  string `json:"actor"`
+	Role   string `json:"role"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	IP     string `json:"ip"`
+}
+
+// handleGetAudit lists the most recent audit log entries
+func handleGetAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	rows, err := tenantFor(r).db.QueryContext(r.Context(), `
+		SELECT at, actor, role, method, path, status, ip FROM admin_audit ORDER BY id DESC LIMIT ?
+	`, limit)
+	if err != nil {
+		log.Printf("Error reading audit log: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.At, &e.Actor, &e.Role, &e.Method, &e.Path, &e.Status, &e.IP); err != nil {
+			log.Printf("Error reading audit log: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Read-heavy endpoints (locations, clusters, ping history) answer with
+// MessagePack for ?format=msgpack or Accept: application/msgpack, which is
+// much smaller than JSON for kiosks on slow links. Values are encoded with
+// the same field names as the JSON, times as msgpack timestamps, and written
+// through a buffer as they're encoded, so large lists stream out.
+
+const msgpackBufferSize = 32 << 10
+
+// wantsMsgpack reports whether the client asked for MessagePack; like
+// wantsCSV, responses vary on Accept
+func wantsMsgpack(w http.ResponseWriter, r *http.Request) bool {
+	varyOnAccept(w)
+	return acceptsMsgpack(r)
+}
+
+// acceptsMsgpack is wantsMsgpack without touching the response
+func acceptsMsgpack(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return strings.EqualFold(format, "msgpack")
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(accept, ";")
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/msgpack", "application/x-msgpack", "application/vnd.msgpack":
+			return true
+		}
+	}
+	return false
+}
+
+// writeMsgpack streams v to the client as MessagePack
+func writeMsgpack(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/msgpack")
+	enc := &msgpackEncoder{w: bufio.NewWriterSize(w, msgpackBufferSize)}
+	if err := enc.encode(reflect.ValueOf(v)); err != nil {
+		return err
+	}
+	return enc.w.Flush()
+}
+
+type msgpackEncoder struct {
+	w   *bufio.Writer
+	buf [9]byte
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		return e.w.WriteByte(0xc0)
+	}
+	if v.Type() == timeType {
+		return e.writeTime(v.Interface().(time.Time))
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return e.w.WriteByte(0xc0)
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return e.w.WriteByte(0xc3)
+		}
+		return e.w.WriteByte(0xc2)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return e.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return e.writeUint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return e.writeFloat(v.Float())
+	case reflect.String:
+		return e.writeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			return e.w.WriteByte(0xc0)
+		}
+		fallthrough
+	case reflect.Array:
+		if err := e.writeHeader(v.Len(), 0x90, 0xdc); err != nil {
+			return err
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		if v.IsNil() {
+			return e.w.WriteByte(0xc0)
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("msgpack: unsupported map key type %s", v.Type().Key())
+		}
+		if err := e.writeHeader(v.Len(), 0x80, 0xde); err != nil {
+			return err
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.writeString(iter.Key().String()); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Struct:
+		return e.writeStruct(v)
+	}
+	return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+}
+
+// writeHeader writes an array or map length: fix for up to 15 entries,
+// otherwise the 16 or 32-bit form (fix16 + 1)
+func (e *msgpackEncoder) writeHeader(n int, fix, fix16 byte) error {
+	switch {
+	case n < 16:
+		return e.w.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		e.buf[0] = fix16
+		binary.BigEndian.PutUint16(e.buf[1:], uint16(n))
+		_, err := e.w.Write(e.buf[:3])
+		return err
+	default:
+		e.buf[0] = fix16 + 1
+		binary.BigEndian.PutUint32(e.buf[1:], uint32(n))
+		_, err := e.w.Write(e.buf[:5])
+		return err
+	}
+}
+
+func (e *msgpackEncoder) writeInt(n int64) error {
+	if n >= 0 {
+		return e.writeUint(uint64(n))
+	}
+	switch {
+	case n >= -32:
+		return e.w.WriteByte(byte(n))
+	case n >= math.MinInt8:
+		_, err := e.w.Write([]byte{0xd0, byte(n)})
+		return err
+	case n >= math.MinInt16:
+		e.buf[0] = 0xd1
+		binary.BigEndian.PutUint16(e.buf[1:], uint16(n))
+		_, err := e.w.Write(e.buf[:3])
+		return err
+	case n >= math.MinInt32:
+		e.buf[0] = 0xd2
+		binary.BigEndian.PutUint32(e.buf[1:], uint32(n))
+		_, err := e.w.Write(e.buf[:5])
+		return err
+	default:
+		e.buf[0] = 0xd3
+		binary.BigEndian.PutUint64(e.buf[1:], uint64(n))
+		_, err := e.w.Write(e.buf[:9])
+		return err
+	}
+}
+
+func (e *msgpackEncoder) writeUint(n uint64) error {
+	switch {
+	case n <= 0x7f:
+		return e.w.WriteByte(byte(n))
+	case n <= math.MaxUint8:
+		_, err := e.w.Write([]byte{0xcc, byte(n)})
+		return err
+	case n <= math.MaxUint16:
+		e.buf[0] = 0xcd
+		binary.BigEndian.PutUint16(e.buf[1:], uint16(n))
+		_, err := e.w.Write(e.buf[:3])
+		return err
+	case n <= math.MaxUint32:
+		e.buf[0] = 0xce
+		binary.BigEndian.PutUint32(e.buf[1:], uint32(n))
+		_, err := e.w.Write(e.buf[:5])
+		return err
+	default:
+		e.buf[0] = 0xcf
+		binary.BigEndian.PutUint64(e.buf[1:], n)
+		_, err := e.w.Write(e.buf[:9])
+		return err
+	}
+}
+
+// writeFloat writes whole numbers as integers (as JSON would print them) and
+// the rest as float32 when that loses nothing, else float64
+func (e *msgpackEncoder) writeFloat(f float64) error {
+	if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return e.writeInt(int64(f))
+	}
+	if float64(float32(f)) == f {
+		e.buf[0] = 0xca
+		binary.BigEndian.PutUint32(e.buf[1:], math.Float32bits(float32(f)))
+		_, err := e.w.Write(e.buf[:5])
+		return err
+	}
+	e.buf[0] = 0xcb
+	binary.BigEndian.PutUint64(e.buf[1:], math.Float64bits(f))
+	_, err := e.w.Write(e.buf[:9])
+	return err
+}
+
+func (e *msgpackEncoder) writeString(s string) error {
+	var err error
+	switch n := len(s); {
+	case n < 32:
+		err = e.w.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		_, err = e.w.Write([]byte{0xd9, byte(n)})
+	case n <= math.MaxUint16:
+		e.buf[0] = 0xda
+		binary.BigEndian.PutUint16(e.buf[1:], uint16(n))
+		_, err = e.w.Write(e.buf[:3])
+	default:
+		e.buf[0] = 0xdb
+		binary.BigEndian.PutUint32(e.buf[1:], uint32(n))
+		_, err = e.w.Write(e.buf[:5])
+	}
+	if err != nil {
+		return err
+	}
+	_, err = e.w.WriteString(s)
+	return err
+}
+
+// writeTime writes the msgpack timestamp extension (type -1) in its
+// smallest form
+func (e *msgpackEncoder) writeTime(t time.Time) error {
+	sec, nsec := t.Unix(), int64(t.Nanosecond())
+	switch {
+	case nsec == 0 && sec >= 0 && sec <= math.MaxUint32:
+		e.w.Write([]byte{0xd6, 0xff})
+		binary.BigEndian.PutUint32(e.buf[:], uint32(sec))
+		_, err := e.w.Write(e.buf[:4])
+		return err
+	case sec >= 0 && sec < 1<<34:
+		e.w.Write([]byte{0xd7, 0xff})
+		binary.BigEndian.PutUint64(e.buf[:], uint64(nsec)<<34|uint64(sec))
+		_, err := e.w.Write(e.buf[:8])
+		return err
+	default:
+		e.w.Write([]byte{0xc7, 12, 0xff})
+		binary.BigEndian.PutUint32(e.buf[:], uint32(nsec))
+		e.w.Write(e.buf[:4])
+		binary.BigEndian.PutUint64(e.buf[:], uint64(sec))
+		_, err := e.w.Write(e.buf[:8])
+		return err
+	}
+}
+
+// msgpackField is a struct field as encoding/json sees it
+type msgpackField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var msgpackFields sync.Map // reflect.Type -> []msgpackField
+
+// structFields lists the fields encoding/json would write, following json
+// tags and flattening embedded structs
+func structFields(t reflect.Type) []msgpackField {
+	if cached, ok := msgpackFields.Load(t); ok {
+		return cached.([]msgpackField)
+	}
+	var fields []msgpackField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for _, inner := range structFields(f.Type) {
+				inner.index = append([]int{i}, inner.index...)
+				fields = append(fields, inner)
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, msgpackField{name: name, index: []int{i}, omitEmpty: strings.Contains(opts, "omitempty")})
+	}
+	msgpackFields.Store(t, fields)
+	return fields
+}
+
+// isEmptyValue matches encoding/json's omitempty
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+func (e *msgpackEncoder) writeStruct(v reflect.Value) error {
+	fields := structFields(v.Type())
+	values := make([]reflect.Value, len(fields))
+	n := 0
+	for i, f := range fields {
+		fv := v.FieldByIndex(f.index)
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		values[i] = fv
+		n++
+	}
+	if err := e.writeHeader(n, 0x80, 0xde); err != nil {
+		return err
+	}
+	for i, f := range fields {
+		if !values[i].IsValid() {
+			continue
+		}
+		if err := e.writeString(f.name); err != nil {
+			return err
+		}
+		if err := e.encode(values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
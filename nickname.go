@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Visitors claim a tag (their three-letter initials) at /api/me/tag, which
+// only they can then put on the boards. A claim that goes unused, neither
+// on a board nor claimed again, for nicknameExpiry is released by the hourly
+// cleanup so abandoned tags free up.
+const nicknameExpiry = 90 * 24 * time.Hour
+
+// NicknameResponse describes the current visitor's claimed tag
+type NicknameResponse struct {
+	Tag string `json:"tag"`
+}
+
+// validNickname reports whether a sanitized name may be reserved
+func validNickname(name string) bool {
+	trimmed := strings.TrimRight(name, " ")
+	if trimmed == "" || trimmed == "CON" {
+		return false
+	}
+	for _, r := range trimmed {
+		if !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// getNicknameOwner returns the visitor that reserved a name, or "" if it is free
+func getNicknameOwner(ctx context.Context, db *sql.DB, name string) (string, error) {
+	var visitorID string
+	err := db.QueryRowContext(ctx, `SELECT visitor_id FROM nicknames WHERE name = ?`, name).Scan(&visitorID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return visitorID, err
+}
+
+// getVisitorNickname returns the name a visitor has reserved, or ""
+func getVisitorNickname(ctx context.Context, db *sql.DB, visitorID string) (string, error) {
+	var name string
+	err := db.QueryRowContext(ctx, `SELECT name FROM nicknames WHERE visitor_id = ?`, visitorID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return name, err
+}
+
+// reserveNickname claims a name for a visitor, replacing any earlier reservation.
+// It reports false if someone else already holds the name.
+func reserveNickname(ctx context.Context, db *sql.DB, visitorID, name string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM nicknames WHERE visitor_id = ? AND name != ?`, visitorID, name); err != nil {
+		return false, err
+	}
+	res, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO nicknames (name, visitor_id, last_used) VALUES (?, ?, CURRENT_TIMESTAMP)`, name, visitorID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var owner string
+		if err := tx.QueryRowContext(ctx, `SELECT visitor_id FROM nicknames WHERE name = ?`, name).Scan(&owner); err != nil {
+			return false, err
+		}
+		if owner != visitorID {
+			return false, nil
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE nicknames SET last_used = CURRENT_TIMESTAMP WHERE name = ?`, name); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// useNickname records that a visitor put their tag on a board, which keeps
+// the claim from expiring
+func useNickname(ctx context.Context, db *sql.DB, visitorID string) {
+	if _, err := db.ExecContext(ctx, `UPDATE nicknames SET last_used = CURRENT_TIMESTAMP WHERE visitor_id = ?`, visitorID); err != nil {
+		log.Printf("Error recording nickname use: %v", err)
+	}
+}
+
+// expireNicknames releases claims unused for nicknameExpiry
+func expireNicknames(db *sql.DB, now time.Time) (int64, error) {
+	cutoff := now.Add(-nicknameExpiry).UTC().Format("2006-01-02 15:04:05")
+	res, err := db.Exec(`DELETE FROM nicknames WHERE COALESCE(last_used, created_at) < ?`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func handleNickname(w http.ResponseWriter, r *http.Request) {
+	db := tenantFor(r).db
+	visitorID := visitorIDFromRequest(w, r)
+
+	switch r.Method {
+	case http.MethodGet:
+		name, err := getVisitorNickname(r.Context(), db, visitorID)
+		if err != nil {
+			log.Printf("Error getting nickname: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(NicknameResponse{Tag: name})
+
+	case http.MethodPost:
+		var req struct {
+			Tag string `json:"tag"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		name := sanitizeName(req.Tag)
+		if !validNickname(name) {
+			http.Error(w, "Invalid name", http.StatusBadRequest)
+			return
+		}
+		ok, err := reserveNickname(r.Context(), db, visitorID, name)
+		if err != nil {
+			log.Printf("Error reserving nickname: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Name already reserved", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(NicknameResponse{Tag: name})
+
+	case http.MethodDelete:
+		if _, err := db.ExecContext(r.Context(), `DELETE FROM nicknames WHERE visitor_id = ?`, visitorID); err != nil {
+			log.Printf("Error releasing nickname: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// NPC is a server-driven cursor that moves around like a visitor would.
+// Enable built-in NPCs with NPCS=wanderer,orbiter,mascot. Each NPC joins its
+// site's hub as a bot Client, so it reaches every terminal through the same
+// join, move and init messages as a visitor, without counting as one.
+type NPC interface {
+	// Name labels the cursor and forms its ID
+	Name() string
+	// Step advances the NPC and returns its new position, or nil to stay put
+	Step(now time.Time) *CursorPosition
+}
+
+// Virtual screen NPCs move around in, matching a typical desktop viewport
+const (
+	npcWidth  = 1280
+	npcHeight = 800
+)
+
+// NPC_HZ sets how many times a second NPCs move
+var npcHz = envInt("NPC_HZ", 10)
+
+// NPC constructors by name; each gets the hub it will run on
+var npcFactories = map[string]func(h *Hub) NPC{
+	"wanderer": func(*Hub) NPC { return newWanderer() },
+	"orbiter":  func(*Hub) NPC { return &orbiter{} },
+}
+
+// registerNPC makes an NPC available by name for the NPCS setting
+func registerNPC(name string, factory func(h *Hub) NPC) {
+	npcFactories[name] = factory
+}
+
+// addBot registers a virtual client named name and has it join the hub.
+// Bots get every broadcast like visitors do; nothing reads them, so they are
+// drained and dropped.
+func (h *Hub) addBot(name string) *Client {
+	bot := &Client{
+		ID:          "npc-" + name,
+		Send:        make(chan []byte, 256),
+		hub:         h,
+		bot:         true,
+		connectedAt: time.Now(),
+	}
+	go func() {
+		for range bot.Send {
+		}
+	}()
+	h.admit(bot)
+	return bot
+}
+
+// moveBot moves a bot's cursor and tells everyone else
+func (h *Hub) moveBot(bot *Client, pos *CursorPosition) {
+	h.mutex.Lock()
+	bot.Position = pos
+	h.mutex.Unlock()
+
+	data, _ := json.Marshal(CursorMessage{Type: "move", ID: bot.ID, Position: pos, Bot: true})
+	h.broadcastToOthers(bot.ID, data)
+}
+
+// wanderer drifts towards random targets, pausing now and then
+type wanderer struct {
+	x, y       float64
+	tx, ty     float64
+	pauseUntil time.Time
+}
+
+func newWanderer() *wanderer {
+	return &wanderer{x: npcWidth / 2, y: npcHeight / 2, tx: npcWidth / 2, ty: npcHeight / 2}
+}
+
+func (w *wanderer) Name() string { return "wanderer" }
+
+func (w *wanderer) Step(now time.Time) *CursorPosition {
+	if now.Before(w.pauseUntil) {
+		return nil
+	}
+	dx, dy := w.tx-w.x, w.ty-w.y
+	dist := math.Hypot(dx, dy)
+	if dist < 5 {
+		// Arrived - linger a moment, then pick somewhere new
+		w.pauseUntil = now.Add(time.Duration(500+rand.Intn(2500)) * time.Millisecond)
+		w.tx = rand.Float64() * npcWidth
+		w.ty = rand.Float64() * npcHeight
+		return nil
+	}
+	step := math.Min(dist, 12+rand.Float64()*8)
+	w.x += dx / dist * step
+	w.y += dy / dist * step
+	return &CursorPosition{X: math.Round(w.x), Y: math.Round(w.y)}
+}
+
+// orbiter circles the middle of the screen
+type orbiter struct {
+	angle float64
+}
+
+func (o *orbiter) Name() string { return "orbiter" }
+
+func (o *orbiter) Step(now time.Time) *CursorPosition {
+	o.angle += 0.05
+	return &CursorPosition{
+		X: math.Round(npcWidth/2 + math.Cos(o.angle)*250),
+		Y: math.Round(npcHeight/2 + math.Sin(o.angle)*180),
+	}
+}
+
+// runNPCs adds the NPCs to the hub as bots, then steps them and broadcasts
+// their movement, pausing while there's nobody to perform for
+func (h *Hub) runNPCs(loop string, npcs []NPC) {
+	bots := make([]*Client, len(npcs))
+	for i, npc := range npcs {
+		bots[i] = h.addBot(npc.Name())
+	}
+	active := func() bool { return h.activeUsers() > 0 }
+	newTickLoop(loop, npcHz, active, func(now time.Time, dt time.Duration) {
+		for i, npc := range npcs {
+			pos := npc.Step(now)
+			if pos == nil {
+				continue
+			}
+			pos.Location = strings.ToUpper(npc.Name())
+			h.moveBot(bots[i], pos)
+		}
+	}).run(nil)
+}
+
+// configuredNPCs builds the NPCs named in the NPCS setting for a hub
+func configuredNPCs(h *Hub) []NPC {
+	var npcs []NPC
+	for _, name := range strings.Split(os.Getenv("NPCS"), ",") {
+		name = strings.TrimSpace(name)
+		if factory, ok := npcFactories[name]; ok {
+			npcs = append(npcs, factory(h))
+		}
+	}
+	return npcs
+}
+
+// startNPCs puts the configured NPCs on every site, each site's in its own
+// tick loop
+func startNPCs() {
+	for _, t := range append([]*Tenant{defaultTenant}, tenantList...) {
+		npcs := configuredNPCs(t.hub)
+		if len(npcs) == 0 {
+			continue
+		}
+		loop := "npcs"
+		if t != defaultTenant {
+			loop += "_" + t.Name
+		}
+		go t.hub.runNPCs(loop, npcs)
+	}
+}
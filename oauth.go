@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Admins can also sign in with GitHub instead of sharing ADMIN_TOKEN. Set
+// GITHUB_CLIENT_ID and GITHUB_CLIENT_SECRET for an OAuth app whose callback is
+// <site>/admin/oauth/callback, and list the allowed logins in
+// ADMIN_GITHUB_USERS as login[:role] (admin by default), or in
+// ADMIN_GITHUB_USERS_<NAME> for a tenant. /admin/login starts the flow and
+// leaves a site-wide admin_session cookie that requireRole accepts in place
+// of the bearer token, including on admin routes outside /admin/.
+var (
+	githubClientID     = os.Getenv("GITHUB_CLIENT_ID")
+	githubClientSecret = secret("GITHUB_CLIENT_SECRET")
+
+	githubURL    = "https://github.com"
+	githubAPIURL = "https://api.github.com"
+)
+
+const adminSessionTTL = 12 * time.Hour
+
+func parseGitHubUsers(spec string) map[string]adminRole {
+	users := make(map[string]adminRole)
+	for _, u := range strings.Split(spec, ",") {
+		login, roleName, hasRole := strings.Cut(strings.TrimSpace(u), ":")
+		if login == "" {
+			continue
+		}
+		role := roleAdmin
+		if hasRole {
+			var ok bool
+			if role, ok = parseRole(roleName); !ok {
+				log.Printf("Ignoring GitHub admin %s: unknown role %q", login, roleName)
+				continue
+			}
+		}
+		users[strings.ToLower(login)] = role
+	}
+	return users
+}
+
+// githubLoginEnabled reports whether a site's admins can sign in with GitHub
+func githubLoginEnabled(site *Tenant) bool {
+	return githubClientID != "" && githubClientSecret != "" && len(site.githubUsers) > 0
+}
+
+// isHTTPS reports whether the request reached us (or the proxy) over TLS
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func oauthCallbackURL(r *http.Request) string {
+	scheme := "http"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/admin/oauth/callback"
+}
+
+// adminSessionLogin returns the GitHub login of a valid admin session cookie, or ""
+func adminSessionLogin(site *Tenant, r *http.Request) string {
+	if !githubLoginEnabled(site) {
+		return ""
+	}
+	cookie, err := r.Cookie("admin_session")
+	if err != nil {
+		return ""
+	}
+	var login string
+	err = site.db.QueryRowContext(r.Context(), `SELECT login FROM admin_sessions WHERE token_hash = ? AND expires_at > ?`,
+		hashToken(cookie.Value), time.Now().Unix()).Scan(&login)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error checking admin session: %v", err)
+	}
+	// The allowlist may have shrunk since the session began
+	if site.githubUsers[strings.ToLower(login)] == roleNone {
+		return ""
+	}
+	return login
+}
+
+func handleAdminLogin(w http.ResponseWriter, r *http.Request) {
+	if !githubLoginEnabled(tenantFor(r)) {
+		http.NotFound(w, r)
+		return
+	}
+	state := generateVisitorID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oauth_state",
+		Value:    state,
+		Path:     "/admin/oauth/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	q := url.Values{
+		"client_id":    {githubClientID},
+		"redirect_uri": {oauthCallbackURL(r)},
+		"state":        {state},
+		"allow_signup": {"false"},
+	}
+	http.Redirect(w, r, githubURL+"/login/oauth/authorize?"+q.Encode(), http.StatusFound)
+}
+
+// githubLogin exchanges an OAuth code for the user's GitHub login
+func githubLogin(code, redirectURI string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, githubURL+"/login/oauth/access_token", strings.NewReader(url.Values{
+		"client_id":     {githubClientID},
+		"client_secret": {githubClientSecret},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+	}.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("token exchange failed: %s", token.Error)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, githubAPIURL+"/user", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", "currentcondition.tv")
+	resp, err = upstreamClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("user lookup: %s", resp.Status)
+	}
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return "", err
+	}
+	return user.Login, nil
+}
+
+func handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	site := tenantFor(r)
+	if !githubLoginEnabled(site) {
+		http.NotFound(w, r)
+		return
+	}
+	state, err := r.Cookie("oauth_state")
+	if err != nil || state.Value == "" || state.Value != r.URL.Query().Get("state") {
+		http.Error(w, "Invalid OAuth state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "oauth_state", Path: "/admin/oauth/", MaxAge: -1})
+
+	login, err := githubLogin(r.URL.Query().Get("code"), oauthCallbackURL(r))
+	if err != nil {
+		log.Printf("Error completing GitHub login: %v", err)
+		http.Error(w, "GitHub login failed", http.StatusBadGateway)
+		return
+	}
+	if site.githubUsers[strings.ToLower(login)] == roleNone {
+		log.Printf("GitHub user %s is not an admin of %s", login, site.Name)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	session := generateVisitorID()
+	now := time.Now()
+	if _, err := site.db.ExecContext(r.Context(), `DELETE FROM admin_sessions WHERE expires_at < ?`, now.Unix()); err != nil {
+		log.Printf("Error pruning admin sessions: %v", err)
+	}
+	_, err = site.db.ExecContext(r.Context(), `INSERT INTO admin_sessions (token_hash, login, expires_at) VALUES (?, ?, ?)`,
+		hashToken(session), login, now.Add(adminSessionTTL).Unix())
+	if err != nil {
+		log.Printf("Error saving admin session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "admin_session",
+		Value:    session,
+		Path:     "/",
+		MaxAge:   int(adminSessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+	log.Printf("Admin %s signed in with GitHub", login)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"login": login})
+}
+
+func handleAdminLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie("admin_session"); err == nil {
+		if _, err := tenantFor(r).db.ExecContext(r.Context(), `DELETE FROM admin_sessions WHERE token_hash = ?`, hashToken(cookie.Value)); err != nil {
+			log.Printf("Error ending admin session: %v", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: "admin_session", Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusNoContent)
+}
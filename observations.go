@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Current conditions are stored as observations per ~1km cell (coordKey)
+// whenever a forecast is fetched or a weather station uploads, which builds
+// up the history behind "this day last year".
+
+// Observation is one stored reading of current conditions
+type Observation struct {
+	Time        int64    `json:"time"`
+	Temperature float64  `json:"temperature"`
+	Humidity    *float64 `json:"humidity,omitempty"`
+	WindSpeed   *float64 `json:"windSpeed,omitempty"`
+	WeatherCode *int     `json:"weatherCode,omitempty"`
+	Source      string   `json:"source"`
+}
+
+// recordObservation stores current conditions for the cell containing lat/lng
+// and updates its daily summary and records (see records.go)
+func recordObservation(ctx context.Context, lat, lng float64, obs Observation) error {
+	loc := coordKey(lat, lng)
+	_, err := defaultTenant.db.ExecContext(ctx, `
+		INSERT INTO weather_observations (loc, lat, lng, observed_at, temperature, humidity, wind_speed, weather_code, source)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, loc, roundCoord(lat, 2), roundCoord(lng, 2), obs.Time,
+		obs.Temperature, obs.Humidity, obs.WindSpeed, obs.WeatherCode, obs.Source)
+	if err != nil {
+		return err
+	}
+	broken, err := updateDailyAndRecords(ctx, loc, lat, lng, obs)
+	if err != nil {
+		return err
+	}
+	announceRecords(lat, lng, broken)
+	return nil
+}
+
+// observationFromForecast turns Open-Meteo's current conditions into an observation
+func observationFromForecast(c ForecastCurrent) Observation {
+	humidity, wind, code := c.Humidity, c.WindSpeed, c.WeatherCode
+	return Observation{
+		Time:        time.Now().Unix(),
+		Temperature: c.Temperature,
+		Humidity:    &humidity,
+		WindSpeed:   &wind,
+		WeatherCode: &code,
+		Source:      "model",
+	}
+}
+
+// DaySummary aggregates the observations of one local calendar day
+type DaySummary struct {
+	Year        int     `json:"year"`
+	Date        string  `json:"date"`
+	Samples     int     `json:"samples"`
+	Mean        float64 `json:"mean"`
+	High        float64 `json:"high"`
+	Low         float64 `json:"low"`
+	WeatherCode *int    `json:"weatherCode,omitempty"`
+}
+
+// summarizeDay aggregates the observations for loc on the day starting at start
+func summarizeDay(ctx context.Context, db *sql.DB, loc string, start time.Time) (*DaySummary, error) {
+	end := start.AddDate(0, 0, 1)
+	day := DaySummary{Year: start.Year(), Date: start.Format("2006-01-02")}
+	var mean, high, low sql.NullFloat64
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*), AVG(temperature), MAX(temperature), MIN(temperature)
+		FROM weather_observations
+		WHERE loc = ? AND observed_at >= ? AND observed_at < ?
+	`, loc, start.Unix(), end.Unix()).Scan(&day.Samples, &mean, &high, &low)
+	if err != nil || day.Samples == 0 {
+		return nil, err
+	}
+	day.Mean = math.Round(mean.Float64*10) / 10
+	day.High, day.Low = high.Float64, low.Float64
+
+	// The most common weather code stands for the day
+	var code int
+	err = db.QueryRowContext(ctx, `
+		SELECT weather_code FROM weather_observations
+		WHERE loc = ? AND observed_at >= ? AND observed_at < ? AND weather_code IS NOT NULL
+		GROUP BY weather_code ORDER BY COUNT(*) DESC, weather_code DESC LIMIT 1
+	`, loc, start.Unix(), end.Unix()).Scan(&code)
+	if err == nil {
+		day.WeatherCode = &code
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+	return &day, nil
+}
+
+// sameDayHistory summarizes the same calendar day as now in each earlier year with observations
+func sameDayHistory(ctx context.Context, db *sql.DB, loc string, now time.Time) ([]DaySummary, error) {
+	var first sql.NullInt64
+	if err := db.QueryRowContext(ctx, `SELECT MIN(observed_at) FROM weather_observations WHERE loc = ?`, loc).Scan(&first); err != nil {
+		return nil, err
+	}
+	history := []DaySummary{}
+	if !first.Valid {
+		return history, nil
+	}
+	firstYear := time.Unix(first.Int64, 0).In(now.Location()).Year()
+	for year := now.Year() - 1; year >= firstYear; year-- {
+		// Feb 29 falls back to Feb 28 in other years
+		day := now.Day()
+		if now.Month() == time.February && day == 29 && !isLeapYear(year) {
+			day = 28
+		}
+		start := time.Date(year, now.Month(), day, 0, 0, 0, 0, now.Location())
+		summary, err := summarizeDay(ctx, db, loc, start)
+		if err != nil {
+			return nil, err
+		}
+		if summary != nil {
+			history = append(history, *summary)
+		}
+	}
+	return history, nil
+}
+
+func isLeapYear(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
+
+// forecastLocation returns the forecast's timezone, or UTC if it can't be loaded
+func forecastLocation(f Forecast) *time.Location {
+	if tz, err := time.LoadLocation(f.Timezone); err == nil && f.Timezone != "" {
+		return tz
+	}
+	return time.UTC
+}
+
+// WeatherCompareResponse is today's weather next to the same day in earlier years
+type WeatherCompareResponse struct {
+	Location string          `json:"location"`
+	Date     string          `json:"date"`
+	Current  ForecastCurrent `json:"current"`
+	High     *float64        `json:"high,omitempty"`
+	Low      *float64        `json:"low,omitempty"`
+	History  []DaySummary    `json:"history"`
+}
+
+func handleWeatherCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lat, lng, ok := parseLatLng(r)
+	if !ok {
+		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+		return
+	}
+
+	f, err := getForecast(r.Context(), lat, lng)
+	if err != nil {
+		log.Printf("Error fetching forecast: %v", err)
+		http.Error(w, "Upstream error", http.StatusBadGateway)
+		return
+	}
+
+	now := time.Now().In(forecastLocation(f))
+	resp := WeatherCompareResponse{
+		Location: coordKey(lat, lng),
+		Date:     now.Format("2006-01-02"),
+		Current:  f.Current,
+	}
+	if len(f.Daily.TempMax) > 0 && len(f.Daily.TempMin) > 0 {
+		resp.High, resp.Low = &f.Daily.TempMax[0], &f.Daily.TempMin[0]
+	}
+	resp.History, err = sameDayHistory(r.Context(), readDB, resp.Location, now)
+	if err != nil {
+		log.Printf("Error reading weather history: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 5x7 bitmap font for the status card, one byte per row, high bit on the left
+var font5x7 = map[rune][7]byte{
+	'A': {0x0E, 0x11, 0x11, 0x1F, 0x11, 0x11, 0x11},
+	'B': {0x1E, 0x11, 0x11, 0x1E, 0x11, 0x11, 0x1E},
+	'C': {0x0E, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0E},
+	'D': {0x1E, 0x11, 0x11, 0x11, 0x11, 0x11, 0x1E},
+	'E': {0x1F, 0x10, 0x10, 0x1E, 0x10, 0x10, 0x1F},
+	'F': {0x1F, 0x10, 0x10, 0x1E, 0x10, 0x10, 0x10},
+	'G': {0x0E, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0F},
+	'H': {0x11, 0x11, 0x11, 0x1F, 0x11, 0x11, 0x11},
+	'I': {0x0E, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0E},
+	'J': {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0C},
+	'K': {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	'L': {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1F},
+	'M': {0x11, 0x1B, 0x15, 0x15, 0x11, 0x11, 0x11},
+	'N': {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11},
+	'O': {0x0E, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0E},
+	'P': {0x1E, 0x11, 0x11, 0x1E, 0x10, 0x10, 0x10},
+	'Q': {0x0E, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0D},
+	'R': {0x1E, 0x11, 0x11, 0x1E, 0x14, 0x12, 0x11},
+	'S': {0x0F, 0x10, 0x10, 0x0E, 0x01, 0x01, 0x1E},
+	'T': {0x1F, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04},
+	'U': {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0E},
+	'V': {0x11, 0x11, 0x11, 0x11, 0x11, 0x0A, 0x04},
+	'W': {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0A},
+	'X': {0x11, 0x11, 0x0A, 0x04, 0x0A, 0x11, 0x11},
+	'Y': {0x11, 0x11, 0x0A, 0x04, 0x04, 0x04, 0x04},
+	'Z': {0x1F, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1F},
+	'0': {0x0E, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0E},
+	'1': {0x04, 0x0C, 0x04, 0x04, 0x04, 0x04, 0x0E},
+	'2': {0x0E, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1F},
+	'3': {0x1F, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0E},
+	'4': {0x02, 0x06, 0x0A, 0x12, 0x1F, 0x02, 0x02},
+	'5': {0x1F, 0x10, 0x1E, 0x01, 0x01, 0x11, 0x0E},
+	'6': {0x06, 0x08, 0x10, 0x1E, 0x11, 0x11, 0x0E},
+	'7': {0x1F, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0E, 0x11, 0x11, 0x0E, 0x11, 0x11, 0x0E},
+	'9': {0x0E, 0x11, 0x11, 0x0F, 0x01, 0x02, 0x0C},
+	':': {0x00, 0x0C, 0x0C, 0x00, 0x0C, 0x0C, 0x00},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0C, 0x0C},
+	'-': {0x00, 0x00, 0x00, 0x1F, 0x00, 0x00, 0x00},
+	'/': {0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00},
+	'>': {0x08, 0x04, 0x02, 0x01, 0x02, 0x04, 0x08},
+	'_': {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1F},
+	'!': {0x04, 0x04, 0x04, 0x04, 0x04, 0x00, 0x04},
+}
+
+const (
+	ogWidth  = 1200
+	ogHeight = 630
+)
+
+var (
+	ogPhosphor = color.RGBA{0x33, 0xff, 0x66, 0xff}
+	ogDim      = color.RGBA{0x0c, 0x40, 0x18, 0xff}
+	ogBlack    = color.RGBA{0x02, 0x0a, 0x04, 0xff}
+)
+
+// drawText renders text with the bitmap font at (x, y), scale pixels per dot
+func drawText(img *image.RGBA, x, y, scale int, text string, c color.RGBA) {
+	for _, ch := range strings.ToUpper(text) {
+		glyph, ok := font5x7[ch]
+		if ok {
+			for row := 0; row < 7; row++ {
+				for col := 0; col < 5; col++ {
+					if glyph[row]&(0x10>>col) == 0 {
+						continue
+					}
+					for dy := 0; dy < scale; dy++ {
+						for dx := 0; dx < scale; dx++ {
+							img.SetRGBA(x+col*scale+dx, y+row*scale+dy, c)
+						}
+					}
+				}
+			}
+		}
+		x += 6 * scale
+	}
+}
+
+// renderStatusCard draws the Open Graph card with live stats in CRT style,
+// signed with the site's address
+func renderStatusCard(address string, users, peak, places int) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, ogWidth, ogHeight))
+	for y := 0; y < ogHeight; y++ {
+		for x := 0; x < ogWidth; x++ {
+			img.SetRGBA(x, y, ogBlack)
+		}
+	}
+
+	// Border
+	for x := 40; x < ogWidth-40; x++ {
+		for t := 0; t < 4; t++ {
+			img.SetRGBA(x, 40+t, ogDim)
+			img.SetRGBA(x, ogHeight-44+t, ogDim)
+		}
+	}
+	for y := 40; y < ogHeight-40; y++ {
+		for t := 0; t < 4; t++ {
+			img.SetRGBA(40+t, y, ogDim)
+			img.SetRGBA(ogWidth-44+t, y, ogDim)
+		}
+	}
+
+	drawText(img, 90, 90, 10, "CURRENT CONDITION", ogPhosphor)
+	drawText(img, 90, 200, 6, fmt.Sprintf("> %d ONLINE NOW", users), ogPhosphor)
+	drawText(img, 90, 290, 6, fmt.Sprintf("> RECORD: %d", peak), ogPhosphor)
+	drawText(img, 90, 380, 6, fmt.Sprintf("> %d PLACES ON THE MAP", places), ogPhosphor)
+	drawText(img, 90, 500, 4, strings.TrimPrefix(strings.TrimPrefix(address, "https://"), "http://")+" _", ogDim)
+
+	// Scanlines
+	for y := 0; y < ogHeight; y += 3 {
+		for x := 0; x < ogWidth; x++ {
+			p := img.RGBAAt(x, y)
+			img.SetRGBA(x, y, color.RGBA{p.R / 2, p.G / 2, p.B / 2, 0xff})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Rendering is cheap but not free, so crawlers share a recent card per site
+var ogCards = struct {
+	sync.Mutex
+	cards map[*Tenant]*ogCard
+}{cards: make(map[*Tenant]*ogCard)}
+
+type ogCard struct {
+	png     []byte
+	expires time.Time
+}
+
+// handleStatusImage serves the link preview card at /api/og.png
+func handleStatusImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	site := tenantFor(r)
+	ogCards.Lock()
+	defer ogCards.Unlock()
+	card := ogCards.cards[site]
+	if card == nil {
+		card = &ogCard{}
+		ogCards.cards[site] = card
+	}
+
+	if time.Now().After(card.expires) {
+		var places int
+		if err := site.readDB.QueryRowContext(r.Context(), `SELECT COUNT(*) FROM locations`).Scan(&places); err != nil {
+			log.Printf("Error counting locations: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		hub := site.hub
+		hub.mutex.RLock()
+		users, peak := hub.users(), hub.peak.Users
+		hub.mutex.RUnlock()
+
+		data, err := renderStatusCard(site.url, users, peak, places)
+		if err != nil {
+			log.Printf("Error rendering status image: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		card.png = data
+		card.expires = time.Now().Add(time.Minute)
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.Write(card.png)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The site owner can say what they're up to: whether they're at the keyboard
+// or away, and what's playing. POST /api/owner/status (admin credentials or
+// the LOCATIONS_API_KEY, so a scrobbler script can push tracks) updates the
+// fields it names and leaves the rest alone. The status is kept in the
+// database, sent to every client as an "owner" message when it changes and
+// in init, and readable by anyone at GET /api/owner/status.
+
+// Presence values
+const (
+	ownerAtKeyboard = "at_keyboard"
+	ownerAway       = "away"
+)
+
+const maxNowPlaying = 120
+
+// Updates change some fields and keep the rest, so they go one at a time
+var ownerUpdates sync.Mutex
+
+// OwnerStatus is the site owner's presence and current track
+type OwnerStatus struct {
+	Presence      string `json:"presence,omitempty"`
+	PresenceSince int64  `json:"presenceSince,omitempty"`
+	NowPlaying    string `json:"nowPlaying,omitempty"`
+	UpdatedAt     int64  `json:"updatedAt,omitempty"`
+}
+
+// loadOwnerStatus reads the stored owner status; it's empty if never set
+func loadOwnerStatus(db *sql.DB) (OwnerStatus, error) {
+	var s OwnerStatus
+	err := db.QueryRow(`
+		SELECT presence, presence_since, now_playing, updated_at FROM owner_status WHERE id = 1
+	`).Scan(&s.Presence, &s.PresenceSince, &s.NowPlaying, &s.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return s, nil
+	}
+	return s, err
+}
+
+func saveOwnerStatus(ctx context.Context, db *sql.DB, s OwnerStatus) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO owner_status (id, presence, presence_since, now_playing, updated_at) VALUES (1, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET presence = excluded.presence, presence_since = excluded.presence_since,
+			now_playing = excluded.now_playing, updated_at = excluded.updated_at
+	`, s.Presence, s.PresenceSince, s.NowPlaying, s.UpdatedAt)
+	return err
+}
+
+// ownerStatus returns the hub's copy of the owner status, or nil if it was never set
+func (h *Hub) ownerStatus() *OwnerStatus {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if h.owner.UpdatedAt == 0 {
+		return nil
+	}
+	s := h.owner
+	return &s
+}
+
+// setOwnerStatus stores a new owner status and tells everyone
+func (h *Hub) setOwnerStatus(ctx context.Context, s OwnerStatus) error {
+	if err := saveOwnerStatus(ctx, h.db, s); err != nil {
+		return err
+	}
+	h.mutex.Lock()
+	h.owner = s
+	h.mutex.Unlock()
+
+	data, _ := json.Marshal(CursorMessage{Type: "owner", Owner: &s})
+	h.broadcastToOthers("", data)
+	return nil
+}
+
+// handleOwnerStatus shows the owner status to anyone (GET) and lets the owner
+// change it (POST)
+func handleOwnerStatus(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s := tenantFor(r).hub.ownerStatus()
+		if s == nil {
+			s = &OwnerStatus{}
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case http.MethodPost:
+		requireAPIKeyOr(roleAdmin, handleSetOwnerStatus)(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleSetOwnerStatus(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Presence   *string `json:"presence"`
+		NowPlaying *string `json:"nowPlaying"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	ownerUpdates.Lock()
+	defer ownerUpdates.Unlock()
+	hub := tenantFor(r).hub
+	hub.mutex.RLock()
+	s := hub.owner
+	hub.mutex.RUnlock()
+	now := time.Now().Unix()
+
+	if p := req.Presence; p != nil {
+		if *p != "" && *p != ownerAtKeyboard && *p != ownerAway {
+			http.Error(w, "Invalid presence", http.StatusBadRequest)
+			return
+		}
+		if *p != s.Presence {
+			s.Presence, s.PresenceSince = *p, now
+		}
+		if s.Presence == "" {
+			s.PresenceSince = 0
+		}
+	}
+	if np := req.NowPlaying; np != nil {
+		if utf8.RuneCountInString(*np) > maxNowPlaying {
+			http.Error(w, "Track too long", http.StatusBadRequest)
+			return
+		}
+		s.NowPlaying = cleanTextLine(*np, maxNowPlaying)
+	}
+	s.UpdatedAt = now
+
+	if err := hub.setOwnerStatus(r.Context(), s); err != nil {
+		log.Printf("Error saving owner status: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Text panels for the CRT (weather, stats, highscores, the activity feed) are
+// text/template files: GET /api/panel/<name>.txt renders panels/<name>.tmpl.
+// The built-in panels are embedded in the binary; with PANEL_TEMPLATES set to
+// a directory, templates there replace them and add new panels, and are read
+// on every request so edits show up without a restart. Templates pull the
+// data they need from the methods of panelData, so a new panel only needs a
+// new template.
+
+//go:embed panels/*.tmpl
+var builtinPanelFiles embed.FS
+
+var panelNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// Built-in panels, parsed once
+var builtinPanels struct {
+	once      sync.Once
+	templates map[string]*template.Template
+}
+
+// panelTemplateDir returns the PANEL_TEMPLATES directory, or "" for built-ins only
+func panelTemplateDir() string {
+	return strings.TrimSpace(os.Getenv("PANEL_TEMPLATES"))
+}
+
+// panelFuncs are the helpers available to panel templates. Units, numbers and
+// dates follow the request's format, like the teletype.
+func panelFuncs(format teletypeFormat) template.FuncMap {
+	return template.FuncMap{
+		"upper":   strings.ToUpper,
+		"wrap":    wrapTeletype,
+		"temp":    format.temp,
+		"speed":   format.speed,
+		"number":  format.number,
+		"coords":  format.coords,
+		"stamp":   format.stamp,
+		"compass": compassPoint,
+		"inc":     func(i int) int { return i + 1 },
+		"conditions": func(code int, night bool) string {
+			return weatherGlyphFor(code, night).Label
+		},
+		"date": func(layout string, t time.Time) string {
+			return strings.ToUpper(t.Format(layout))
+		},
+	}
+}
+
+// parsePanel parses a panel template
+func parsePanel(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(panelFuncs(teletypeFormat{})).Parse(text)
+}
+
+// loadPanel returns the template for a panel, preferring PANEL_TEMPLATES, or
+// nil if there's no such panel
+func loadPanel(name string) (*template.Template, error) {
+	if dir := panelTemplateDir(); dir != "" {
+		data, err := os.ReadFile(filepath.Join(dir, name+".tmpl"))
+		if err == nil {
+			return parsePanel(name, string(data))
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	builtinPanels.once.Do(func() {
+		builtinPanels.templates = make(map[string]*template.Template)
+		paths, _ := fs.Glob(builtinPanelFiles, "panels/*.tmpl")
+		for _, path := range paths {
+			data, _ := builtinPanelFiles.ReadFile(path)
+			name := strings.TrimSuffix(filepath.Base(path), ".tmpl")
+			builtinPanels.templates[name] = template.Must(parsePanel(name, string(data)))
+		}
+	})
+	return builtinPanels.templates[name], nil
+}
+
+// panelData is what a panel template renders. Each method loads its data
+// when a template first asks for it.
+type panelData struct {
+	ctx    context.Context
+	site   *Tenant
+	lat    float64
+	lng    float64
+	place  string
+	format teletypeFormat
+
+	// Now is the time the panel is rendered
+	Now time.Time
+
+	weather    *PanelWeather
+	weatherErr error
+}
+
+// PanelWeather is the forecast as seen by panel templates
+type PanelWeather struct {
+	Place   string
+	Lat     float64
+	Lng     float64
+	Time    time.Time
+	Current ForecastCurrent
+	Days    []PanelDay
+}
+
+// PanelDay is one day of the outlook
+type PanelDay struct {
+	Date       time.Time
+	Code       int
+	High       float64
+	Low        float64
+	PrecipProb float64
+}
+
+// PanelStats is the visitor summary as seen by panel templates
+type PanelStats struct {
+	Online int
+	Peak   int
+	PeakAt time.Time
+	Places int
+}
+
+// Weather returns the forecast for the requested spot, or the home base
+func (p *panelData) Weather() (*PanelWeather, error) {
+	if p.weather != nil || p.weatherErr != nil {
+		return p.weather, p.weatherErr
+	}
+	f, err := getForecast(p.ctx, p.lat, p.lng)
+	if err != nil {
+		p.weatherErr = err
+		return nil, err
+	}
+	loc, err := time.LoadLocation(f.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	w := &PanelWeather{Place: p.place, Lat: p.lat, Lng: p.lng, Time: p.Now.In(loc), Current: f.Current}
+	if w.Place == "" {
+		w.Place = p.format.coords(p.lat, p.lng)
+	}
+	d := f.Daily
+	for i := range d.Time {
+		if i >= len(d.WeatherCode) || i >= len(d.TempMax) || i >= len(d.TempMin) {
+			break
+		}
+		date, err := time.Parse("2006-01-02", d.Time[i])
+		if err != nil {
+			continue
+		}
+		day := PanelDay{Date: date, Code: d.WeatherCode[i], High: d.TempMax[i], Low: d.TempMin[i]}
+		if i < len(d.PrecipProb) {
+			day.PrecipProb = d.PrecipProb[i]
+		}
+		w.Days = append(w.Days, day)
+	}
+	p.weather = w
+	return w, nil
+}
+
+// Stats returns who is online, the all-time peak and the number of places
+func (p *panelData) Stats() (PanelStats, error) {
+	hub := p.site.hub
+	hub.mutex.RLock()
+	stats := PanelStats{Online: hub.users(), Peak: hub.peak.Users}
+	if hub.peak.At > 0 {
+		stats.PeakAt = time.Unix(hub.peak.At, 0).UTC()
+	}
+	hub.mutex.RUnlock()
+	err := p.site.readDB.QueryRowContext(p.ctx, `SELECT COUNT(*) FROM locations`).Scan(&stats.Places)
+	return stats, err
+}
+
+// Games lists the games with highscore tables
+func (p *panelData) Games() []string {
+	return []string{"SNAKE", "TETRIS", "ASTEROIDS", "PONG"}
+}
+
+// Highscores returns the top scores of a game
+func (p *panelData) Highscores(game string) ([]Highscore, error) {
+	return cachedHighscores(p.ctx, p.site, strings.ToUpper(game))
+}
+
+// Feed returns the newest n activity feed items
+func (p *panelData) Feed(n int) ([]FeedItem, error) {
+	if n <= 0 || n > 50 {
+		n = 50
+	}
+	return getFeedItems(p.ctx, p.site, n)
+}
+
+func handleGetPanel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/panel/"), ".txt")
+	if !ok || !panelNamePattern.MatchString(name) {
+		http.NotFound(w, r)
+		return
+	}
+	tmpl, err := loadPanel(name)
+	if err != nil {
+		log.Printf("Error loading panel %s: %v", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if tmpl == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	site := tenantFor(r)
+	data := &panelData{ctx: r.Context(), site: site, Now: time.Now()}
+	q := r.URL.Query()
+	home := site.hub.home
+	data.lat, data.lng, data.place = home.Lat, home.Lng, home.Place
+	if q.Get("lat") != "" || q.Get("lng") != "" {
+		data.lat, data.lng, ok = parseLatLng(r)
+		if !ok {
+			http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+			return
+		}
+		data.place = cleanPlace(q.Get("place"))
+	}
+	if data.format, ok = teletypeFormatFor(r); !ok {
+		http.Error(w, "Invalid clock", http.StatusBadRequest)
+		return
+	}
+
+	// Rebind the helpers to this request's units and locale
+	tmpl, err = tmpl.Clone()
+	if err != nil {
+		log.Printf("Error cloning panel %s: %v", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Funcs(panelFuncs(data.format)).Execute(&buf, data); err != nil {
+		if data.weatherErr != nil {
+			log.Printf("Error fetching forecast: %v", data.weatherErr)
+			http.Error(w, "Upstream error", http.StatusBadGateway)
+			return
+		}
+		log.Printf("Error rendering panel %s: %v", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf.Bytes())
+}
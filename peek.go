@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// A client can ask for the weather where another cursor is:
+// {"type":"peek","target":<id>} is answered, to the asker only, with
+// {"type":"peek","target":<id>,"weather":{...}} for the rough area the target
+// has shared (see lightning.go), or "peek_error" with a reason. Only the
+// current conditions go back, never the target's coordinates.
+
+const (
+	peekBurst  = 5
+	peekWindow = 30 * time.Second
+)
+
+// handlePeek answers a peek from c (called from readPump)
+func (c *Client) handlePeek(msg CursorMessage) {
+	h := c.hub
+	if msg.Target == "" || msg.Target == c.ID {
+		return
+	}
+	if !allowBurst(&c.peekTimes, peekBurst, peekWindow) {
+		c.peekReply(CursorMessage{Type: "peek_error", Target: msg.Target, Reason: "rate_limited", RetryAfter: int(peekWindow.Seconds())})
+		return
+	}
+
+	// Clients that haven't shared an area, or have blocked c, look the same
+	var area *Area
+	h.mutex.RLock()
+	if target := h.clients[msg.Target]; target != nil && !h.blocks[msg.Target][c.ID] {
+		area = target.area
+	}
+	h.mutex.RUnlock()
+	if area == nil {
+		c.peekReply(CursorMessage{Type: "peek_error", Target: msg.Target, Reason: "unavailable"})
+		return
+	}
+
+	// The forecast may need a fetch, so don't hold up readPump
+	go func() {
+		f, err := getForecast(context.Background(), area.Lat, area.Lng)
+		if err != nil {
+			log.Printf("Error fetching forecast for peek: %v", err)
+			c.peekReply(CursorMessage{Type: "peek_error", Target: msg.Target, Reason: "weather_unavailable"})
+			return
+		}
+		c.peekReply(CursorMessage{Type: "peek", Target: msg.Target, Weather: &f.Current})
+	}()
+}
+
+// peekReply sends a peek answer to c, if it's still connected
+func (c *Client) peekReply(msg CursorMessage) {
+	c.hub.mutex.Lock()
+	defer c.hub.mutex.Unlock()
+	c.hub.sendTo(c.ID, msg)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Pings are kept in the hub event log, and never pruned from it, so
+// /api/pings can page through the whole history. Pages are keyed by the
+// event's sequence number, which only ever grows: the newest page comes
+// first, ?before=<seq> walks back in time and ?after=<seq> catches up on
+// newer pings, without skipping or repeating any as new ones arrive.
+
+const (
+	defaultPingPage = 50
+	maxPingPage     = 500
+)
+
+// PingHistoryEntry is one ping from the history. The sender's IP stays out of
+// it.
+type PingHistoryEntry struct {
+	Seq       int64   `json:"seq"`
+	Location  string  `json:"location"`
+	Lat       float64 `json:"lat"`
+	Lng       float64 `json:"lng"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// PingHistoryPage is returned by /api/pings
+type PingHistoryPage struct {
+	Pings []PingHistoryEntry `json:"pings"`
+	// Cursors for the neighbouring pages; Before is 0 once the oldest ping is reached
+	Before int64 `json:"before,omitempty"`
+	After  int64 `json:"after,omitempty"`
+}
+
+func handleGetPings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	limit := defaultPingPage
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if n > maxPingPage {
+			n = maxPingPage
+		}
+		limit = n
+	}
+	var before, after int64
+	var err error
+	if s := q.Get("before"); s != "" {
+		if before, err = strconv.ParseInt(s, 10, 64); err != nil || before < 1 {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("after"); s != "" {
+		if after, err = strconv.ParseInt(s, 10, 64); err != nil || after < 0 {
+			http.Error(w, "Invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+	if before > 0 && q.Get("after") != "" {
+		http.Error(w, "Use either before or after", http.StatusBadRequest)
+		return
+	}
+
+	// Newest first, except when reading forward from a cursor
+	query := `SELECT seq, data FROM hub_events WHERE type = 'ping' ORDER BY seq DESC LIMIT ?`
+	args := []interface{}{limit}
+	if before > 0 {
+		query = `SELECT seq, data FROM hub_events WHERE type = 'ping' AND seq < ? ORDER BY seq DESC LIMIT ?`
+		args = []interface{}{before, limit}
+	} else if q.Get("after") != "" {
+		query = `SELECT seq, data FROM hub_events WHERE type = 'ping' AND seq > ? ORDER BY seq LIMIT ?`
+		args = []interface{}{after, limit}
+	}
+	rows, err := tenantFor(r).readDB.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		log.Printf("Error getting ping history: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// Track the seqs scanned, not just the pings decoded, so a bad row
+	// can't end the history early
+	page := PingHistoryPage{Pings: []PingHistoryEntry{}}
+	var scanned int
+	var oldest, newest int64
+	for rows.Next() {
+		var seq int64
+		var data string
+		if err := rows.Scan(&seq, &data); err != nil {
+			log.Printf("Error reading ping history: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		scanned++
+		if oldest == 0 || seq < oldest {
+			oldest = seq
+		}
+		if seq > newest {
+			newest = seq
+		}
+		var msg CursorMessage
+		if json.Unmarshal([]byte(data), &msg) != nil || msg.Ping == nil {
+			continue
+		}
+		page.Pings = append(page.Pings, PingHistoryEntry{
+			Seq:       seq,
+			Location:  msg.Ping.Location,
+			Lat:       msg.Ping.Lat,
+			Lng:       msg.Ping.Lng,
+			Timestamp: msg.Ping.Timestamp,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading ping history: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Reading forward, there are always older pings behind the page; reading
+	// back, only a full page may have more
+	forward := q.Get("after") != ""
+	if scanned > 0 {
+		page.After = newest
+		if forward || scanned == limit {
+			page.Before = oldest
+		}
+	} else if forward {
+		page.After = after
+	}
+
+	// A page is identified by the range of pings in it, so an unchanged page is a 304
+	msgpack := wantsMsgpack(w, r)
+	etag := fmt.Sprintf(`"pings-%d-%d-%d"`, oldest, newest, scanned)
+	if msgpack {
+		etag = fmt.Sprintf(`"pings-%d-%d-%d-msgpack"`, oldest, newest, scanned)
+	}
+	w.Header().Set("ETag", etag)
+	if before > 0 && scanned == limit {
+		// A full page of older pings never changes
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if msgpack {
+		if err := writeMsgpack(w, page); err != nil {
+			log.Printf("Error writing ping history: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Cursors can say roughly where they're from: join messages (and the cursor
+// list in init) carry a city-level "place" label for the visitor's stored
+// location. The label comes from a reverse geocoder (PLACE_LOOKUP_URL, e.g.
+// Nominatim), looked up once per rounded spot and kept in the places table,
+// so coordinates are never sent to other clients. Visitors can opt out with
+// POST /api/place {"share":false}; it applies from their next connection.
+
+const maxPlaceLength = 40
+
+// placeLookupURL returns the reverse geocoder endpoint, or "" if labels are off
+func placeLookupURL() string {
+	return strings.TrimSpace(os.Getenv("PLACE_LOOKUP_URL"))
+}
+
+// Spots being looked up, so a busy spot is only fetched once
+var placeLookups = struct {
+	sync.Mutex
+	pending map[string]bool
+}{pending: make(map[string]bool)}
+
+// loadCursorPlace returns the place label to show for a visitor's cursor, or
+// "" if they have no location, opted out, or the spot isn't known yet. An
+// unknown spot is looked up in the background for next time.
+func loadCursorPlace(ctx context.Context, db *sql.DB, visitorID string) string {
+	if visitorID == "" || placeLookupURL() == "" {
+		return ""
+	}
+	var lat, lng sql.NullFloat64
+	var name sql.NullString
+	var hidden bool
+	err := db.QueryRowContext(ctx, `
+		SELECT v.lat_rounded, v.lng_rounded, p.name, COALESCE(vp.hide_place, 0)
+		FROM visitors v
+		LEFT JOIN places p ON p.lat_rounded = v.lat_rounded AND p.lng_rounded = v.lng_rounded
+		LEFT JOIN visitor_prefs vp ON vp.visitor_id = v.visitor_id
+		WHERE v.visitor_id = ?
+	`, visitorID).Scan(&lat, &lng, &name, &hidden)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error loading cursor place: %v", err)
+		}
+		return ""
+	}
+	if hidden || !lat.Valid || !lng.Valid {
+		return ""
+	}
+	if !name.Valid {
+		go lookupPlace(ctx, db, lat.Float64, lng.Float64)
+	}
+	return name.String
+}
+
+// lookupPlace reverse geocodes a rounded spot and stores its label; spots
+// without a city are stored as "" so they aren't asked about again
+func lookupPlace(ctx context.Context, db *sql.DB, lat, lng float64) {
+	key := coordKey(lat, lng)
+	placeLookups.Lock()
+	if placeLookups.pending[key] {
+		placeLookups.Unlock()
+		return
+	}
+	placeLookups.pending[key] = true
+	placeLookups.Unlock()
+	defer func() {
+		placeLookups.Lock()
+		delete(placeLookups.pending, key)
+		placeLookups.Unlock()
+	}()
+
+	name, err := reverseGeocode(lat, lng)
+	if err != nil {
+		log.Printf("Error looking up place for %s: %v", key, err)
+		return
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO places (lat_rounded, lng_rounded, name) VALUES (?, ?, ?)
+		ON CONFLICT(lat_rounded, lng_rounded) DO UPDATE SET name = excluded.name, updated_at = CURRENT_TIMESTAMP
+	`, roundCoord(lat, 2), roundCoord(lng, 2), name)
+	if err != nil {
+		log.Printf("Error saving place: %v", err)
+	}
+}
+
+// reverseGeocode asks the geocoder for the city at a spot, Nominatim style
+func reverseGeocode(lat, lng float64) (string, error) {
+	base := placeLookupURL()
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+	var resp struct {
+		Address struct {
+			City         string `json:"city"`
+			Town         string `json:"town"`
+			Village      string `json:"village"`
+			Municipality string `json:"municipality"`
+		} `json:"address"`
+	}
+	err := fetchJSON(fmt.Sprintf("%s%sformat=jsonv2&zoom=10&lat=%.2f&lon=%.2f", base, sep, lat, lng), &resp)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range []string{resp.Address.City, resp.Address.Town, resp.Address.Village, resp.Address.Municipality} {
+		if name = cleanPlace(name); name != "" {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// cleanPlace drops control characters and shortens a label for display
+func cleanPlace(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	runes := []rune(strings.TrimSpace(name))
+	if len(runes) > maxPlaceLength {
+		runes = runes[:maxPlaceLength]
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+// PlaceResponse describes the current visitor's cursor label
+type PlaceResponse struct {
+	Place string `json:"place,omitempty"`
+	Share bool   `json:"share"`
+}
+
+func handlePlace(w http.ResponseWriter, r *http.Request) {
+	visitorID := visitorIDFromRequest(w, r)
+	site := tenantFor(r)
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Share bool `json:"share"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		_, err := site.db.ExecContext(r.Context(), `
+			INSERT INTO visitor_prefs (visitor_id, hide_place, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT(visitor_id) DO UPDATE SET hide_place = excluded.hide_place, updated_at = excluded.updated_at
+		`, visitorID, !req.Share)
+		if err != nil {
+			log.Printf("Error saving place preference: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var hidden bool
+	err := site.db.QueryRowContext(r.Context(), `SELECT hide_place FROM visitor_prefs WHERE visitor_id = ?`, visitorID).Scan(&hidden)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error loading place preference: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	resp := PlaceResponse{Share: !hidden}
+	if resp.Share {
+		resp.Place = loadCursorPlace(r.Context(), site.db, visitorID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
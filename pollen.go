@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// PollenUVResponse is returned by /api/weather/pollen
+type PollenUVResponse struct {
+	UVIndex     float64            `json:"uvIndex"`
+	UVMax       float64            `json:"uvMax"`
+	UVLevel     string             `json:"uvLevel"`
+	Pollen      map[string]float64 `json:"pollen,omitempty"`
+	PollenLevel string             `json:"pollenLevel,omitempty"`
+}
+
+var pollenCache = newTTLCache[PollenUVResponse](30 * time.Minute)
+
+// Pollen types reported by the Open-Meteo air quality API (Europe only)
+var pollenTypes = []string{"alder", "birch", "grass", "mugwort", "olive", "ragweed"}
+
+// uvLevel buckets a UV index using the WHO scale
+func uvLevel(uv float64) string {
+	switch {
+	case uv < 3:
+		return "LOW"
+	case uv < 6:
+		return "MODERATE"
+	case uv < 8:
+		return "HIGH"
+	case uv < 11:
+		return "VERY HIGH"
+	default:
+		return "EXTREME"
+	}
+}
+
+// pollenLevel buckets a pollen count in grains/m³
+func pollenLevel(count float64) string {
+	switch {
+	case count < 10:
+		return "LOW"
+	case count < 50:
+		return "MODERATE"
+	case count < 200:
+		return "HIGH"
+	default:
+		return "VERY HIGH"
+	}
+}
+
+func fetchPollenUV(lat, lng float64) (PollenUVResponse, error) {
+	var result PollenUVResponse
+
+	var forecast struct {
+		Current struct {
+			UVIndex float64 `json:"uv_index"`
+		} `json:"current"`
+		Daily struct {
+			UVIndexMax []float64 `json:"uv_index_max"`
+		} `json:"daily"`
+	}
+	err := fetchJSON(fmt.Sprintf(
+		"https://api.open-meteo.com/v1/forecast?latitude=%.4f&longitude=%.4f&current=uv_index&daily=uv_index_max&forecast_days=1&timezone=auto",
+		lat, lng), &forecast)
+	if err != nil {
+		return result, err
+	}
+	result.UVIndex = forecast.Current.UVIndex
+	if len(forecast.Daily.UVIndexMax) > 0 {
+		result.UVMax = forecast.Daily.UVIndexMax[0]
+	}
+	result.UVLevel = uvLevel(math.Max(result.UVIndex, result.UVMax))
+
+	var air struct {
+		Current map[string]*float64 `json:"current"`
+	}
+	err = fetchJSON(fmt.Sprintf(
+		"https://air-quality-api.open-meteo.com/v1/air-quality?latitude=%.4f&longitude=%.4f&current=alder_pollen,birch_pollen,grass_pollen,mugwort_pollen,olive_pollen,ragweed_pollen",
+		lat, lng), &air)
+	if err != nil {
+		// Pollen is a bonus - UV alone is still worth returning
+		log.Printf("Error fetching pollen: %v", err)
+		return result, nil
+	}
+
+	// Outside Europe the pollen values come back null
+	highest := -1.0
+	for _, name := range pollenTypes {
+		if v := air.Current[name+"_pollen"]; v != nil {
+			if result.Pollen == nil {
+				result.Pollen = make(map[string]float64)
+			}
+			result.Pollen[name] = *v
+			highest = math.Max(highest, *v)
+		}
+	}
+	if highest >= 0 {
+		result.PollenLevel = pollenLevel(highest)
+	}
+	return result, nil
+}
+
+func handleGetPollen(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lat, lng, ok := parseLatLng(r)
+	if !ok {
+		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+		return
+	}
+
+	result, err := pollenCache.get(coordKey(lat, lng), func() (PollenUVResponse, error) {
+		return fetchPollenUV(lat, lng)
+	})
+	if err != nil {
+		log.Printf("Error fetching UV index: %v", err)
+		http.Error(w, "Upstream error", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// PresenceResponse is a snapshot of who is connected, for consumers that don't
+// hold a websocket open
+type PresenceResponse struct {
+	Users     int            `json:"users"`
+	Waiting   int            `json:"waiting"`
+	Zones     map[string]int `json:"zones"`
+	Countries map[string]int `json:"countries"`
+}
+
+// presence counts connected clients by zone and by country (from the CDN's
+// CF-IPCountry header; "unknown" when it wasn't sent)
+func (h *Hub) presence() PresenceResponse {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	p := PresenceResponse{
+		Users:     h.users(),
+		Waiting:   len(h.waiting),
+		Zones:     make(map[string]int),
+		Countries: make(map[string]int),
+	}
+	for _, c := range h.clients {
+		if c.bot {
+			continue
+		}
+		if c.Position != nil && c.Position.Zone != "" {
+			p.Zones[c.Position.Zone]++
+		}
+		country := c.country
+		if country == "" {
+			country = "unknown"
+		}
+		p.Countries[country]++
+	}
+	return p
+}
+
+func handleGetPresence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(tenantFor(r).hub.presence())
+}
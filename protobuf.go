@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// The Connect API (connect.go) also speaks the protobuf binary codec. Its
+// messages are small and flat, so they're written and read here by hand, the
+// way msgpack.go does MessagePack, rather than from generated code. Zero
+// values are left out, as proto3 does.
+
+// protoMessage is a response that can write itself in the wire format
+type protoMessage interface {
+	marshalProto(p *protoWriter)
+}
+
+// Wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+type protoWriter struct {
+	buf []byte
+}
+
+func marshalProto(m protoMessage) []byte {
+	var p protoWriter
+	m.marshalProto(&p)
+	return p.buf
+}
+
+func (p *protoWriter) tag(num, wireType int) {
+	p.buf = binary.AppendUvarint(p.buf, uint64(num)<<3|uint64(wireType))
+}
+
+// varint writes an int32, int64 or bool field
+func (p *protoWriter) varint(num int, v int64) {
+	if v == 0 {
+		return
+	}
+	p.tag(num, protoVarint)
+	p.buf = binary.AppendUvarint(p.buf, uint64(v))
+}
+
+func (p *protoWriter) double(num int, v float64) {
+	if v == 0 {
+		return
+	}
+	p.tag(num, protoFixed64)
+	p.buf = binary.LittleEndian.AppendUint64(p.buf, math.Float64bits(v))
+}
+
+func (p *protoWriter) bytes(num int, b []byte) {
+	p.tag(num, protoBytes)
+	p.buf = binary.AppendUvarint(p.buf, uint64(len(b)))
+	p.buf = append(p.buf, b...)
+}
+
+func (p *protoWriter) str(num int, s string) {
+	if s != "" {
+		p.bytes(num, []byte(s))
+	}
+}
+
+// message writes a nested message, which is always present
+func (p *protoWriter) message(num int, m protoMessage) {
+	p.bytes(num, marshalProto(m))
+}
+
+// timestamp writes a google.protobuf.Timestamp, unless t is zero
+func (p *protoWriter) timestamp(num int, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	var ts protoWriter
+	ts.varint(1, t.Unix())
+	ts.varint(2, int64(t.Nanosecond()))
+	p.bytes(num, ts.buf)
+}
+
+// protoValue is a decoded field: varints and fixed values in n, length-
+// delimited values in b
+type protoValue struct {
+	n uint64
+	b []byte
+}
+
+// protoFields holds the last value of each field of a message, as proto3
+// does for repeated scalars it doesn't expect
+type protoFields map[int]protoValue
+
+var errProtoMalformed = errors.New("malformed protobuf message")
+
+func parseProto(b []byte) (protoFields, error) {
+	fields := make(protoFields)
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errProtoMalformed
+		}
+		b = b[n:]
+		num := int(key >> 3)
+		var v protoValue
+		switch key & 7 {
+		case protoVarint:
+			if v.n, n = binary.Uvarint(b); n <= 0 {
+				return nil, errProtoMalformed
+			}
+			b = b[n:]
+		case protoFixed64:
+			if len(b) < 8 {
+				return nil, errProtoMalformed
+			}
+			v.n, b = binary.LittleEndian.Uint64(b), b[8:]
+		case protoFixed32:
+			if len(b) < 4 {
+				return nil, errProtoMalformed
+			}
+			v.n, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case protoBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return nil, errProtoMalformed
+			}
+			v.b, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return nil, errProtoMalformed
+		}
+		if num == 0 {
+			return nil, errProtoMalformed
+		}
+		fields[num] = v
+	}
+	return fields, nil
+}
+
+// timestamp reads a google.protobuf.Timestamp field, or nil if it's unset
+func (f protoFields) timestamp(num int) (*time.Time, error) {
+	v, ok := f[num]
+	if !ok {
+		return nil, nil
+	}
+	ts, err := parseProto(v.b)
+	if err != nil {
+		return nil, err
+	}
+	t := time.Unix(int64(ts[1].n), int64(int32(ts[2].n)))
+	return &t, nil
+}
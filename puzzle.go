@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The daily puzzle is a five-letter word to find in six guesses, the same for
+// everyone on a UTC day. The answer is picked from puzzleWords by an HMAC of
+// the date keyed with PUZZLE_SEED, so it can't be worked out from the source;
+// without one a random seed is made on first start and kept in the database.
+// Each guess comes back marked letter by letter; every visitor's guesses are
+// kept so a reload picks up where they left off, and finished games feed the
+// shared guess distribution. The first solve of the day is announced to
+// everyone on the terminal.
+
+const (
+	puzzleLength      = 5
+	puzzleMaxAttempts = 6
+)
+
+// Letter marks, as in the usual game
+const (
+	markCorrect = "correct"
+	markPresent = "present"
+	markAbsent  = "absent"
+)
+
+// Puzzle #1 was this day
+var puzzleEpoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Answers to draw from; guesses can be any five letters
+var puzzleWords = []string{
+	"STORM", "CLOUD", "FROST", "SLEET", "SUNNY", "RAINY", "WINDY", "FOGGY",
+	"HUMID", "MISTY", "GUSTY", "CHILL", "FLOOD", "SNOWY", "ICING", "THAWS",
+	"SOLAR", "LUNAR", "ORBIT", "PRISM", "OZONE", "POLAR", "TIDAL", "DELTA",
+	"FRONT", "SPRAY", "SWELL", "WAVES", "VAPOR", "CRISP", "BALMY", "MUGGY",
+	"DUSTY", "SMOKE", "HAILS", "DRIFT", "BLAZE", "FLARE", "GLEAM", "GLOOM",
+	"HEAVY", "STEAM", "ALOFT", "RADAR", "GAUGE", "COAST", "OCEAN", "RIVER",
+	"NORTH", "SOUTH", "WHIRL", "TWIST", "CREST", "CLEAR", "NIGHT", "LIGHT",
+	"SPARK", "AMBER", "PIXEL", "MODEM", "RETRO", "GLOWS", "GHOST", "TUBES",
+	"VOLTS", "RELAY", "MORSE", "NOISE", "GAMMA", "ALPHA", "SIGMA", "DUNES",
+}
+
+// Puzzle key, loaded at startup by loadPuzzleSeed
+var puzzleSeed []byte
+
+// loadPuzzleSeed returns PUZZLE_SEED or, if it's unset, the seed stored in
+// the database, making one the first time. Instances sharing the database
+// agree on it because only the first insert sticks.
+func loadPuzzleSeed(db *sql.DB) ([]byte, error) {
+	if seed := secret("PUZZLE_SEED"); seed != "" {
+		return []byte(seed), nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("INSERT OR IGNORE INTO puzzle_seed (id, seed) VALUES (1, ?)", hex.EncodeToString(b)); err != nil {
+		return nil, err
+	}
+	var seed string
+	if err := db.QueryRow("SELECT seed FROM puzzle_seed WHERE id = 1").Scan(&seed); err != nil {
+		return nil, err
+	}
+	registerSecret(seed)
+	return []byte(seed), nil
+}
+
+// PuzzleGuess is a guess and how each of its letters scored
+type PuzzleGuess struct {
+	Guess string   `json:"guess"`
+	Marks []string `json:"marks"`
+}
+
+// PuzzleState is a visitor's game for the day
+type PuzzleState struct {
+	Date        string        `json:"date"`
+	Number      int           `json:"number"`
+	Length      int           `json:"length"`
+	MaxAttempts int           `json:"maxAttempts"`
+	ResetsAt    int64         `json:"resetsAt"`
+	Guesses     []PuzzleGuess `json:"guesses"`
+	Solved      bool          `json:"solved"`
+	Done        bool          `json:"done"`
+	Answer      string        `json:"answer,omitempty"`
+	First       bool          `json:"first,omitempty"`
+}
+
+// PuzzleStats is the shared guess distribution for a day. Distribution[i]
+// counts the players who solved it in i+1 guesses.
+type PuzzleStats struct {
+	Date         string `json:"date"`
+	Number       int    `json:"number"`
+	Players      int    `json:"players"`
+	Solved       int    `json:"solved"`
+	Failed       int    `json:"failed"`
+	Distribution []int  `json:"distribution"`
+}
+
+// PuzzleSolve announces the first solve of the day
+type PuzzleSolve struct {
+	Date     string `json:"date"`
+	Number   int    `json:"number"`
+	Attempts int    `json:"attempts"`
+	Name     string `json:"name,omitempty"`
+}
+
+// puzzleNumber counts puzzles from puzzleEpoch
+func puzzleNumber(day string) int {
+	d, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return 0
+	}
+	return int(d.Sub(puzzleEpoch).Hours()/24) + 1
+}
+
+// puzzleAnswer returns the word for a day
+func puzzleAnswer(day string) string {
+	mac := hmac.New(sha256.New, puzzleSeed)
+	mac.Write([]byte("puzzle/" + day))
+	n := binary.BigEndian.Uint64(mac.Sum(nil))
+	return puzzleWords[n%uint64(len(puzzleWords))]
+}
+
+// normalizeGuess uppercases a guess, or returns "" if it isn't five letters
+func normalizeGuess(s string) string {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if len(s) != puzzleLength {
+		return ""
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < 'A' || s[i] > 'Z' {
+			return ""
+		}
+	}
+	return s
+}
+
+// scoreGuess marks each letter of a guess. A repeated letter is only marked
+// present as many times as the answer has it left over after exact matches.
+func scoreGuess(guess, answer string) []string {
+	marks := make([]string, len(guess))
+	var left [26]int
+	for i := range guess {
+		if guess[i] == answer[i] {
+			marks[i] = markCorrect
+		} else {
+			left[answer[i]-'A']++
+		}
+	}
+	for i := range guess {
+		if marks[i] != "" {
+			continue
+		}
+		if c := guess[i] - 'A'; left[c] > 0 {
+			left[c]--
+			marks[i] = markPresent
+		} else {
+			marks[i] = markAbsent
+		}
+	}
+	return marks
+}
+
+// newPuzzleState returns an empty game for a day
+func newPuzzleState(day string) PuzzleState {
+	midnight, _ := time.Parse("2006-01-02", day)
+	return PuzzleState{
+		Date:        day,
+		Number:      puzzleNumber(day),
+		Length:      puzzleLength,
+		MaxAttempts: puzzleMaxAttempts,
+		ResetsAt:    midnight.Add(24 * time.Hour).Unix(),
+		Guesses:     []PuzzleGuess{},
+	}
+}
+
+// loadPuzzleState replays a visitor's guesses for a day
+func loadPuzzleState(ctx context.Context, db *sql.DB, day, visitorID string) (PuzzleState, error) {
+	state := newPuzzleState(day)
+	rows, err := db.QueryContext(ctx, `
+		SELECT guess FROM puzzle_guesses
+		WHERE day = ? AND visitor_id = ?
+		ORDER BY attempt
+	`, day, visitorID)
+	if err != nil {
+		return state, err
+	}
+	defer rows.Close()
+
+	answer := puzzleAnswer(day)
+	for rows.Next() {
+		var guess string
+		if err := rows.Scan(&guess); err != nil {
+			return state, err
+		}
+		state.Guesses = append(state.Guesses, PuzzleGuess{Guess: guess, Marks: scoreGuess(guess, answer)})
+		if guess == answer {
+			state.Solved = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return state, err
+	}
+	state.Done = state.Solved || len(state.Guesses) >= puzzleMaxAttempts
+	if state.Done {
+		state.Answer = answer
+	}
+	return state, nil
+}
+
+// savePuzzleGuess records a visitor's next guess, and their result once the
+// game is over. It returns the attempt number, 0 if the visitor's game is
+// already finished, and whether this was the first solve of the day.
+func savePuzzleGuess(ctx context.Context, db *sql.DB, day, visitorID, guess string) (int, bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	// Writing first holds the write lock, so two guesses can't take the same attempt
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO puzzle_guesses (day, visitor_id, attempt, guess)
+		SELECT ?, ?, (SELECT COUNT(*) + 1 FROM puzzle_guesses WHERE day = ? AND visitor_id = ?), ?
+		WHERE NOT EXISTS (SELECT 1 FROM puzzle_results WHERE day = ? AND visitor_id = ?)
+	`, day, visitorID, day, visitorID, guess, day, visitorID)
+	if err != nil {
+		return 0, false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, false, nil
+	}
+	var attempt int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM puzzle_guesses WHERE day = ? AND visitor_id = ?`, day, visitorID).Scan(&attempt)
+	if err != nil {
+		return 0, false, err
+	}
+
+	solved := guess == puzzleAnswer(day)
+	first := false
+	if solved || attempt >= puzzleMaxAttempts {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO puzzle_results (day, visitor_id, attempts, solved) VALUES (?, ?, ?, ?)
+		`, day, visitorID, attempt, solved)
+		if err != nil {
+			return 0, false, err
+		}
+		if solved {
+			var solves int
+			err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM puzzle_results WHERE day = ? AND solved = 1`, day).Scan(&solves)
+			if err != nil {
+				return 0, false, err
+			}
+			first = solves == 1
+		}
+	}
+	return attempt, first, tx.Commit()
+}
+
+// getPuzzleStats returns the guess distribution for a day
+func getPuzzleStats(ctx context.Context, db *sql.DB, day string) (PuzzleStats, error) {
+	stats := PuzzleStats{Date: day, Number: puzzleNumber(day), Distribution: make([]int, puzzleMaxAttempts)}
+	rows, err := db.QueryContext(ctx, `
+		SELECT attempts, solved, COUNT(*) FROM puzzle_results
+		WHERE day = ?
+		GROUP BY attempts, solved
+	`, day)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var attempts, count int
+		var solved bool
+		if err := rows.Scan(&attempts, &solved, &count); err != nil {
+			return stats, err
+		}
+		stats.Players += count
+		if !solved {
+			stats.Failed += count
+			continue
+		}
+		stats.Solved += count
+		if attempts >= 1 && attempts <= puzzleMaxAttempts {
+			stats.Distribution[attempts-1] += count
+		}
+	}
+	return stats, rows.Err()
+}
+
+// announcePuzzleSolve tells everyone on the terminal about the day's first solve
+func (h *Hub) announcePuzzleSolve(solve PuzzleSolve) {
+	data, _ := json.Marshal(CursorMessage{Type: "puzzle_solved", Puzzle: &solve})
+	h.broadcastToOthers("", data)
+	h.logEvent("puzzle_solved", "", data)
+}
+
+func handlePuzzleToday(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	visitorID := visitorIDFromRequest(w, r)
+	state, err := loadPuzzleState(r.Context(), tenantFor(r).db, challengeDay(time.Now()), visitorID)
+	if err != nil {
+		log.Printf("Error loading puzzle: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// handlePuzzleGuess takes a guess at today's word and returns the visitor's game
+func handlePuzzleGuess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Guess string `json:"guess"`
+		Date  string `json:"date"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	guess := normalizeGuess(req.Guess)
+	if guess == "" {
+		http.Error(w, "Invalid guess", http.StatusBadRequest)
+		return
+	}
+	// A game started before midnight doesn't carry over into the new day
+	day := challengeDay(time.Now())
+	if req.Date != "" && req.Date != day {
+		http.Error(w, "Puzzle expired", http.StatusConflict)
+		return
+	}
+
+	site := tenantFor(r)
+	visitorID := visitorIDFromRequest(w, r)
+	attempt, first, err := savePuzzleGuess(r.Context(), site.db, day, visitorID, guess)
+	if err != nil {
+		log.Printf("Error saving puzzle guess: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if attempt == 0 {
+		http.Error(w, "Puzzle finished", http.StatusConflict)
+		return
+	}
+	state, err := loadPuzzleState(r.Context(), site.db, day, visitorID)
+	if err != nil {
+		log.Printf("Error loading puzzle: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if first {
+		state.First = true
+		name, err := getVisitorNickname(r.Context(), site.db, visitorID)
+		if err != nil {
+			log.Printf("Error getting nickname: %v", err)
+		}
+		go site.hub.announcePuzzleSolve(PuzzleSolve{Date: day, Number: state.Number, Attempts: attempt, Name: name})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+func handlePuzzleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	day := r.URL.Query().Get("date")
+	if day == "" {
+		day = challengeDay(time.Now())
+	} else if _, err := time.Parse("2006-01-02", day); err != nil {
+		http.Error(w, "Invalid date", http.StatusBadRequest)
+		return
+	}
+
+	stats, err := getPuzzleStats(r.Context(), tenantFor(r).readDB, day)
+	if err != nil {
+		log.Printf("Error getting puzzle stats: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if wantsCSV(w, r) {
+		writeCSVMetrics(w, "puzzle.csv", stats)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=30")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
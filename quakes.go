@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Earthquake is a simplified USGS feed entry for plotting on the globe
+type Earthquake struct {
+	ID    string  `json:"id"`
+	Lat   float64 `json:"lat"`
+	Lng   float64 `json:"lng"`
+	Depth float64 `json:"depth"`
+	Mag   float64 `json:"mag"`
+	Place string  `json:"place"`
+	Time  int64   `json:"time"`
+	URL   string  `json:"url"`
+}
+
+var quakeCache = newTTLCache[[]Earthquake](5 * time.Minute)
+
+// USGS summary feeds by period
+var quakeFeeds = map[string]string{
+	"hour": "https://earthquake.usgs.gov/earthquakes/feed/v1.0/summary/all_hour.geojson",
+	"day":  "https://earthquake.usgs.gov/earthquakes/feed/v1.0/summary/2.5_day.geojson",
+	"week": "https://earthquake.usgs.gov/earthquakes/feed/v1.0/summary/4.5_week.geojson",
+}
+
+func fetchEarthquakes(period string) ([]Earthquake, error) {
+	var feed struct {
+		Features []struct {
+			ID         string `json:"id"`
+			Properties struct {
+				Mag   *float64 `json:"mag"`
+				Place string   `json:"place"`
+				Time  int64    `json:"time"`
+				URL   string   `json:"url"`
+			} `json:"properties"`
+			Geometry struct {
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := fetchJSON(quakeFeeds[period], &feed); err != nil {
+		return nil, err
+	}
+
+	quakes := make([]Earthquake, 0, len(feed.Features))
+	for _, f := range feed.Features {
+		if f.Properties.Mag == nil || len(f.Geometry.Coordinates) < 3 {
+			continue
+		}
+		quakes = append(quakes, Earthquake{
+			ID:    f.ID,
+			Lng:   f.Geometry.Coordinates[0],
+			Lat:   f.Geometry.Coordinates[1],
+			Depth: f.Geometry.Coordinates[2],
+			Mag:   *f.Properties.Mag,
+			Place: f.Properties.Place,
+			Time:  f.Properties.Time / 1000,
+			URL:   f.Properties.URL,
+		})
+	}
+	return quakes, nil
+}
+
+func getEarthquakes(period string) ([]Earthquake, error) {
+	return quakeCache.get(period, func() ([]Earthquake, error) {
+		return fetchEarthquakes(period)
+	})
+}
+
+// handleGetEarthquakes lists recent quakes from the USGS feed for ?range=
+// (hour, day or week) of at least ?minMag=
+func handleGetEarthquakes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	period := r.URL.Query().Get("range")
+	if period == "" {
+		period = "day"
+	}
+	if quakeFeeds[period] == "" {
+		http.Error(w, "Invalid range", http.StatusBadRequest)
+		return
+	}
+	minMag, _ := strconv.ParseFloat(r.URL.Query().Get("minMag"), 64)
+
+	quakes, err := getEarthquakes(period)
+	if err != nil {
+		log.Printf("Error fetching earthquakes: %v", err)
+		http.Error(w, "Upstream error", http.StatusBadGateway)
+		return
+	}
+
+	filtered := make([]Earthquake, 0, len(quakes))
+	for _, q := range quakes {
+		if q.Mag >= minMag {
+			filtered = append(filtered, q)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(filtered)
+}
+
+// runQuakeAlerts broadcasts new earthquakes at or above minMag to everyone on the site.
+// Only the leader instance polls.
+func runQuakeAlerts(minMag float64) {
+	seen := make(map[string]bool)
+	first := true
+	for {
+		if !jobLeader.isLeader() {
+			// Catch up silently if we take over later
+			first = true
+			time.Sleep(time.Minute)
+			continue
+		}
+		quakes, err := getEarthquakes("day")
+		if err != nil {
+			log.Printf("Error fetching earthquakes: %v", err)
+		}
+		for _, q := range quakes {
+			if seen[q.ID] || q.Mag < minMag {
+				continue
+			}
+			seen[q.ID] = true
+			// Don't replay the whole day's feed on startup
+			if first {
+				continue
+			}
+			quake := q
+			data, _ := json.Marshal(CursorMessage{Type: "quake", Quake: &quake})
+			hub.broadcastToOthers("", data)
+			hub.logEvent("quake", "", data)
+			log.Printf("Earthquake alert: M%.1f %s", q.Mag, q.Place)
+		}
+		first = false
+		time.Sleep(5 * time.Minute)
+	}
+}
+
+// quakeAlertMag returns the EARTHQUAKE_ALERT_MAG setting, or 0 when alerts are off
+func quakeAlertMag() float64 {
+	mag, _ := strconv.ParseFloat(os.Getenv("EARTHQUAKE_ALERT_MAG"), 64)
+	return mag
+}
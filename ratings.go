@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// Each finished match between two visitors updates their Elo rating for the
+// game. New players start at 1200 and move faster for their first few games.
+const (
+	initialRating    = 1200
+	ratingK          = 32
+	provisionalK     = 48
+	provisionalGames = 10
+	rankingsLimit    = 20
+)
+
+// eloExpected is the chance a player rated a beats one rated b
+func eloExpected(a, b float64) float64 {
+	return 1 / (1 + math.Pow(10, (b-a)/400))
+}
+
+// loadRating returns a visitor's rating and games played, defaulting for new players
+func loadRating(ctx context.Context, tx *sql.Tx, visitorID, game string) (float64, int, error) {
+	var rating float64
+	var games int
+	err := tx.QueryRowContext(ctx, `SELECT rating, games FROM ratings WHERE visitor_id = ? AND game = ?`, visitorID, game).Scan(&rating, &games)
+	if err == sql.ErrNoRows {
+		return initialRating, 0, nil
+	}
+	return rating, games, err
+}
+
+func saveRating(ctx context.Context, tx *sql.Tx, visitorID, game string, rating float64, won bool) error {
+	win, loss := 0, 1
+	if won {
+		win, loss = 1, 0
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO ratings (visitor_id, game, rating, games, wins, losses, updated_at)
+		VALUES (?, ?, ?, 1, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(visitor_id, game) DO UPDATE SET
+			rating = excluded.rating, games = games + 1, wins = wins + excluded.wins,
+			losses = losses + excluded.losses, updated_at = excluded.updated_at
+	`, visitorID, game, rating, win, loss)
+	return err
+}
+
+// updateRatings applies a match result to both players' ratings
+func updateRatings(ctx context.Context, tx *sql.Tx, m MatchResult) error {
+	if m.Winner == "" || m.Loser == "" {
+		return nil
+	}
+	winner, winnerGames, err := loadRating(ctx, tx, m.Winner, m.Game)
+	if err != nil {
+		return err
+	}
+	loser, loserGames, err := loadRating(ctx, tx, m.Loser, m.Game)
+	if err != nil {
+		return err
+	}
+	k := func(games int) float64 {
+		if games < provisionalGames {
+			return provisionalK
+		}
+		return ratingK
+	}
+	expected := eloExpected(winner, loser)
+	if err := saveRating(ctx, tx, m.Winner, m.Game, winner+k(winnerGames)*(1-expected), true); err != nil {
+		return err
+	}
+	return saveRating(ctx, tx, m.Loser, m.Game, loser-k(loserGames)*(1-expected), false)
+}
+
+// RankingEntry is a player on a game's ladder
+type RankingEntry struct {
+	Rank   int    `json:"rank"`
+	Name   string `json:"name"`
+	Rating int    `json:"rating"`
+	Games  int    `json:"games"`
+	Wins   int    `json:"wins"`
+	Losses int    `json:"losses"`
+}
+
+// getRankings lists the best rated players with a nickname
+func getRankings(ctx context.Context, db *sql.DB, game string, limit int) ([]RankingEntry, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT visitor_id, rating, games, wins, losses FROM ratings
+		WHERE game = ?
+		ORDER BY rating DESC
+	`, game)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []RankingEntry{}
+	for rows.Next() && len(entries) < limit {
+		var visitorID string
+		var rating float64
+		var e RankingEntry
+		if err := rows.Scan(&visitorID, &rating, &e.Games, &e.Wins, &e.Losses); err != nil {
+			return nil, err
+		}
+		// Only players who reserved a name are listed; visitor IDs stay private
+		if e.Name, err = getVisitorNickname(ctx, db, visitorID); err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(e.Name) == "" {
+			continue
+		}
+		e.Rank = len(entries) + 1
+		e.Rating = int(math.Round(rating))
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func handleGetRankings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Every game has a ladder; those without battles yet (see battle.go) have
+	// no matches to rate, so theirs is empty
+	game := strings.ToUpper(r.URL.Query().Get("game"))
+	validGames := map[string]bool{"SNAKE": true, "TETRIS": true, "ASTEROIDS": true, "PONG": true}
+	if !validGames[game] {
+		http.Error(w, "Invalid game", http.StatusBadRequest)
+		return
+	}
+	entries, err := getRankings(r.Context(), tenantFor(r).readDB, game, rankingsLimit)
+	if err != nil {
+		log.Printf("Error getting rankings: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
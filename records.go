@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Each observation also updates its cell's daily min/max/mean (with heating
+// and cooling degree days) and its all-time record high and low. The weather
+// is the same whichever site asked for it, so, like the observations, these
+// live in the default site's database. Breaking a record is announced to the
+// clients near the cell on every site, once the cell has enough history for
+// a record to mean something.
+
+// Degree days are counted against this base temperature (°C)
+const degreeDayBase = 18.0
+
+// Days of history a cell needs before its broken records are broadcast
+const minRecordHistoryDays = 30
+
+// How close a client's shared area must be to hear of a broken record
+const recordNearbyKm = 50.0
+
+// WeatherDay is the daily summary of a cell
+type WeatherDay struct {
+	Date        string  `json:"date"`
+	Min         float64 `json:"min"`
+	Max         float64 `json:"max"`
+	Mean        float64 `json:"mean"`
+	Samples     int     `json:"samples"`
+	HeatingDays float64 `json:"heatingDegreeDays"`
+	CoolingDays float64 `json:"coolingDegreeDays"`
+}
+
+// WeatherRecord is a record high or low for a cell
+type WeatherRecord struct {
+	Location string   `json:"location"`
+	Kind     string   `json:"kind"`
+	Value    float64  `json:"value"`
+	Previous *float64 `json:"previous,omitempty"`
+	Time     int64    `json:"time"`
+}
+
+// observationDate approximates the local calendar day of an observation from
+// its longitude (15° per hour), since cells don't carry a timezone
+func observationDate(lng float64, observedAt int64) string {
+	offset := time.Duration(math.Round(lng/15)) * time.Hour
+	return time.Unix(observedAt, 0).UTC().Add(offset).Format("2006-01-02")
+}
+
+// degreeDays returns heating and cooling degree days for a daily mean
+func degreeDays(mean float64) (heating, cooling float64) {
+	return math.Max(0, degreeDayBase-mean), math.Max(0, mean-degreeDayBase)
+}
+
+// updateDailyAndRecords folds an observation into its cell's daily summary and
+// records, returning any records it broke
+func updateDailyAndRecords(ctx context.Context, loc string, lat, lng float64, obs Observation) ([]WeatherRecord, error) {
+	tx, err := defaultTenant.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	t := obs.Temperature
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO weather_daily (loc, date, lat, lng, min_temp, max_temp, mean_temp, samples)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 1)
+		ON CONFLICT(loc, date) DO UPDATE SET
+			min_temp = MIN(min_temp, excluded.min_temp),
+			max_temp = MAX(max_temp, excluded.max_temp),
+			mean_temp = (mean_temp * samples + excluded.mean_temp) / (samples + 1),
+			samples = samples + 1
+	`, loc, observationDate(lng, obs.Time), roundCoord(lat, 2), roundCoord(lng, 2), t, t, t)
+	if err != nil {
+		return nil, err
+	}
+
+	var high, low sql.NullFloat64
+	var highAt, lowAt sql.NullInt64
+	err = tx.QueryRowContext(ctx, `SELECT high, high_at, low, low_at FROM weather_records WHERE loc = ?`, loc).Scan(&high, &highAt, &low, &lowAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	// A record creeping up through the day is only announced the first time
+	today := observationDate(lng, obs.Time)
+	setEarlier := func(at sql.NullInt64) bool {
+		return at.Valid && observationDate(lng, at.Int64) != today
+	}
+
+	var broken []WeatherRecord
+	if !high.Valid || t > high.Float64 {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO weather_records (loc, high, high_at) VALUES (?, ?, ?)
+			ON CONFLICT(loc) DO UPDATE SET high = excluded.high, high_at = excluded.high_at
+		`, loc, t, obs.Time); err != nil {
+			return nil, err
+		}
+		if setEarlier(highAt) {
+			previous := high.Float64
+			broken = append(broken, WeatherRecord{Location: loc, Kind: "high", Value: t, Previous: &previous, Time: obs.Time})
+		}
+	}
+	if !low.Valid || t < low.Float64 {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO weather_records (loc, low, low_at) VALUES (?, ?, ?)
+			ON CONFLICT(loc) DO UPDATE SET low = excluded.low, low_at = excluded.low_at
+		`, loc, t, obs.Time); err != nil {
+			return nil, err
+		}
+		if setEarlier(lowAt) {
+			previous := low.Float64
+			broken = append(broken, WeatherRecord{Location: loc, Kind: "low", Value: t, Previous: &previous, Time: obs.Time})
+		}
+	}
+
+	// A record over a few days of history isn't worth announcing
+	if len(broken) > 0 {
+		var days int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM weather_daily WHERE loc = ?`, loc).Scan(&days); err != nil {
+			return nil, err
+		}
+		if days < minRecordHistoryDays {
+			broken = nil
+		}
+	}
+	return broken, tx.Commit()
+}
+
+// announceRecords sends records broken at lat/lng to the clients near it on
+// every site, and logs them on the sites that had someone there
+func announceRecords(lat, lng float64, records []WeatherRecord) {
+	for i := range records {
+		rec := records[i]
+		data, _ := json.Marshal(CursorMessage{Type: "weather_record", WeatherRecord: &rec})
+		for _, h := range allHubs() {
+			if h.sendNearby(lat, lng, recordNearbyKm, data) > 0 {
+				h.logEvent("weather_record", "", data)
+			}
+		}
+		log.Printf("Weather record at %s: %s %.1f", rec.Location, rec.Kind, rec.Value)
+	}
+}
+
+// sendNearby sends a message to the clients whose shared area is within km
+// of lat/lng, returning how many it reached
+func (h *Hub) sendNearby(lat, lng, km float64, data []byte) int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	sent := 0
+	for _, c := range h.clients {
+		if c.area != nil && haversineKm(c.area.Lat, c.area.Lng, lat, lng) <= km && c.trySend(data) {
+			sent++
+		}
+	}
+	return sent
+}
+
+// WeatherRecordsResponse holds a cell's records and recent daily summaries
+type WeatherRecordsResponse struct {
+	Location    string         `json:"location"`
+	High        *WeatherRecord `json:"high,omitempty"`
+	Low         *WeatherRecord `json:"low,omitempty"`
+	Days        []WeatherDay   `json:"days"`
+	HeatingDays float64        `json:"heatingDegreeDays"`
+	CoolingDays float64        `json:"coolingDegreeDays"`
+}
+
+func getWeatherRecords(ctx context.Context, db *sql.DB, loc string, days int) (WeatherRecordsResponse, error) {
+	resp := WeatherRecordsResponse{Location: loc, Days: []WeatherDay{}}
+
+	var high, low sql.NullFloat64
+	var highAt, lowAt sql.NullInt64
+	err := db.QueryRowContext(ctx, `SELECT high, high_at, low, low_at FROM weather_records WHERE loc = ?`, loc).Scan(&high, &highAt, &low, &lowAt)
+	if err != nil && err != sql.ErrNoRows {
+		return resp, err
+	}
+	if high.Valid {
+		resp.High = &WeatherRecord{Location: loc, Kind: "high", Value: high.Float64, Time: highAt.Int64}
+	}
+	if low.Valid {
+		resp.Low = &WeatherRecord{Location: loc, Kind: "low", Value: low.Float64, Time: lowAt.Int64}
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT date, min_temp, max_temp, mean_temp, samples
+		FROM weather_daily WHERE loc = ?
+		ORDER BY date DESC LIMIT ?
+	`, loc, days)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d WeatherDay
+		if err := rows.Scan(&d.Date, &d.Min, &d.Max, &d.Mean, &d.Samples); err != nil {
+			return resp, err
+		}
+		d.Mean = math.Round(d.Mean*10) / 10
+		d.HeatingDays, d.CoolingDays = degreeDays(d.Mean)
+		resp.HeatingDays += d.HeatingDays
+		resp.CoolingDays += d.CoolingDays
+		resp.Days = append(resp.Days, d)
+	}
+	resp.HeatingDays = math.Round(resp.HeatingDays*10) / 10
+	resp.CoolingDays = math.Round(resp.CoolingDays*10) / 10
+	return resp, rows.Err()
+}
+
+func handleGetWeatherRecords(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lat, lng, ok := parseLatLng(r)
+	if !ok {
+		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+		return
+	}
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+	if days > 366 {
+		days = 366
+	}
+
+	resp, err := getWeatherRecords(r.Context(), defaultTenant.readDB, coordKey(lat, lng), days)
+	if err != nil {
+		log.Printf("Error reading weather records: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
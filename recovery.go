@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+)
+
+// Panics in handlers and websocket pumps are recovered, logged with the
+// request or client they happened in, and counted for /api/stats.
+
+var panicCounts struct {
+	http      atomic.Int64
+	websocket atomic.Int64
+}
+
+// PanicStats counts recovered panics by where they happened
+type PanicStats struct {
+	HTTP      int64 `json:"http"`
+	WebSocket int64 `json:"websocket"`
+}
+
+func panicStats() PanicStats {
+	return PanicStats{HTTP: panicCounts.http.Load(), WebSocket: panicCounts.websocket.Load()}
+}
+
+// logPanic logs a recovered panic as key=value fields followed by the stack
+func logPanic(rec interface{}, fields ...string) {
+	log.Printf("panic=%q %s\n%s", fmt.Sprint(rec), strings.Join(fields, " "), debug.Stack())
+}
+
+// panicWriter notes whether a response has been started, so a 500 is only
+// written when the handler hadn't written anything yet
+type panicWriter struct {
+	statusWriter
+	wrote bool
+}
+
+func (w *panicWriter) WriteHeader(status int) {
+	w.wrote = true
+	w.statusWriter.WriteHeader(status)
+}
+
+func (w *panicWriter) Write(p []byte) (int, error) {
+	w.wrote = true
+	return w.statusWriter.Write(p)
+}
+
+// recoverPanics turns a handler panic into a logged 500 instead of a dropped connection
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pw := &panicWriter{statusWriter: statusWriter{ResponseWriter: w, status: http.StatusOK}}
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			// The server's own way of aborting a response; let it through
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			panicCounts.http.Add(1)
+			logPanic(rec,
+				"method="+r.Method,
+				fmt.Sprintf("path=%q", r.URL.Path),
+				"host="+r.Host,
+				"ip="+clientIP(r),
+			)
+			// Nothing can be sent on a hijacked or half-written response
+			if pw.wrote || pw.status == http.StatusSwitchingProtocols {
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal"})
+		}()
+		next.ServeHTTP(pw, r)
+	})
+}
+
+// recoverPump recovers a panic in one of a client's pumps so the deferred
+// cleanup still unregisters and closes it. It must be deferred directly.
+func (c *Client) recoverPump(pump string) {
+	rec := recover()
+	if rec == nil {
+		return
+	}
+	panicCounts.websocket.Add(1)
+	logPanic(rec, "pump="+pump, "client="+c.ID, "ip="+c.IP, "visitor="+c.visitorID)
+	if pump == "read" {
+		c.disconnectReason = "panic"
+	}
+}
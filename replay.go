@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ReplayMeta opens a replay stream and tells the client how to pace it
+type ReplayMeta struct {
+	Count    int     `json:"count"`
+	Start    int64   `json:"start"`
+	End      int64   `json:"end"`
+	Speed    float64 `json:"speed"`
+	Duration int64   `json:"durationMs"`
+}
+
+// ReplayEvent is one location appearing on the map during a replay
+type ReplayEvent struct {
+	Lat      float64 `json:"lat"`
+	Lng      float64 `json:"lng"`
+	Time     int64   `json:"t"`
+	OffsetMs int64   `json:"offsetMs"`
+}
+
+// Default replay length when neither speed nor duration is given
+const defaultReplayDuration = 60 * time.Second
+
+// handleLocationReplay streams locations in the order they first appeared, as server-sent events
+func handleLocationReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// MIN/MAX lose the column type, so the driver hands back plain strings
+	var meta ReplayMeta
+	var first, last sql.NullString
+	site := tenantFor(r)
+	err := site.readDB.QueryRowContext(r.Context(), `SELECT COUNT(*), MIN(created_at), MAX(created_at) FROM locations`).Scan(&meta.Count, &first, &last)
+	if err != nil {
+		log.Printf("Error getting replay range: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	start := parseImportTime(first.String)
+	end := parseImportTime(last.String)
+	span := end.Sub(start)
+	if meta.Count > 0 {
+		meta.Start = start.Unix()
+		meta.End = end.Unix()
+	}
+
+	// Playback speed is a multiplier on real time; duration picks one to fit
+	q := r.URL.Query()
+	if speed, err := strconv.ParseFloat(q.Get("speed"), 64); err == nil && speed > 0 {
+		meta.Speed = speed
+	} else {
+		duration := defaultReplayDuration
+		if secs, err := strconv.ParseFloat(q.Get("duration"), 64); err == nil && secs > 0 {
+			duration = time.Duration(secs * float64(time.Second))
+		}
+		meta.Speed = 1
+		if span > 0 {
+			meta.Speed = float64(span) / float64(duration)
+		}
+	}
+	meta.Duration = int64(float64(span.Milliseconds()) / meta.Speed)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	writeSSE(w, "meta", meta)
+	flusher.Flush()
+
+	rows, err := site.readDB.QueryContext(r.Context(), `SELECT lat, lng, created_at FROM locations ORDER BY created_at, id`)
+	if err != nil {
+		log.Printf("Error getting replay locations: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	sent := 0
+	for rows.Next() {
+		var ev ReplayEvent
+		var created time.Time
+		if err := rows.Scan(&ev.Lat, &ev.Lng, &created); err != nil {
+			log.Printf("Error reading replay location: %v", err)
+			return
+		}
+		ev.Time = created.Unix()
+		ev.OffsetMs = int64(float64(created.Sub(start).Milliseconds()) / meta.Speed)
+		writeSSE(w, "location", ev)
+
+		// Flush in batches to keep the stream moving without a syscall per row
+		sent++
+		if sent%100 == 0 {
+			flusher.Flush()
+		}
+	}
+	writeSSE(w, "done", map[string]int{"count": sent})
+	flusher.Flush()
+}
+
+// writeSSE writes one server-sent event with a JSON payload
+func writeSSE(w http.ResponseWriter, event string, v interface{}) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
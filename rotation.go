@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Content rotation keeps kiosk displays showing the same thing: an hourly
+// schedule says which panel the terminal highlights from which minute, e.g.
+// ROTATION_SCHEDULE="00=weather,15=map,30=highscores". Each hub checks the
+// schedule on the minute and sends a "rotate" message to everyone when the
+// panel changes, and new clients get the current one in init. The schedule
+// can be replaced at runtime with POST /admin/rotation; like maintenance
+// mode, that lasts until the next restart. Minutes are UTC, so every
+// instance switches at the same moment.
+
+// RotationSlot shows a panel from a minute past every hour
+type RotationSlot struct {
+	Minute int    `json:"minute"`
+	Panel  string `json:"panel"`
+}
+
+// Rotation is the panel being highlighted now and the one coming up
+type Rotation struct {
+	Panel  string `json:"panel"`
+	Since  int64  `json:"since"`
+	Next   string `json:"next"`
+	NextAt int64  `json:"nextAt"`
+}
+
+// rotationState is a hub's schedule and what it last announced
+type rotationState struct {
+	slots   []RotationSlot
+	current Rotation
+}
+
+// RotationResponse is returned by /admin/rotation
+type RotationResponse struct {
+	Slots   []RotationSlot `json:"slots"`
+	Current *Rotation      `json:"current,omitempty"`
+}
+
+// tenantRotationSchedule reads ROTATION_SCHEDULE, or its per-tenant override
+func tenantRotationSchedule(tenant string) []RotationSlot {
+	for _, name := range []string{tenantEnvName(tenant, "ROTATION_SCHEDULE"), "ROTATION_SCHEDULE"} {
+		spec := strings.TrimSpace(envString(name, ""))
+		if spec == "" {
+			continue
+		}
+		slots, err := parseRotationSchedule(spec)
+		if err != nil {
+			log.Printf("Invalid %s, ignoring it: %v", name, err)
+			return nil
+		}
+		return slots
+	}
+	return nil
+}
+
+// parseRotationSchedule parses "minute=panel" pairs separated by commas
+func parseRotationSchedule(spec string) ([]RotationSlot, error) {
+	var slots []RotationSlot
+	for _, entry := range strings.Split(spec, ",") {
+		minute, panel, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not minute=panel", entry)
+		}
+		m, err := strconv.Atoi(strings.TrimSpace(minute))
+		if err != nil {
+			return nil, fmt.Errorf("invalid minute %q", minute)
+		}
+		slots = append(slots, RotationSlot{Minute: m, Panel: strings.TrimSpace(panel)})
+	}
+	return checkRotationSlots(slots)
+}
+
+// checkRotationSlots validates a schedule and sorts it by minute
+func checkRotationSlots(slots []RotationSlot) ([]RotationSlot, error) {
+	seen := make(map[int]bool)
+	for _, s := range slots {
+		if s.Minute < 0 || s.Minute > 59 {
+			return nil, fmt.Errorf("minute %d out of range", s.Minute)
+		}
+		if !panelNamePattern.MatchString(s.Panel) {
+			return nil, fmt.Errorf("invalid panel %q", s.Panel)
+		}
+		if seen[s.Minute] {
+			return nil, fmt.Errorf("minute %d is scheduled twice", s.Minute)
+		}
+		seen[s.Minute] = true
+	}
+	sorted := append([]RotationSlot(nil), slots...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Minute < sorted[j].Minute })
+	return sorted, nil
+}
+
+// rotationAt works out which panel a schedule shows at t, wrapping around
+// the hour; ok is false for an empty schedule
+func rotationAt(slots []RotationSlot, t time.Time) (Rotation, bool) {
+	if len(slots) == 0 {
+		return Rotation{}, false
+	}
+	hour := t.UTC().Truncate(time.Hour)
+	// Before the first slot of the hour, the last one of the previous hour is on
+	i := len(slots) - 1
+	start := hour.Add(-time.Hour)
+	for j, s := range slots {
+		if t.Minute() >= s.Minute {
+			i, start = j, hour
+		}
+	}
+	current, next := slots[i], slots[(i+1)%len(slots)]
+	nextAt := start.Add(time.Duration(next.Minute) * time.Minute)
+	if i+1 >= len(slots) {
+		nextAt = nextAt.Add(time.Hour)
+	}
+	return Rotation{
+		Panel:  current.Panel,
+		Since:  start.Add(time.Duration(current.Minute) * time.Minute).Unix(),
+		Next:   next.Panel,
+		NextAt: nextAt.Unix(),
+	}, true
+}
+
+// currentRotation returns the rotation last announced, or nil when there's no schedule
+func (h *Hub) currentRotation() *Rotation {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if len(h.rotation.slots) == 0 {
+		return nil
+	}
+	r := h.rotation.current
+	return &r
+}
+
+// checkRotation announces the scheduled panel if it changed. A schedule
+// that was emptied is announced once as a "rotate" without a panel.
+func (h *Hub) checkRotation(now time.Time) {
+	h.mutex.Lock()
+	r, ok := rotationAt(h.rotation.slots, now)
+	if r == h.rotation.current {
+		h.mutex.Unlock()
+		return
+	}
+	h.rotation.current = r
+	h.mutex.Unlock()
+
+	msg := CursorMessage{Type: "rotate"}
+	if ok {
+		msg.Rotate = &r
+	}
+	data, _ := json.Marshal(msg)
+	h.broadcastToOthers("", data)
+}
+
+// runRotation checks the schedule at the start of every minute
+func (h *Hub) runRotation() {
+	h.checkRotation(time.Now())
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+		h.checkRotation(time.Now())
+	}
+}
+
+// handleRotation shows (GET) or replaces (POST {"slots":[...]}) the schedule;
+// an empty list turns rotation off
+func handleRotation(w http.ResponseWriter, r *http.Request) {
+	hub := tenantFor(r).hub
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Slots []RotationSlot `json:"slots"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		slots, err := checkRotationSlots(req.Slots)
+		if err != nil {
+			http.Error(w, "Invalid schedule: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		hub.mutex.Lock()
+		hub.rotation.slots = slots
+		hub.mutex.Unlock()
+		hub.checkRotation(time.Now())
+		log.Printf("Rotation schedule: %d slots", len(slots))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hub.mutex.RLock()
+	resp := RotationResponse{Slots: append([]RotationSlot{}, hub.rotation.slots...)}
+	hub.mutex.RUnlock()
+	resp.Current = hub.currentRotation()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
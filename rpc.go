@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// JSON-RPC 2.0 over the cursor websocket, for clients that want request/response
+// semantics instead of fire-and-forget messages
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// Standard JSON-RPC error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+)
+
+// errInvalidParams marks handler errors that should be reported as bad params
+var errInvalidParams = errors.New("invalid params")
+
+// rpcMethod handles one JSON-RPC method for a client
+type rpcMethod func(c *Client, params json.RawMessage) (interface{}, error)
+
+var rpcMethods = map[string]rpcMethod{
+	"ping": func(c *Client, params json.RawMessage) (interface{}, error) {
+		return "pong", nil
+	},
+	"stats": func(c *Client, params json.RawMessage) (interface{}, error) {
+		c.hub.mutex.RLock()
+		defer c.hub.mutex.RUnlock()
+		return StatsResponse{CurrentUsers: len(c.hub.clients), Peak: c.hub.peak}, nil
+	},
+	"zones": func(c *Client, params json.RawMessage) (interface{}, error) {
+		return c.hub.countZones(), nil
+	},
+	"highscores": func(c *Client, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Game string `json:"game"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, errInvalidParams
+		}
+		game := strings.ToUpper(p.Game)
+		validGames := map[string]bool{"SNAKE": true, "TETRIS": true, "ASTEROIDS": true, "PONG": true}
+		if !validGames[game] {
+			return nil, errInvalidParams
+		}
+		return getHighscores(context.Background(), c.hub.db, game)
+	},
+	"glyph": func(c *Client, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Code  int  `json:"code"`
+			Night bool `json:"night"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, errInvalidParams
+		}
+		return weatherGlyphFor(p.Code, p.Night), nil
+	},
+}
+
+// isRPC reports whether a raw websocket message is a JSON-RPC request
+func isRPC(message []byte) bool {
+	var probe struct {
+		JSONRPC string `json:"jsonrpc"`
+	}
+	return json.Unmarshal(message, &probe) == nil && probe.JSONRPC == "2.0"
+}
+
+// handleRPC runs a JSON-RPC request and queues the response for the client
+func (c *Client) handleRPC(message []byte) {
+	var req rpcRequest
+	resp := rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null")}
+
+	if err := json.Unmarshal(message, &req); err != nil {
+		resp.Error = &rpcError{Code: rpcParseError, Message: "parse error"}
+	} else if req.Method == "" {
+		resp.ID = req.ID
+		resp.Error = &rpcError{Code: rpcInvalidRequest, Message: "invalid request"}
+	} else {
+		// Notifications (no id) run but get no reply
+		if len(req.ID) == 0 {
+			if method, ok := rpcMethods[req.Method]; ok {
+				method(c, req.Params)
+			}
+			return
+		}
+		resp.ID = req.ID
+
+		method, ok := rpcMethods[req.Method]
+		if !ok {
+			resp.Error = &rpcError{Code: rpcMethodNotFound, Message: "method not found"}
+		} else if result, err := method(c, req.Params); errors.Is(err, errInvalidParams) {
+			resp.Error = &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		} else if err != nil {
+			resp.Error = &rpcError{Code: rpcInternalError, Message: "internal error"}
+		} else {
+			resp.Result = result
+		}
+	}
+
+	data, _ := json.Marshal(resp)
+	c.trySend(data)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Satellite pass predictions from CelesTrak TLEs, propagated with SGP4 (see
+// sgp4.go). A pass is visible when the satellite is sunlit while the observer
+// is in darkness, i.e. the sun is more than sunDarkElevation below the horizon.
+
+const (
+	earthRadius      = 6378.137 // km, WGS84 equatorial
+	earthFlat        = 1 / 298.257223563
+	issCatalog       = 25544
+	sunDarkElevation = -6 // degrees, civil twilight
+)
+
+// Elements are the orbital elements parsed from a two-line element set
+type Elements struct {
+	Name         string
+	Epoch        time.Time
+	Inclination  float64 // rad
+	RAAN         float64 // rad
+	Eccentricity float64
+	ArgPerigee   float64 // rad
+	MeanAnomaly  float64 // rad
+	MeanMotion   float64 // rad/min
+	BStar        float64 // drag term, 1/Earth radii
+
+	orbit *sgp4
+}
+
+// SatellitePass is one pass of a satellite over an observer
+type SatellitePass struct {
+	Rise         int64   `json:"rise"`
+	Peak         int64   `json:"peak"`
+	Set          int64   `json:"set"`
+	MaxElevation float64 `json:"maxElevation"`
+	RiseAzimuth  float64 `json:"riseAzimuth"`
+	SetAzimuth   float64 `json:"setAzimuth"`
+	Visible      bool    `json:"visible"`
+}
+
+// SatellitePosition is the point on Earth a satellite is directly above
+type SatellitePosition struct {
+	Name     string  `json:"name"`
+	Lat      float64 `json:"lat"`
+	Lng      float64 `json:"lng"`
+	Altitude float64 `json:"altitude"`
+	Time     int64   `json:"time"`
+}
+
+var tleCache = newTTLCache[Elements](6 * time.Hour)
+
+// parseTLE parses a three-line (name + two lines) element set
+func parseTLE(text string) (Elements, error) {
+	var el Elements
+	lines := strings.Split(strings.TrimSpace(strings.ReplaceAll(text, "\r", "")), "\n")
+	if len(lines) < 3 || !strings.HasPrefix(lines[1], "1 ") || !strings.HasPrefix(lines[2], "2 ") || len(lines[1]) < 61 || len(lines[2]) < 63 {
+		return el, fmt.Errorf("malformed TLE")
+	}
+	el.Name = strings.TrimSpace(lines[0])
+	l1, l2 := lines[1], lines[2]
+
+	field := func(line string, from, to int) float64 {
+		v, _ := strconv.ParseFloat(strings.TrimSpace(line[from:to]), 64)
+		return v
+	}
+	deg := math.Pi / 180
+
+	// Epoch is YYDDD.DDDDDDDD
+	year := int(field(l1, 18, 20))
+	if year < 57 {
+		year += 2000
+	} else {
+		year += 1900
+	}
+	day := field(l1, 20, 32)
+	el.Epoch = time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration((day - 1) * 24 * float64(time.Hour)))
+
+	el.Inclination = field(l2, 8, 16) * deg
+	el.RAAN = field(l2, 17, 25) * deg
+	el.Eccentricity, _ = strconv.ParseFloat("0."+strings.TrimSpace(l2[26:33]), 64)
+	el.ArgPerigee = field(l2, 34, 42) * deg
+	el.MeanAnomaly = field(l2, 43, 51) * deg
+	el.MeanMotion = field(l2, 52, 63) * 2 * math.Pi / 1440
+	if el.MeanMotion <= 0 {
+		return el, fmt.Errorf("malformed TLE mean motion")
+	}
+
+	// B* is written with an implied decimal point, e.g. " 28098-4" is 0.28098e-4
+	m := strings.TrimSpace(l1[53:59])
+	mantissa, _ := strconv.ParseFloat("0."+strings.TrimLeft(m, "+-"), 64)
+	if strings.HasPrefix(m, "-") {
+		mantissa = -mantissa
+	}
+	exponent, _ := strconv.Atoi(strings.TrimSpace(l1[59:61]))
+	el.BStar = mantissa * math.Pow10(exponent)
+
+	// Deep-space elements still parse (and cache), but can't be propagated
+	el.orbit, _ = newSGP4(el.Eccentricity, el.Inclination, el.RAAN, el.ArgPerigee, el.MeanAnomaly, el.MeanMotion, el.BStar)
+	return el, nil
+}
+
+func fetchTLE(catalog int) (Elements, error) {
+	return tleCache.get(strconv.Itoa(catalog), func() (Elements, error) {
+		resp, err := upstreamClient.Get(fmt.Sprintf("https://celestrak.org/NORAD/elements/gp.php?CATNR=%d&FORMAT=tle", catalog))
+		if err != nil {
+			return Elements{}, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return Elements{}, fmt.Errorf("celestrak: %s", resp.Status)
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if err != nil {
+			return Elements{}, err
+		}
+		return parseTLE(string(body))
+	})
+}
+
+// eciPosition propagates the elements to t, returning an Earth-centred inertial position in km
+func (el Elements) eciPosition(t time.Time) ([3]float64, error) {
+	if el.orbit == nil {
+		return [3]float64{}, errDeepSpace
+	}
+	return el.orbit.at(el.Epoch, t)
+}
+
+// gmst is the Greenwich mean sidereal time at t, in radians
+func gmst(t time.Time) float64 {
+	jd := float64(t.UnixNano())/86400e9 + 2440587.5
+	deg := 280.46061837 + 360.98564736629*(jd-2451545.0)
+	return math.Mod(deg, 360) * math.Pi / 180
+}
+
+// toECEF rotates an inertial position into Earth-fixed coordinates at t
+func toECEF(eci [3]float64, t time.Time) [3]float64 {
+	theta := gmst(t)
+	c, s := math.Cos(theta), math.Sin(theta)
+	return [3]float64{c*eci[0] + s*eci[1], -s*eci[0] + c*eci[1], eci[2]}
+}
+
+// ecefPosition returns the satellite position in Earth-fixed coordinates at t
+func (el Elements) ecefPosition(t time.Time) ([3]float64, error) {
+	eci, err := el.eciPosition(t)
+	return toECEF(eci, t), err
+}
+
+// sunDirection returns the unit vector towards the sun in inertial
+// coordinates at t, from the Astronomical Almanac's low-precision formulae
+// (good to about 0.01°)
+func sunDirection(t time.Time) [3]float64 {
+	n := float64(t.UnixNano())/86400e9 + 2440587.5 - 2451545.0
+	deg := math.Pi / 180
+	l := (280.460 + 0.9856474*n) * deg
+	g := (357.528 + 0.9856003*n) * deg
+	lambda := l + (1.915*math.Sin(g)+0.020*math.Sin(2*g))*deg
+	eps := (23.439 - 0.0000004*n) * deg
+	return [3]float64{math.Cos(lambda), math.Cos(eps) * math.Sin(lambda), math.Sin(eps) * math.Sin(lambda)}
+}
+
+// sunlit reports whether an inertial position is outside Earth's
+// (cylindrical) shadow
+func sunlit(eci, sun [3]float64) bool {
+	along := eci[0]*sun[0] + eci[1]*sun[1] + eci[2]*sun[2]
+	if along >= 0 {
+		return true
+	}
+	perp := [3]float64{eci[0] - along*sun[0], eci[1] - along*sun[1], eci[2] - along*sun[2]}
+	return math.Sqrt(perp[0]*perp[0]+perp[1]*perp[1]+perp[2]*perp[2]) > earthRadius
+}
+
+// observerECEF converts a geodetic position on the ground to Earth-fixed km
+func observerECEF(lat, lng float64) [3]float64 {
+	phi, lambda := lat*math.Pi/180, lng*math.Pi/180
+	e2 := earthFlat * (2 - earthFlat)
+	n := earthRadius / math.Sqrt(1-e2*math.Sin(phi)*math.Sin(phi))
+	return [3]float64{
+		n * math.Cos(phi) * math.Cos(lambda),
+		n * math.Cos(phi) * math.Sin(lambda),
+		n * (1 - e2) * math.Sin(phi),
+	}
+}
+
+// topocentric returns the elevation and azimuth (degrees) of an Earth-fixed
+// target seen from the observer
+func topocentric(target [3]float64, lat, lng float64, obs [3]float64) (elevation, azimuth float64) {
+	dx, dy, dz := target[0]-obs[0], target[1]-obs[1], target[2]-obs[2]
+	phi, lambda := lat*math.Pi/180, lng*math.Pi/180
+
+	// Rotate the range vector into the observer's south/east/zenith frame
+	south := math.Sin(phi)*math.Cos(lambda)*dx + math.Sin(phi)*math.Sin(lambda)*dy - math.Cos(phi)*dz
+	east := -math.Sin(lambda)*dx + math.Cos(lambda)*dy
+	zenith := math.Cos(phi)*math.Cos(lambda)*dx + math.Cos(phi)*math.Sin(lambda)*dy + math.Sin(phi)*dz
+	rng := math.Sqrt(dx*dx + dy*dy + dz*dz)
+
+	elevation = math.Asin(zenith/rng) * 180 / math.Pi
+	azimuth = math.Mod(math.Atan2(east, -south)*180/math.Pi+360, 360)
+	return elevation, azimuth
+}
+
+// sunElevation returns the sun's elevation (degrees) seen from the observer
+func sunElevation(t time.Time, lat, lng float64, obs [3]float64) float64 {
+	const au = 149597870.7 // km
+	dir := sunDirection(t)
+	elev, _ := topocentric(toECEF([3]float64{dir[0] * au, dir[1] * au, dir[2] * au}, t), lat, lng, obs)
+	return elev
+}
+
+// predictPasses finds passes above minElevation degrees within the window. A
+// pass still in progress when the window ends is included, set at the end.
+func (el Elements) predictPasses(lat, lng float64, from time.Time, window time.Duration, minElevation float64) ([]SatellitePass, error) {
+	const step = 20 * time.Second
+	obs := observerECEF(lat, lng)
+	passes := []SatellitePass{}
+
+	var cur *SatellitePass
+	for t := from; t.Before(from.Add(window)); t = t.Add(step) {
+		eci, err := el.eciPosition(t)
+		if err != nil {
+			return nil, err
+		}
+		elev, az := topocentric(toECEF(eci, t), lat, lng, obs)
+		if elev >= minElevation {
+			if cur == nil {
+				cur = &SatellitePass{Rise: t.Unix(), RiseAzimuth: math.Round(az)}
+			}
+			if elev > cur.MaxElevation {
+				cur.MaxElevation = math.Round(elev*10) / 10
+				cur.Peak = t.Unix()
+			}
+			cur.Set = t.Unix()
+			cur.SetAzimuth = math.Round(az)
+			if !cur.Visible && sunlit(eci, sunDirection(t)) && sunElevation(t, lat, lng, obs) < sunDarkElevation {
+				cur.Visible = true
+			}
+		} else if cur != nil {
+			passes = append(passes, *cur)
+			cur = nil
+		}
+	}
+	if cur != nil {
+		passes = append(passes, *cur)
+	}
+	return passes, nil
+}
+
+// subPoint returns the latitude, longitude and altitude of the satellite at t
+func (el Elements) subPoint(t time.Time) (lat, lng, alt float64, err error) {
+	p, err := el.ecefPosition(t)
+	r := math.Sqrt(p[0]*p[0] + p[1]*p[1] + p[2]*p[2])
+	lat = math.Atan2(p[2], math.Hypot(p[0], p[1])) * 180 / math.Pi
+	lng = math.Atan2(p[1], p[0]) * 180 / math.Pi
+	return lat, lng, r - earthRadius, err
+}
+
+// satelliteCatalog reads the NORAD catalog number from ?sat=, defaulting to the ISS
+func satelliteCatalog(r *http.Request) (int, bool) {
+	param := r.URL.Query().Get("sat")
+	if param == "" {
+		return issCatalog, true
+	}
+	n, err := strconv.Atoi(param)
+	return n, err == nil && n > 0
+}
+
+// handleGetSatellitePasses lists the visible passes over ?lat=&lng= in the
+// next ?hours= (24 by default), of the ISS unless ?sat= names another
+// satellite. ?all=1 includes passes in daylight or in Earth's shadow.
+func handleGetSatellitePasses(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lat, lng, ok := parseLatLng(r)
+	if !ok {
+		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+		return
+	}
+	catalog, ok := satelliteCatalog(r)
+	if !ok {
+		http.Error(w, "Invalid satellite", http.StatusBadRequest)
+		return
+	}
+	hours, err := strconv.Atoi(r.URL.Query().Get("hours"))
+	if err != nil || hours <= 0 || hours > 72 {
+		hours = 24
+	}
+
+	el, err := fetchTLE(catalog)
+	if err != nil {
+		log.Printf("Error fetching TLE: %v", err)
+		http.Error(w, "Upstream error", http.StatusBadGateway)
+		return
+	}
+	passes, err := el.predictPasses(lat, lng, time.Now(), time.Duration(hours)*time.Hour, 10)
+	if err != nil {
+		http.Error(w, "Satellite not supported", http.StatusUnprocessableEntity)
+		return
+	}
+	if r.URL.Query().Get("all") != "1" {
+		visible := passes[:0]
+		for _, p := range passes {
+			if p.Visible {
+				visible = append(visible, p)
+			}
+		}
+		passes = visible
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"satellite": el.Name,
+		"passes":    passes,
+	})
+}
+
+func handleGetSatellitePosition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	catalog, ok := satelliteCatalog(r)
+	if !ok {
+		http.Error(w, "Invalid satellite", http.StatusBadRequest)
+		return
+	}
+	el, err := fetchTLE(catalog)
+	if err != nil {
+		log.Printf("Error fetching TLE: %v", err)
+		http.Error(w, "Upstream error", http.StatusBadGateway)
+		return
+	}
+
+	now := time.Now()
+	lat, lng, alt, err := el.subPoint(now)
+	if err != nil {
+		http.Error(w, "Satellite not supported", http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SatellitePosition{
+		Name:     el.Name,
+		Lat:      math.Round(lat*1e4) / 1e4,
+		Lng:      math.Round(lng*1e4) / 1e4,
+		Altitude: math.Round(alt*10) / 10,
+		Time:     now.Unix(),
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Vanguard 1 (00005) from the SGP4 verification set in Vallado et al.,
+// "Revisiting Spacetrack Report #3"
+const vanguardTLE = `VANGUARD 1
+1 00005U 58002B   00179.78495062  .00000023  00000-0  28098-4 0  4753
+2 00005  34.2682 348.7242 1859667 331.7664  19.3264 10.82419157413667`
+
+func TestSGP4Vanguard(t *testing.T) {
+	el, err := parseTLE(vanguardTLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		minutes float64
+		r       [3]float64
+	}{
+		{0, [3]float64{7022.46529266, -1400.08296755, 0.03995155}},
+		{360, [3]float64{-7154.03120202, -3783.17682504, -3536.19412294}},
+		{720, [3]float64{-7134.59340119, 6531.68641334, 3260.27186483}},
+		{1080, [3]float64{5568.53901181, 4492.06992591, 3863.87641983}},
+	} {
+		r, _, err := el.orbit.propagate(tc.minutes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range r {
+			if math.Abs(r[i]-tc.r[i]) > 1e-3 {
+				t.Errorf("t=%v: got %v, want %v", tc.minutes, r, tc.r)
+				break
+			}
+		}
+	}
+}
+
+// The ISS example element set from Wikipedia's "Two-line element set" article
+const issTLE = `ISS (ZARYA)
+1 25544U 98067A   08264.51782528 -.00002182  00000-0 -11606-4 0  2927
+2 25544  51.6416 247.4627 0006703 130.5360 325.0288 15.72125391563537`
+
+func TestPredictPasses(t *testing.T) {
+	el, err := parseTLE(issTLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if el.BStar != -0.11606e-4 {
+		t.Errorf("B* = %v", el.BStar)
+	}
+	lat, lng := 51.5, -0.13
+	obs := observerECEF(lat, lng)
+	elevation := func(ts int64) float64 {
+		eci, err := el.eciPosition(time.Unix(ts, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		elev, _ := topocentric(toECEF(eci, time.Unix(ts, 0)), lat, lng, obs)
+		return elev
+	}
+
+	from := el.Epoch.Truncate(time.Minute)
+	passes, err := el.predictPasses(lat, lng, from, 72*time.Hour, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passes) < 6 {
+		t.Fatalf("got %d passes in 72 hours, want at least 6", len(passes))
+	}
+	visible := 0
+	for _, p := range passes {
+		if !(p.Rise <= p.Peak && p.Peak <= p.Set) || p.Set-p.Rise > 15*60 {
+			t.Errorf("bad pass timing: %+v", p)
+		}
+		if elevation(p.Rise-20) >= 10 || elevation(p.Set+20) >= 10 {
+			t.Errorf("pass doesn't start and end at the horizon mask: %+v", p)
+		}
+		if math.Abs(elevation(p.Peak)-p.MaxElevation) > 0.1 {
+			t.Errorf("peak elevation %v, want %v", p.MaxElevation, elevation(p.Peak))
+		}
+		if p.Visible {
+			visible++
+			if sunElevation(time.Unix(p.Peak, 0), lat, lng, obs) > 0 {
+				t.Errorf("visible pass in daylight: %+v", p)
+			}
+		}
+	}
+	if visible == 0 || visible == len(passes) {
+		t.Errorf("%d of %d passes visible, want some but not all", visible, len(passes))
+	}
+
+	// A window ending mid-pass still reports that pass
+	p := passes[0]
+	cut, err := el.predictPasses(lat, lng, from, time.Unix(p.Peak, 0).Sub(from), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cut) != 1 || cut[0].Rise != p.Rise || cut[0].Set >= p.Peak {
+		t.Errorf("got %+v for a window ending at the peak of %+v", cut, p)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Seasonal events switch features on for a few days a year.
+// SEASONAL_EVENTS lists them as name=MM-DD[/MM-DD]:flag|flag entries, e.g.
+// "christmas=12-24/12-26:snow|bells" (ranges may wrap past New Year; "none"
+// turns the built-in calendar off). Dates follow the server's local time
+// zone (TZ). The server checks the calendar every minute and tells every
+// client which flags are on with a "season" message, and new clients get it
+// in init. While "snow" is on the server drops the same snowflakes on every
+// screen with "snow" messages; "bells" makes pings chime. Admins can pretend
+// it's another day at /admin/season to preview an event; only the connections
+// opened with their admin session see it, everyone else keeps today's.
+
+// SeasonalEvent is a calendar entry and the flags it turns on
+type SeasonalEvent struct {
+	Name  string   `json:"name"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	Flags []string `json:"flags"`
+}
+
+// Season is what's on today
+type Season struct {
+	Events []string `json:"events"`
+	Flags  []string `json:"flags"`
+}
+
+const defaultSeasonalEvents = "christmas=12-24/12-26:snow|bells,new_year=12-31/01-01:bells"
+
+// How often snowflakes are dropped while it's snowing, and how many at a time
+const (
+	snowInterval = 2 * time.Second
+	snowBatch    = 3
+)
+
+var seasonalEvents = loadSeasonalEvents()
+
+var season struct {
+	sync.RWMutex
+	current Season
+}
+
+// Days (MM-DD) admins are previewing, by the hash of their admin session,
+// until the next restart
+var seasonPreviews = struct {
+	sync.Mutex
+	days map[string]string
+}{days: make(map[string]string)}
+
+func loadSeasonalEvents() []SeasonalEvent {
+	spec := strings.TrimSpace(os.Getenv("SEASONAL_EVENTS"))
+	if spec == "" {
+		spec = defaultSeasonalEvents
+	}
+	if spec == "none" {
+		return nil
+	}
+	events, err := parseSeasonalEvents(spec)
+	if err != nil {
+		log.Printf("Invalid SEASONAL_EVENTS, ignoring it: %v", err)
+		return nil
+	}
+	return events
+}
+
+// parseSeasonalEvents parses comma-separated name=MM-DD[/MM-DD]:flag|flag entries
+func parseSeasonalEvents(spec string) ([]SeasonalEvent, error) {
+	var events []SeasonalEvent
+	for _, entry := range strings.Split(spec, ",") {
+		name, rest, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		dates, flags, ok2 := strings.Cut(rest, ":")
+		if !ok || !ok2 || !panelNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("%q is not name=MM-DD[/MM-DD]:flags", entry)
+		}
+		e := SeasonalEvent{Name: name}
+		e.Start, e.End, ok = strings.Cut(dates, "/")
+		if !ok {
+			e.End = e.Start
+		}
+		for _, day := range []string{e.Start, e.End} {
+			if _, err := time.Parse("01-02", day); err != nil {
+				return nil, fmt.Errorf("invalid date %q in %s", day, name)
+			}
+		}
+		for _, f := range strings.Split(flags, "|") {
+			if f = strings.TrimSpace(f); panelNamePattern.MatchString(f) {
+				e.Flags = append(e.Flags, f)
+			}
+		}
+		if len(e.Flags) == 0 {
+			return nil, fmt.Errorf("%s turns no flags on", name)
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// on reports whether the event covers a day, given as MM-DD
+func (e SeasonalEvent) on(day string) bool {
+	if e.Start <= e.End {
+		return day >= e.Start && day <= e.End
+	}
+	// Wraps past New Year
+	return day >= e.Start || day <= e.End
+}
+
+// seasonOn works out which events and flags are on for a day
+func seasonOn(day string) Season {
+	s := Season{Events: []string{}, Flags: []string{}}
+	seen := make(map[string]bool)
+	for _, e := range seasonalEvents {
+		if !e.on(day) {
+			continue
+		}
+		s.Events = append(s.Events, e.Name)
+		for _, f := range e.Flags {
+			if !seen[f] {
+				seen[f] = true
+				s.Flags = append(s.Flags, f)
+			}
+		}
+	}
+	sort.Strings(s.Flags)
+	return s
+}
+
+// currentSeason returns what's on, or nil outside every event
+func currentSeason() *Season {
+	season.RLock()
+	defer season.RUnlock()
+	if len(season.current.Events) == 0 {
+		return nil
+	}
+	s := season.current
+	return &s
+}
+
+// seasonFor returns what a client sees: today's events, or those of the day
+// its admin is previewing (nil outside every event)
+func seasonFor(preview string) *Season {
+	if preview == "" {
+		return currentSeason()
+	}
+	s := seasonOn(preview)
+	if len(s.Events) == 0 {
+		return nil
+	}
+	return &s
+}
+
+func (s Season) has(flag string) bool {
+	for _, f := range s.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func seasonFlag(flag string) bool {
+	season.RLock()
+	defer season.RUnlock()
+	return season.current.has(flag)
+}
+
+// seasonPreviewFor returns the day an admin session is previewing, or ""
+func seasonPreviewFor(session string) string {
+	seasonPreviews.Lock()
+	defer seasonPreviews.Unlock()
+	return seasonPreviews.days[session]
+}
+
+// checkSeason switches to the events for today and tells every client that
+// isn't previewing another day if that changed anything
+func checkSeason(now time.Time) {
+	day := now.Format("01-02")
+	s := seasonOn(day)
+	season.Lock()
+	changed := strings.Join(s.Events, ",") != strings.Join(season.current.Events, ",")
+	season.current = s
+	season.Unlock()
+	if !changed {
+		return
+	}
+
+	log.Printf("Seasonal events on %s: %v (flags: %v)", day, s.Events, s.Flags)
+	data, _ := json.Marshal(CursorMessage{Type: "season", Season: &s})
+	for _, h := range allHubs() {
+		h.mutex.RLock()
+		for _, c := range h.clients {
+			if c.seasonPreview == "" {
+				c.trySend(data)
+			}
+		}
+		h.mutex.RUnlock()
+	}
+}
+
+// previewSeason shows the connections opened with an admin session the
+// events of day, or today's again if day is ""
+func (h *Hub) previewSeason(session, day string) {
+	data, _ := json.Marshal(CursorMessage{Type: "season", Season: seasonFor(day)})
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, c := range h.clients {
+		if c.adminSession == session {
+			c.seasonPreview = day
+			c.trySend(data)
+		}
+	}
+}
+
+// runSeasons checks the calendar every minute and drops snow while it's on
+func runSeasons() {
+	checkSeason(time.Now())
+	calendar := time.NewTicker(time.Minute)
+	snow := time.NewTicker(snowInterval)
+	defer calendar.Stop()
+	defer snow.Stop()
+	for {
+		select {
+		case now := <-calendar.C:
+			checkSeason(now)
+		case <-snow.C:
+			dropSnow()
+		}
+	}
+}
+
+// dropSnow sends the same few snowflakes, as fractions of the screen width,
+// to everyone it's snowing for, today or on the day they're previewing
+func dropSnow() {
+	snowing := map[string]bool{"": seasonFlag("snow")}
+	var data []byte
+	for _, h := range allHubs() {
+		h.mutex.RLock()
+		for _, c := range h.clients {
+			on, ok := snowing[c.seasonPreview]
+			if !ok {
+				on = seasonOn(c.seasonPreview).has("snow")
+				snowing[c.seasonPreview] = on
+			}
+			if !on {
+				continue
+			}
+			if data == nil {
+				flakes := make([]float64, snowBatch)
+				for i := range flakes {
+					flakes[i] = float64(rand.Intn(1000)) / 1000
+				}
+				data, _ = json.Marshal(CursorMessage{Type: "snow", Snow: flakes})
+			}
+			c.trySend(data)
+		}
+		h.mutex.RUnlock()
+	}
+}
+
+// SeasonResponse is returned by /api/season and /admin/season
+type SeasonResponse struct {
+	Season
+	Preview  string          `json:"preview,omitempty"`
+	Calendar []SeasonalEvent `json:"calendar"`
+}
+
+func seasonResponse() SeasonResponse {
+	season.RLock()
+	defer season.RUnlock()
+	resp := SeasonResponse{Season: season.current, Calendar: seasonalEvents}
+	if resp.Calendar == nil {
+		resp.Calendar = []SeasonalEvent{}
+	}
+	return resp
+}
+
+// handleGetSeason shows the calendar and what's on today
+func handleGetSeason(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(seasonResponse())
+}
+
+// handleSeasonPreview pretends it's another day (POST {"day":"12-24"}), or
+// goes back to today (POST {"day":""}), for the asking admin until the next
+// restart. Only connections opened with the same admin session see it; with
+// ADMIN_TOKEN it just returns what's on that day.
+func handleSeasonPreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Day string `json:"day"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Day != "" {
+		if _, err := time.Parse("01-02", req.Day); err != nil {
+			http.Error(w, "Invalid day", http.StatusBadRequest)
+			return
+		}
+	}
+
+	site := tenantFor(r)
+	if cookie, err := r.Cookie("admin_session"); err == nil && adminSessionLogin(site, r) != "" {
+		session := hashToken(cookie.Value)
+		seasonPreviews.Lock()
+		if req.Day == "" {
+			delete(seasonPreviews.days, session)
+		} else {
+			seasonPreviews.days[session] = req.Day
+		}
+		seasonPreviews.Unlock()
+		site.hub.previewSeason(session, req.Day)
+	}
+
+	resp := seasonResponse()
+	if req.Day != "" {
+		resp.Season = seasonOn(req.Day)
+		resp.Preview = req.Day
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Secrets (admin tokens, the captcha and webhook secrets, collector headers)
+// are read from the environment, from a file named by <NAME>_FILE (Docker and
+// Kubernetes secrets), or from SECRETS_FILE: KEY=value lines, optionally
+// encrypted with age (*.age, decrypted with the age CLI using the identity in
+// AGE_IDENTITY_FILE). Secret values are redacted from the logs.
+
+var secretsFromFile = loadSecretsFile(os.Getenv("SECRETS_FILE"))
+
+// knownSecrets holds every secret value loaded, for redaction
+var knownSecrets struct {
+	sync.RWMutex
+	values []string
+}
+
+// secret looks a secret up in the environment, its _FILE variant, then SECRETS_FILE
+func secret(name string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		if path := os.Getenv(name + "_FILE"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				log.Fatalf("Failed to read %s_FILE: %v", name, err)
+			}
+			value = strings.TrimSpace(string(data))
+		}
+	}
+	if value == "" {
+		value = secretsFromFile[name]
+	}
+	registerSecret(value)
+	return value
+}
+
+func registerSecret(value string) {
+	// Very short values would redact ordinary words
+	if len(value) < 4 {
+		return
+	}
+	knownSecrets.Lock()
+	knownSecrets.values = append(knownSecrets.values, value)
+	knownSecrets.Unlock()
+}
+
+// loadSecretsFile reads KEY=value lines, decrypting the file first if it is age-encrypted
+func loadSecretsFile(path string) map[string]string {
+	secrets := make(map[string]string)
+	if path == "" {
+		return secrets
+	}
+
+	var data []byte
+	var err error
+	if strings.HasSuffix(path, ".age") {
+		identity := os.Getenv("AGE_IDENTITY_FILE")
+		if identity == "" {
+			log.Fatalf("SECRETS_FILE %s is age-encrypted but AGE_IDENTITY_FILE is not set", path)
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command("age", "--decrypt", "--identity", identity, path)
+		cmd.Stderr = &stderr
+		data, err = cmd.Output()
+		if err != nil {
+			log.Fatalf("Failed to decrypt %s: %v %s", path, err, strings.TrimSpace(stderr.String()))
+		}
+	} else {
+		data, err = os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Failed to read SECRETS_FILE: %v", err)
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			continue
+		}
+		secrets[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+	return secrets
+}
+
+// redact replaces every known secret in s
+func redact(s string) string {
+	knownSecrets.RLock()
+	defer knownSecrets.RUnlock()
+	for _, v := range knownSecrets.values {
+		s = strings.ReplaceAll(s, v, "[REDACTED]")
+	}
+	return s
+}
+
+// redactingWriter scrubs secrets from log lines
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func init() {
+	log.SetOutput(redactingWriter{os.Stderr})
+}
+
+// configSettings lists the settings shown by --print-config; true marks secrets
+var configSettings = []struct {
+	name   string
+	secret bool
+}{
+	{"LISTEN_ADDR", false}, {"DB_PATH", false}, {"DB_READ_PATH", false},
+	{"MAX_CONNECTIONS", false}, {"WAITING_ROOM_SIZE", false}, {"MAX_CONNECTIONS_PER_IP", false}, {"TRUSTED_PROXIES", false},
+	{"ADMIN_TOKEN", true}, {"LOCATIONS_API_KEY", true}, {"KIOSK_TOKEN", true}, {"CAPTCHA_PROVIDER", false}, {"CAPTCHA_SECRET", true},
+	{"AMBIENT_REPLAY", false}, {"AMBIENT_MAX_USERS", false}, {"HUB_STATE_FILE", false},
+	{"EARTHQUAKE_ALERT_MAG", false}, {"AURORA_ALERT_KP", false}, {"LIGHTNING_FEED", false},
+	{"WEBCAMS", false}, {"TELNET_ADDR", false},
+	{"GOPHER_ADDR", false}, {"GOPHER_HOST", false},
+	{"FINGER_ADDR", false}, {"DEFAULT_LOCATION", false}, {"PLACE_LOOKUP_URL", false}, {"PANEL_TEMPLATES", false}, {"WEBHOOK_SECRET", true}, {"PUZZLE_SEED", true}, {"GUESTBOOK_APPROVE", false}, {"GUESTBOOK_BLOCKLIST", false}, {"ROTATION_SCHEDULE", false}, {"SEASONAL_EVENTS", false}, {"SITE_URL", false},
+	{"NPCS", false}, {"NPC_HZ", false}, {"CURSOR_PALETTE", false}, {"TENANTS", false}, {"EXPERIMENTS", false},
+	{"SMTP_ADDR", false}, {"SMTP_FROM", false}, {"SMTP_USER", false}, {"SMTP_PASSWORD", true},
+	{"GITHUB_CLIENT_ID", false}, {"GITHUB_CLIENT_SECRET", true}, {"ADMIN_GITHUB_USERS", false},
+	{"OTEL_EXPORTER_OTLP_ENDPOINT", false}, {"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", false},
+	{"OTEL_EXPORTER_OTLP_HEADERS", true}, {"OTEL_SERVICE_NAME", false},
+	{"SECRETS_FILE", false}, {"AGE_IDENTITY_FILE", false},
+}
+
+// printConfig writes the effective configuration, with secrets redacted
+func printConfig(out io.Writer) {
+	show := func(name string, isSecret bool) {
+		value := os.Getenv(name)
+		if isSecret {
+			value = secret(name)
+			if value != "" {
+				value = "[REDACTED]"
+			}
+		}
+		if value == "" {
+			value = "(unset)"
+		}
+		fmt.Fprintf(out, "%s=%s\n", name, value)
+	}
+	for _, s := range configSettings {
+		show(s.name, s.secret)
+	}
+
+	// Per-tenant overrides
+	var names []string
+	for _, entry := range strings.Split(os.Getenv("TENANTS"), ",") {
+		if name, _, ok := strings.Cut(strings.TrimSpace(entry), "="); ok {
+			names = append(names, strings.ToLower(strings.TrimSpace(name)))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		show(tenantEnvName(name, "ADMIN_TOKEN"), true)
+		if secret(tenantEnvName(name, "LOCATIONS_API_KEY")) != "" {
+			show(tenantEnvName(name, "LOCATIONS_API_KEY"), true)
+		}
+		if secret(tenantEnvName(name, "KIOSK_TOKEN")) != "" {
+			show(tenantEnvName(name, "KIOSK_TOKEN"), true)
+		}
+		for _, key := range []string{"ADMIN_GITHUB_USERS", "DB_READ_PATH", "MAX_CONNECTIONS", "WAITING_ROOM_SIZE", "MAX_CONNECTIONS_PER_IP", "DEFAULT_LOCATION", "ROTATION_SCHEDULE"} {
+			if os.Getenv(tenantEnvName(name, key)) != "" {
+				show(tenantEnvName(name, key), false)
+			}
+		}
+	}
+}
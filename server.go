@@ -1,15 +1,25 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"math"
+	mathrand "math/rand"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -21,6 +31,9 @@ type Location struct {
 	Lat       float64   `json:"lat"`
 	Lng       float64   `json:"lng"`
 	Timestamp time.Time `json:"timestamp"`
+
+	// Only filled in for historical (asOf) queries
+	VisitorCount int `json:"visitorCount,omitempty"`
 }
 
 // LocationResponse includes visitor count info
@@ -28,6 +41,10 @@ type LocationResponse struct {
 	Added        bool `json:"added"`
 	IsFirst      bool `json:"isFirst"`
 	VisitorCount int  `json:"visitorCount"`
+	// Version of the visitor's location, to send back with the next update
+	Version int `json:"version"`
+	// Set when the database was unavailable and the visit will be saved later
+	Queued bool `json:"queued,omitempty"`
 }
 
 // Highscore represents a game high score entry
@@ -36,6 +53,10 @@ type Highscore struct {
 	Game  string `json:"game"`
 	Name  string `json:"name"`
 	Score int    `json:"score"`
+
+	// Submitter's country (ISO 3166-1 alpha-2) and its flag emoji
+	Country string `json:"country,omitempty"`
+	Flag    string `json:"flag,omitempty"`
 }
 
 // LocationStore holds unique visitor locations
@@ -50,6 +71,32 @@ var store = &LocationStore{
 
 var db *sql.DB
 
+// readDB serves heavy read endpoints; it is db unless a replica is configured
+var readDB *sql.DB
+
+// Writes go to DB_PATH; DB_READ_PATH optionally points reads at a replica
+// (e.g. "file:replica.db?mode=ro")
+var (
+	dbPath     = envString("DB_PATH", "./crt-weather.db")
+	dbReadPath = os.Getenv("DB_READ_PATH")
+)
+
+// envString reads a setting from the environment, falling back to def
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt reads an integer setting from the environment, falling back to def
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
 // WebSocket cursor tracking
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
@@ -60,6 +107,14 @@ type CursorPosition struct {
 	X        float64 `json:"x"`
 	Y        float64 `json:"y"`
 	Location string  `json:"location,omitempty"`
+	Zone     string  `json:"zone,omitempty"`
+
+	// Viewport of the sender, used to work out Normalized (see viewport.go)
+	ScrollX    float64          `json:"scrollX,omitempty"`
+	ScrollY    float64          `json:"scrollY,omitempty"`
+	PageWidth  float64          `json:"pageWidth,omitempty"`
+	PageHeight float64          `json:"pageHeight,omitempty"`
+	Normalized *NormalizedPoint `json:"normalized,omitempty"`
 }
 
 // PingData represents a user ping
@@ -73,22 +128,195 @@ type PingData struct {
 
 // CursorMessage is sent over websocket
 type CursorMessage struct {
-	Type        string                      `json:"type"`
-	ID          string                      `json:"id,omitempty"`
-	Position    *CursorPosition             `json:"position,omitempty"`
-	Cursors     map[string]*CursorPosition  `json:"cursors,omitempty"`
-	UserCount   int                         `json:"userCount,omitempty"`
-	Ping        *PingData                   `json:"ping,omitempty"`
-	Pings       []PingData                  `json:"pings,omitempty"`
+	Type          string                     `json:"type"`
+	ID            string                     `json:"id,omitempty"`
+	Position      *CursorPosition            `json:"position,omitempty"`
+	Cursors       map[string]*CursorPosition `json:"cursors,omitempty"`
+	UserCount     int                        `json:"userCount,omitempty"`
+	Ping          *PingData                  `json:"ping,omitempty"`
+	Pings         []PingData                 `json:"pings,omitempty"`
+	QueuePos      int                        `json:"queuePosition,omitempty"`
+	Zones         map[string]int             `json:"zones,omitempty"`
+	Record        *PeakRecord                `json:"record,omitempty"`
+	Ghost         bool                       `json:"ghost,omitempty"`
+	Bot           bool                       `json:"bot,omitempty"`
+	Code          int                        `json:"code,omitempty"`
+	Reason        string                     `json:"reason,omitempty"`
+	RetryAfter    int                        `json:"retryAfter,omitempty"`
+	Quake         *Earthquake                `json:"quake,omitempty"`
+	Aurora        *AuroraAlert               `json:"aurora,omitempty"`
+	Event         *ExternalEvent             `json:"event,omitempty"`
+	Maintenance   *MaintenanceNotice         `json:"maintenance,omitempty"`
+	Target        string                     `json:"target,omitempty"`
+	Scroll        *ScrollPosition            `json:"scroll,omitempty"`
+	Text          string                     `json:"text,omitempty"`
+	WeatherRecord *WeatherRecord             `json:"weatherRecord,omitempty"`
+	Area          *Area                      `json:"area,omitempty"`
+	Lightning     *LightningStrike           `json:"lightning,omitempty"`
+	Color         string                     `json:"color,omitempty"`
+	Colors        map[string]string          `json:"colors,omitempty"`
+	Battle        *BattleEvent               `json:"battle,omitempty"`
+	Weather       *ForecastCurrent           `json:"weather,omitempty"`
+	Place         string                     `json:"place,omitempty"`
+	Places        map[string]string          `json:"places,omitempty"`
+	Home          *GeoPoint                  `json:"home,omitempty"`
+	Puzzle        *PuzzleSolve               `json:"puzzle,omitempty"`
+	Guestbook     *GuestbookEntry            `json:"guestbook,omitempty"`
+	Owner         *OwnerStatus               `json:"owner,omitempty"`
+	Rotate        *Rotation                  `json:"rotate,omitempty"`
+	Device        *DeviceCommand             `json:"device,omitempty"`
+	Version       string                     `json:"version,omitempty"`
+	Theme         *Theme                     `json:"theme,omitempty"`
+	Season        *Season                    `json:"season,omitempty"`
+	Snow          []float64                  `json:"snow,omitempty"`
+	ResumeToken   string                     `json:"resumeToken,omitempty"`
 }
 
+// Close codes sent to clients (4000-4999 are application specific)
+const (
+	closeServerFull   = websocket.CloseTryAgainLater
+	closeRestarting   = websocket.CloseServiceRestart
+	closeIPLimit      = 4001
+	closeSlowClient   = 4002
+	closeBadInput     = 4003
+	closeBanned       = 4004
+	closeIdleTimeout  = 4005
+	closeRateLimited  = 4006
+)
+
+// A client sending more than maxMessagesPerSecond is dropped, and asked to
+// wait rateLimitBackoff before reconnecting
+const (
+	maxMessagesPerSecond = 300
+	rateLimitBackoff     = 10 * time.Second
+)
+
 // Client represents a connected websocket client
 type Client struct {
 	ID       string
+	IP       string
 	Conn     *websocket.Conn
 	Position *CursorPosition
 	Location string
 	Send     chan []byte
+	waiting  bool
+
+	// Hub of the site this client connected to
+	hub *Hub
+
+	// Country from the CDN, for presence counts
+	country string
+
+	// Registered kiosk this connection belongs to, if any (see devices.go;
+	// guarded by the hub mutex)
+	device string
+
+	// Cursor colour assigned by the hub (guarded by the hub mutex) and the
+	// visitor's saved choice
+	color          string
+	preferredColor string
+
+	// City the visitor is from, shown next to the cursor (see places.go)
+	place string
+
+	// Rough area shared by the client and when it was last warned of
+	// lightning there (guarded by the hub mutex)
+	area                 *Area
+	lastLightningWarning time.Time
+
+	// Secret the client must show to resume its ID after a restart
+	resumeToken string
+
+	// Server-driven cursor with no connection behind it (see npc.go)
+	bot bool
+
+	// Hash of the admin session the connection was opened with, and the day
+	// (MM-DD) that admin is previewing, if any (see seasonal.go; guarded by
+	// the hub mutex)
+	adminSession  string
+	seasonPreview string
+
+	// Session stats for experiment metrics (owned by readPump)
+	visitorID   string
+	connectedAt time.Time
+	pings       int
+
+	// When this client's cursor was last sampled for the heatmap (owned by readPump)
+	lastHeatSample time.Time
+
+	// Recent direct messages and peeks, for rate limiting (owned by readPump)
+	dmTimes   []time.Time
+	peekTimes []time.Time
+
+	// Invalid cursor positions in the current minute (owned by readPump)
+	badMoves      int
+	badMovesSince time.Time
+
+	// Messages in the current second (owned by readPump)
+	messages      int
+	messagesSince time.Time
+
+	// Cursor movement sampled for ambient replay, if the visitor opted in
+	// (owned by readPump)
+	recordCursor bool
+	recording    CursorRecording
+
+	// Close frame sent when Send is closed by the hub
+	closeCode   int
+	closeReason string
+
+	// Why the connection ended, for logging (set by readPump)
+	disconnectReason string
+
+	// Guards Send against sends after it has been closed
+	sendMu sync.Mutex
+	closed bool
+}
+
+// trySend queues a message without blocking; it reports false if the queue is full or closed
+func (c *Client) trySend(data []byte) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	select {
+	case c.Send <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// setClose picks the close frame writePump sends once Send is closed; the
+// first reason given wins
+func (c *Client) setClose(code int, reason string) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if !c.closed && c.closeCode == 0 {
+		c.closeCode = code
+		c.closeReason = reason
+	}
+}
+
+// closeInfo returns the close code and reason picked so far, if any
+func (c *Client) closeInfo() (int, string) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.closeCode, c.closeReason
+}
+
+// closeSend closes the send queue, which makes writePump say goodbye; safe to call twice
+func (c *Client) closeSend() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.Send)
+	}
 }
 
 // Hub manages all websocket connections
@@ -99,81 +327,520 @@ type Hub struct {
 	unregister    chan *Client
 	mutex         sync.RWMutex
 	recentPings   []PingData
+
+	// Connection limit (0 = unlimited) and waiting room for clients over it
+	maxClients    int
+	maxWaiting    int
+	waiting       []*Client
+
+	// Connections per remote IP, capped at maxPerIP (0 = unlimited)
+	ipCounts      map[string]int
+	maxPerIP      int
+
+	// Last zone occupancy broadcast, to skip unchanged updates
+	zones         map[string]int
+
+	// Activity counters, reset by the per-minute rollup
+	minutePeak    int
+	messages      atomic.Int64
+
+	// All-time peak of concurrent users
+	peak          PeakRecord
+
+	// How many of the clients are bots (see npc.go)
+	bots          int
+
+	// Recent rejections per IP, for exponential reconnect backoff
+	rejections    map[string]*rejection
+
+	// Clients handed off by the previous process, claimable until resumableUntil
+	resumable      map[string]ResumableClient
+	resumableUntil time.Time
+	// Database of the site this hub belongs to
+	db *sql.DB
+	// Queue for the append-only event log (see eventlog.go)
+	events     chan HubEvent
+	eventsStop chan struct{}
+	eventsDone chan struct{}
+	// Live listeners to logged events, such as GraphQL subscriptions
+	tapsMu sync.Mutex
+	taps   map[chan HubEvent]bool
+	// Cursor samples waiting to be added to the heatmap
+	heat heatmapBuffer
+	// Who is following whom (see follow.go)
+	follows followState
+	// Last typing keepalive per client (see typing.go)
+	typing map[string]time.Time
+	// Clients each client has blocked from sending it DMs (see dm.go)
+	blocks map[string]map[string]bool
+	// Visitors muted or banned by a moderator, until when (see moderation.go)
+	muted  map[string]time.Time
+	banned map[string]time.Time
+	// Matchmaking and matches in progress (see battle.go)
+	battles battleState
+	// Last user count broadcast (see usercount.go)
+	count countState
+	// The site owner's home base (DEFAULT_LOCATION)
+	home GeoPoint
+	// The site owner's presence and current track (see owner.go)
+	owner OwnerStatus
+	// Scheduled panel rotation (see rotation.go)
+	rotation rotationState
+	// Site-wide CRT theme, or nil to let visitors choose (see themes.go)
+	theme *Theme
+	// Scheduled downtime notice for this site (see maintenance.go)
+	maintenance MaintenanceNotice
+	// Recent events pushed in by webhooks (see webhooks.go)
+	external []ExternalEvent
+	// Where the hub's state goes on handoff (see handoff.go)
+	stateFile string
+}
+
+// rejection tracks how often an IP has been turned away recently
+type rejection struct {
+	count int
+	last  time.Time
 }
 
-var hub = &Hub{
-	clients:       make(map[string]*Client),
-	broadcast:     make(chan []byte),
-	register:      make(chan *Client),
-	unregister:    make(chan *Client),
-	recentPings:   make([]PingData, 0, 10),
+// Reconnect backoff for rejected clients: doubles per rejection up to the max
+const (
+	retryBase   = 2 * time.Second
+	retryMax    = 5 * time.Minute
+	retryWindow = 10 * time.Minute
+)
+
+// hub is the default site's hub, created once the database is open
+var hub *Hub
+
+func newHub(db *sql.DB, maxClients, maxWaiting, maxPerIP int) *Hub {
+	return &Hub{
+		clients:     make(map[string]*Client),
+		broadcast:   make(chan []byte),
+		register:    make(chan *Client),
+		unregister:  make(chan *Client),
+		recentPings: make([]PingData, 0, 10),
+		maxClients:  maxClients,
+		maxWaiting:  maxWaiting,
+		ipCounts:    make(map[string]int),
+		maxPerIP:    maxPerIP,
+		rejections:  make(map[string]*rejection),
+		db:          db,
+		events:      make(chan HubEvent, eventLogBuffer),
+		eventsStop:  make(chan struct{}),
+		eventsDone:  make(chan struct{}),
+		taps:        make(map[chan HubEvent]bool),
+		heat:        heatmapBuffer{counts: make(map[heatCell]int)},
+		follows:     newFollowState(),
+		typing:      make(map[string]time.Time),
+		blocks:      make(map[string]map[string]bool),
+		muted:       make(map[string]time.Time),
+		banned:      make(map[string]time.Time),
+		battles:     newBattleState(),
+	}
 }
 
 func (h *Hub) run() {
+	zoneTicker := time.NewTicker(5 * time.Second)
+	defer zoneTicker.Stop()
+	typingTicker := time.NewTicker(time.Second)
+	defer typingTicker.Stop()
+	countTicker := time.NewTicker(countInterval / 4)
+	defer countTicker.Stop()
+
 	for {
 		select {
+		case <-zoneTicker.C:
+			h.broadcastZones()
+
+		case <-typingTicker.C:
+			h.expireTyping()
+
+		case <-countTicker.C:
+			h.flushCount()
+
 		case client := <-h.register:
 			h.mutex.Lock()
-			h.clients[client.ID] = client
-			userCount := len(h.clients)
-			h.mutex.Unlock()
-			
-			// Send existing cursors and state to new client
-			h.mutex.RLock()
-			cursors := make(map[string]*CursorPosition)
-			for id, c := range h.clients {
-				if id != client.ID && c.Position != nil {
-					cursors[id] = c.Position
-				}
+			if h.maxPerIP > 0 && h.ipCounts[client.IP] >= h.maxPerIP {
+				h.mutex.Unlock()
+				h.disconnect(client, closeIPLimit, "ip_limit", h.retryAfter(client.IP))
+				log.Printf("Client rejected, too many connections from %s: %s", client.IP, client.ID)
+				continue
 			}
-			pings := make([]PingData, len(h.recentPings))
-			copy(pings, h.recentPings)
-			h.mutex.RUnlock()
-			
-			// Send init message with cursors, user count, and recent pings
-			initMsg := CursorMessage{Type: "init", Cursors: cursors, UserCount: userCount, Pings: pings}
-			data, _ := json.Marshal(initMsg)
-			select {
-			case client.Send <- data:
-			default:
+			full := h.maxClients > 0 && h.users() >= h.maxClients
+			if full && len(h.waiting) < h.maxWaiting {
+				// Park the client in the waiting room until a slot frees up
+				client.waiting = true
+				h.waiting = append(h.waiting, client)
+				h.ipCounts[client.IP]++
+				h.mutex.Unlock()
+				h.sendQueuePositions()
+				log.Printf("Client queued: %s (waiting: %d)", client.ID, len(h.waiting))
+				continue
 			}
-			
-			// Broadcast join and user count to others
-			joinMsg := CursorMessage{Type: "join", ID: client.ID, UserCount: userCount}
-			data, _ = json.Marshal(joinMsg)
-			h.broadcastToOthers(client.ID, data)
-			
-			log.Printf("Client connected: %s (total: %d)", client.ID, userCount)
-
-		case client := <-h.unregister:
-			h.mutex.Lock()
-			if _, ok := h.clients[client.ID]; ok {
-				delete(h.clients, client.ID)
-				close(client.Send)
+			if full {
+				h.mutex.Unlock()
+				h.disconnect(client, closeServerFull, "full", h.retryAfter(client.IP))
+				log.Printf("Client rejected, hub full: %s", client.ID)
+				continue
 			}
-			userCount := len(h.clients)
+			h.ipCounts[client.IP]++
 			h.mutex.Unlock()
-			
-			// Broadcast leave and user count to others
-			leaveMsg := CursorMessage{Type: "leave", ID: client.ID, UserCount: userCount}
-			data, _ := json.Marshal(leaveMsg)
-			h.broadcastToOthers(client.ID, data)
-			
-			log.Printf("Client disconnected: %s (total: %d)", client.ID, userCount)
+			h.admit(client)
+
+		case client := <-h.unregister:
+			// readPump is done with the client, so its reason can be read
+			h.remove(client, client.disconnectReason)
 
 		case message := <-h.broadcast:
+			var slow []*Client
 			h.mutex.RLock()
 			for _, client := range h.clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(h.clients, client.ID)
+				if !client.trySend(message) {
+					slow = append(slow, client)
 				}
 			}
 			h.mutex.RUnlock()
+
+			// Too slow to keep up - tell them why before dropping them
+			for _, client := range slow {
+				client.setClose(closeSlowClient, "slow_client")
+				h.remove(client, "slow_client")
+			}
+		}
+	}
+}
+
+// remove takes a client out of the hub, closes its queue and tells everyone
+// it left; removing one that already left (or never joined) is harmless
+func (h *Hub) remove(client *Client, reason string) {
+	h.mutex.Lock()
+	if client.waiting {
+		for i, c := range h.waiting {
+			if c == client {
+				h.waiting = append(h.waiting[:i], h.waiting[i+1:]...)
+				h.releaseIP(client)
+				client.closeSend()
+				break
+			}
+		}
+		h.mutex.Unlock()
+		h.sendQueuePositions()
+		return
+	}
+	if h.clients[client.ID] != client {
+		// Rejected before it ever joined, or already removed
+		h.mutex.Unlock()
+		return
+	}
+	h.dropFollows(client.ID)
+	h.dropBattles(client.ID)
+	delete(h.typing, client.ID)
+	delete(h.blocks, client.ID)
+	delete(h.clients, client.ID)
+	if client.bot {
+		h.bots--
+	}
+	h.releaseIP(client)
+	client.closeSend()
+	userCount := h.users()
+	countUpdate := h.takeCount(time.Now())
+
+	// Let the next waiting client in
+	var next *Client
+	if len(h.waiting) > 0 && (h.maxClients <= 0 || userCount < h.maxClients) {
+		next = h.waiting[0]
+		h.waiting = h.waiting[1:]
+		next.waiting = false
+	}
+	h.mutex.Unlock()
+
+	// Broadcast leave to others, with the user count if one is due
+	leaveMsg := CursorMessage{Type: "leave", ID: client.ID, UserCount: countUpdate}
+	data, _ := json.Marshal(leaveMsg)
+	h.broadcastToOthers(client.ID, data)
+	h.logEvent("leave", client.ID, data)
+
+	log.Printf("Client disconnected: %s (total: %d, reason: %s)", client.ID, userCount, reason)
+
+	if next != nil {
+		h.admit(next)
+		h.sendQueuePositions()
+	}
+}
+
+// admit adds a client to the active set and sends it the current state
+func (h *Hub) admit(client *Client) {
+	_, s := startSpan(context.Background(), "hub.admit", spanKindInternal)
+	defer s.end(nil)
+
+	h.mutex.Lock()
+	client.color = h.pickColor(client.preferredColor)
+	h.clients[client.ID] = client
+	if client.bot {
+		h.bots++
+	}
+	userCount := h.users()
+	countUpdate := h.takeCount(time.Now())
+	s.setAttr("hub.client_id", client.ID)
+	s.setAttr("hub.users", userCount)
+	if userCount > h.minutePeak {
+		h.minutePeak = userCount
+	}
+	h.mutex.Unlock()
+	
+	// Send existing cursors and state to new client
+	h.mutex.RLock()
+	cursors := make(map[string]*CursorPosition)
+	colors := make(map[string]string)
+	places := make(map[string]string)
+	for id, c := range h.clients {
+		if id != client.ID && c.Position != nil {
+			cursors[id] = c.Position
+		}
+		colors[id] = c.color
+		if id != client.ID && c.place != "" {
+			places[id] = c.place
+		}
+	}
+	pings := make([]PingData, len(h.recentPings))
+	copy(pings, h.recentPings)
+	zones := h.zones
+	home := h.home
+	var owner *OwnerStatus
+	if h.owner.UpdatedAt > 0 {
+		o := h.owner
+		owner = &o
+	}
+	var rotate *Rotation
+	if h.rotation.current.Panel != "" {
+		r := h.rotation.current
+		rotate = &r
+	}
+	var theme *Theme
+	if h.theme != nil {
+		t := *h.theme
+		theme = &t
+	}
+	seasonNow := seasonFor(client.seasonPreview)
+	h.mutex.RUnlock()
+	
+	// Send init message with cursors, user count, recent pings, zone occupancy,
+	// what the site owner is up to, the panel in rotation, the frontend version,
+	// the site theme, any seasonal events and the client's resume token
+	initMsg := CursorMessage{Type: "init", Cursors: cursors, Colors: colors, Places: places, Color: client.color, UserCount: userCount, Pings: pings, Zones: zones, Home: &home, Owner: owner, Rotate: rotate, Version: frontendVersion(), Theme: theme, Season: seasonNow, ResumeToken: client.resumeToken}
+	data, _ := json.Marshal(initMsg)
+	client.trySend(data)
+	
+	// Broadcast join to others, with the user count if one is due
+	joinMsg := CursorMessage{Type: "join", ID: client.ID, UserCount: countUpdate, Color: client.color, Place: client.place, Bot: client.bot}
+	data, _ = json.Marshal(joinMsg)
+	h.broadcastToOthers(client.ID, data)
+	h.logEvent("join", client.ID, data)
+	
+	log.Printf("Client connected: %s (total: %d)", client.ID, userCount)
+
+	h.checkPeak(userCount)
+}
+
+// countZones tallies how many active clients are in each named zone
+func (h *Hub) countZones() map[string]int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	zones := make(map[string]int)
+	for _, c := range h.clients {
+		if c.Position != nil && c.Position.Zone != "" {
+			zones[c.Position.Zone]++
+		}
+	}
+	return zones
+}
+
+// broadcastZones sends zone occupancy counts to everyone when they change
+func (h *Hub) broadcastZones() {
+	zones := h.countZones()
+
+	h.mutex.Lock()
+	changed := len(zones) != len(h.zones)
+	for zone, n := range zones {
+		if h.zones[zone] != n {
+			changed = true
+		}
+	}
+	h.zones = zones
+	h.mutex.Unlock()
+
+	if !changed {
+		return
+	}
+
+	// Always send the map, even when empty, so clients can clear counts
+	data, _ := json.Marshal(struct {
+		Type  string         `json:"type"`
+		Zones map[string]int `json:"zones"`
+	}{Type: "zones", Zones: zones})
+	h.broadcastToOthers("", data)
+}
+
+// sanitizeZone keeps zone names short and limited to [a-z0-9_-]
+func sanitizeZone(zone string) string {
+	zone = strings.ToLower(zone)
+	if len(zone) > 32 {
+		zone = zone[:32]
+	}
+	for _, r := range zone {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return ""
+		}
+	}
+	return zone
+}
+
+// disconnect sends a client a final "close" message explaining why, then closes it.
+// A non-zero retryAfter tells the client how long to wait before reconnecting.
+// Only for clients that aren't in the active set (or when the hub is shutting
+// down); active clients are dropped with kick.
+func (h *Hub) disconnect(client *Client, code int, reason string, retryAfter time.Duration) {
+	client.trySend(closeFrame(code, reason, retryAfter))
+	client.setClose(code, reason)
+	client.closeSend()
+}
+
+// kick drops an active client: it sends the "close" message, then has the
+// hub unregister it, which takes it out of the active set before closing Send
+// so no broadcast can race the close. Called from the client's readPump.
+func (h *Hub) kick(client *Client, code int, reason string, retryAfter time.Duration) {
+	client.trySend(closeFrame(code, reason, retryAfter))
+	client.setClose(code, reason)
+	h.unregister <- client
+}
+
+// drop kicks a client from outside its pumps: it sends the "close" message
+// and wakes readPump, which sees the close code and unregisters the client
+func (c *Client) drop(code int, reason string, retryAfter time.Duration) {
+	c.trySend(closeFrame(code, reason, retryAfter))
+	c.setClose(code, reason)
+	c.Conn.SetReadDeadline(time.Now())
+}
+
+// tooManyMessages counts a message and reports whether the client has sent
+// more than maxMessagesPerSecond
+func (c *Client) tooManyMessages() bool {
+	if now := time.Now(); now.Sub(c.messagesSince) > time.Second {
+		c.messages, c.messagesSince = 0, now
+	}
+	c.messages++
+	return c.messages > maxMessagesPerSecond
+}
+
+// reconnectFrame is the "reconnect" message telling a client the server is
+// restarting and when to come back
+func reconnectFrame(retryAfter time.Duration) []byte {
+	data, _ := json.Marshal(CursorMessage{
+		Type:       "reconnect",
+		Code:       closeRestarting,
+		Reason:     "restart",
+		RetryAfter: int(retryAfter.Seconds()),
+	})
+	return data
+}
+
+// closeFrame is the "close" message telling a client why it's being dropped
+func closeFrame(code int, reason string, retryAfter time.Duration) []byte {
+	data, _ := json.Marshal(CursorMessage{
+		Type:       "close",
+		Code:       code,
+		Reason:     reason,
+		RetryAfter: int(retryAfter.Seconds()),
+	})
+	return data
+}
+
+// UpgradeRejection is the body of a refused websocket upgrade. Code is the
+// close code the client would have got had it been let in.
+type UpgradeRejection struct {
+	Error      string `json:"error"`
+	Code       int    `json:"code"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+// rejectUpgrade refuses a websocket upgrade, telling the client how long to
+// back off in both the Retry-After header and the body
+func rejectUpgrade(w http.ResponseWriter, status, code int, reason string, retryAfter time.Duration) {
+	seconds := int(retryAfter.Seconds())
+	if seconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(UpgradeRejection{Error: reason, Code: code, RetryAfter: seconds})
+}
+
+// checkCapacity reports whether a new connection from ip would be turned away
+func (h *Hub) checkCapacity(ip string) (code int, reason string) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if h.maxPerIP > 0 && h.ipCounts[ip] >= h.maxPerIP {
+		return closeIPLimit, "ip_limit"
+	}
+	if h.maxClients > 0 && h.users() >= h.maxClients && len(h.waiting) >= h.maxWaiting {
+		return closeServerFull, "full"
+	}
+	return 0, ""
+}
+
+// retryAfter records a rejection for ip and returns how long it should back off
+func (h *Hub) retryAfter(ip string) time.Duration {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now()
+	if len(h.rejections) > 1024 {
+		for k, rej := range h.rejections {
+			if now.Sub(rej.last) > retryWindow {
+				delete(h.rejections, k)
+			}
 		}
 	}
+
+	rej, ok := h.rejections[ip]
+	if !ok || now.Sub(rej.last) > retryWindow {
+		rej = &rejection{}
+		h.rejections[ip] = rej
+	}
+	rej.count++
+	rej.last = now
+
+	delay := retryBase
+	for i := 1; i < rej.count && delay < retryMax; i++ {
+		delay *= 2
+	}
+	if delay > retryMax {
+		delay = retryMax
+	}
+	// Jitter by up to 20% so rejected clients don't come back in lockstep
+	jitter := time.Duration(float64(delay) * 0.2 * mathrand.Float64())
+	return (delay + jitter).Round(time.Second)
+}
+
+// releaseIP drops a client from its IP's connection count (caller holds the lock)
+func (h *Hub) releaseIP(client *Client) {
+	if h.ipCounts[client.IP] <= 1 {
+		delete(h.ipCounts, client.IP)
+	} else {
+		h.ipCounts[client.IP]--
+	}
+}
+
+// sendQueuePositions tells each waiting client where it is in line
+func (h *Hub) sendQueuePositions() {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	for i, client := range h.waiting {
+		client.trySend(queueFrames.get(i + 1))
+	}
 }
 
 func (h *Hub) broadcastToOthers(senderID string, message []byte) {
@@ -182,15 +849,111 @@ func (h *Hub) broadcastToOthers(senderID string, message []byte) {
 	
 	for id, client := range h.clients {
 		if id != senderID {
-			select {
-			case client.Send <- message:
-			default:
+			client.trySend(message)
+		}
+	}
+}
+
+// Proxies allowed to say who the client is with X-Forwarded-For or
+// X-Real-IP, as comma-separated IPs or CIDRs (TRUSTED_PROXIES); the headers
+// are ignored from anyone else, so they can't be used to dodge per-IP limits
+var trustedProxies = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+
+func parseTrustedProxies(spec string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid TRUSTED_PROXIES entry %q: %v", entry, err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// trustedProxy reports whether an address is one of TRUSTED_PROXIES
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the remote address of a request. Behind a trusted proxy it
+// is the last X-Forwarded-For hop that isn't a trusted proxy itself (or
+// X-Real-IP); everyone else's headers are ignored.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		hops := strings.Split(fwd, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop != "" && (i == 0 || !trustedProxy(hop)) {
+				return hop
 			}
 		}
 	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	return host
+}
+
+// Cap on JSON request bodies
+const maxJSONBody = 64 << 10
+
+// decodeJSONBody decodes a request body, refusing to read more than maxJSONBody
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	return json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBody)).Decode(v)
 }
 
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	hub := tenantFor(r).hub
+
+	ip := clientIP(r)
+	visitorID := ""
+	if cookie, err := r.Cookie("visitor_id"); err == nil {
+		visitorID = cookie.Value
+	}
+	if wait := hub.bannedFor(visitorID, ip); wait > 0 {
+		rejectUpgrade(w, http.StatusForbidden, closeBanned, "banned", wait)
+		return
+	}
+
+	// Turn clients away before upgrading when we already know there is no room
+	if code, reason := hub.checkCapacity(ip); code != 0 {
+		status := http.StatusServiceUnavailable
+		if code == closeIPLimit {
+			status = http.StatusTooManyRequests
+		}
+		rejectUpgrade(w, status, code, reason, hub.retryAfter(ip))
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
@@ -204,16 +967,50 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	
 	client := &Client{
 		ID:   clientID,
+		IP:   ip,
 		Conn: conn,
 		Send: make(chan []byte, 256),
+		hub:  hub,
+
+		resumeToken: generateVisitorID(),
+		connectedAt: time.Now(),
+		country:     normalizeCountry(r.Header.Get("CF-IPCountry")),
+	}
+	if cookie, err := r.Cookie("visitor_id"); err == nil {
+		client.visitorID = cookie.Value
+		client.preferredColor = loadPreferredColor(r.Context(), hub.db, client.visitorID)
+		client.place = loadCursorPlace(r.Context(), hub.db, client.visitorID)
+		client.recordCursor = ambientReplay && loadReplayOptIn(r.Context(), hub.db, client.visitorID)
+		touchVisitor(r.Context(), hub.db, client.visitorID)
+	}
+
+	client.device = deviceForRequest(r, tenantFor(r))
+	if cookie, err := r.Cookie("admin_session"); err == nil && adminSessionLogin(tenantFor(r), r) != "" {
+		client.adminSession = hashToken(cookie.Value)
+		client.seasonPreview = seasonPreviewFor(client.adminSession)
+	}
+
+	// Clients reconnecting after a restart keep their ID and cursor, if they
+	// know the resume token they were given
+	if resume := r.URL.Query().Get("resume"); resume != "" {
+		if pos, ok := hub.takeResumable(resume, r.URL.Query().Get("token")); ok {
+			client.ID = resume
+			client.Position = pos
+		}
 	}
 	
-	hub.register <- client
-	
-	// Send client their ID
-	idMsg := CursorMessage{Type: "id", ID: clientID}
+	// Send client their ID (before registering, the hub may close Send)
+	idMsg := CursorMessage{Type: "id", ID: client.ID}
 	data, _ := json.Marshal(idMsg)
 	client.Send <- data
+
+	// Let late joiners know about scheduled downtime
+	if notice := hub.maintenanceNotice(); notice.Enabled {
+		data, _ := json.Marshal(CursorMessage{Type: "maintenance", Maintenance: &notice})
+		client.Send <- data
+	}
+	
+	hub.register <- client
 	
 	// Start goroutines for reading and writing
 	go client.writePump()
@@ -221,15 +1018,30 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 }
 
 func (c *Client) readPump() {
+	hub := c.hub
 	defer func() {
 		hub.unregister <- c
-		c.Conn.Close()
+		// With a close code set, writePump closes the connection once the
+		// close frame is out
+		if code, _ := c.closeInfo(); code == 0 {
+			c.Conn.Close()
+		}
+		if c.recordCursor {
+			go saveCursorRecording(hub.db, c.recording.frames)
+		}
+		if c.visitorID != "" {
+			go recordSession(hub.db, c.visitorID, c.connectedAt, c.pings)
+		}
 	}()
+	defer c.recoverPump("read")
 	
-	c.Conn.SetReadLimit(512)
+	c.Conn.SetReadLimit(1024)
 	c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	c.Conn.SetPongHandler(func(string) error {
-		c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		// A dropped client's deadline has been cut short on purpose
+		if code, _ := c.closeInfo(); code == 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		}
 		return nil
 	})
 	
@@ -239,15 +1051,66 @@ func (c *Client) readPump() {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
 			}
+			if code, reason := c.closeInfo(); code != 0 && c.disconnectReason == "" {
+				// Dropped by the hub or a moderator
+				c.disconnectReason = reason
+			} else if c.disconnectReason == "" {
+				c.disconnectReason = disconnectReason(err)
+				if c.disconnectReason == "timeout" {
+					// No pong within the read deadline
+					c.disconnectReason = "idle_timeout"
+					c.trySend(closeFrame(closeIdleTimeout, "idle_timeout", 0))
+					c.setClose(closeIdleTimeout, "idle_timeout")
+				}
+			}
 			break
 		}
+		if c.disconnectReason != "" {
+			continue
+		}
+		if c.tooManyMessages() {
+			log.Printf("Dropping client %s for sending too many messages", c.ID)
+			c.disconnectReason = "rate_limited"
+			hub.kick(c, closeRateLimited, "rate_limited", rateLimitBackoff)
+			continue
+		}
 		
 		var msg CursorMessage
 		if err := json.Unmarshal(message, &msg); err != nil {
 			continue
 		}
+		hub.messages.Add(1)
+		
+		if msg.Type == "" && isRPC(message) {
+			c.handleRPC(message)
+			continue
+		}
+		
+		// Clients in the waiting room can only wait
+		hub.mutex.RLock()
+		waiting := c.waiting
+		hub.mutex.RUnlock()
+		if waiting || mutedMessages[msg.Type] && c.isMuted() {
+			continue
+		}
 		
 		if msg.Type == "move" && msg.Position != nil {
+			if !validCursorPosition(msg.Position) {
+				if c.rejectMove() {
+					log.Printf("Dropping client %s for sending invalid cursor positions", c.ID)
+					// Keep reading until the close frame has gone out
+					c.disconnectReason = "bad_input"
+					hub.kick(c, closeBadInput, "bad_input", 0)
+				}
+				continue
+			}
+			msg.Position.Zone = sanitizeZone(msg.Position.Zone)
+			normalizePosition(msg.Position)
+			if c.recordCursor {
+				c.recording.add(msg.Position)
+			}
+			c.sampleHeatmap(msg.Position)
+
 			// Update client's position
 			hub.mutex.Lock()
 			if client, ok := hub.clients[c.ID]; ok {
@@ -256,16 +1119,11 @@ func (c *Client) readPump() {
 			hub.mutex.Unlock()
 			
 			// Broadcast to others
-			broadcastMsg := CursorMessage{
-				Type:     "move",
-				ID:       c.ID,
-				Position: msg.Position,
-			}
-			data, _ := json.Marshal(broadcastMsg)
-			hub.broadcastToOthers(c.ID, data)
+			hub.broadcastToOthers(c.ID, encodeMove(c.ID, msg.Position))
 		} else if msg.Type == "ping" && msg.Ping != nil {
 			// Add timestamp
 			msg.Ping.Timestamp = time.Now().Unix()
+			c.pings++
 			
 			// Store in recent pings (keep last 10)
 			hub.mutex.Lock()
@@ -283,25 +1141,64 @@ func (c *Client) readPump() {
 			}
 			data, _ := json.Marshal(pingMsg)
 			hub.broadcast <- data
+			hub.logEvent("ping", c.ID, data)
 			
 			log.Printf("Ping from %s @ %s", msg.Ping.IP, msg.Ping.Location)
+		} else if msg.Type == "color" {
+			c.setColor(msg.Color)
+		} else if msg.Type == "area" {
+			c.setArea(msg.Area)
+		} else if msg.Type == "dm" || msg.Type == "block" || msg.Type == "unblock" {
+			c.handleDM(msg)
+		} else if msg.Type == "peek" {
+			c.handlePeek(msg)
+		} else if msg.Type == "typing" || msg.Type == "typing_stop" {
+			c.setTyping(msg.Type == "typing")
+		} else if followMessages[msg.Type] {
+			c.handleFollow(msg)
+		} else if battleMessages[msg.Type] {
+			c.handleBattle(msg)
 		}
 	}
 }
 
-func (c *Client) writePump() {
-	ticker := time.NewTicker(30 * time.Second)
+// disconnectReason describes a read error as a short reason for the logs
+func disconnectReason(err error) string {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		if closeErr.Text != "" {
+			return fmt.Sprintf("closed %d %s", closeErr.Code, closeErr.Text)
+		}
+		return fmt.Sprintf("closed %d", closeErr.Code)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return "message too large"
+	}
+	return "error"
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(30 * time.Second)
 	defer func() {
 		ticker.Stop()
 		c.Conn.Close()
 	}()
+	defer c.recoverPump("write")
 	
 	for {
 		select {
 		case message, ok := <-c.Send:
 			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if !ok {
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				closeMsg := []byte{}
+				if c.closeCode != 0 {
+					closeMsg = websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+				}
+				c.Conn.WriteMessage(websocket.CloseMessage, closeMsg)
 				return
 			}
 			
@@ -334,86 +1231,616 @@ func (s *LocationStore) exists(lat, lng float64) bool {
 			return true
 		}
 	}
-	return false
-}
-
-// Add location if it doesn't exist
-func (s *LocationStore) Add(lat, lng float64) bool {
-	s.Lock()
-	defer s.Unlock()
+	return false
+}
+
+// Add location if it doesn't exist
+func (s *LocationStore) Add(lat, lng float64) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.exists(lat, lng) {
+		return false
+	}
+
+	s.locations = append(s.locations, Location{
+		Lat:       lat,
+		Lng:       lng,
+		Timestamp: time.Now(),
+	})
+	return true
+}
+
+// Get all locations
+func (s *LocationStore) GetAll() []Location {
+	s.RLock()
+	defer s.RUnlock()
+
+	result := make([]Location, len(s.locations))
+	copy(result, s.locations)
+	return result
+}
+
+func initDB() error {
+	var err error
+	db, err = sql.Open(sqlDriver(), dbPath)
+	if err != nil {
+		return err
+	}
+	if err := initSchema(db); err != nil {
+		return err
+	}
+	readDB, err = openReadDB(dbReadPath, db)
+	return err
+}
+
+// openReadDB opens a read replica, or returns the primary when there is none
+func openReadDB(path string, primary *sql.DB) (*sql.DB, error) {
+	if path == "" {
+		return primary, nil
+	}
+	return sql.Open(sqlDriver(), path)
+}
+
+// initSchema creates or migrates the tables of a site database
+func initSchema(db *sql.DB) error {
+	// Create highscores table
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS highscores (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			game TEXT NOT NULL,
+			name TEXT NOT NULL,
+			score INTEGER NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_highscores_game_score ON highscores(game, score DESC);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create locations table with visitor count
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS locations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			lat REAL NOT NULL,
+			lng REAL NOT NULL,
+			lat_rounded REAL NOT NULL,
+			lng_rounded REAL NOT NULL,
+			visitor_count INTEGER DEFAULT 1,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(lat_rounded, lng_rounded)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Add visitor_count column if it doesn't exist (migration for existing DBs)
+	_, _ = db.Exec(`ALTER TABLE locations ADD COLUMN visitor_count INTEGER DEFAULT 1`)
+
+	// Index for bounding-box queries
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_locations_lat_lng ON locations(lat, lng)`); err != nil {
+		return err
+	}
+
+	// Add country column for highscore flair (migration for existing DBs)
+	_, _ = db.Exec(`ALTER TABLE highscores ADD COLUMN country TEXT`)
+
+	// Add the visitor who set each score, so it can follow them to an account
+	// (migration for existing DBs; older scores have no owner)
+	_, _ = db.Exec(`ALTER TABLE highscores ADD COLUMN visitor_id TEXT`)
+
+	// Create visitors table to track unique visitors by cookie
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS visitors (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			visitor_id TEXT UNIQUE NOT NULL,
+			lat_rounded REAL,
+			lng_rounded REAL,
+			version INTEGER NOT NULL DEFAULT 1,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Add version column for optimistic relocation (migration for existing DBs)
+	_, _ = db.Exec(`ALTER TABLE visitors ADD COLUMN version INTEGER NOT NULL DEFAULT 1`)
+
+	// Add last_seen column for purging idle visitors (migration for existing DBs)
+	if _, err := db.Exec(`ALTER TABLE visitors ADD COLUMN last_seen DATETIME`); err == nil {
+		_, _ = db.Exec(`UPDATE visitors SET last_seen = created_at`)
+	}
+	_, _ = db.Exec(`CREATE INDEX IF NOT EXISTS idx_visitors_last_seen ON visitors(last_seen)`)
+
+	// Create table for per-visitor preferences such as cursor colour
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS visitor_prefs (
+			visitor_id TEXT PRIMARY KEY,
+			color TEXT,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Add opt-out for the place label on cursors (migration for existing DBs)
+	_, _ = db.Exec(`ALTER TABLE visitor_prefs ADD COLUMN hide_place INTEGER NOT NULL DEFAULT 0`)
+
+	// Add theme column for the visitor's CRT theme (migration for existing DBs)
+	_, _ = db.Exec(`ALTER TABLE visitor_prefs ADD COLUMN theme TEXT NOT NULL DEFAULT ''`)
+
+	// Add opt-in for ambient replay recordings (migration for existing DBs)
+	_, _ = db.Exec(`ALTER TABLE visitor_prefs ADD COLUMN share_replay INTEGER NOT NULL DEFAULT 0`)
+
+	// Create table for city labels of rounded visitor locations (see places.go)
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS places (
+			lat_rounded REAL NOT NULL,
+			lng_rounded REAL NOT NULL,
+			name TEXT NOT NULL,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (lat_rounded, lng_rounded)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create tables for optional email accounts and their magic login links
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS accounts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			email TEXT UNIQUE NOT NULL,
+			visitor_id TEXT UNIQUE NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS magic_links (
+			token_hash TEXT PRIMARY KEY,
+			email TEXT NOT NULL,
+			visitor_id TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_magic_links_email ON magic_links(email, created_at);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Add the visitor who asked for each link (migration for existing DBs)
+	_, _ = db.Exec(`ALTER TABLE magic_links ADD COLUMN visitor_id TEXT NOT NULL DEFAULT ''`)
+
+	// Create table for admin sessions from GitHub login
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS admin_sessions (
+			token_hash TEXT PRIMARY KEY,
+			login TEXT NOT NULL,
+			expires_at INTEGER NOT NULL
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create table for the audit log of privileged admin requests
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS admin_audit (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			at INTEGER NOT NULL,
+			actor TEXT NOT NULL,
+			role TEXT NOT NULL,
+			method TEXT NOT NULL,
+			path TEXT NOT NULL,
+			status INTEGER NOT NULL,
+			ip TEXT
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create table for finished multiplayer matches
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS matches (
+			id TEXT PRIMARY KEY,
+			game TEXT NOT NULL,
+			winner_id TEXT NOT NULL,
+			loser_id TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			started_at INTEGER NOT NULL,
+			ended_at INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_matches_game ON matches(game, ended_at);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create tables for tournament brackets
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS tournaments (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			game TEXT NOT NULL,
+			starts_at INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'open',
+			winner_id TEXT,
+			finished_at INTEGER,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS tournament_entries (
+			tournament_id INTEGER NOT NULL,
+			visitor_id TEXT NOT NULL,
+			registered_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (tournament_id, visitor_id)
+		);
+		CREATE TABLE IF NOT EXISTS tournament_matches (
+			tournament_id INTEGER NOT NULL,
+			round INTEGER NOT NULL,
+			slot INTEGER NOT NULL,
+			player_a TEXT NOT NULL,
+			player_b TEXT NOT NULL,
+			winner_id TEXT,
+			ready_at INTEGER NOT NULL,
+			PRIMARY KEY (tournament_id, round, slot)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create table for responses to replay for repeated Idempotency-Keys
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			key TEXT PRIMARY KEY,
+			status INTEGER NOT NULL DEFAULT 0,
+			content_type TEXT NOT NULL DEFAULT '',
+			body BLOB,
+			created_at INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created ON idempotency_keys(created_at);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create table for daily challenge scores
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS challenge_scores (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			day TEXT NOT NULL,
+			game TEXT NOT NULL,
+			name TEXT NOT NULL,
+			score INTEGER NOT NULL,
+			country TEXT,
+			visitor_id TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_challenge_scores_day ON challenge_scores(day, game, score DESC);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create tables for the daily puzzle: every guess, each finished game, and
+	// the seed used when PUZZLE_SEED is unset
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS puzzle_guesses (
+			day TEXT NOT NULL,
+			visitor_id TEXT NOT NULL,
+			attempt INTEGER NOT NULL,
+			guess TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (day, visitor_id, attempt)
+		);
+		CREATE TABLE IF NOT EXISTS puzzle_results (
+			day TEXT NOT NULL,
+			visitor_id TEXT NOT NULL,
+			attempts INTEGER NOT NULL,
+			solved INTEGER NOT NULL,
+			finished_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (day, visitor_id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_puzzle_results_day ON puzzle_results(day, solved);
+		CREATE TABLE IF NOT EXISTS puzzle_seed (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			seed TEXT NOT NULL
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create table for the guestbook
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS guestbook (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			message TEXT NOT NULL,
+			country TEXT NOT NULL DEFAULT '',
+			visitor_id TEXT,
+			ip TEXT,
+			status TEXT NOT NULL DEFAULT 'pending',
+			filtered INTEGER NOT NULL DEFAULT 0,
+			created_at INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_guestbook_status ON guestbook(status, id);
+		CREATE INDEX IF NOT EXISTS idx_guestbook_visitor ON guestbook(visitor_id, created_at);
+		CREATE INDEX IF NOT EXISTS idx_guestbook_ip ON guestbook(ip, created_at);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create table for CRT themes, with the built-ins on first run
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS themes (
+			name TEXT PRIMARY KEY,
+			label TEXT NOT NULL,
+			phosphor TEXT NOT NULL,
+			scanlines REAL NOT NULL,
+			flicker REAL NOT NULL,
+			active INTEGER NOT NULL DEFAULT 0
+		);
+		INSERT INTO themes (name, label, phosphor, scanlines, flicker)
+		SELECT * FROM (VALUES
+			('classic', 'Classic green', '#00ff00', 1, 1),
+			('amber', 'Midnight amber', '#ffb000', 0.6, 0.4),
+			('storm', 'Storm mode', '#ff3333', 1, 1),
+			('paper', 'Paper white', '#e0e0e0', 0.3, 0.2)
+		) WHERE NOT EXISTS (SELECT 1 FROM themes);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create table for registered kiosk devices
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS devices (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			key_hash TEXT NOT NULL,
+			registered_at INTEGER NOT NULL,
+			last_seen INTEGER NOT NULL,
+			resolution TEXT NOT NULL DEFAULT '',
+			version TEXT NOT NULL DEFAULT '',
+			ip TEXT NOT NULL DEFAULT ''
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create table for the site owner's status (a single row)
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS owner_status (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			presence TEXT NOT NULL DEFAULT '',
+			presence_since INTEGER NOT NULL DEFAULT 0,
+			now_playing TEXT NOT NULL DEFAULT '',
+			updated_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create table for per-game Elo ratings
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS ratings (
+			visitor_id TEXT NOT NULL,
+			game TEXT NOT NULL,
+			rating REAL NOT NULL,
+			games INTEGER NOT NULL DEFAULT 0,
+			wins INTEGER NOT NULL DEFAULT 0,
+			losses INTEGER NOT NULL DEFAULT 0,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (visitor_id, game)
+		);
+		CREATE INDEX IF NOT EXISTS idx_ratings_game ON ratings(game, rating DESC);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create table for nicknames reserved by visitors
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS nicknames (
+			name TEXT PRIMARY KEY,
+			visitor_id TEXT UNIQUE NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Add last_used column for expiring unused tags (migration for existing DBs)
+	if _, err := db.Exec(`ALTER TABLE nicknames ADD COLUMN last_used DATETIME`); err == nil {
+		_, _ = db.Exec(`UPDATE nicknames SET last_used = created_at`)
+	}
+
+	// Create daily visitor buckets per location for the map timeline
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS location_daily (
+			lat_rounded REAL NOT NULL,
+			lng_rounded REAL NOT NULL,
+			day TEXT NOT NULL,
+			visitors INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (lat_rounded, lng_rounded, day)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+	if err = backfillLocationDaily(db); err != nil {
+		return err
+	}
+
+	// Create table for recorded cursor sessions (ambient replay)
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cursor_recordings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			frames TEXT NOT NULL,
+			duration_ms INTEGER NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create tables for personal weather stations and their uploads
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS weather_stations (
+			station_id TEXT PRIMARY KEY,
+			key TEXT NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			lat REAL NOT NULL,
+			lng REAL NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS station_readings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			station_id TEXT NOT NULL,
+			observed_at INTEGER NOT NULL,
+			data TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_station_readings_station ON station_readings(station_id, observed_at DESC);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create table for observed conditions per ~1km cell
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS weather_observations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			loc TEXT NOT NULL,
+			lat REAL NOT NULL,
+			lng REAL NOT NULL,
+			observed_at INTEGER NOT NULL,
+			temperature REAL NOT NULL,
+			humidity REAL,
+			wind_speed REAL,
+			weather_code INTEGER,
+			source TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_weather_observations_loc ON weather_observations(loc, observed_at);
+		CREATE TABLE IF NOT EXISTS weather_daily (
+			loc TEXT NOT NULL,
+			date TEXT NOT NULL,
+			lat REAL NOT NULL,
+			lng REAL NOT NULL,
+			min_temp REAL NOT NULL,
+			max_temp REAL NOT NULL,
+			mean_temp REAL NOT NULL,
+			samples INTEGER NOT NULL,
+			PRIMARY KEY (loc, date)
+		);
+		CREATE TABLE IF NOT EXISTS weather_records (
+			loc TEXT PRIMARY KEY,
+			high REAL,
+			high_at INTEGER,
+			low REAL,
+			low_at INTEGER
+		);
+	`)
+	if err != nil {
+		return err
+	}
 
-	if s.exists(lat, lng) {
-		return false
+	// Create tables for A/B experiment exposures and websocket sessions
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS experiment_exposures (
+			experiment TEXT NOT NULL,
+			visitor_id TEXT NOT NULL,
+			variant TEXT NOT NULL,
+			exposed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (experiment, visitor_id)
+		);
+		CREATE TABLE IF NOT EXISTS visitor_sessions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			visitor_id TEXT NOT NULL,
+			started_at INTEGER NOT NULL,
+			ended_at INTEGER,
+			duration_s INTEGER NOT NULL,
+			pings INTEGER NOT NULL DEFAULT 0
+		);
+		CREATE INDEX IF NOT EXISTS idx_visitor_sessions_visitor ON visitor_sessions(visitor_id, started_at);
+		CREATE INDEX IF NOT EXISTS idx_visitor_sessions_started ON visitor_sessions(started_at);
+	`)
+	if err != nil {
+		return err
 	}
 
-	s.locations = append(s.locations, Location{
-		Lat:       lat,
-		Lng:       lng,
-		Timestamp: time.Now(),
-	})
-	return true
-}
-
-// Get all locations
-func (s *LocationStore) GetAll() []Location {
-	s.RLock()
-	defer s.RUnlock()
-
-	result := make([]Location, len(s.locations))
-	copy(result, s.locations)
-	return result
-}
+	// Add session end time (migration for existing DBs)
+	_, _ = db.Exec(`ALTER TABLE visitor_sessions ADD COLUMN ended_at INTEGER`)
 
-func initDB() error {
-	var err error
-	db, err = sql.Open("sqlite3", "./crt-weather.db")
+	// Create the append-only hub event log
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS hub_events (
+			seq INTEGER PRIMARY KEY AUTOINCREMENT,
+			type TEXT NOT NULL,
+			client_id TEXT NOT NULL DEFAULT '',
+			data TEXT NOT NULL,
+			created_at INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_hub_events_type ON hub_events(type, seq);
+	`)
 	if err != nil {
 		return err
 	}
 
-	// Create highscores table
+	// Create the aggregate cursor heatmap
 	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS highscores (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			game TEXT NOT NULL,
-			name TEXT NOT NULL,
-			score INTEGER NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		CREATE TABLE IF NOT EXISTS cursor_heatmap (
+			page TEXT NOT NULL,
+			cell_x INTEGER NOT NULL,
+			cell_y INTEGER NOT NULL,
+			day TEXT NOT NULL,
+			samples INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (page, cell_x, cell_y, day)
 		);
-		CREATE INDEX IF NOT EXISTS idx_highscores_game_score ON highscores(game, score DESC);
 	`)
 	if err != nil {
 		return err
 	}
 
-	// Create locations table with visitor count
+	// Create the lease table used for leader election between instances
 	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS locations (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			lat REAL NOT NULL,
-			lng REAL NOT NULL,
-			lat_rounded REAL NOT NULL,
-			lng_rounded REAL NOT NULL,
-			visitor_count INTEGER DEFAULT 1,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			UNIQUE(lat_rounded, lng_rounded)
+		CREATE TABLE IF NOT EXISTS leader_leases (
+			name TEXT PRIMARY KEY,
+			holder TEXT NOT NULL,
+			expires_at INTEGER NOT NULL
 		);
 	`)
 	if err != nil {
 		return err
 	}
 
-	// Add visitor_count column if it doesn't exist (migration for existing DBs)
-	_, _ = db.Exec(`ALTER TABLE locations ADD COLUMN visitor_count INTEGER DEFAULT 1`)
+	// Create per-minute activity rollups
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS metrics_rollup (
+			minute INTEGER PRIMARY KEY,
+			users INTEGER NOT NULL DEFAULT 0,
+			messages INTEGER NOT NULL DEFAULT 0
+		);
+	`)
+	if err != nil {
+		return err
+	}
 
-	// Create visitors table to track unique visitors by cookie
+	// Create table for all-time records
 	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS visitors (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			visitor_id TEXT UNIQUE NOT NULL,
-			lat_rounded REAL,
-			lng_rounded REAL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		CREATE TABLE IF NOT EXISTS records (
+			name TEXT PRIMARY KEY,
+			value INTEGER NOT NULL,
+			achieved_at INTEGER NOT NULL
 		);
 	`)
 	if err != nil {
@@ -442,9 +1869,9 @@ func initDB() error {
 	return nil
 }
 
-func getHighscores(game string) ([]Highscore, error) {
-	rows, err := db.Query(`
-		SELECT id, game, name, score FROM highscores 
+func getHighscores(ctx context.Context, db *sql.DB, game string) ([]Highscore, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, game, name, score, COALESCE(country, '') FROM highscores 
 		WHERE game = ? 
 		ORDER BY score DESC 
 		LIMIT 5
@@ -457,9 +1884,10 @@ func getHighscores(game string) ([]Highscore, error) {
 	var scores []Highscore
 	for rows.Next() {
 		var h Highscore
-		if err := rows.Scan(&h.ID, &h.Game, &h.Name, &h.Score); err != nil {
+		if err := rows.Scan(&h.ID, &h.Game, &h.Name, &h.Score, &h.Country); err != nil {
 			return nil, err
 		}
+		h.Flag = countryFlag(h.Country)
 		scores = append(scores, h)
 	}
 
@@ -471,24 +1899,66 @@ func getHighscores(game string) ([]Highscore, error) {
 	return scores, nil
 }
 
-func saveHighscore(game, name string, score int) error {
-	// Sanitize name to 3 uppercase letters
-	name = strings.ToUpper(name)
-	if len(name) > 3 {
-		name = name[:3]
+// Boards change rarely, so keep them in memory; saving a score refreshes its
+// board here, and other instances (or a lagging replica) catch up within
+// highscoreCacheTTL
+const highscoreCacheTTL = 30 * time.Second
+
+var highscoreCache = newLRUCache[[]Highscore](64, highscoreCacheTTL)
+
+func highscoreCacheKey(site *Tenant, game string) string {
+	return site.Name + "/" + game
+}
+
+// cachedHighscores returns a site's board for a game, from memory when possible
+func cachedHighscores(ctx context.Context, site *Tenant, game string) ([]Highscore, error) {
+	return highscoreCache.get(highscoreCacheKey(site, game), func() ([]Highscore, error) {
+		return getHighscores(ctx, site.readDB, game)
+	})
+}
+
+// normalizeCountry returns an uppercase two-letter country code, or "" if invalid
+func normalizeCountry(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' || code == "XX" {
+		return ""
+	}
+	return code
+}
+
+// countryFlag turns a country code into its regional indicator flag emoji
+func countryFlag(code string) string {
+	if normalizeCountry(code) == "" {
+		return ""
+	}
+	return string([]rune{rune(code[0]-'A') + 0x1F1E6, rune(code[1]-'A') + 0x1F1E6})
+}
+
+// sanitizeName normalizes a highscore name to 3 uppercase characters
+func sanitizeName(name string) string {
+	// Count characters, not bytes, so a multi-byte letter isn't cut in half
+	runes := []rune(strings.ToUpper(name))
+	if len(runes) > 3 {
+		runes = runes[:3]
 	}
-	for len(name) < 3 {
-		name += " "
+	for len(runes) < 3 {
+		runes = append(runes, ' ')
 	}
+	return string(runes)
+}
+
+func saveHighscore(ctx context.Context, db *sql.DB, game, name string, score int, country, visitorID string) error {
+	name = sanitizeName(name)
 
 	// Insert the new score
-	_, err := db.Exec("INSERT INTO highscores (game, name, score) VALUES (?, ?, ?)", game, name, score)
+	_, err := db.ExecContext(ctx, "INSERT INTO highscores (game, name, score, country, visitor_id) VALUES (?, ?, ?, ?, ?)",
+		game, name, score, normalizeCountry(country), visitorID)
 	if err != nil {
 		return err
 	}
 
 	// Keep only top 5 scores per game
-	_, err = db.Exec(`
+	_, err = db.ExecContext(ctx, `
 		DELETE FROM highscores 
 		WHERE game = ? AND id NOT IN (
 			SELECT id FROM highscores 
@@ -508,56 +1978,98 @@ func generateVisitorID() string {
 	return hex.EncodeToString(b)
 }
 
-// checkVisitorExists checks if a visitor ID already exists and has a location
-func checkVisitorExists(visitorID string) (bool, float64, float64, error) {
+// errVisitorConflict means the visitor's location changed since it was read,
+// e.g. two tabs submitting different locations at the same time
+var errVisitorConflict = errors.New("visitor location changed concurrently")
+
+// checkVisitorExists checks if a visitor ID already has a location, returning
+// the row's version for the optimistic update in updateVisitor (0 if there is
+// no row yet)
+func checkVisitorExists(ctx context.Context, tx *sql.Tx, visitorID string) (bool, float64, float64, int, error) {
 	var latRounded, lngRounded sql.NullFloat64
-	err := db.QueryRow(`SELECT lat_rounded, lng_rounded FROM visitors WHERE visitor_id = ?`, visitorID).Scan(&latRounded, &lngRounded)
+	var version int
+	err := tx.QueryRowContext(ctx, `SELECT lat_rounded, lng_rounded, version FROM visitors WHERE visitor_id = ?`, visitorID).Scan(&latRounded, &lngRounded, &version)
 	if err == sql.ErrNoRows {
-		return false, 0, 0, nil
+		return false, 0, 0, 0, nil
 	}
 	if err != nil {
-		return false, 0, 0, err
+		return false, 0, 0, 0, err
 	}
-	return true, latRounded.Float64, lngRounded.Float64, nil
+	hasLocation := latRounded.Valid && lngRounded.Valid
+	return hasLocation, latRounded.Float64, lngRounded.Float64, version, nil
 }
 
-// addOrUpdateVisitor adds a new visitor or updates existing one
-func addOrUpdateVisitor(visitorID string, latRounded, lngRounded float64) error {
-	_, err := db.Exec(`
-		INSERT INTO visitors (visitor_id, lat_rounded, lng_rounded) 
-		VALUES (?, ?, ?)
-		ON CONFLICT(visitor_id) DO UPDATE SET lat_rounded = ?, lng_rounded = ?
-	`, visitorID, latRounded, lngRounded, latRounded, lngRounded)
-	return err
+// updateVisitor adds a new visitor (version 0) or moves an existing one if it
+// is still at the given version, returning errVisitorConflict otherwise
+func updateVisitor(ctx context.Context, tx *sql.Tx, visitorID string, latRounded, lngRounded float64, version int) error {
+	var result sql.Result
+	var err error
+	if version == 0 {
+		result, err = tx.ExecContext(ctx, `
+			INSERT INTO visitors (visitor_id, lat_rounded, lng_rounded, version)
+			VALUES (?, ?, ?, 1)
+			ON CONFLICT(visitor_id) DO NOTHING
+		`, visitorID, latRounded, lngRounded)
+	} else {
+		result, err = tx.ExecContext(ctx, `
+			UPDATE visitors SET lat_rounded = ?, lng_rounded = ?, version = version + 1
+			WHERE visitor_id = ? AND version = ?
+		`, latRounded, lngRounded, visitorID, version)
+	}
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errVisitorConflict
+	}
+	return nil
 }
 
-func addLocationToDB(lat, lng float64, visitorID string) (LocationResponse, error) {
+// addLocationToDB counts a visitor at a location. If expectedVersion is set it
+// must match the visitor's current version, so a tab holding stale state gets
+// errVisitorConflict instead of counting the visitor twice.
+func addLocationToDB(ctx context.Context, db *sql.DB, lat, lng float64, visitorID string, expectedVersion int) (LocationResponse, error) {
 	latRounded := roundCoord(lat, 2)
 	lngRounded := roundCoord(lng, 2)
 	response := LocationResponse{}
 
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return response, err
+	}
+	defer tx.Rollback()
+
 	// Check if this visitor already registered a location
-	exists, oldLat, oldLng, err := checkVisitorExists(visitorID)
+	exists, oldLat, oldLng, version, err := checkVisitorExists(ctx, tx, visitorID)
 	if err != nil {
 		return response, err
 	}
+	if expectedVersion != 0 && expectedVersion != version {
+		response.Version = version
+		return response, errVisitorConflict
+	}
 
 	// If visitor exists and already has the same location, don't count again
 	if exists && oldLat == latRounded && oldLng == lngRounded {
 		// Just return current count for this location
 		var count int
-		err = db.QueryRow(`SELECT visitor_count FROM locations WHERE lat_rounded = ? AND lng_rounded = ?`, latRounded, lngRounded).Scan(&count)
+		err = tx.QueryRowContext(ctx, `SELECT visitor_count FROM locations WHERE lat_rounded = ? AND lng_rounded = ?`, latRounded, lngRounded).Scan(&count)
 		if err != nil && err != sql.ErrNoRows {
 			return response, err
 		}
 		response.Added = false
 		response.IsFirst = false
 		response.VisitorCount = count
+		response.Version = version
 		return response, nil
 	}
 
 	// Try to insert new location
-	result, err := db.Exec(`
+	result, err := tx.ExecContext(ctx, `
 		INSERT OR IGNORE INTO locations (lat, lng, lat_rounded, lng_rounded, visitor_count) 
 		VALUES (?, ?, ?, ?, 1)
 	`, lat, lng, latRounded, lngRounded)
@@ -577,14 +2089,14 @@ func addLocationToDB(lat, lng float64, visitorID string) (LocationResponse, erro
 		response.VisitorCount = 1
 	} else {
 		// Location exists - increment visitor count
-		_, err = db.Exec(`UPDATE locations SET visitor_count = visitor_count + 1 WHERE lat_rounded = ? AND lng_rounded = ?`, latRounded, lngRounded)
+		_, err = tx.ExecContext(ctx, `UPDATE locations SET visitor_count = visitor_count + 1 WHERE lat_rounded = ? AND lng_rounded = ?`, latRounded, lngRounded)
 		if err != nil {
 			return response, err
 		}
 
 		// Get updated count
 		var count int
-		err = db.QueryRow(`SELECT visitor_count FROM locations WHERE lat_rounded = ? AND lng_rounded = ?`, latRounded, lngRounded).Scan(&count)
+		err = tx.QueryRowContext(ctx, `SELECT visitor_count FROM locations WHERE lat_rounded = ? AND lng_rounded = ?`, latRounded, lngRounded).Scan(&count)
 		if err != nil {
 			return response, err
 		}
@@ -594,17 +2106,24 @@ func addLocationToDB(lat, lng float64, visitorID string) (LocationResponse, erro
 		response.VisitorCount = count
 	}
 
-	// Record this visitor
-	err = addOrUpdateVisitor(visitorID, latRounded, lngRounded)
+	// Record this visitor, unless another request moved them in the meantime
+	err = updateVisitor(ctx, tx, visitorID, latRounded, lngRounded, version)
+	if err != nil {
+		return response, err
+	}
+	response.Version = version + 1
+
+	// Count the visit towards today's bucket for the map timeline
+	err = recordLocationVisit(tx, latRounded, lngRounded, time.Now(), 1)
 	if err != nil {
 		return response, err
 	}
 
-	return response, nil
+	return response, tx.Commit()
 }
 
-func getLocationsFromDB() ([]Location, error) {
-	rows, err := db.Query(`SELECT lat, lng, created_at FROM locations`)
+func getLocationsFromDB(ctx context.Context, db *sql.DB) ([]Location, error) {
+	rows, err := db.QueryContext(ctx, `SELECT lat, lng, created_at FROM locations`)
 	if err != nil {
 		return nil, err
 	}
@@ -622,25 +2141,32 @@ func getLocationsFromDB() ([]Location, error) {
 	return locations, nil
 }
 
-func handleAddLocation(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// getLocationsInBBox returns the locations inside a bounding box
+func getLocationsInBBox(ctx context.Context, db *sql.DB, b BBox) ([]Location, error) {
+	lngFilter := `lng BETWEEN ? AND ?`
+	if b.MinLng > b.MaxLng {
+		lngFilter = `(lng >= ? OR lng <= ?)`
 	}
-
-	var loc Location
-	if err := json.NewDecoder(r.Body).Decode(&loc); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+	rows, err := db.QueryContext(ctx, `SELECT lat, lng, created_at FROM locations WHERE lat BETWEEN ? AND ? AND `+lngFilter,
+		b.MinLat, b.MaxLat, b.MinLng, b.MaxLng)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Validate coordinates
-	if loc.Lat < -90 || loc.Lat > 90 || loc.Lng < -180 || loc.Lng > 180 {
-		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
-		return
+	var locations []Location
+	for rows.Next() {
+		var loc Location
+		if err := rows.Scan(&loc.Lat, &loc.Lng, &loc.Timestamp); err != nil {
+			return nil, err
+		}
+		locations = append(locations, loc)
 	}
+	return locations, rows.Err()
+}
 
-	// Get or create visitor ID from cookie
+// visitorIDFromRequest gets or creates the visitor ID cookie and refreshes it
+func visitorIDFromRequest(w http.ResponseWriter, r *http.Request) string {
 	visitorID := ""
 	cookie, err := r.Cookie("visitor_id")
 	if err == nil {
@@ -649,7 +2175,14 @@ func handleAddLocation(w http.ResponseWriter, r *http.Request) {
 		visitorID = generateVisitorID()
 	}
 
-	// Set cookie (valid for 1 year)
+	setVisitorCookie(w, visitorID)
+	csrfTokenFromRequest(w, r)
+	touchVisitor(r.Context(), tenantFor(r).db, visitorID)
+	return visitorID
+}
+
+// setVisitorCookie sets the visitor ID cookie (valid for 1 year)
+func setVisitorCookie(w http.ResponseWriter, visitorID string) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     "visitor_id",
 		Value:    visitorID,
@@ -658,13 +2191,63 @@ func handleAddLocation(w http.ResponseWriter, r *http.Request) {
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
 	})
+}
+
+func handleAddLocation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var loc struct {
+		Location
+		// Version from the previous response; a stale one is rejected with 409
+		Version int `json:"version"`
+	}
+	if err := decodeJSONBody(w, r, &loc); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	// Validate coordinates
+	if loc.Lat < -90 || loc.Lat > 90 || loc.Lng < -180 || loc.Lng > 180 {
+		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+		return
+	}
+
+	visitorID := visitorIDFromRequest(w, r)
 
-	response, err := addLocationToDB(loc.Lat, loc.Lng, visitorID)
+	site := tenantFor(r)
+	response, err := addLocationToDB(r.Context(), site.db, loc.Lat, loc.Lng, visitorID, loc.Version)
+	if errors.Is(err, errVisitorConflict) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "conflict", "version": response.Version})
+		return
+	}
+	if err != nil && isTransientDBError(err) {
+		// Retries run after the response, so they must outlive the request
+		ctx := context.WithoutCancel(r.Context())
+		queued := pendingWrites.enqueue("location for "+visitorID, func() error {
+			_, err := addLocationToDB(ctx, site.db, loc.Lat, loc.Lng, visitorID, 0)
+			if err == nil {
+				site.clusters.invalidate()
+			}
+			return err
+		})
+		if queued {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(LocationResponse{Queued: true})
+			return
+		}
+	}
 	if err != nil {
 		log.Printf("Error adding location: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	site.clusters.invalidate()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -676,7 +2259,40 @@ func handleGetLocations(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	locations, err := getLocationsFromDB()
+	site := tenantFor(r)
+	var bbox *BBox
+	if s := r.URL.Query().Get("bbox"); s != "" {
+		b, ok := parseBBox(s)
+		if !ok {
+			http.Error(w, "Invalid bbox parameter", http.StatusBadRequest)
+			return
+		}
+		bbox = &b
+	}
+
+	var locations []Location
+	var err error
+	if asOfParam := r.URL.Query().Get("asOf"); asOfParam != "" {
+		asOf, ok := parseAsOf(asOfParam)
+		if !ok {
+			http.Error(w, "Invalid asOf parameter", http.StatusBadRequest)
+			return
+		}
+		locations, err = getLocationsAsOf(r.Context(), site.readDB, asOf)
+		if err == nil && bbox != nil {
+			inside := locations[:0]
+			for _, loc := range locations {
+				if bbox.contains(loc.Lat, loc.Lng) {
+					inside = append(inside, loc)
+				}
+			}
+			locations = inside
+		}
+	} else if bbox != nil {
+		locations, err = getLocationsInBBox(r.Context(), site.readDB, *bbox)
+	} else {
+		locations, err = getLocationsFromDB(r.Context(), site.readDB)
+	}
 	if err != nil {
 		log.Printf("Error getting locations: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -687,6 +2303,23 @@ func handleGetLocations(w http.ResponseWriter, r *http.Request) {
 		locations = []Location{}
 	}
 
+	if wantsCSV(w, r) {
+		out := newCSVResponse(w, "locations.csv", "lat", "lng", "timestamp")
+		for _, loc := range locations {
+			if err := out.row(csvFloat(loc.Lat), csvFloat(loc.Lng), loc.Timestamp.UTC().Format(time.RFC3339)); err != nil {
+				return
+			}
+		}
+		out.close()
+		return
+	}
+	if wantsMsgpack(w, r) {
+		if err := writeMsgpack(w, locations); err != nil {
+			log.Printf("Error writing locations: %v", err)
+		}
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(locations)
 }
@@ -710,13 +2343,24 @@ func handleGetHighscores(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	scores, err := getHighscores(strings.ToUpper(game))
+	scores, err := cachedHighscores(r.Context(), tenantFor(r), strings.ToUpper(game))
 	if err != nil {
 		log.Printf("Error getting highscores: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	if wantsCSV(w, r) {
+		out := newCSVResponse(w, "highscores-"+strings.ToLower(game)+".csv", "rank", "game", "name", "score", "country")
+		for i, hs := range scores {
+			if err := out.row(csvInt(i+1), strings.ToUpper(game), csvText(hs.Name), csvInt(hs.Score), hs.Country); err != nil {
+				return
+			}
+		}
+		out.close()
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(scores)
 }
@@ -728,12 +2372,13 @@ func handleSaveHighscore(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Game  string `json:"game"`
-		Name  string `json:"name"`
-		Score int    `json:"score"`
+		Game    string `json:"game"`
+		Name    string `json:"name"`
+		Score   int    `json:"score"`
+		Country string `json:"country"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := decodeJSONBody(w, r, &req); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
@@ -756,7 +2401,65 @@ func handleSaveHighscore(w http.ResponseWriter, r *http.Request) {
 		score = 999999
 	}
 
-	err := saveHighscore(strings.ToUpper(req.Game), req.Name, score)
+	// Prefer the CDN's geolocation over what the client claims
+	country := r.Header.Get("CF-IPCountry")
+	if normalizeCountry(country) == "" {
+		country = req.Country
+	}
+
+	site := tenantFor(r)
+	game := strings.ToUpper(req.Game)
+	visitorID := visitorIDFromRequest(w, r)
+	// save may be retried from the write queue after the response
+	ctx := context.WithoutCancel(r.Context())
+	save := func() error {
+		return saveHighscore(ctx, site.db, game, req.Name, score, country, visitorID)
+	}
+
+	// Reserved names can only be used by the visitor who holds them
+	owner, err := getNicknameOwner(r.Context(), site.db, sanitizeName(req.Name))
+	if err != nil && !isTransientDBError(err) {
+		log.Printf("Error checking nickname: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		// The database is unavailable; check the name when the write is retried
+		save = func() error {
+			owner, err := getNicknameOwner(ctx, site.db, sanitizeName(req.Name))
+			if err != nil {
+				return err
+			}
+			if owner != "" && owner != visitorID {
+				return errNameReserved
+			}
+			return saveHighscore(ctx, site.db, game, req.Name, score, country, visitorID)
+		}
+	} else if owner != "" && owner != visitorID {
+		http.Error(w, "Name reserved", http.StatusConflict)
+		return
+	} else if owner != "" {
+		go useNickname(ctx, site.db, owner)
+	}
+
+	err = save()
+	if err != nil && isTransientDBError(err) {
+		queued := pendingWrites.enqueue("highscore "+game+" "+sanitizeName(req.Name), func() error {
+			if err := save(); err != nil {
+				return err
+			}
+			highscoreCache.remove(highscoreCacheKey(site, game))
+			return nil
+		})
+		if queued {
+			// Show the score on the board as if it were saved
+			board := provisionalBoard(site, game, req.Name, score, country)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(board)
+			return
+		}
+	}
 	if err != nil {
 		log.Printf("Error saving highscore: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -764,39 +2467,306 @@ func handleSaveHighscore(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Return updated scores
-	scores, err := getHighscores(strings.ToUpper(req.Game))
+	scores, err := getHighscores(r.Context(), site.db, strings.ToUpper(req.Game))
+	if err != nil && isTransientDBError(err) {
+		// Saved, but the board can't be read right now
+		highscoreCache.remove(highscoreCacheKey(site, game))
+		scores, err = provisionalBoard(site, game, req.Name, score, country), nil
+	}
 	if err != nil {
 		log.Printf("Error getting highscores: %v", err)
+		highscoreCache.remove(highscoreCacheKey(site, strings.ToUpper(req.Game)))
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	highscoreCache.put(highscoreCacheKey(site, strings.ToUpper(req.Game)), scores)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(scores)
 }
 
 func main() {
-	log.Println("Starting CRT Weather Terminal on :8000")
+	// Subcommands for operating the server from a shell
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "--print-config", "print-config":
+			printConfig(os.Stdout)
+			return
+		case "stats", "inspect":
+			var err error
+			if db, err = openInspectDB(dbPath); err != nil {
+				log.Fatalf("Failed to open database: %v", err)
+			}
+			defer db.Close()
+			if err := runInspect(os.Stdout); err != nil {
+				log.Fatalf("Inspect failed: %v", err)
+			}
+			return
+		case "import":
+			if len(os.Args) < 3 {
+				log.Fatalf("Usage: %s import <locations.csv|locations.geojson>", os.Args[0])
+			}
+			if err := initDB(); err != nil {
+				log.Fatalf("Failed to initialize database: %v", err)
+			}
+			defer db.Close()
+			f, err := os.Open(os.Args[2])
+			if err != nil {
+				log.Fatalf("Failed to open import file: %v", err)
+			}
+			defer f.Close()
+			locations, skipped, err := parseLocationImport(f)
+			if err != nil {
+				log.Fatalf("Failed to parse import file: %v", err)
+			}
+			result, err := importLocations(context.Background(), db, locations)
+			if err != nil {
+				log.Fatalf("Import failed: %v", err)
+			}
+			log.Printf("Imported locations: %d added, %d merged, %d skipped", result.Added, result.Merged, result.Skipped+skipped)
+			return
+		default:
+			log.Fatalf("Unknown command: %s (available: stats, inspect, import, --print-config)", os.Args[1])
+		}
+	}
+
+	listenAddr := envString("LISTEN_ADDR", ":8000")
+	log.Printf("Starting CRT Weather Terminal on %s", listenAddr)
+
+	if err := checkCaptchaConfig(); err != nil {
+		log.Fatalf("Invalid captcha configuration: %v", err)
+	}
 
 	// Initialize database
 	if err := initDB(); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
-	defer db.Close()
 	log.Println("Database initialized")
 
+	hub = newTenantHub("", db)
+	defaultTenant = &Tenant{Name: "default", adminToken: adminToken, githubUsers: parseGitHubUsers(os.Getenv("ADMIN_GITHUB_USERS")), apiKey: secret("LOCATIONS_API_KEY"), kioskToken: secret("KIOSK_TOKEN"), webhookSecret: webhookSecret, url: siteURL, db: db, readDB: readDB, hub: hub, clusters: newClusterIndex()}
+	peak, err := loadPeakRecord(db)
+	if err != nil {
+		log.Fatalf("Failed to load peak record: %v", err)
+	}
+	hub.peak = peak
+	if hub.owner, err = loadOwnerStatus(db); err != nil {
+		log.Fatalf("Failed to load owner status: %v", err)
+	}
+	if hub.theme, err = loadActiveTheme(context.Background(), db); err != nil {
+		log.Fatalf("Failed to load site theme: %v", err)
+	}
+	if puzzleSeed, err = loadPuzzleSeed(db); err != nil {
+		log.Fatalf("Failed to load puzzle seed: %v", err)
+	}
+
+	if err := loadTenants(os.Getenv("TENANTS")); err != nil {
+		log.Fatalf("Failed to load tenants: %v", err)
+	}
+
+	for _, h := range allHubs() {
+		if err := h.rebuildFromEventLog(); err != nil {
+			log.Printf("Failed to rebuild hub from event log: %v", err)
+		}
+	}
+	for _, h := range allHubs() {
+		h.restoreState(h.stateFile)
+	}
+
+	startDBMonitors()
+
+	go pendingWrites.run()
+	if tracingEnabled {
+		go runSpanExporter()
+		log.Printf("Exporting traces to %s", tracesEndpoint)
+	}
+
+	// Scheduled jobs run on whichever instance holds the lease
+	jobLeader = newLeaderElector(db, "jobs")
+	go jobLeader.run()
+
 	// Start WebSocket hub
-	go hub.run()
+	for _, h := range allHubs() {
+		go h.run()
+		go h.runEventLog()
+		go h.runHeatmapFlush()
+		go runActivityRollup(h)
+		go h.runRotation()
+	}
+	if ambientReplay {
+		for _, h := range allHubs() {
+			go h.runAmbientReplay()
+		}
+	}
+	startNPCs()
+	go runTournaments()
+	go runCleanup()
+	for _, h := range allHubs() {
+		go h.watchHandoff(h.stateFile)
+	}
+	checkFrontendAssets()
+	go watchFrontendAssets()
+	go runSeasons()
+	if addr := telnetAddr(); addr != "" {
+		go runTelnet(addr)
+	}
+	if addr := gopherAddr(); addr != "" {
+		go runGopher(addr)
+	}
+	if addr := fingerAddr(); addr != "" {
+		go runFinger(addr)
+	}
+	if feeds := lightningFeeds(); len(feeds) > 0 {
+		go runLightningFeed(feeds)
+	}
+	if mag := quakeAlertMag(); mag > 0 {
+		go runQuakeAlerts(mag)
+	}
+	if kp := auroraAlertKp(); kp > 0 {
+		go runAuroraAlerts(kp)
+	}
 
 	// API endpoints
-	http.HandleFunc("/api/location", handleAddLocation)
+	http.HandleFunc("/api/location", requireCSRF(requireCaptcha(handleAddLocation)))
+	http.HandleFunc("/api/locations/batch", requireAPIKeyOr(roleAdmin, handleBatchLocations))
 	http.HandleFunc("/api/locations", handleGetLocations)
+	http.HandleFunc("/api/locations/replay", handleLocationReplay)
+	http.HandleFunc("/api/pings", handleGetPings)
+	http.HandleFunc("/api/locations/export.ndjson", requireRole(roleViewer, handleExportLocations))
 	http.HandleFunc("/api/highscores", handleGetHighscores)
-	http.HandleFunc("/api/highscore", handleSaveHighscore)
+	http.HandleFunc("/api/highscore", requireCSRF(withIdempotency(requireCaptcha(handleSaveHighscore))))
+	http.HandleFunc("/api/me/tag", requireCSRF(requireCaptcha(handleNickname)))
+	http.HandleFunc("/api/place", requireCSRF(handlePlace))
+	http.HandleFunc("/api/replay", requireCSRF(handleReplay))
+	http.HandleFunc("/api/account", requireCSRF(requireCaptcha(handleAccount)))
+	http.HandleFunc("/api/account/verify", handleAccountVerify)
+	http.HandleFunc("/api/stats", handleGetStats)
+	http.HandleFunc("/api/presence", handleGetPresence)
+	http.HandleFunc("/api/owner/status", handleOwnerStatus)
+	http.HandleFunc("/api/themes", handleThemes)
+	http.HandleFunc("/api/season", handleGetSeason)
+	http.HandleFunc("/api/theme", requireCSRF(handleSetTheme))
+	http.HandleFunc("/api/devices/register", handleRegisterDevice)
+	http.HandleFunc("/api/devices/heartbeat", handleDeviceHeartbeat)
+	http.HandleFunc("/api/badge/visitors.json", handleVisitorsBadge)
+	http.HandleFunc("/api/matches/leaderboard", handleVersusLeaderboard)
+	http.HandleFunc("/api/rankings", handleGetRankings)
+	http.HandleFunc("/api/tournaments", handleGetTournaments)
+	http.HandleFunc("/api/tournaments/register", requireCSRF(handleTournamentRegister))
+	http.HandleFunc("/api/challenge/today", handleChallengeToday)
+	http.HandleFunc("/api/challenge/scores", requireCSRF(requireCaptcha(handleChallengeScores)))
+	http.HandleFunc("/api/puzzle/today", handlePuzzleToday)
+	http.HandleFunc("/api/puzzle/guess", requireCSRF(handlePuzzleGuess))
+	http.HandleFunc("/api/puzzle/stats", handlePuzzleStats)
+	http.HandleFunc("/api/guestbook", requireCSRF(requireCaptcha(handleGuestbook)))
+	http.HandleFunc("/api/badge/highscore.json", handleHighscoreBadge)
+	http.HandleFunc("/api/stats/activity", handleGetActivity)
+	http.HandleFunc("/api/stats/cursor-heatmap", handleGetCursorHeatmap)
+	http.HandleFunc("/api/stats/sessions", handleGetSessionStats)
+	http.HandleFunc("/api/stats/distances", handleGetDistanceStats)
+	http.HandleFunc("/api/geo/fun", handleGetGeoFun)
+	http.HandleFunc("/api/weather/glyphs", handleGetGlyphs)
+	http.HandleFunc("/api/weather/pollen", handleGetPollen)
+	http.HandleFunc("/api/tides", handleGetMarine)
+	http.HandleFunc("/api/weather/compare", handleWeatherCompare)
+	http.HandleFunc("/api/weather/records", handleGetWeatherRecords)
+	http.HandleFunc("/api/lightning", handleGetLightning)
+	http.HandleFunc("/api/webcam", handleGetWebcam)
+	http.HandleFunc("/api/map/ascii", handleGetASCIIMap)
+	http.HandleFunc("/api/locations/clusters", handleGetLocationClusters)
+	http.HandleFunc("/api/quakes", handleGetEarthquakes)
+	http.HandleFunc("/api/iss", handleGetSatellitePasses)
+	http.HandleFunc("/api/satellites/position", handleGetSatellitePosition)
+	http.HandleFunc("/api/aurora", handleGetAurora)
+	http.HandleFunc("/api/events", handleGetEvents)
+	http.HandleFunc("/api/experiments", handleGetExperiments)
+	http.HandleFunc("/api/stations", handleGetStations)
+	http.HandleFunc("/api/pws/update", handleStationUpload)
+	http.HandleFunc("/api/ingest", handleIngest)
+	http.HandleFunc("/api/webhooks/", handleWebhook)
+	http.HandleFunc("/api/weather/teletype", handleGetTeletype)
+	http.HandleFunc("/api/panel/", handleGetPanel)
 	http.HandleFunc("/ws", handleWebSocket)
+	http.HandleFunc("/readyz", handleReadyz)
+	http.HandleFunc("/feed.xml", handleFeed)
+	http.HandleFunc("/api/og.png", handleStatusImage)
+	http.HandleFunc(connectPrefix, handleConnect)
+	http.HandleFunc("/graphql", handleGraphQL)
+
+	// Admin endpoints (require ADMIN_TOKEN)
+	http.HandleFunc("/admin/import/locations", requireRole(roleAdmin, handleImportLocations))
+	http.HandleFunc("/admin/stations", requireRole(roleAdmin, handleRegisterStation))
+	http.HandleFunc("/admin/maintenance", requireRole(roleAdmin, handleMaintenance))
+	http.HandleFunc("/admin/rotation", requireRole(roleAdmin, handleRotation))
+	http.HandleFunc("/admin/devices", requireRole(roleAdmin, handleDevices))
+	http.HandleFunc("/admin/devices/command", requireRole(roleAdmin, handleDeviceCommand))
+	http.HandleFunc("/admin/themes", requireRole(roleAdmin, handleAdminThemes))
+	http.HandleFunc("/admin/themes/active", requireRole(roleAdmin, handleActiveTheme))
+	http.HandleFunc("/admin/season", requireRole(roleAdmin, handleSeasonPreview))
+	http.HandleFunc("/admin/experiments", requireRole(roleViewer, handleExperimentResults))
+	http.HandleFunc("/admin/eventlog", requireRole(roleViewer, handleGetEventLog))
+	http.HandleFunc("/admin/highscores", requireRole(roleModerator, handleDeleteHighscore))
+	http.HandleFunc("/admin/mute", requireRole(roleModerator, handleMute))
+	http.HandleFunc("/admin/ban", requireRole(roleModerator, handleBan))
+	http.HandleFunc("/admin/guestbook", requireRole(roleModerator, handleModerateGuestbook))
+	http.HandleFunc("/admin/purge", requireRole(roleAdmin, handlePurge))
+	http.HandleFunc("/admin/audit", requireRole(roleViewer, handleGetAudit))
+	http.HandleFunc("/admin/tournaments", requireRole(roleAdmin, handleCreateTournament))
+	http.HandleFunc("/admin/login", handleAdminLogin)
+	http.HandleFunc("/admin/oauth/callback", handleOAuthCallback)
+	http.HandleFunc("/admin/logout", handleAdminLogout)
 
 	// Static files
-	http.Handle("/", http.FileServer(http.Dir(".")))
+	http.Handle("/", withCSRFCookie(http.FileServer(http.Dir("."))))
+
+	srv := &http.Server{Addr: listenAddr, Handler: traceRequests(recoverPanics(maintenanceGuard(http.DefaultServeMux)))}
+	ln, err := listen(listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// On deploy, hand off hub state and send clients to the new process
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	<-stop
+	log.Println("Shutting down")
+
+	// Stop accepting first, so new connections go to the new process, then
+	// let in-flight requests finish while the hub hands off
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	httpDone := make(chan error, 1)
+	go func() { httpDone <- srv.Shutdown(ctx) }()
+
+	for _, h := range allHubs() {
+		if err := h.saveState(h.stateFile); err != nil {
+			log.Printf("Failed to save hub state: %v", err)
+		}
+		h.shutdown()
+	}
 
-	log.Fatal(http.ListenAndServe(":8000", nil))
+	// Give write pumps a moment to deliver the close frames
+	time.Sleep(500 * time.Millisecond)
+
+	if err := <-httpDone; err != nil {
+		log.Printf("HTTP shutdown error: %v", err)
+	}
+	jobLeader.release()
+	for _, h := range allHubs() {
+		h.stopEventLog()
+		if err := h.flushHeatmap(); err != nil {
+			log.Printf("Error saving cursor heatmap: %v", err)
+		}
+	}
+	for _, t := range append([]*Tenant{defaultTenant}, tenantList...) {
+		if t.readDB != t.db {
+			t.readDB.Close()
+		}
+		t.db.Close()
+	}
 }
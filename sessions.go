@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Keep three months of websocket sessions
+const sessionRetention = 90 * 24 * time.Hour
+
+// recordSession saves a finished websocket session of a visitor
+func recordSession(db *sql.DB, visitorID string, started time.Time, pings int) {
+	ended := time.Now()
+	_, err := db.Exec(`
+		INSERT INTO visitor_sessions (visitor_id, started_at, ended_at, duration_s, pings) VALUES (?, ?, ?, ?, ?)
+	`, visitorID, started.Unix(), ended.Unix(), int(ended.Sub(started).Seconds()), pings)
+	if err != nil {
+		log.Printf("Error recording session: %v", err)
+	}
+}
+
+// SessionBucket counts sessions whose length falls in [Min, Max) seconds
+type SessionBucket struct {
+	Label string `json:"label"`
+	Min   int    `json:"min"`
+	Max   int    `json:"max,omitempty"`
+	Count int    `json:"count"`
+}
+
+// SessionStats is returned by /api/stats/sessions
+type SessionStats struct {
+	Range          string          `json:"range"`
+	Sessions       int             `json:"sessions"`
+	Visitors       int             `json:"visitors"`
+	AvgSeconds     float64         `json:"avgSeconds"`
+	MedianSeconds  int             `json:"medianSeconds"`
+	P90Seconds     int             `json:"p90Seconds"`
+	Distribution   []SessionBucket `json:"distribution"`
+	ReturnRate     float64         `json:"returnRate"`
+	ReturningCount int             `json:"returningVisitors"`
+}
+
+// sessionBuckets are the session-length histogram bins
+var sessionBuckets = []SessionBucket{
+	{Label: "0-10s", Min: 0, Max: 10},
+	{Label: "10s-1m", Min: 10, Max: 60},
+	{Label: "1-5m", Min: 60, Max: 300},
+	{Label: "5-15m", Min: 300, Max: 900},
+	{Label: "15-60m", Min: 900, Max: 3600},
+	{Label: "1h+", Min: 3600},
+}
+
+// getSessionStats aggregates websocket sessions started since a time. A
+// visitor counts as returning if their sessions fall on more than one day.
+func getSessionStats(ctx context.Context, db *sql.DB, since time.Time) (SessionStats, error) {
+	var stats SessionStats
+	stats.Distribution = make([]SessionBucket, len(sessionBuckets))
+	copy(stats.Distribution, sessionBuckets)
+
+	rows, err := db.QueryContext(ctx, `SELECT duration_s FROM visitor_sessions WHERE started_at >= ?`, since.Unix())
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	var durations []int
+	total := 0
+	for rows.Next() {
+		var d int
+		if err := rows.Scan(&d); err != nil {
+			return stats, err
+		}
+		durations = append(durations, d)
+		total += d
+		for i := len(stats.Distribution) - 1; i >= 0; i-- {
+			if d >= stats.Distribution[i].Min {
+				stats.Distribution[i].Count++
+				break
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return stats, err
+	}
+
+	stats.Sessions = len(durations)
+	if stats.Sessions > 0 {
+		sort.Ints(durations)
+		stats.AvgSeconds = float64(total) / float64(stats.Sessions)
+		stats.MedianSeconds = durations[len(durations)/2]
+		stats.P90Seconds = durations[len(durations)*9/10]
+	}
+
+	err = db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(days > 1), 0) FROM (
+			SELECT visitor_id, COUNT(DISTINCT date(started_at, 'unixepoch')) AS days
+			FROM visitor_sessions
+			WHERE started_at >= ?
+			GROUP BY visitor_id
+		)
+	`, since.Unix()).Scan(&stats.Visitors, &stats.ReturningCount)
+	if err != nil {
+		return stats, err
+	}
+	if stats.Visitors > 0 {
+		stats.ReturnRate = float64(stats.ReturningCount) / float64(stats.Visitors)
+	}
+	return stats, nil
+}
+
+func handleGetSessionStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rangeParam := r.URL.Query().Get("range")
+	if rangeParam == "" {
+		rangeParam = "7d"
+	}
+	span, err := parseRange(rangeParam)
+	if err != nil || span < time.Minute || span > sessionRetention {
+		http.Error(w, "Invalid range", http.StatusBadRequest)
+		return
+	}
+
+	stats, err := getSessionStats(r.Context(), tenantFor(r).readDB, time.Now().Add(-span))
+	if err != nil {
+		log.Printf("Error getting session stats: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	stats.Range = rangeParam
+
+	if wantsCSV(w, r) {
+		writeCSVMetrics(w, "sessions-"+rangeParam+".csv", stats)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// SGP4 propagation of near-Earth orbits (period under 225 minutes), after
+// Vallado et al., "Revisiting Spacetrack Report #3" (AIAA 2006-6753), with the
+// WGS-72 constants TLEs are generated with. Deep-space orbits would need the
+// SDP4 extensions and are rejected.
+
+const (
+	sgp4Mu     = 398600.8 // km³/s², WGS-72
+	sgp4Radius = 6378.135 // km, WGS-72
+	sgp4J2     = 0.001082616
+	sgp4J3     = -0.00000253881
+	sgp4J4     = -0.00000165597
+	sgp4J3oJ2  = sgp4J3 / sgp4J2
+)
+
+// sgp4Xke is sqrt(mu) in Earth radii^1.5 per minute
+var sgp4Xke = 60 / math.Sqrt(sgp4Radius*sgp4Radius*sgp4Radius/sgp4Mu)
+
+var (
+	errDeepSpace = errors.New("sgp4: deep-space orbits are not supported")
+	errDecayed   = errors.New("sgp4: satellite has decayed")
+)
+
+// sgp4 holds the elements and the coefficients derived from them at epoch
+type sgp4 struct {
+	ecco, inclo, nodeo, argpo, mo, bstar float64
+	noUnkozai                            float64 // rad/min
+
+	isimp                               bool
+	aycof, con41, cc1, cc4, cc5         float64
+	d2, d3, d4, delmo, eta, argpdot     float64
+	omgcof, sinmao, t2cof, t3cof, t4cof float64
+	t5cof, x1mth2, x7thm1, mdot         float64
+	nodedot, xlcof, xmcof, nodecf       float64
+}
+
+// newSGP4 initialises the model from TLE mean elements (angles in radians,
+// mean motion in rad/min)
+func newSGP4(ecco, inclo, nodeo, argpo, mo, noKozai, bstar float64) (*sgp4, error) {
+	s := &sgp4{ecco: ecco, inclo: inclo, nodeo: nodeo, argpo: argpo, mo: mo, bstar: bstar}
+	const x2o3 = 2.0 / 3.0
+
+	// Recover the original mean motion and semi-major axis from the
+	// Kozai mean motion in the TLE
+	eccsq := ecco * ecco
+	omeosq := 1 - eccsq
+	rteosq := math.Sqrt(omeosq)
+	cosio := math.Cos(inclo)
+	cosio2 := cosio * cosio
+	ak := math.Pow(sgp4Xke/noKozai, x2o3)
+	d1 := 0.75 * sgp4J2 * (3*cosio2 - 1) / (rteosq * omeosq)
+	del := d1 / (ak * ak)
+	adel := ak * (1 - del*del - del*(1.0/3.0+134*del*del/81))
+	del = d1 / (adel * adel)
+	s.noUnkozai = noKozai / (1 + del)
+	if 2*math.Pi/s.noUnkozai >= 225 {
+		return nil, errDeepSpace
+	}
+	ao := math.Pow(sgp4Xke/s.noUnkozai, x2o3)
+	sinio := math.Sin(inclo)
+	po := ao * omeosq
+	con42 := 1 - 5*cosio2
+	s.con41 = -con42 - cosio2 - cosio2
+	posq := po * po
+	rp := ao * (1 - ecco)
+
+	// Perigees below 220 km use a simplified drag model
+	s.isimp = rp < 220/sgp4Radius+1
+	sfour := 78/sgp4Radius + 1
+	qzms24 := math.Pow((120-78)/sgp4Radius, 4)
+	if perige := (rp - 1) * sgp4Radius; perige < 156 {
+		sfour = perige - 78
+		if perige < 98 {
+			sfour = 20
+		}
+		qzms24 = math.Pow((120-sfour)/sgp4Radius, 4)
+		sfour = sfour/sgp4Radius + 1
+	}
+
+	pinvsq := 1 / posq
+	tsi := 1 / (ao - sfour)
+	s.eta = ao * ecco * tsi
+	etasq := s.eta * s.eta
+	eeta := ecco * s.eta
+	psisq := math.Abs(1 - etasq)
+	coef := qzms24 * math.Pow(tsi, 4)
+	coef1 := coef / math.Pow(psisq, 3.5)
+	cc2 := coef1 * s.noUnkozai * (ao*(1+1.5*etasq+eeta*(4+etasq)) +
+		0.375*sgp4J2*tsi/psisq*s.con41*(8+3*etasq*(8+etasq)))
+	s.cc1 = bstar * cc2
+	cc3 := 0.0
+	if ecco > 1e-4 {
+		cc3 = -2 * coef * tsi * sgp4J3oJ2 * s.noUnkozai * sinio / ecco
+	}
+	s.x1mth2 = 1 - cosio2
+	s.cc4 = 2 * s.noUnkozai * coef1 * ao * omeosq * (s.eta*(2+0.5*etasq) + ecco*(0.5+2*etasq) -
+		sgp4J2*tsi/(ao*psisq)*(-3*s.con41*(1-2*eeta+etasq*(1.5-0.5*eeta))+
+			0.75*s.x1mth2*(2*etasq-eeta*(1+etasq))*math.Cos(2*argpo)))
+	s.cc5 = 2 * coef1 * ao * omeosq * (1 + 2.75*(etasq+eeta) + eeta*etasq)
+
+	// Secular rates from J2 and J4
+	cosio4 := cosio2 * cosio2
+	temp1 := 1.5 * sgp4J2 * pinvsq * s.noUnkozai
+	temp2 := 0.5 * temp1 * sgp4J2 * pinvsq
+	temp3 := -0.46875 * sgp4J4 * pinvsq * pinvsq * s.noUnkozai
+	s.mdot = s.noUnkozai + 0.5*temp1*rteosq*s.con41 + 0.0625*temp2*rteosq*(13-78*cosio2+137*cosio4)
+	s.argpdot = -0.5*temp1*con42 + 0.0625*temp2*(7-114*cosio2+395*cosio4) + temp3*(3-36*cosio2+49*cosio4)
+	xhdot1 := -temp1 * cosio
+	s.nodedot = xhdot1 + (0.5*temp2*(4-19*cosio2)+2*temp3*(3-7*cosio2))*cosio
+	s.omgcof = bstar * cc3 * math.Cos(argpo)
+	if ecco > 1e-4 {
+		s.xmcof = -x2o3 * coef * bstar / eeta
+	}
+	s.nodecf = 3.5 * omeosq * xhdot1 * s.cc1
+	s.t2cof = 1.5 * s.cc1
+	denom := 1 + cosio
+	if math.Abs(denom) < 1.5e-12 {
+		denom = 1.5e-12
+	}
+	s.xlcof = -0.25 * sgp4J3oJ2 * sinio * (3 + 5*cosio) / denom
+	s.aycof = -0.5 * sgp4J3oJ2 * sinio
+	s.delmo = math.Pow(1+s.eta*math.Cos(mo), 3)
+	s.sinmao = math.Sin(mo)
+	s.x7thm1 = 7*cosio2 - 1
+
+	if !s.isimp {
+		cc1sq := s.cc1 * s.cc1
+		s.d2 = 4 * ao * tsi * cc1sq
+		temp := s.d2 * tsi * s.cc1 / 3
+		s.d3 = (17*ao + sfour) * temp
+		s.d4 = 0.5 * temp * ao * tsi * (221*ao + 31*sfour) * s.cc1
+		s.t3cof = s.d2 + 2*cc1sq
+		s.t4cof = 0.25 * (3*s.d3 + s.cc1*(12*s.d2+10*cc1sq))
+		s.t5cof = 0.2 * (3*s.d4 + 12*s.cc1*s.d3 + 6*s.d2*s.d2 + 15*cc1sq*(2*s.d2+cc1sq))
+	}
+	return s, nil
+}
+
+// propagate returns the TEME position (km) and velocity (km/s) tsince
+// minutes after epoch
+func (s *sgp4) propagate(tsince float64) (r, v [3]float64, err error) {
+	const x2o3 = 2.0 / 3.0
+	twoPi := 2 * math.Pi
+
+	// Secular gravity and atmospheric drag
+	xmdf := s.mo + s.mdot*tsince
+	argpdf := s.argpo + s.argpdot*tsince
+	nodedf := s.nodeo + s.nodedot*tsince
+	argpm := argpdf
+	mm := xmdf
+	t2 := tsince * tsince
+	nodem := nodedf + s.nodecf*t2
+	tempa := 1 - s.cc1*tsince
+	tempe := s.bstar * s.cc4 * tsince
+	templ := s.t2cof * t2
+	if !s.isimp {
+		delomg := s.omgcof * tsince
+		delm := s.xmcof * (math.Pow(1+s.eta*math.Cos(xmdf), 3) - s.delmo)
+		temp := delomg + delm
+		mm = xmdf + temp
+		argpm = argpdf - temp
+		t3 := t2 * tsince
+		t4 := t3 * tsince
+		tempa = tempa - s.d2*t2 - s.d3*t3 - s.d4*t4
+		tempe += s.bstar * s.cc5 * (math.Sin(mm) - s.sinmao)
+		templ += s.t3cof*t3 + t4*(s.t4cof+tsince*s.t5cof)
+	}
+
+	am := math.Pow(sgp4Xke/s.noUnkozai, x2o3) * tempa * tempa
+	nm := sgp4Xke / math.Pow(am, 1.5)
+	em := s.ecco - tempe
+	if em >= 1 || em < -0.001 {
+		return r, v, errDecayed
+	}
+	if em < 1e-6 {
+		em = 1e-6
+	}
+	mm += s.noUnkozai * templ
+	xlm := mm + argpm + nodem
+	nodem = math.Mod(nodem, twoPi)
+	argpm = math.Mod(argpm, twoPi)
+	xlm = math.Mod(xlm, twoPi)
+	mm = math.Mod(xlm-argpm-nodem, twoPi)
+
+	// Long-period periodics
+	sinip, cosip := math.Sin(s.inclo), math.Cos(s.inclo)
+	axnl := em * math.Cos(argpm)
+	temp := 1 / (am * (1 - em*em))
+	aynl := em*math.Sin(argpm) + temp*s.aycof
+	xl := mm + argpm + nodem + temp*s.xlcof*axnl
+
+	// Solve Kepler's equation
+	u := math.Mod(xl-nodem, twoPi)
+	eo1 := u
+	var sineo1, coseo1 float64
+	for i := 0; i < 10; i++ {
+		sineo1, coseo1 = math.Sin(eo1), math.Cos(eo1)
+		tem5 := (u - aynl*coseo1 + axnl*sineo1 - eo1) / (1 - coseo1*axnl - sineo1*aynl)
+		if math.Abs(tem5) >= 0.95 {
+			tem5 = math.Copysign(0.95, tem5)
+		}
+		eo1 += tem5
+		if math.Abs(tem5) < 1e-12 {
+			break
+		}
+	}
+
+	// Short-period periodics
+	ecose := axnl*coseo1 + aynl*sineo1
+	esine := axnl*sineo1 - aynl*coseo1
+	el2 := axnl*axnl + aynl*aynl
+	pl := am * (1 - el2)
+	if pl < 0 {
+		return r, v, errDecayed
+	}
+	rl := am * (1 - ecose)
+	rdotl := math.Sqrt(am) * esine / rl
+	rvdotl := math.Sqrt(pl) / rl
+	betal := math.Sqrt(1 - el2)
+	temp = esine / (1 + betal)
+	sinu := am / rl * (sineo1 - aynl - axnl*temp)
+	cosu := am / rl * (coseo1 - axnl + aynl*temp)
+	su := math.Atan2(sinu, cosu)
+	sin2u := (cosu + cosu) * sinu
+	cos2u := 1 - 2*sinu*sinu
+	temp = 1 / pl
+	temp1 := 0.5 * sgp4J2 * temp
+	temp2 := temp1 * temp
+
+	mrt := rl*(1-1.5*temp2*betal*s.con41) + 0.5*temp1*s.x1mth2*cos2u
+	if mrt < 1 {
+		return r, v, errDecayed
+	}
+	su -= 0.25 * temp2 * s.x7thm1 * sin2u
+	xnode := nodem + 1.5*temp2*cosip*sin2u
+	xinc := s.inclo + 1.5*temp2*cosip*sinip*cos2u
+	mvt := rdotl - nm*temp1*s.x1mth2*sin2u/sgp4Xke
+	rvdot := rvdotl + nm*temp1*(s.x1mth2*cos2u+1.5*s.con41)/sgp4Xke
+
+	// Orientation vectors
+	sinsu, cossu := math.Sin(su), math.Cos(su)
+	snod, cnod := math.Sin(xnode), math.Cos(xnode)
+	sini, cosi := math.Sin(xinc), math.Cos(xinc)
+	xmx := -snod * cosi
+	xmy := cnod * cosi
+	ux := [3]float64{xmx*sinsu + cnod*cossu, xmy*sinsu + snod*cossu, sini * sinsu}
+	vx := [3]float64{xmx*cossu - cnod*sinsu, xmy*cossu - snod*sinsu, sini * cossu}
+
+	vkmpersec := sgp4Radius * sgp4Xke / 60
+	for i := range r {
+		r[i] = mrt * ux[i] * sgp4Radius
+		v[i] = (mvt*ux[i] + rvdot*vx[i]) * vkmpersec
+	}
+	return r, v, nil
+}
+
+// at propagates to an absolute time given the element epoch
+func (s *sgp4) at(epoch, t time.Time) ([3]float64, error) {
+	r, _, err := s.propagate(t.Sub(epoch).Minutes())
+	return r, err
+}
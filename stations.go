@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Personal weather stations upload to /api/pws/update using the Weather
+// Underground parameters (ID, PASSWORD, tempf, humidity, ...) or Ecowitt's
+// PASSKEY variant. Stations are registered through POST /admin/stations.
+
+// WeatherStation is a registered personal weather station
+type WeatherStation struct {
+	ID      string          `json:"id"`
+	Key     string          `json:"key,omitempty"`
+	Name    string          `json:"name"`
+	Lat     float64         `json:"lat"`
+	Lng     float64         `json:"lng"`
+	Reading *StationReading `json:"reading,omitempty"`
+}
+
+// StationReading is one upload from a station, converted to metric
+type StationReading struct {
+	Time        int64    `json:"time"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	Humidity    *float64 `json:"humidity,omitempty"`
+	WindSpeed   *float64 `json:"windSpeed,omitempty"`
+	WindGust    *float64 `json:"windGust,omitempty"`
+	WindDir     *float64 `json:"windDirection,omitempty"`
+	Pressure    *float64 `json:"pressure,omitempty"`
+	RainDaily   *float64 `json:"rainDaily,omitempty"`
+	UVIndex     *float64 `json:"uvIndex,omitempty"`
+}
+
+// Keep a week of station history
+const stationRetention = 7 * 24 * time.Hour
+
+// Station readings replace remote conditions within this radius, while fresh
+const (
+	stationRadiusKm = 10.0
+	stationMaxAge   = 30 * time.Minute
+)
+
+// formFloat reads a numeric form value and converts it, or returns nil if absent
+func formFloat(r *http.Request, name string, convert func(float64) float64) *float64 {
+	v, err := strconv.ParseFloat(r.FormValue(name), 64)
+	// -9999 is the WU convention for "no data"
+	if err != nil || v <= -9999 {
+		return nil
+	}
+	if convert != nil {
+		v = convert(v)
+	}
+	v = math.Round(v*10) / 10
+	return &v
+}
+
+func fahrenheitToCelsius(f float64) float64 { return (f - 32) * 5 / 9 }
+func mphToKmh(mph float64) float64          { return mph * 1.609344 }
+func inHgToHPa(in float64) float64          { return in * 33.8639 }
+func inchesToMM(in float64) float64         { return in * 25.4 }
+
+// parseStationReading reads the fields shared by the WU and Ecowitt protocols
+func parseStationReading(r *http.Request) StationReading {
+	reading := StationReading{
+		Time:        time.Now().Unix(),
+		Temperature: formFloat(r, "tempf", fahrenheitToCelsius),
+		Humidity:    formFloat(r, "humidity", nil),
+		WindSpeed:   formFloat(r, "windspeedmph", mphToKmh),
+		WindGust:    formFloat(r, "windgustmph", mphToKmh),
+		WindDir:     formFloat(r, "winddir", nil),
+		Pressure:    formFloat(r, "baromin", inHgToHPa),
+		RainDaily:   formFloat(r, "dailyrainin", inchesToMM),
+		UVIndex:     formFloat(r, "UV", nil),
+	}
+	if reading.Pressure == nil {
+		reading.Pressure = formFloat(r, "baromrelin", inHgToHPa)
+	}
+	if reading.UVIndex == nil {
+		reading.UVIndex = formFloat(r, "uv", nil)
+	}
+	return reading
+}
+
+// stationForKey returns the station ID if the key matches a registered station
+func stationForKey(ctx context.Context, db *sql.DB, id, key string) (string, error) {
+	var storedID, storedKey string
+	var err error
+	if id != "" {
+		err = db.QueryRowContext(ctx, `SELECT station_id, key FROM weather_stations WHERE station_id = ?`, id).Scan(&storedID, &storedKey)
+	} else {
+		// Ecowitt only sends its passkey
+		err = db.QueryRowContext(ctx, `SELECT station_id, key FROM weather_stations WHERE key = ?`, key).Scan(&storedID, &storedKey)
+	}
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if subtle.ConstantTimeCompare([]byte(storedKey), []byte(key)) != 1 {
+		return "", nil
+	}
+	return storedID, nil
+}
+
+func saveStationReading(ctx context.Context, db *sql.DB, stationID string, reading StationReading) error {
+	data, _ := json.Marshal(reading)
+	_, err := db.ExecContext(ctx, `INSERT INTO station_readings (station_id, observed_at, data) VALUES (?, ?, ?)`,
+		stationID, reading.Time, string(data))
+	if err != nil {
+		return err
+	}
+	if reading.Temperature != nil {
+		var lat, lng float64
+		if err := db.QueryRowContext(ctx, `SELECT lat, lng FROM weather_stations WHERE station_id = ?`, stationID).Scan(&lat, &lng); err != nil {
+			return err
+		}
+		obs := Observation{
+			Time:        reading.Time,
+			Temperature: *reading.Temperature,
+			Humidity:    reading.Humidity,
+			WindSpeed:   reading.WindSpeed,
+			Source:      "station",
+		}
+		if err := recordObservation(ctx, lat, lng, obs); err != nil {
+			return err
+		}
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM station_readings WHERE observed_at < ?`, time.Now().Add(-stationRetention).Unix())
+	return err
+}
+
+// handleStationUpload accepts both the WU (ID/PASSWORD) and Ecowitt (PASSKEY) upload formats
+func handleStationUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 16<<10)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	id, key := r.FormValue("ID"), r.FormValue("PASSWORD")
+	if key == "" {
+		key = r.FormValue("PASSKEY")
+	}
+	if key == "" {
+		http.Error(w, "Missing credentials", http.StatusUnauthorized)
+		return
+	}
+
+	site := tenantFor(r)
+	stationID, err := stationForKey(r.Context(), site.db, id, key)
+	if err != nil {
+		log.Printf("Error looking up station: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if stationID == "" {
+		http.Error(w, "Unknown station", http.StatusUnauthorized)
+		return
+	}
+
+	if err := saveStationReading(r.Context(), site.db, stationID, parseStationReading(r)); err != nil {
+		log.Printf("Error saving station reading: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// WU clients expect a plain "success"
+	w.Write([]byte("success\n"))
+}
+
+// getStations lists a site's stations with their latest reading
+func getStations(ctx context.Context, db *sql.DB) ([]WeatherStation, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT s.station_id, s.name, s.lat, s.lng,
+			(SELECT data FROM station_readings r WHERE r.station_id = s.station_id ORDER BY observed_at DESC, id DESC LIMIT 1)
+		FROM weather_stations s
+		ORDER BY s.name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stations := []WeatherStation{}
+	for rows.Next() {
+		var s WeatherStation
+		var data sql.NullString
+		if err := rows.Scan(&s.ID, &s.Name, &s.Lat, &s.Lng, &data); err != nil {
+			return nil, err
+		}
+		if data.Valid {
+			var reading StationReading
+			if json.Unmarshal([]byte(data.String), &reading) == nil {
+				s.Reading = &reading
+			}
+		}
+		stations = append(stations, s)
+	}
+	return stations, rows.Err()
+}
+
+func handleGetStations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stations, err := getStations(r.Context(), tenantFor(r).db)
+	if err != nil {
+		log.Printf("Error getting stations: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stations)
+}
+
+// handleRegisterStation adds or updates a station (admin only)
+func handleRegisterStation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var s WeatherStation
+	if err := decodeJSONBody(w, r, &s); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if s.ID == "" || s.Key == "" || s.Lat < -90 || s.Lat > 90 || s.Lng < -180 || s.Lng > 180 {
+		http.Error(w, "Invalid station", http.StatusBadRequest)
+		return
+	}
+
+	_, err := tenantFor(r).db.ExecContext(r.Context(), `
+		INSERT INTO weather_stations (station_id, key, name, lat, lng) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(station_id) DO UPDATE SET key = excluded.key, name = excluded.name, lat = excluded.lat, lng = excluded.lng
+	`, s.ID, s.Key, cleanTextLine(s.Name, 60), s.Lat, s.Lng)
+	if err != nil {
+		log.Printf("Error registering station: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// nearbyStationReading returns the freshest reading from the closest station
+// within stationRadiusKm, or nil if there is none. The weather is the same
+// whichever site a station was registered with, so every site's count.
+func nearbyStationReading(ctx context.Context, lat, lng float64) *StationReading {
+	var stations []WeatherStation
+	for _, h := range allHubs() {
+		s, err := getStations(ctx, h.db)
+		if err != nil {
+			log.Printf("Error getting stations: %v", err)
+			continue
+		}
+		stations = append(stations, s...)
+	}
+
+	var best *StationReading
+	bestDist := stationRadiusKm
+	cutoff := time.Now().Add(-stationMaxAge).Unix()
+	for _, s := range stations {
+		if s.Reading == nil || s.Reading.Time < cutoff {
+			continue
+		}
+		if d := haversineKm(lat, lng, s.Lat, s.Lng); d <= bestDist {
+			best, bestDist = s.Reading, d
+		}
+	}
+	return best
+}
+
+// applyStationReading overlays whatever a local station measured onto remote conditions
+func applyStationReading(c *ForecastCurrent, reading *StationReading) {
+	if reading.Temperature != nil {
+		c.Temperature = *reading.Temperature
+	}
+	if reading.Humidity != nil {
+		c.Humidity = *reading.Humidity
+	}
+	if reading.WindSpeed != nil {
+		c.WindSpeed = *reading.WindSpeed
+	}
+	if reading.WindDir != nil {
+		c.WindDirection = *reading.WindDir
+	}
+	c.Station = true
+}
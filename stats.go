@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ActivityPoint is one bucket of the activity time series
+type ActivityPoint struct {
+	Time     int64 `json:"t"`
+	Users    int   `json:"users"`
+	Messages int   `json:"messages"`
+}
+
+// ActivityResponse is returned by /api/stats/activity
+type ActivityResponse struct {
+	Range  string          `json:"range"`
+	Step   int64           `json:"step"`
+	Points []ActivityPoint `json:"points"`
+}
+
+// Keep a month of per-minute rollups
+const activityRetention = 30 * 24 * time.Hour
+
+// runActivityRollup records a hub's concurrent users and message volume once a minute
+func runActivityRollup(hub *Hub) {
+	for {
+		// Wake up on the minute boundary
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+
+		hub.mutex.Lock()
+		users := hub.minutePeak
+		hub.minutePeak = hub.users()
+		hub.mutex.Unlock()
+		messages := hub.messages.Swap(0)
+
+		minute := next.Add(-time.Minute).Unix()
+		_, err := hub.db.Exec(`
+			INSERT INTO metrics_rollup (minute, users, messages) VALUES (?, ?, ?)
+			ON CONFLICT(minute) DO UPDATE SET users = MAX(users, ?), messages = messages + ?
+		`, minute, users, messages, users, messages)
+		if err != nil {
+			log.Printf("Error saving activity rollup: %v", err)
+		}
+	}
+}
+
+// parseRange parses ranges like "90m", "24h" or "7d"
+func parseRange(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// activityStep picks a bucket size giving a few hundred points, whatever the range
+func activityStep(span time.Duration) int64 {
+	step := int64(span.Minutes()/288) * 60
+	if step < 60 {
+		step = 60
+	}
+	return step
+}
+
+func getActivity(ctx context.Context, db *sql.DB, since time.Time, step int64) ([]ActivityPoint, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT (minute / ?) * ? AS bucket, MAX(users), SUM(messages)
+		FROM metrics_rollup
+		WHERE minute >= ?
+		GROUP BY bucket
+		ORDER BY bucket
+	`, step, step, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []ActivityPoint{}
+	for rows.Next() {
+		var p ActivityPoint
+		if err := rows.Scan(&p.Time, &p.Users, &p.Messages); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+func handleGetActivity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rangeParam := r.URL.Query().Get("range")
+	if rangeParam == "" {
+		rangeParam = "24h"
+	}
+	span, err := parseRange(rangeParam)
+	if err != nil || span < time.Minute || span > activityRetention {
+		http.Error(w, "Invalid range", http.StatusBadRequest)
+		return
+	}
+
+	step := activityStep(span)
+	points, err := getActivity(r.Context(), tenantFor(r).readDB, time.Now().Add(-span), step)
+	if err != nil {
+		log.Printf("Error getting activity: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if wantsCSV(w, r) {
+		out := newCSVResponse(w, "activity-"+rangeParam+".csv", "time", "users", "messages")
+		for _, p := range points {
+			if err := out.row(time.Unix(p.Time, 0).UTC().Format(time.RFC3339), csvInt(p.Users), csvInt(p.Messages)); err != nil {
+				return
+			}
+		}
+		out.close()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ActivityResponse{Range: rangeParam, Step: step, Points: points})
+}
+
+// PeakRecord is the all-time peak of concurrent users
+type PeakRecord struct {
+	Users int   `json:"users"`
+	At    int64 `json:"at"`
+}
+
+// StatsResponse is returned by /api/stats
+type StatsResponse struct {
+	CurrentUsers   int                      `json:"currentUsers"`
+	Peak           PeakRecord               `json:"peak"`
+	HighscoreCache *CacheStats              `json:"highscoreCache,omitempty"`
+	WriteQueue     *WriteQueueStats         `json:"writeQueue,omitempty"`
+	Panics         *PanicStats              `json:"panics,omitempty"`
+	TickLoops      map[string]TickLoopStats `json:"tickLoops,omitempty"`
+}
+
+func loadPeakRecord(db *sql.DB) (PeakRecord, error) {
+	var rec PeakRecord
+	err := db.QueryRow(`SELECT value, achieved_at FROM records WHERE name = 'peak_users'`).Scan(&rec.Users, &rec.At)
+	if err == sql.ErrNoRows {
+		return rec, nil
+	}
+	return rec, err
+}
+
+func savePeakRecord(ctx context.Context, db *sql.DB, rec PeakRecord) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO records (name, value, achieved_at) VALUES ('peak_users', ?, ?)
+		ON CONFLICT(name) DO UPDATE SET value = excluded.value, achieved_at = excluded.achieved_at
+		WHERE excluded.value > records.value
+	`, rec.Users, rec.At)
+	return err
+}
+
+// checkPeak records a new all-time peak and celebrates it with everyone
+func (h *Hub) checkPeak(userCount int) {
+	h.mutex.Lock()
+	if userCount <= h.peak.Users {
+		h.mutex.Unlock()
+		return
+	}
+	previous := h.peak.Users
+	h.peak = PeakRecord{Users: userCount, At: time.Now().Unix()}
+	rec := h.peak
+	h.mutex.Unlock()
+
+	go func() {
+		if err := savePeakRecord(context.Background(), h.db, rec); err != nil {
+			log.Printf("Error saving peak record: %v", err)
+		}
+	}()
+
+	// Nothing to celebrate on a fresh database
+	if previous == 0 {
+		return
+	}
+	data, _ := json.Marshal(CursorMessage{Type: "record", UserCount: userCount, Record: &rec})
+	h.broadcastToOthers("", data)
+	h.logEvent("record", "", data)
+	log.Printf("New concurrent user record: %d", userCount)
+}
+
+func handleGetStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hub := tenantFor(r).hub
+	hub.mutex.RLock()
+	stats := StatsResponse{CurrentUsers: hub.users(), Peak: hub.peak}
+	hub.mutex.RUnlock()
+	cache := highscoreCache.stats()
+	stats.HighscoreCache = &cache
+	queue := pendingWrites.stats()
+	stats.WriteQueue = &queue
+	panics := panicStats()
+	stats.Panics = &panics
+	stats.TickLoops = tickLoopStats()
+
+	if wantsCSV(w, r) {
+		writeCSVMetrics(w, "stats.csv", stats)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Teletype products are wrapped like the old NWS wire at 69 columns
+const teletypeWidth = 69
+
+// Digit groups in some locales are separated by spaces, which mustn't be
+// broken across lines
+const noBreakSpace = "\u00a0"
+
+// wrapTeletype uppercases and word-wraps text to the teletype width
+func wrapTeletype(text string) []string {
+	var lines []string
+	line := ""
+	flush := func() {
+		lines = append(lines, strings.ReplaceAll(line, noBreakSpace, " "))
+		line = ""
+	}
+	words := strings.FieldsFunc(strings.ToUpper(text), func(r rune) bool {
+		return unicode.IsSpace(r) && r != '\u00a0'
+	})
+	for _, word := range words {
+		if line != "" && utf8.RuneCountInString(line)+1+utf8.RuneCountInString(word) > teletypeWidth {
+			flush()
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		flush()
+	}
+	return lines
+}
+
+// teletypeFormat formats values for teletype output: metric or imperial
+// units, a locale's way of writing numbers and dates, and a 12 or 24-hour
+// clock. The zero value is the wire's own US style. Times and dates are
+// zero-padded so the header keeps its width from one bulletin to the next.
+type teletypeFormat struct {
+	imperial bool
+	locale   textLocale
+	clock24  bool
+}
+
+// textLocale is how a locale writes numbers and dates
+type textLocale struct {
+	decimal   byte
+	group     string
+	dateOrder string // "mdy", "dmy" or "ymd"
+	clock24   bool   // the locale's usual clock
+}
+
+var defaultTextLocale = textLocale{decimal: '.', group: ",", dateOrder: "mdy"}
+
+// textLocales by language, with regional variants where they differ
+var textLocales = map[string]textLocale{
+	"en":    defaultTextLocale,
+	"en-gb": {decimal: '.', group: ",", dateOrder: "dmy", clock24: true},
+	"en-ie": {decimal: '.', group: ",", dateOrder: "dmy", clock24: true},
+	"en-au": {decimal: '.', group: ",", dateOrder: "dmy"},
+	"en-nz": {decimal: '.', group: ",", dateOrder: "dmy"},
+	"en-in": {decimal: '.', group: ",", dateOrder: "dmy"},
+	"en-ca": {decimal: '.', group: ",", dateOrder: "ymd"},
+	"de":    {decimal: ',', group: ".", dateOrder: "dmy", clock24: true},
+	"de-ch": {decimal: '.', group: "'", dateOrder: "dmy", clock24: true},
+	"nl":    {decimal: ',', group: ".", dateOrder: "dmy", clock24: true},
+	"da":    {decimal: ',', group: ".", dateOrder: "dmy", clock24: true},
+	"it":    {decimal: ',', group: ".", dateOrder: "dmy", clock24: true},
+	"es":    {decimal: ',', group: ".", dateOrder: "dmy", clock24: true},
+	"pt":    {decimal: ',', group: ".", dateOrder: "dmy", clock24: true},
+	"tr":    {decimal: ',', group: ".", dateOrder: "dmy", clock24: true},
+	"fr":    {decimal: ',', group: noBreakSpace, dateOrder: "dmy", clock24: true},
+	"fi":    {decimal: ',', group: noBreakSpace, dateOrder: "dmy", clock24: true},
+	"sv":    {decimal: ',', group: noBreakSpace, dateOrder: "ymd", clock24: true},
+	"nb":    {decimal: ',', group: noBreakSpace, dateOrder: "dmy", clock24: true},
+	"no":    {decimal: ',', group: noBreakSpace, dateOrder: "dmy", clock24: true},
+	"pl":    {decimal: ',', group: noBreakSpace, dateOrder: "dmy", clock24: true},
+	"cs":    {decimal: ',', group: noBreakSpace, dateOrder: "dmy", clock24: true},
+	"ru":    {decimal: ',', group: noBreakSpace, dateOrder: "dmy", clock24: true},
+	"uk":    {decimal: ',', group: noBreakSpace, dateOrder: "dmy", clock24: true},
+	"ja":    {decimal: '.', group: ",", dateOrder: "ymd", clock24: true},
+	"zh":    {decimal: '.', group: ",", dateOrder: "ymd", clock24: true},
+	"ko":    {decimal: '.', group: ",", dateOrder: "ymd"},
+}
+
+// lookupTextLocale finds a locale by BCP 47 tag ("de-AT", "pt_BR"), trying
+// the language alone if the region isn't listed
+func lookupTextLocale(tag string) (textLocale, bool) {
+	tag = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+	if l, ok := textLocales[tag]; ok {
+		return l, true
+	}
+	lang, _, _ := strings.Cut(tag, "-")
+	l, ok := textLocales[lang]
+	return l, ok
+}
+
+// loc returns the locale to format with
+func (f teletypeFormat) loc() textLocale {
+	if f.locale.decimal == 0 {
+		return defaultTextLocale
+	}
+	return f.locale
+}
+
+// number writes v with the locale's separators
+func (f teletypeFormat) number(v float64, decimals int) string {
+	l := f.loc()
+	s := strconv.FormatFloat(v, 'f', decimals, 64)
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+		// Don't print "-0" for values that round to zero
+		if strings.Trim(s, "0.") == "" {
+			sign = ""
+		}
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	var b strings.Builder
+	b.WriteString(sign)
+	for i := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(l.group)
+		}
+		b.WriteByte(whole[i])
+	}
+	if frac != "" {
+		b.WriteByte(l.decimal)
+		b.WriteString(frac)
+	}
+	return b.String()
+}
+
+func (f teletypeFormat) temp(c float64) string {
+	if f.imperial {
+		return f.number(c*9/5+32, 0) + "F"
+	}
+	return f.number(c, 0) + "C"
+}
+
+func (f teletypeFormat) speed(kmh float64) string {
+	if f.imperial {
+		return f.number(kmh/1.609344, 0) + " MPH"
+	}
+	return f.number(kmh, 0) + " KM/H"
+}
+
+// coords renders a position like "52.52N 13.40E"
+func (f teletypeFormat) coords(lat, lng float64) string {
+	ns, ew := "N", "E"
+	if lat < 0 {
+		ns = "S"
+	}
+	if lng < 0 {
+		ew = "W"
+	}
+	return f.number(math.Abs(lat), 2) + ns + " " + f.number(math.Abs(lng), 2) + ew
+}
+
+// stamp writes the bulletin's issue time in wire style, like
+// "0304 PM CEST MON JAN 02 2006" or "1504 CEST MON 02 JAN 2006"
+func (f teletypeFormat) stamp(t time.Time) string {
+	clock := t.Format("0304 PM MST")
+	if f.clock24 {
+		clock = t.Format("1504 MST")
+	}
+	var date string
+	switch f.loc().dateOrder {
+	case "dmy":
+		date = t.Format("Mon 02 Jan 2006")
+	case "ymd":
+		date = t.Format("Mon 2006 Jan 02")
+	default:
+		date = t.Format("Mon Jan 02 2006")
+	}
+	return strings.ToUpper(clock + " " + date)
+}
+
+// renderTeletype writes a text weather product in the style of a wire service bulletin
+func renderTeletype(f Forecast, place string, lat, lng float64, format teletypeFormat, now time.Time) string {
+	loc, err := time.LoadLocation(f.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	local := now.In(loc)
+
+	var b strings.Builder
+	line := func(s string) { b.WriteString(s + "\n") }
+	para := func(s string) {
+		for _, l := range wrapTeletype(s) {
+			line(l)
+		}
+		line("")
+	}
+
+	line("ZCZC CCTWXTXT")
+	line("FPUS00 KCCT " + now.UTC().Format("021504"))
+	line("")
+	if place == "" {
+		place = format.coords(lat, lng)
+	}
+	for _, l := range wrapTeletype("CURRENT CONDITIONS AND FORECAST FOR " + place) {
+		line(l)
+	}
+	line("CURRENTCONDITION.TV")
+	line(format.stamp(local))
+	line("")
+
+	c := f.Current
+	glyph := weatherGlyphFor(c.WeatherCode, c.IsDay == 0)
+	para(fmt.Sprintf(".NOW...%s. TEMPERATURE %s, FEELS LIKE %s. HUMIDITY %s PERCENT. WIND %s %s.",
+		glyph.Label, format.temp(c.Temperature), format.temp(c.FeelsLike), format.number(c.Humidity, 0),
+		compassPoint(c.WindDirection), format.speed(c.WindSpeed)))
+
+	d := f.Daily
+	for i := range d.Time {
+		if i >= len(d.WeatherCode) || i >= len(d.TempMax) || i >= len(d.TempMin) {
+			break
+		}
+		day, err := time.Parse("2006-01-02", d.Time[i])
+		if err != nil {
+			continue
+		}
+		name := day.Format("Monday")
+		if i == 0 {
+			name = "TODAY"
+		}
+		text := fmt.Sprintf(".%s...%s. HIGH %s, LOW %s.", name, weatherGlyphFor(d.WeatherCode[i], false).Label,
+			format.temp(d.TempMax[i]), format.temp(d.TempMin[i]))
+		if i < len(d.PrecipProb) && d.PrecipProb[i] >= 20 {
+			text += " CHANCE OF PRECIPITATION " + format.number(d.PrecipProb[i], 0) + " PERCENT."
+		}
+		para(text)
+	}
+
+	line("$$")
+	line("NNNN")
+	return b.String()
+}
+
+func handleGetTeletype(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Without coordinates, print the bulletin for the site's home base
+	q := r.URL.Query()
+	home := tenantFor(r).hub.home
+	lat, lng, ok := home.Lat, home.Lng, true
+	place := home.Place
+	if q.Get("lat") != "" || q.Get("lng") != "" {
+		lat, lng, ok = parseLatLng(r)
+		place = q.Get("place")
+	}
+	if !ok {
+		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+		return
+	}
+	format, ok := teletypeFormatFor(r)
+	if !ok {
+		http.Error(w, "Invalid clock", http.StatusBadRequest)
+		return
+	}
+
+	// Place names are printed verbatim, so keep them short and printable
+	place = cleanPlace(place)
+
+	f, err := getForecast(r.Context(), lat, lng)
+	if err != nil {
+		log.Printf("Error fetching forecast: %v", err)
+		http.Error(w, "Upstream error", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(renderTeletype(f, place, lat, lng, format, time.Now())))
+}
+
+// teletypeFormatFor reads the units, locale and clock a request asks for.
+// The locale comes from ?locale= or else Accept-Language, and sets the
+// clock unless ?clock=12 or 24 is given.
+func teletypeFormatFor(r *http.Request) (teletypeFormat, bool) {
+	q := r.URL.Query()
+	format := teletypeFormat{imperial: q.Get("units") == "imperial"}
+	tag := q.Get("locale")
+	if tag == "" {
+		// The first language listed is the preferred one
+		tag, _, _ = strings.Cut(r.Header.Get("Accept-Language"), ",")
+		tag, _, _ = strings.Cut(tag, ";")
+	}
+	if l, ok := lookupTextLocale(tag); ok {
+		format.locale = l
+	}
+	format.clock24 = format.loc().clock24
+	switch q.Get("clock") {
+	case "":
+	case "12":
+		format.clock24 = false
+	case "24":
+		format.clock24 = true
+	default:
+		return format, false
+	}
+	return format, true
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With TELNET_ADDR set (e.g. ":2323"), a telnet listener serves a text version
+// of the terminal: weather bulletins, the ASCII visitor map and highscores,
+// from the same code paths as the HTTP API. There is no SSH listener; that
+// would need an SSH server library this module doesn't depend on.
+
+const (
+	maxTelnetSessions  = 50
+	telnetIdleTimeout  = 5 * time.Minute
+	telnetWriteTimeout = 10 * time.Second
+)
+
+// Telnet protocol bytes
+const (
+	telnetIAC  = 255
+	telnetSB   = 250
+	telnetSE   = 240
+	telnetWILL = 251
+	telnetDONT = 254
+)
+
+// telnetReader strips telnet command sequences from client input
+type telnetReader struct {
+	r *bufio.Reader
+}
+
+func (t telnetReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if n > 0 && t.r.Buffered() == 0 {
+			break
+		}
+		b, err := t.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		if b != telnetIAC {
+			p[n] = b
+			n++
+			continue
+		}
+		cmd, err := t.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		switch {
+		case cmd == telnetIAC:
+			// Escaped 0xFF data byte
+			p[n] = cmd
+			n++
+		case cmd >= telnetWILL && cmd <= telnetDONT:
+			// Option negotiation; we don't negotiate anything
+			if _, err := t.r.ReadByte(); err != nil {
+				return n, err
+			}
+		case cmd == telnetSB:
+			// Skip subnegotiation up to IAC SE
+			for {
+				c, err := t.r.ReadByte()
+				if err != nil {
+					return n, err
+				}
+				if c == telnetIAC {
+					if c, err = t.r.ReadByte(); err != nil || c == telnetSE {
+						break
+					}
+				}
+			}
+		}
+	}
+	return n, nil
+}
+
+// runTelnet accepts telnet sessions on addr
+func runTelnet(addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Telnet listener failed: %v", err)
+		return
+	}
+	log.Printf("Telnet interface on %s", addr)
+
+	sessions := make(chan struct{}, maxTelnetSessions)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Telnet accept error: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		select {
+		case sessions <- struct{}{}:
+			go func() {
+				defer func() { <-sessions }()
+				serveTelnet(conn)
+			}()
+		default:
+			conn.SetWriteDeadline(time.Now().Add(telnetWriteTimeout))
+			io.WriteString(conn, "ALL LINES BUSY. TRY AGAIN LATER.\r\n")
+			conn.Close()
+		}
+	}
+}
+
+// crlf converts newlines for telnet clients
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+func serveTelnet(conn net.Conn) {
+	defer conn.Close()
+	defer func() {
+		if rec := recover(); rec != nil {
+			logPanic(rec, "telnet="+conn.RemoteAddr().String())
+		}
+	}()
+
+	in := bufio.NewScanner(telnetReader{bufio.NewReader(conn)})
+	in.Buffer(make([]byte, 256), 256)
+	out := bufio.NewWriter(conn)
+	say := func(s string) {
+		conn.SetWriteDeadline(time.Now().Add(telnetWriteTimeout))
+		out.WriteString(crlf(s))
+		if err := out.Flush(); err != nil {
+			// The client stopped reading; closing makes the next prompt fail
+			conn.Close()
+		}
+	}
+	prompt := func(p string) (string, bool) {
+		say(p)
+		conn.SetReadDeadline(time.Now().Add(telnetIdleTimeout))
+		if !in.Scan() {
+			return "", false
+		}
+		return strings.TrimSpace(in.Text()), true
+	}
+
+	site := defaultTenant
+	say("\nCURRENTCONDITION.TV\nCONNECTED " + strings.ToUpper(time.Now().UTC().Format("15:04 MST Mon Jan 2 2006")) + "\n")
+	for {
+		choice, ok := prompt("\n[W] WEATHER  [M] MAP  [H] HIGHSCORES  [Q] QUIT\n> ")
+		if !ok {
+			return
+		}
+		switch strings.ToUpper(choice) {
+		case "W":
+			answer, ok := prompt("LAT,LNG> ")
+			if !ok {
+				return
+			}
+			say(weatherBulletin(answer))
+		case "M":
+			locations, err := getLocationsFromDB(context.Background(), site.readDB)
+			if err != nil {
+				log.Printf("Error getting locations: %v", err)
+				say("MAP UNAVAILABLE\n")
+				continue
+			}
+			say(renderASCIIMap(locations, 80, 22, true))
+		case "H":
+			say(highscoresText(site))
+		case "Q":
+			say("73\n")
+			return
+		case "":
+		default:
+			say("?\n")
+		}
+	}
+}
+
+// weatherBulletin renders the teletype bulletin for a "lat,lng" query
+func weatherBulletin(query string) string {
+	latStr, lngStr, _ := strings.Cut(query, ",")
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+	lng, err2 := strconv.ParseFloat(strings.TrimSpace(lngStr), 64)
+	if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return "INVALID COORDINATES\n"
+	}
+	f, err := getForecast(context.Background(), lat, lng)
+	if err != nil {
+		log.Printf("Error fetching forecast: %v", err)
+		return "WEATHER UNAVAILABLE\n"
+	}
+	return renderTeletype(f, "", lat, lng, teletypeFormat{}, time.Now())
+}
+
+// highscoresText lists the top scores of every game
+func highscoresText(site *Tenant) string {
+	var b strings.Builder
+	for _, game := range []string{"SNAKE", "TETRIS", "ASTEROIDS", "PONG"} {
+		scores, err := cachedHighscores(context.Background(), site, game)
+		if err != nil {
+			log.Printf("Error getting highscores: %v", err)
+			return "HIGHSCORES UNAVAILABLE\n"
+		}
+		fmt.Fprintf(&b, "\n%s\n", game)
+		for i, s := range scores {
+			fmt.Fprintf(&b, "%2d. %-12s %7d %s\n", i+1, s.Name, s.Score, s.Country)
+		}
+	}
+	return b.String()
+}
+
+// telnetAddr returns the TELNET_ADDR setting, or "" when telnet is off
+func telnetAddr() string {
+	return os.Getenv("TELNET_ADDR")
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// One process can serve several sites. TENANTS maps tenant names to the
+// hosts they answer on, e.g. "alpha=alpha.example.com,beta=beta.example.org|www.beta.example.org".
+// Each tenant gets its own database (highscores, locations, activity,
+// nicknames, weather stations, cursor recordings), hub (cursor room), admin
+// token and GitHub admins. Weather observations and forecasts are the same
+// for every site and stay in the default site's database; the default site
+// also serves unknown hosts.
+// Settings can be overridden per tenant by suffixing the variable with the
+// upper-cased name, e.g. ADMIN_TOKEN_ALPHA or MAX_CONNECTIONS_BETA.
+
+// Tenant is one site served by this process
+type Tenant struct {
+	Name          string
+	Hosts         []string
+	adminToken    string
+	apiKey        string // LOCATIONS_API_KEY, for syncing locations from elsewhere
+	kioskToken    string // KIOSK_TOKEN, for registering kiosk devices
+	url           string // SITE_URL, for links in mail and feeds
+	webhookSecret string // WEBHOOK_SECRET, for signed external events
+	db            *sql.DB
+	readDB        *sql.DB
+	hub           *Hub
+	clusters      *clusterIndex
+
+	// ADMIN_GITHUB_USERS, the GitHub logins allowed to sign in as admins
+	githubUsers map[string]adminRole
+}
+
+var (
+	defaultTenant *Tenant
+	tenantsByHost = make(map[string]*Tenant)
+	tenantList    []*Tenant
+)
+
+var validTenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// tenantEnvInt reads a per-tenant override, falling back to the global setting
+func tenantEnvInt(tenant, name string, def int) int {
+	return envInt(tenantEnvName(tenant, name), envInt(name, def))
+}
+
+func tenantEnvName(tenant, name string) string {
+	return name + "_" + strings.ToUpper(strings.ReplaceAll(tenant, "-", "_"))
+}
+
+// newTenantHub creates a hub configured from the tenant's settings
+func newTenantHub(tenant string, db *sql.DB) *Hub {
+	h := newHub(db,
+		tenantEnvInt(tenant, "MAX_CONNECTIONS", 0),
+		tenantEnvInt(tenant, "WAITING_ROOM_SIZE", 0),
+		tenantEnvInt(tenant, "MAX_CONNECTIONS_PER_IP", 0))
+	h.home = tenantHomeBase(tenant)
+	h.rotation.slots = tenantRotationSchedule(tenant)
+	h.stateFile = hubStateFile
+	if tenant != "" {
+		h.stateFile = strings.TrimSuffix(hubStateFile, ".json") + "-" + tenant + ".json"
+	}
+	return h
+}
+
+// tenantHomeBase reads the site owner's home base from DEFAULT_LOCATION
+// ("lat,lng[,place]"), or its per-tenant override, falling back to Greenwich
+func tenantHomeBase(tenant string) GeoPoint {
+	for _, name := range []string{tenantEnvName(tenant, "DEFAULT_LOCATION"), "DEFAULT_LOCATION"} {
+		spec := os.Getenv(name)
+		if spec == "" {
+			continue
+		}
+		if home, ok := parseHomeBase(spec); ok {
+			return home
+		}
+		log.Printf("Invalid %s, ignoring it", name)
+	}
+	return GeoPoint{Lat: 51.48, Lng: 0, Place: "Greenwich"}
+}
+
+// parseHomeBase parses "lat,lng[,place]"
+func parseHomeBase(spec string) (GeoPoint, bool) {
+	parts := strings.SplitN(spec, ",", 3)
+	if len(parts) < 2 {
+		return GeoPoint{}, false
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lng, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return GeoPoint{}, false
+	}
+	home := GeoPoint{Lat: lat, Lng: lng}
+	if len(parts) == 3 {
+		home.Place = cleanPlace(parts[2])
+	}
+	return home, true
+}
+
+// loadTenants opens a database and starts a hub for every configured tenant
+func loadTenants(spec string) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, hosts, ok := strings.Cut(entry, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || !validTenantName.MatchString(name) {
+			return fmt.Errorf("invalid tenant %q", entry)
+		}
+		// The default site goes by this name in cache keys and file names
+		if name == "default" {
+			return fmt.Errorf("tenant name %q is reserved", name)
+		}
+
+		path := strings.TrimSuffix(dbPath, ".db") + "-" + name + ".db"
+		tdb, err := sql.Open(sqlDriver(), path)
+		if err != nil {
+			return err
+		}
+		if err := initSchema(tdb); err != nil {
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+
+		readPath := os.Getenv(tenantEnvName(name, "DB_READ_PATH"))
+		tReadDB, err := openReadDB(readPath, tdb)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+
+		t := &Tenant{
+			Name:          name,
+			adminToken:    secret(tenantEnvName(name, "ADMIN_TOKEN")),
+			githubUsers:   parseGitHubUsers(os.Getenv(tenantEnvName(name, "ADMIN_GITHUB_USERS"))),
+			apiKey:        secret(tenantEnvName(name, "LOCATIONS_API_KEY")),
+			kioskToken:    secret(tenantEnvName(name, "KIOSK_TOKEN")),
+			webhookSecret: secret(tenantEnvName(name, "WEBHOOK_SECRET")),
+			db:            tdb,
+			readDB:        tReadDB,
+			hub:           newTenantHub(name, tdb),
+			clusters:      newClusterIndex(),
+		}
+		if t.hub.peak, err = loadPeakRecord(tdb); err != nil {
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+		if t.hub.owner, err = loadOwnerStatus(tdb); err != nil {
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+		if t.hub.theme, err = loadActiveTheme(context.Background(), tdb); err != nil {
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+		for _, host := range strings.Split(hosts, "|") {
+			host = strings.ToLower(strings.TrimSpace(host))
+			if host == "" {
+				continue
+			}
+			if _, dup := tenantsByHost[host]; dup {
+				return fmt.Errorf("host %q is assigned to more than one tenant", host)
+			}
+			t.Hosts = append(t.Hosts, host)
+			tenantsByHost[host] = t
+		}
+		t.url = os.Getenv(tenantEnvName(name, "SITE_URL"))
+		if t.url == "" && len(t.Hosts) > 0 {
+			t.url = "https://" + t.Hosts[0]
+		}
+		tenantList = append(tenantList, t)
+		log.Printf("Tenant %s serving %s", name, strings.Join(t.Hosts, ", "))
+	}
+	return nil
+}
+
+// tenantFor picks the tenant for a request by its Host header
+func tenantFor(r *http.Request) *Tenant {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if t, ok := tenantsByHost[host]; ok {
+		return t
+	}
+	return defaultTenant
+}
+
+// allHubs returns the hubs of the default site and every tenant
+func allHubs() []*Hub {
+	hubs := []*Hub{defaultTenant.hub}
+	for _, t := range tenantList {
+		hubs = append(hubs, t.hub)
+	}
+	return hubs
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// CRT themes (phosphor colour, scanline and flicker strength) live in the
+// themes table, seeded with a few built-ins. GET /api/themes lists them with
+// the visitor's saved choice and POST /api/theme saves it. Admins edit themes
+// at /admin/themes and can put the whole site in one (storm mode red,
+// midnight amber) at /admin/themes/active; the site theme overrides
+// visitors' choices until it's cleared and goes to everyone as a "theme"
+// message, and to new clients in init.
+
+// Theme is a CRT look
+type Theme struct {
+	Name      string  `json:"name"`
+	Label     string  `json:"label"`
+	Phosphor  string  `json:"phosphor"`
+	Scanlines float64 `json:"scanlines"`
+	Flicker   float64 `json:"flicker"`
+}
+
+// ThemesResponse is returned by /api/themes
+type ThemesResponse struct {
+	Themes   []Theme `json:"themes"`
+	Selected string  `json:"selected,omitempty"`
+	Active   *Theme  `json:"active,omitempty"`
+}
+
+const maxThemeLabel = 40
+
+// validTheme checks a theme definition, normalising the phosphor colour
+func validTheme(t *Theme) bool {
+	t.Phosphor = strings.ToLower(t.Phosphor)
+	t.Label = cleanTextLine(t.Label, maxThemeLabel)
+	if t.Label == "" {
+		t.Label = t.Name
+	}
+	return panelNamePattern.MatchString(t.Name) && hexColor.MatchString(t.Phosphor) &&
+		t.Scanlines >= 0 && t.Scanlines <= 1 && t.Flicker >= 0 && t.Flicker <= 1
+}
+
+// getThemes lists all themes by name
+func getThemes(ctx context.Context, db *sql.DB) ([]Theme, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name, label, phosphor, scanlines, flicker FROM themes ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	themes := []Theme{}
+	for rows.Next() {
+		var t Theme
+		if err := rows.Scan(&t.Name, &t.Label, &t.Phosphor, &t.Scanlines, &t.Flicker); err != nil {
+			return nil, err
+		}
+		themes = append(themes, t)
+	}
+	return themes, rows.Err()
+}
+
+// loadActiveTheme returns the site-wide theme, or nil if there is none
+func loadActiveTheme(ctx context.Context, db *sql.DB) (*Theme, error) {
+	var t Theme
+	err := db.QueryRowContext(ctx, `
+		SELECT name, label, phosphor, scanlines, flicker FROM themes WHERE active = 1
+	`).Scan(&t.Name, &t.Label, &t.Phosphor, &t.Scanlines, &t.Flicker)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// loadVisitorTheme returns the theme a visitor picked, or ""
+func loadVisitorTheme(ctx context.Context, db *sql.DB, visitorID string) (string, error) {
+	var theme string
+	err := db.QueryRowContext(ctx, `SELECT theme FROM visitor_prefs WHERE visitor_id = ?`, visitorID).Scan(&theme)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return theme, err
+}
+
+// activeTheme returns the hub's site-wide theme, or nil
+func (h *Hub) activeTheme() *Theme {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if h.theme == nil {
+		return nil
+	}
+	t := *h.theme
+	return &t
+}
+
+// setActiveTheme switches the site theme (nil clears it) and tells everyone
+func (h *Hub) setActiveTheme(t *Theme) {
+	h.mutex.Lock()
+	h.theme = t
+	h.mutex.Unlock()
+
+	data, _ := json.Marshal(CursorMessage{Type: "theme", Theme: t})
+	h.broadcastToOthers("", data)
+}
+
+// handleThemes lists the themes with the visitor's choice and the site theme
+func handleThemes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	site := tenantFor(r)
+	themes, err := getThemes(r.Context(), site.readDB)
+	if err != nil {
+		log.Printf("Error listing themes: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	resp := ThemesResponse{Themes: themes, Active: site.hub.activeTheme()}
+	if cookie, err := r.Cookie("visitor_id"); err == nil {
+		if resp.Selected, err = loadVisitorTheme(r.Context(), site.db, cookie.Value); err != nil {
+			log.Printf("Error loading theme preference: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleSetTheme saves the visitor's theme ("" goes back to the default)
+func handleSetTheme(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Theme string `json:"theme"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	site := tenantFor(r)
+	if req.Theme != "" {
+		var exists bool
+		err := site.db.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM themes WHERE name = ?)`, req.Theme).Scan(&exists)
+		if err != nil {
+			log.Printf("Error checking theme: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Unknown theme", http.StatusBadRequest)
+			return
+		}
+	}
+	visitorID := visitorIDFromRequest(w, r)
+	_, err := site.db.ExecContext(r.Context(), `
+		INSERT INTO visitor_prefs (visitor_id, theme, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(visitor_id) DO UPDATE SET theme = excluded.theme, updated_at = excluded.updated_at
+	`, visitorID, req.Theme)
+	if err != nil {
+		log.Printf("Error saving theme preference: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminThemes adds or replaces (POST) or removes (DELETE ?name=) a theme.
+// Changes to the site theme go out to everyone straight away.
+func handleAdminThemes(w http.ResponseWriter, r *http.Request) {
+	site := tenantFor(r)
+
+	switch r.Method {
+	case http.MethodPost:
+		var t Theme
+		if err := decodeJSONBody(w, r, &t); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if !validTheme(&t) {
+			http.Error(w, "Invalid theme", http.StatusBadRequest)
+			return
+		}
+		_, err := site.db.ExecContext(r.Context(), `
+			INSERT INTO themes (name, label, phosphor, scanlines, flicker) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(name) DO UPDATE SET label = excluded.label, phosphor = excluded.phosphor,
+				scanlines = excluded.scanlines, flicker = excluded.flicker
+		`, t.Name, t.Label, t.Phosphor, t.Scanlines, t.Flicker)
+		if err != nil {
+			log.Printf("Error saving theme: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if active := site.hub.activeTheme(); active != nil && active.Name == t.Name {
+			site.hub.setActiveTheme(&t)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		res, err := site.db.ExecContext(r.Context(), `DELETE FROM themes WHERE name = ?`, name)
+		if err != nil {
+			log.Printf("Error deleting theme: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		if active := site.hub.activeTheme(); active != nil && active.Name == name {
+			site.hub.setActiveTheme(nil)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleActiveTheme puts the whole site in a theme (POST {"theme":"storm"})
+// or clears it (POST {"theme":""})
+func handleActiveTheme(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Theme string `json:"theme"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	site := tenantFor(r)
+	res, err := site.db.ExecContext(r.Context(), `
+		UPDATE themes SET active = (name = ?1) WHERE ?1 = '' OR EXISTS (SELECT 1 FROM themes WHERE name = ?1)
+	`, req.Theme)
+	if err != nil {
+		log.Printf("Error setting site theme: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 && req.Theme != "" {
+		http.Error(w, "Unknown theme", http.StatusBadRequest)
+		return
+	}
+	active, err := loadActiveTheme(r.Context(), site.db)
+	if err != nil {
+		log.Printf("Error loading site theme: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	site.hub.setActiveTheme(active)
+	log.Printf("Site theme: %q", req.Theme)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// tickLoop runs authoritative server-side game logic at a fixed rate. The NPC
+// cursors are its only user: PONG is still played in the browser, so a
+// server-side PONG would be the first game on it. Ticks are scheduled from
+// the loop's start rather than the previous tick so they don't drift; a loop
+// that falls behind skips the ticks it missed instead of bursting to catch
+// up. While active reports false (nobody in the room) the loop pauses.
+type tickLoop struct {
+	name   string
+	period time.Duration
+	active func() bool
+	tick   func(now time.Time, dt time.Duration)
+
+	mutex    sync.Mutex
+	ticks    int64
+	skipped  int64
+	overruns int64
+	paused   bool
+	busy     time.Duration
+	maxBusy  time.Duration
+}
+
+// TickLoopStats reports how a tick loop is keeping up with its budget
+type TickLoopStats struct {
+	Hz       int     `json:"hz"`
+	Ticks    int64   `json:"ticks"`
+	Skipped  int64   `json:"skipped"`
+	Overruns int64   `json:"overruns"`
+	Paused   bool    `json:"paused"`
+	AvgMs    float64 `json:"avgMs"`
+	MaxMs    float64 `json:"maxMs"`
+	BudgetMs float64 `json:"budgetMs"`
+}
+
+// How often a paused loop checks whether anyone has arrived
+const tickPausePoll = 250 * time.Millisecond
+
+var tickLoops = struct {
+	sync.Mutex
+	loops map[string]*tickLoop
+}{loops: make(map[string]*tickLoop)}
+
+// newTickLoop creates a loop ticking hz times a second, registered by name
+// for /api/stats. active may be nil for a loop that never pauses.
+func newTickLoop(name string, hz int, active func() bool, tick func(now time.Time, dt time.Duration)) *tickLoop {
+	if hz <= 0 {
+		hz = 10
+	}
+	l := &tickLoop{name: name, period: time.Second / time.Duration(hz), active: active, tick: tick}
+	tickLoops.Lock()
+	tickLoops.loops[name] = l
+	tickLoops.Unlock()
+	return l
+}
+
+// run ticks until stop is closed
+func (l *tickLoop) run(stop <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var start, last time.Time
+	var n int64
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		if l.active != nil && !l.active() {
+			l.setPaused(true)
+			start = time.Time{}
+			timer.Reset(tickPausePoll)
+			continue
+		}
+		if start.IsZero() {
+			// (Re)starting: the first tick covers one period
+			l.setPaused(false)
+			start, last, n = now, now.Add(-l.period), 0
+		}
+
+		l.tick(now, now.Sub(last))
+		last = now
+		busy := time.Since(now)
+
+		// Schedule the next tick on the fixed grid, skipping any we've missed
+		n++
+		next := start.Add(time.Duration(n) * l.period)
+		var skipped int64
+		if behind := time.Since(next); behind > 0 {
+			missed := int64(behind/l.period) + 1
+			n += missed
+			skipped = missed
+			next = start.Add(time.Duration(n) * l.period)
+		}
+		l.record(busy, skipped)
+		timer.Reset(time.Until(next))
+	}
+}
+
+func (l *tickLoop) setPaused(paused bool) {
+	l.mutex.Lock()
+	l.paused = paused
+	l.mutex.Unlock()
+}
+
+func (l *tickLoop) record(busy time.Duration, skipped int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.ticks++
+	l.skipped += skipped
+	l.busy += busy
+	if busy > l.maxBusy {
+		l.maxBusy = busy
+	}
+	if busy > l.period {
+		l.overruns++
+	}
+}
+
+func (l *tickLoop) stats() TickLoopStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	s := TickLoopStats{
+		Hz:       int(time.Second / l.period),
+		Ticks:    l.ticks,
+		Skipped:  l.skipped,
+		Overruns: l.overruns,
+		Paused:   l.paused,
+		MaxMs:    float64(l.maxBusy.Microseconds()) / 1000,
+		BudgetMs: float64(l.period.Microseconds()) / 1000,
+	}
+	if l.ticks > 0 {
+		s.AvgMs = float64(l.busy.Microseconds()) / 1000 / float64(l.ticks)
+	}
+	return s
+}
+
+// tickLoopStats returns the stats of every registered loop, or nil if none run
+func tickLoopStats() map[string]TickLoopStats {
+	tickLoops.Lock()
+	defer tickLoops.Unlock()
+	if len(tickLoops.loops) == 0 {
+		return nil
+	}
+	stats := make(map[string]TickLoopStats, len(tickLoops.loops))
+	for name, l := range tickLoops.loops {
+		stats[name] = l.stats()
+	}
+	return stats
+}
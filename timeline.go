@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+// recordLocationVisit adds visitors to a location's daily bucket
+func recordLocationVisit(exec interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, latRounded, lngRounded float64, day time.Time, visitors int) error {
+	_, err := exec.Exec(`
+		INSERT INTO location_daily (lat_rounded, lng_rounded, day, visitors) VALUES (?, ?, ?, ?)
+		ON CONFLICT(lat_rounded, lng_rounded, day) DO UPDATE SET visitors = visitors + excluded.visitors
+	`, latRounded, lngRounded, day.UTC().Format("2006-01-02"), visitors)
+	return err
+}
+
+// backfillLocationDaily seeds the daily buckets from existing locations, once
+func backfillLocationDaily(db *sql.DB) error {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM location_daily`).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	// Older visits were never bucketed, so credit them to the first visit day
+	_, err := db.Exec(`
+		INSERT INTO location_daily (lat_rounded, lng_rounded, day, visitors)
+		SELECT lat_rounded, lng_rounded, date(created_at), COALESCE(visitor_count, 1) FROM locations
+	`)
+	return err
+}
+
+// parseAsOf accepts a date (meaning the end of that day), RFC 3339 or unix seconds
+func parseAsOf(s string) (time.Time, bool) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0).UTC(), true
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t.Add(24*time.Hour - time.Second), true
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// getLocationsAsOf reconstructs the map as it looked at a point in time
+func getLocationsAsOf(ctx context.Context, db *sql.DB, asOf time.Time) ([]Location, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT l.lat, l.lng, l.created_at,
+			COALESCE((SELECT SUM(d.visitors) FROM location_daily d
+				WHERE d.lat_rounded = l.lat_rounded AND d.lng_rounded = l.lng_rounded AND d.day <= ?), 1)
+		FROM locations l
+		WHERE l.created_at <= ?
+		ORDER BY l.created_at
+	`, asOf.Format("2006-01-02"), asOf.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var locations []Location
+	for rows.Next() {
+		var loc Location
+		if err := rows.Scan(&loc.Lat, &loc.Lng, &loc.Timestamp, &loc.VisitorCount); err != nil {
+			return nil, err
+		}
+		locations = append(locations, loc)
+	}
+	return locations, rows.Err()
+}
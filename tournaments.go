@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Tournaments are single-elimination brackets for a battle game. An admin
+// creates one with a start time, visitors register until then, and at the
+// start the entrants are shuffled into round one (an odd player out gets a
+// bye). The scheduler starts each bracket match as a battle as soon as both
+// players are online; someone who doesn't show up within tournamentNoShow
+// forfeits. Winners meet in the next round until one is left, and the result
+// goes to the activity feed.
+const (
+	tournamentTick   = 5 * time.Second
+	tournamentNoShow = 5 * time.Minute
+)
+
+// tournamentSlot identifies a bracket match
+type tournamentSlot struct {
+	tournament int64
+	round      int
+	slot       int
+}
+
+// Tournament describes a bracket for /api/tournaments
+type Tournament struct {
+	ID         int64                   `json:"id"`
+	Name       string                  `json:"name"`
+	Game       string                  `json:"game"`
+	StartsAt   int64                   `json:"startsAt"`
+	Status     string                  `json:"status"`
+	Entrants   int                     `json:"entrants"`
+	Winner     string                  `json:"winner,omitempty"`
+	Bracket    []TournamentBracketGame `json:"bracket,omitempty"`
+	Round      int                     `json:"round,omitempty"`
+	Finished   int64                   `json:"finishedAt,omitempty"`
+	Registered bool                    `json:"registered,omitempty"`
+}
+
+// TournamentBracketGame is one match in a bracket, by player nickname
+type TournamentBracketGame struct {
+	Round  int    `json:"round"`
+	Slot   int    `json:"slot"`
+	A      string `json:"a"`
+	B      string `json:"b,omitempty"`
+	Winner string `json:"winner,omitempty"`
+}
+
+// bracketMatch is an undecided match of the current round
+type bracketMatch struct {
+	tournamentSlot
+	game    string
+	a, b    string
+	readyAt time.Time
+}
+
+// playerName returns a visitor's nickname for brackets, or "???"
+func playerName(ctx context.Context, db *sql.DB, visitorID string) string {
+	if visitorID == "" {
+		return ""
+	}
+	name, err := getVisitorNickname(ctx, db, visitorID)
+	if name = strings.TrimSpace(name); err != nil || name == "" {
+		return "???"
+	}
+	return name
+}
+
+// runTournaments advances every site's tournaments; only the leader does
+func runTournaments() {
+	for {
+		time.Sleep(tournamentTick)
+		if !jobLeader.isLeader() {
+			continue
+		}
+		for _, h := range allHubs() {
+			if err := h.advanceTournaments(time.Now()); err != nil {
+				log.Printf("Error advancing tournaments: %v", err)
+			}
+		}
+	}
+}
+
+func (h *Hub) advanceTournaments(now time.Time) error {
+	if err := startDueTournaments(h.db, now); err != nil {
+		return err
+	}
+	if err := closeFinishedRounds(h.db, now); err != nil {
+		return err
+	}
+	pending, err := pendingBracketMatches(h.db)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		if winner, ok := h.playBracketMatch(m, now); ok {
+			if err := recordBracketResult(context.Background(), h.db, m.tournamentSlot, winner); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// startDueTournaments seeds round one of tournaments whose start has come
+func startDueTournaments(db *sql.DB, now time.Time) error {
+	rows, err := db.Query(`SELECT id FROM tournaments WHERE status = 'open' AND starts_at <= ?`, now.Unix())
+	if err != nil {
+		return err
+	}
+	var due []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, id)
+	}
+	rows.Close()
+
+	for _, id := range due {
+		if err := seedTournament(db, id, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func seedTournament(db *sql.DB, id int64, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT visitor_id FROM tournament_entries WHERE tournament_id = ? ORDER BY random()`, id)
+	if err != nil {
+		return err
+	}
+	var players []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			rows.Close()
+			return err
+		}
+		players = append(players, p)
+	}
+	rows.Close()
+
+	if len(players) < 2 {
+		_, err = tx.Exec(`UPDATE tournaments SET status = 'cancelled', finished_at = ? WHERE id = ?`, now.Unix(), id)
+		if err != nil {
+			return err
+		}
+		log.Printf("Tournament %d cancelled: not enough entrants", id)
+		return tx.Commit()
+	}
+	if err := insertRound(tx, id, 1, players, now); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE tournaments SET status = 'running' WHERE id = ?`, id); err != nil {
+		return err
+	}
+	log.Printf("Tournament %d started with %d players", id, len(players))
+	return tx.Commit()
+}
+
+// insertRound pairs players in order; an odd player out advances on a bye
+func insertRound(tx *sql.Tx, id int64, round int, players []string, now time.Time) error {
+	for slot := 0; slot*2 < len(players); slot++ {
+		a := players[slot*2]
+		b, winner := "", a
+		if slot*2+1 < len(players) {
+			b, winner = players[slot*2+1], ""
+		}
+		_, err := tx.Exec(`
+			INSERT INTO tournament_matches (tournament_id, round, slot, player_a, player_b, winner_id, ready_at)
+			VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?)
+		`, id, round, slot, a, b, winner, now.Unix())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingBracketMatches lists the undecided matches of running tournaments
+func pendingBracketMatches(db *sql.DB) ([]bracketMatch, error) {
+	rows, err := db.Query(`
+		SELECT m.tournament_id, m.round, m.slot, t.game, m.player_a, m.player_b, m.ready_at
+		FROM tournament_matches m JOIN tournaments t ON t.id = m.tournament_id
+		WHERE t.status = 'running' AND m.winner_id IS NULL
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var matches []bracketMatch
+	for rows.Next() {
+		var m bracketMatch
+		var readyAt int64
+		if err := rows.Scan(&m.tournament, &m.round, &m.slot, &m.game, &m.a, &m.b, &readyAt); err != nil {
+			return nil, err
+		}
+		m.readyAt = time.Unix(readyAt, 0)
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+// playBracketMatch starts a bracket match if both players are online and
+// free, or decides it by forfeit once the no-show time has passed
+func (h *Hub) playBracketMatch(m bracketMatch, now time.Time) (string, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, live := range h.battles.matches {
+		if live.tournament != nil && *live.tournament == m.tournamentSlot {
+			return "", false
+		}
+	}
+	if h.battles.finishing[m.tournamentSlot] {
+		return "", false
+	}
+
+	var a, b *Client
+	for _, c := range h.clients {
+		if c.waiting || h.battles.matches[c.ID] != nil {
+			continue
+		}
+		if c.visitorID == m.a && a == nil {
+			a = c
+		} else if c.visitorID == m.b && b == nil {
+			b = c
+		}
+	}
+	if a != nil && b != nil {
+		h.leaveBattleQueue(a.ID)
+		h.leaveBattleQueue(b.ID)
+		match := h.startMatch(m.game, a, b, &m.tournamentSlot)
+		log.Printf("Tournament %d round %d match %d started (%s)", m.tournament, m.round, m.slot, match.id)
+		return "", false
+	}
+	if now.Sub(m.readyAt) < tournamentNoShow {
+		return "", false
+	}
+	// Whoever turned up wins; if nobody did, the first seed goes through
+	if b != nil {
+		return m.b, true
+	}
+	return m.a, true
+}
+
+func recordBracketResult(ctx context.Context, db *sql.DB, slot tournamentSlot, winner string) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE tournament_matches SET winner_id = ?
+		WHERE tournament_id = ? AND round = ? AND slot = ? AND winner_id IS NULL
+	`, winner, slot.tournament, slot.round, slot.slot)
+	return err
+}
+
+// closeFinishedRounds starts the next round of tournaments whose current
+// round is decided, or crowns the winner
+func closeFinishedRounds(db *sql.DB, now time.Time) error {
+	rows, err := db.Query(`
+		SELECT t.id, MAX(m.round) FROM tournaments t JOIN tournament_matches m ON m.tournament_id = t.id
+		WHERE t.status = 'running'
+		GROUP BY t.id
+	`)
+	if err != nil {
+		return err
+	}
+	current := make(map[int64]int)
+	for rows.Next() {
+		var id int64
+		var round int
+		if err := rows.Scan(&id, &round); err != nil {
+			rows.Close()
+			return err
+		}
+		current[id] = round
+	}
+	rows.Close()
+
+	for id, round := range current {
+		if err := closeRound(db, id, round, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func closeRound(db *sql.DB, id int64, round int, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT winner_id FROM tournament_matches WHERE tournament_id = ? AND round = ? ORDER BY slot`, id, round)
+	if err != nil {
+		return err
+	}
+	var winners []string
+	for rows.Next() {
+		var w sql.NullString
+		if err := rows.Scan(&w); err != nil {
+			rows.Close()
+			return err
+		}
+		if !w.Valid {
+			// Still being played
+			rows.Close()
+			return nil
+		}
+		winners = append(winners, w.String)
+	}
+	rows.Close()
+
+	if len(winners) == 1 {
+		_, err = tx.Exec(`UPDATE tournaments SET status = 'finished', winner_id = ?, finished_at = ? WHERE id = ?`,
+			winners[0], now.Unix(), id)
+		if err != nil {
+			return err
+		}
+		log.Printf("Tournament %d won by %s", id, playerName(context.Background(), db, winners[0]))
+	} else if err := insertRound(tx, id, round+1, winners, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// listTournaments returns recent and upcoming tournaments with their brackets
+func listTournaments(ctx context.Context, db *sql.DB, visitorID string) ([]Tournament, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.id, t.name, t.game, t.starts_at, t.status, COALESCE(t.winner_id, ''), COALESCE(t.finished_at, 0),
+			(SELECT COUNT(*) FROM tournament_entries e WHERE e.tournament_id = t.id),
+			EXISTS (SELECT 1 FROM tournament_entries e WHERE e.tournament_id = t.id AND e.visitor_id = ?)
+		FROM tournaments t
+		WHERE t.status IN ('open', 'running') OR t.finished_at > ?
+		ORDER BY t.starts_at DESC
+		LIMIT 20
+	`, visitorID, time.Now().Add(-7*24*time.Hour).Unix())
+	if err != nil {
+		return nil, err
+	}
+	tournaments := []Tournament{}
+	for rows.Next() {
+		var t Tournament
+		var winner string
+		if err := rows.Scan(&t.ID, &t.Name, &t.Game, &t.StartsAt, &t.Status, &winner, &t.Finished, &t.Entrants, &t.Registered); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t.Winner = playerName(ctx, db, winner)
+		tournaments = append(tournaments, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range tournaments {
+		t := &tournaments[i]
+		rows, err := db.QueryContext(ctx, `
+			SELECT round, slot, player_a, player_b, COALESCE(winner_id, '') FROM tournament_matches
+			WHERE tournament_id = ? ORDER BY round, slot
+		`, t.ID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var g TournamentBracketGame
+			if err := rows.Scan(&g.Round, &g.Slot, &g.A, &g.B, &g.Winner); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			g.A, g.B, g.Winner = playerName(ctx, db, g.A), playerName(ctx, db, g.B), playerName(ctx, db, g.Winner)
+			t.Bracket = append(t.Bracket, g)
+			t.Round = g.Round
+		}
+		rows.Close()
+	}
+	return tournaments, nil
+}
+
+func handleGetTournaments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	visitorID := ""
+	if cookie, err := r.Cookie("visitor_id"); err == nil {
+		visitorID = cookie.Value
+	}
+	tournaments, err := listTournaments(r.Context(), tenantFor(r).db, visitorID)
+	if err != nil {
+		log.Printf("Error listing tournaments: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tournaments)
+}
+
+// handleTournamentRegister signs the visitor up for (POST) or out of (DELETE)
+// an open tournament
+func handleTournamentRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		ID int64 `json:"id"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	visitorID := visitorIDFromRequest(w, r)
+	db := tenantFor(r).db
+
+	var status string
+	err := db.QueryRowContext(r.Context(), `SELECT status FROM tournaments WHERE id = ?`, req.ID).Scan(&status)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error registering for tournament: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if status != "open" {
+		http.Error(w, "Registration closed", http.StatusConflict)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		_, err = db.ExecContext(r.Context(), `INSERT OR IGNORE INTO tournament_entries (tournament_id, visitor_id) VALUES (?, ?)`, req.ID, visitorID)
+	} else {
+		_, err = db.ExecContext(r.Context(), `DELETE FROM tournament_entries WHERE tournament_id = ? AND visitor_id = ?`, req.ID, visitorID)
+	}
+	if err != nil {
+		log.Printf("Error registering for tournament: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCreateTournament creates a tournament from {name, game, startsAt}
+func handleCreateTournament(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Name     string `json:"name"`
+		Game     string `json:"game"`
+		StartsAt string `json:"startsAt"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	game := strings.ToUpper(req.Game)
+	if _, ok := battleGames[game]; !ok {
+		http.Error(w, "Invalid game", http.StatusBadRequest)
+		return
+	}
+	name := cleanTextLine(req.Name, 60)
+	startsAt := parseImportTime(req.StartsAt)
+	if name == "" || startsAt.IsZero() {
+		http.Error(w, "Name and startsAt are required", http.StatusBadRequest)
+		return
+	}
+	res, err := tenantFor(r).db.ExecContext(r.Context(), `INSERT INTO tournaments (name, game, starts_at) VALUES (?, ?, ?)`, name, game, startsAt.Unix())
+	if err != nil {
+		log.Printf("Error creating tournament: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Tournament{ID: id, Name: name, Game: game, StartsAt: startsAt.Unix(), Status: "open"})
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Requests, hub operations, database queries and upstream API calls are
+// recorded as OpenTelemetry spans and exported with OTLP/HTTP (JSON) when
+// OTEL_EXPORTER_OTLP_ENDPOINT (or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT) is set.
+// Incoming W3C traceparent headers are honoured and passed on upstream.
+
+var (
+	tracesEndpoint = otlpTracesEndpoint()
+	tracingEnabled = tracesEndpoint != ""
+	serviceName    = envString("OTEL_SERVICE_NAME", "currentcondition")
+	otlpHeaders    = secret("OTEL_EXPORTER_OTLP_HEADERS")
+)
+
+func otlpTracesEndpoint() string {
+	if url := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); url != "" {
+		return url
+	}
+	if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+		return strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+// Span kinds and status codes from the OTLP spec
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusError = 2
+)
+
+// span is one timed operation in a trace. A nil span is valid and does nothing,
+// which is what startSpan returns while tracing is off.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	attrs    map[string]interface{}
+	err      error
+	// Only kept when slow, for low-level spans that started without a parent
+	dropIfFast bool
+}
+
+// Low-level operations (queries, upstream calls) outside any traced request
+// are only exported when they take at least this long
+const orphanSpanThreshold = 100 * time.Millisecond
+
+type spanKey struct{}
+
+// startSpan begins a span as a child of the span in ctx, if any
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if !tracingEnabled {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]interface{})}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok && parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startChildSpan is startSpan for low-level operations, which only start a
+// trace of their own when they turn out to be slow
+func startChildSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	ctx, s := startSpan(ctx, name, kind)
+	if s != nil && parent == nil {
+		s.dropIfFast = true
+	}
+	return ctx, s
+}
+
+func (s *span) setAttr(key string, value interface{}) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// end finishes the span, marking it failed if err is set, and queues it for export
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.err = err
+	now := time.Now()
+	if s.dropIfFast && now.Sub(s.start) < orphanSpanThreshold {
+		return
+	}
+	select {
+	case spanQueue <- otlpSpanFrom(s, now):
+	default:
+		// Drop spans rather than slow down requests when the collector can't keep up
+	}
+}
+
+// traceparent formats the span as a W3C traceparent header
+func (s *span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+// contextFromTraceparent continues a trace started by the caller
+func contextFromTraceparent(ctx context.Context, header string) context.Context {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	remote := &span{}
+	if _, err := hex.Decode(remote.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(remote.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, remote)
+}
+
+// OTLP/JSON encoding
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       otlpStatus `json:"status"`
+}
+
+func otlpAttribute(key string, v interface{}) otlpAttr {
+	var val otlpValue
+	switch x := v.(type) {
+	case string:
+		val.StringValue = &x
+	case int:
+		s := strconv.Itoa(x)
+		val.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		val.IntValue = &s
+	case float64:
+		val.DoubleValue = &x
+	case bool:
+		val.BoolValue = &x
+	default:
+		s := fmt.Sprint(x)
+		val.StringValue = &s
+	}
+	return otlpAttr{Key: key, Value: val}
+}
+
+func otlpSpanFrom(s *span, end time.Time) otlpSpan {
+	out := otlpSpan{
+		TraceID: hex.EncodeToString(s.traceID[:]),
+		SpanID:  hex.EncodeToString(s.spanID[:]),
+		Name:    s.name,
+		Kind:    s.kind,
+		Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+		End:     strconv.FormatInt(end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for k, v := range s.attrs {
+		out.Attributes = append(out.Attributes, otlpAttribute(k, v))
+	}
+	if s.err != nil {
+		out.Status = otlpStatus{Code: spanStatusError, Message: s.err.Error()}
+	}
+	return out
+}
+
+// Finished spans are batched and posted to the collector
+const (
+	spanQueueSize     = 4096
+	spanBatchSize     = 512
+	spanFlushInterval = 5 * time.Second
+)
+
+var spanQueue = make(chan otlpSpan, spanQueueSize)
+
+// exportClient talks to the collector; it is not traced itself
+var exportClient = &http.Client{Timeout: 10 * time.Second}
+
+func runSpanExporter() {
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+
+	var batch []otlpSpan
+	for {
+		select {
+		case s := <-spanQueue:
+			batch = append(batch, s)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if err := exportSpans(batch); err != nil {
+			log.Printf("Error exporting %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+func exportSpans(spans []otlpSpan) error {
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttr{otlpAttribute("service.name", serviceName)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "currentcondition"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, tracesEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, h := range strings.Split(otlpHeaders, ",") {
+		if k, v, ok := strings.Cut(h, "="); ok {
+			req.Header.Set(strings.TrimSpace(k), strings.TrimSpace(v))
+		}
+	}
+	resp, err := exportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// HTTP server spans
+
+// statusWriter records the status code while keeping websocket upgrades and streaming working
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// traceRequests wraps every request in a server span
+func traceRequests(next http.Handler) http.Handler {
+	if !tracingEnabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := contextFromTraceparent(r.Context(), r.Header.Get("traceparent"))
+		ctx, s := startSpan(ctx, r.Method+" "+r.URL.Path, spanKindServer)
+		s.setAttr("http.request.method", r.Method)
+		s.setAttr("url.path", r.URL.Path)
+		s.setAttr("server.address", r.Host)
+		s.setAttr("client.address", clientIP(r))
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		s.setAttr("http.response.status_code", sw.status)
+		var err error
+		if sw.status >= 500 {
+			err = errors.New(http.StatusText(sw.status))
+		}
+		s.end(err)
+	})
+}
+
+// Upstream client spans
+
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, s := startChildSpan(req.Context(), req.Method+" "+req.URL.Host, spanKindClient)
+	if s == nil {
+		return t.base.RoundTrip(req)
+	}
+	s.setAttr("http.request.method", req.Method)
+	s.setAttr("url.full", req.URL.String())
+	req = req.Clone(ctx)
+	req.Header.Set("traceparent", s.traceparent())
+
+	resp, err := t.base.RoundTrip(req)
+	spanErr := err
+	if err == nil {
+		s.setAttr("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= 500 {
+			spanErr = errors.New(resp.Status)
+		}
+	}
+	s.end(spanErr)
+	return resp, err
+}
+
+// Database spans: a wrapper around the SQLite driver times every statement
+
+const tracedDriverName = "sqlite3-traced"
+
+func init() {
+	sql.Register(tracedDriverName, &tracedDriver{})
+}
+
+// sqlDriver is the driver name to open databases with
+func sqlDriver() string {
+	if tracingEnabled {
+		return tracedDriverName
+	}
+	return "sqlite3"
+}
+
+type tracedDriver struct {
+	sqlite3.SQLiteDriver
+}
+
+func (d *tracedDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+type tracedConn struct {
+	*sqlite3.SQLiteConn
+}
+
+// dbSpan starts a span for a statement, named after its first keyword
+func dbSpan(ctx context.Context, query string) (context.Context, *span) {
+	op := strings.ToUpper(strings.Fields(query + " ?")[0])
+	ctx, s := startChildSpan(ctx, "sqlite "+op, spanKindClient)
+	s.setAttr("db.system", "sqlite")
+	s.setAttr("db.statement", strings.Join(strings.Fields(query), " "))
+	return ctx, s
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ctx, s := dbSpan(ctx, query)
+	res, err := c.SQLiteConn.ExecContext(ctx, query, args)
+	s.end(err)
+	return res, err
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	ctx, s := dbSpan(ctx, query)
+	rows, err := c.SQLiteConn.QueryContext(ctx, query, args)
+	s.end(err)
+	return rows, err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Typing indicators are ephemeral: a client sends {"type":"typing"} while its
+// user types (repeating it as a keepalive) and {"type":"typing_stop"} when
+// done. The hub tells the room when someone starts and stops, and clears the
+// state itself once keepalives stop arriving.
+
+const typingTimeout = 5 * time.Second
+
+// setTyping records a typing keepalive or stop from c
+func (c *Client) setTyping(typing bool) {
+	h := c.hub
+	h.mutex.Lock()
+	_, wasTyping := h.typing[c.ID]
+	if typing {
+		h.typing[c.ID] = time.Now()
+	} else {
+		delete(h.typing, c.ID)
+	}
+	h.mutex.Unlock()
+
+	// Only changes are broadcast, not every keepalive
+	if typing != wasTyping {
+		h.broadcastTyping(c.ID, typing)
+	}
+}
+
+// expireTyping clears typing state that hasn't been kept alive
+func (h *Hub) expireTyping() {
+	cutoff := time.Now().Add(-typingTimeout)
+	var expired []string
+	h.mutex.Lock()
+	for id, last := range h.typing {
+		if last.Before(cutoff) {
+			delete(h.typing, id)
+			expired = append(expired, id)
+		}
+	}
+	h.mutex.Unlock()
+
+	for _, id := range expired {
+		h.broadcastTyping(id, false)
+	}
+}
+
+func (h *Hub) broadcastTyping(id string, typing bool) {
+	msg := CursorMessage{Type: "typing_stop", ID: id}
+	if typing {
+		msg.Type = "typing"
+	}
+	data, _ := json.Marshal(msg)
+	h.broadcastToOthers(id, data)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Client for the third-party data APIs (Open-Meteo, USGS, NOAA, ...)
+var upstreamClient = &http.Client{Timeout: 10 * time.Second, Transport: tracingTransport{http.DefaultTransport}}
+
+// fetchJSON GETs a URL and decodes the JSON response into v
+func fetchJSON(url string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "currentcondition.tv")
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// ttlCache keeps upstream responses for a while so visitors don't hammer the APIs
+type ttlCache[T any] struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]ttlEntry[T]
+}
+
+type ttlEntry[T any] struct {
+	value   T
+	expires time.Time
+}
+
+func newTTLCache[T any](ttl time.Duration) *ttlCache[T] {
+	return &ttlCache[T]{ttl: ttl, entries: make(map[string]ttlEntry[T])}
+}
+
+// get returns the cached value for key, calling load on a miss
+func (c *ttlCache[T]) get(key string, load func() (T, error)) (T, error) {
+	c.Lock()
+	if e, ok := c.entries[key]; ok && time.Now().Before(e.expires) {
+		c.Unlock()
+		return e.value, nil
+	}
+	c.Unlock()
+
+	value, err := load()
+	if err != nil {
+		return value, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	// Drop expired entries now and then so the map doesn't grow forever
+	if len(c.entries) > 1000 {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = ttlEntry[T]{value: value, expires: time.Now().Add(c.ttl)}
+	return value, nil
+}
+
+// parseLatLng reads and validates lat/lng query parameters
+func parseLatLng(r *http.Request) (float64, float64, bool) {
+	lat, err1 := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	lng, err2 := strconv.ParseFloat(r.URL.Query().Get("lng"), 64)
+	if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return 0, 0, false
+	}
+	return lat, lng, true
+}
+
+// coordKey rounds coordinates to ~1km so nearby visitors share cache entries
+func coordKey(lat, lng float64) string {
+	return fmt.Sprintf("%.2f,%.2f", roundCoord(lat, 2), roundCoord(lng, 2))
+}
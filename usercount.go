@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// User count updates go out at most once per countInterval, always with the
+// latest value. A join or leave carries the count itself when an update is
+// due; otherwise the hub sends {"type":"users"} on its own once the interval
+// has passed, so a storm of joins and leaves costs one update per second
+// rather than one per event.
+
+const countInterval = time.Second
+
+// countState is the last user count broadcast by a hub
+type countState struct {
+	sent   int
+	sentAt time.Time
+}
+
+// users returns how many visitors are connected, leaving out bots (see
+// npc.go); it must be called with the hub mutex held
+func (h *Hub) users() int {
+	return len(h.clients) - h.bots
+}
+
+// takeCount returns the user count if an update is due and marks it as sent,
+// or 0 if there's nothing to send yet; it must be called with the hub mutex held
+func (h *Hub) takeCount(now time.Time) int {
+	n := h.users()
+	if n == h.count.sent || now.Sub(h.count.sentAt) < countInterval {
+		return 0
+	}
+	h.count = countState{sent: n, sentAt: now}
+	return n
+}
+
+// flushCount sends the latest user count if it changed without being sent
+func (h *Hub) flushCount() {
+	h.mutex.Lock()
+	n := h.takeCount(time.Now())
+	h.mutex.Unlock()
+
+	if n > 0 {
+		h.broadcastToOthers("", userCountFrames.get(n))
+	}
+}
+
+var userCountFrames = &numberFrames{encode: func(n int) []byte {
+	data, _ := json.Marshal(CursorMessage{Type: "users", UserCount: n})
+	return data
+}}
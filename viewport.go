@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Cursor positions arrive in viewport pixels, which only line up between
+// clients with the same window size and scroll offset. When a client also
+// sends its scroll offset and page size, the hub converts the position to a
+// point relative to the whole page (0-1 on each axis) that every receiver
+// can map back onto its own page.
+
+// NormalizedPoint is a position as a fraction of the page's width and height
+type NormalizedPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// Pages larger than this are treated as bogus
+const maxPageSize = 100000
+
+// normalizePosition fills in pos.Normalized from its viewport coordinates,
+// scroll offset and page size, and drops the raw viewport fields
+func normalizePosition(pos *CursorPosition) {
+	pos.Normalized = nil
+	defer func() {
+		pos.ScrollX, pos.ScrollY, pos.PageWidth, pos.PageHeight = 0, 0, 0, 0
+	}()
+	if !validPageSize(pos.PageWidth) || !validPageSize(pos.PageHeight) {
+		return
+	}
+	pos.Normalized = &NormalizedPoint{
+		X: clampUnit((pos.X + pos.ScrollX) / pos.PageWidth),
+		Y: clampUnit((pos.Y + pos.ScrollY) / pos.PageHeight),
+	}
+}
+
+// Coordinates further out than this aren't from a real browser
+const maxCursorCoord = 10 * maxPageSize
+
+// validCursorPosition rejects a position with NaN, infinite or absurd
+// coordinates, and clamps the rest onto the page, so nothing odd gets
+// broadcast to other clients
+func validCursorPosition(pos *CursorPosition) bool {
+	for _, v := range []float64{pos.X, pos.Y, pos.ScrollX, pos.ScrollY, pos.PageWidth, pos.PageHeight} {
+		if math.IsNaN(v) || math.IsInf(v, 0) || math.Abs(v) > maxCursorCoord {
+			return false
+		}
+	}
+	pos.X = clampCoord(pos.X)
+	pos.Y = clampCoord(pos.Y)
+	pos.ScrollX = clampCoord(pos.ScrollX)
+	pos.ScrollY = clampCoord(pos.ScrollY)
+	return true
+}
+
+// A client sending more invalid positions than this in a minute is dropped
+const maxBadMoves = 20
+
+// rejectMove counts an invalid position and reports whether the client has
+// now sent too many to keep
+func (c *Client) rejectMove() bool {
+	if now := time.Now(); now.Sub(c.badMovesSince) > time.Minute {
+		c.badMoves, c.badMovesSince = 0, now
+	}
+	c.badMoves++
+	return c.badMoves > maxBadMoves
+}
+
+func clampCoord(v float64) float64 {
+	return math.Max(0, math.Min(maxPageSize, v))
+}
+
+func validPageSize(v float64) bool {
+	return v > 0 && v <= maxPageSize && !math.IsNaN(v)
+}
+
+func clampUnit(v float64) float64 {
+	if math.IsNaN(v) {
+		return 0
+	}
+	return math.Max(0, math.Min(1, v))
+}
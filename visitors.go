@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// Visitors get a row in visitors on their first visit, which gains a location
+// once they submit one; its last_seen is refreshed on activity (at most once
+// per visitorTouchInterval). Rows nobody has used for a while are purged
+// hourly, along with the preferences, ratings and experiment exposures left
+// behind by them. Visitors with an account are kept. Nicknames expire on their
+// own (see nickname.go).
+const (
+	visitorTouchInterval = time.Hour
+	// Visitors who never submitted a location
+	incompleteVisitorRetention = 30 * 24 * time.Hour
+	// Everyone else, past the one-year cookie lifetime
+	visitorRetention = 400 * 24 * time.Hour
+)
+
+// visitorTouch identifies a visitor in one site's database
+type visitorTouch struct {
+	db        *sql.DB
+	visitorID string
+}
+
+// Remember recent touches so busy visitors don't write on every request
+var visitorTouches = struct {
+	sync.Mutex
+	seen map[visitorTouch]time.Time
+}{seen: make(map[visitorTouch]time.Time)}
+
+// touchVisitor records that a visitor is active, adding a row without a
+// location for visitors who don't have one yet
+func touchVisitor(ctx context.Context, db *sql.DB, visitorID string) {
+	key := visitorTouch{db, visitorID}
+	now := time.Now()
+	visitorTouches.Lock()
+	if now.Sub(visitorTouches.seen[key]) < visitorTouchInterval {
+		visitorTouches.Unlock()
+		return
+	}
+	if len(visitorTouches.seen) >= 10000 {
+		visitorTouches.seen = make(map[visitorTouch]time.Time)
+	}
+	visitorTouches.seen[key] = now
+	visitorTouches.Unlock()
+
+	// The update runs after the request may have finished
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		_, err := db.ExecContext(ctx, `
+			INSERT INTO visitors (visitor_id, last_seen) VALUES (?, CURRENT_TIMESTAMP)
+			ON CONFLICT(visitor_id) DO UPDATE SET last_seen = CURRENT_TIMESTAMP
+		`, visitorID)
+		if err != nil {
+			log.Printf("Error updating visitor last seen: %v", err)
+		}
+	}()
+}
+
+// purgeStaleVisitors deletes idle visitors and rows orphaned by them
+func purgeStaleVisitors(db *sql.DB, now time.Time) (int64, error) {
+	incompleteCutoff := now.Add(-incompleteVisitorRetention).UTC().Format("2006-01-02 15:04:05")
+	cutoff := now.Add(-visitorRetention).UTC().Format("2006-01-02 15:04:05")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		DELETE FROM visitors
+		WHERE ((lat_rounded IS NULL AND COALESCE(last_seen, created_at) < ?)
+		   OR COALESCE(last_seen, created_at) < ?)
+		  AND visitor_id NOT IN (SELECT visitor_id FROM accounts)
+	`, incompleteCutoff, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	purged, _ := result.RowsAffected()
+
+	// Active visitors all have a row, so these belong to purged visitors. Rows
+	// written before visitors were touched on every visit may still lack one
+	// until the visitor comes back, so only drop orphans that are old themselves
+	for _, orphans := range []string{
+		`DELETE FROM visitor_prefs WHERE updated_at < ? AND visitor_id NOT IN (SELECT visitor_id FROM visitors)`,
+		`DELETE FROM experiment_exposures WHERE exposed_at < ? AND visitor_id NOT IN (SELECT visitor_id FROM visitors)`,
+		`DELETE FROM ratings WHERE updated_at < ? AND visitor_id NOT IN (SELECT visitor_id FROM visitors)`,
+	} {
+		if _, err := tx.Exec(orphans, incompleteCutoff); err != nil {
+			return 0, err
+		}
+	}
+	return purged, tx.Commit()
+}
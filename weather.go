@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// Forecast is the current conditions and daily outlook for a location, in metric units
+type Forecast struct {
+	Timezone string          `json:"timezone"`
+	Current  ForecastCurrent `json:"current"`
+	Daily    ForecastDaily   `json:"daily"`
+}
+
+// ForecastCurrent holds Open-Meteo's current conditions
+type ForecastCurrent struct {
+	Time          string  `json:"time"`
+	Temperature   float64 `json:"temperature_2m"`
+	Humidity      float64 `json:"relative_humidity_2m"`
+	FeelsLike     float64 `json:"apparent_temperature"`
+	WeatherCode   int     `json:"weather_code"`
+	WindSpeed     float64 `json:"wind_speed_10m"`
+	WindDirection float64 `json:"wind_direction_10m"`
+	IsDay         int     `json:"is_day"`
+	Station       bool    `json:"station,omitempty"`
+}
+
+// ForecastDaily holds Open-Meteo's daily series, one entry per day
+type ForecastDaily struct {
+	Time        []string  `json:"time"`
+	WeatherCode []int     `json:"weather_code"`
+	TempMax     []float64 `json:"temperature_2m_max"`
+	TempMin     []float64 `json:"temperature_2m_min"`
+	PrecipProb  []float64 `json:"precipitation_probability_max"`
+}
+
+var forecastCache = newTTLCache[Forecast](10 * time.Minute)
+
+// getForecast fetches (or returns cached) Open-Meteo conditions for a location,
+// preferring a nearby personal weather station for current conditions
+func getForecast(ctx context.Context, lat, lng float64) (Forecast, error) {
+	f, err := getRemoteForecast(ctx, lat, lng)
+	if err != nil {
+		return f, err
+	}
+	if reading := nearbyStationReading(ctx, lat, lng); reading != nil {
+		applyStationReading(&f.Current, reading)
+	}
+	return f, nil
+}
+
+func getRemoteForecast(ctx context.Context, lat, lng float64) (Forecast, error) {
+	return forecastCache.get(coordKey(lat, lng), func() (Forecast, error) {
+		var f Forecast
+		err := fetchJSON(fmt.Sprintf(
+			"https://api.open-meteo.com/v1/forecast?latitude=%.4f&longitude=%.4f"+
+				"&current=temperature_2m,relative_humidity_2m,apparent_temperature,weather_code,wind_speed_10m,wind_direction_10m,is_day"+
+				"&daily=weather_code,temperature_2m_max,temperature_2m_min,precipitation_probability_max&forecast_days=4&timezone=auto",
+			lat, lng), &f)
+		if err == nil {
+			if err := recordObservation(ctx, lat, lng, observationFromForecast(f.Current)); err != nil {
+				log.Printf("Error recording observation: %v", err)
+			}
+		}
+		return f, err
+	})
+}
+
+// compassPoint turns a wind bearing into a 16-point compass direction
+func compassPoint(deg float64) string {
+	points := []string{"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE", "S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW"}
+	i := int(math.Mod(deg+11.25+360, 360) / 22.5)
+	return points[i%16]
+}
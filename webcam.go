@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "image/gif"
+	_ "image/jpeg"
+)
+
+// Public webcams are configured with WEBCAMS as comma-separated
+// name=lat|lng|url entries. /api/webcam proxies the one nearest to lat/lng,
+// shrunk and dithered to a 1-bit PNG for the CRT look.
+
+// Webcam is a public snapshot image at a known location
+type Webcam struct {
+	Name string
+	Lat  float64
+	Lng  float64
+	URL  string
+}
+
+// Cams further away than this aren't "nearby"
+const webcamRadiusKm = 50.0
+
+const (
+	webcamTTL       = 5 * time.Minute
+	webcamMaxBytes  = 5 << 20
+	webcamMaxPixels = 24 << 20 // what a compressed image may unpack to
+)
+
+// Widths served, so each camera is fetched at most len(webcamWidths) times per TTL
+var webcamWidths = []int{160, 320, 480, 640}
+
+var webcams = parseWebcams(os.Getenv("WEBCAMS"))
+
+// Webcam images are slow and large; don't let one hold a request for long
+var webcamClient = &http.Client{Timeout: 8 * time.Second, Transport: tracingTransport{http.DefaultTransport}}
+
+// webcamImage is a processed snapshot and when it was fetched
+type webcamImage struct {
+	png     []byte
+	fetched time.Time
+}
+
+var webcamCache = newTTLCache[webcamImage](webcamTTL)
+
+func parseWebcams(spec string) []Webcam {
+	var list []Webcam
+	for _, entry := range strings.Split(spec, ",") {
+		name, rest, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		parts := strings.SplitN(rest, "|", 3)
+		if !ok || name == "" || len(parts) != 3 {
+			continue
+		}
+		lat, err1 := strconv.ParseFloat(parts[0], 64)
+		lng, err2 := strconv.ParseFloat(parts[1], 64)
+		if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+			log.Printf("Ignoring webcam %q: invalid coordinates", name)
+			continue
+		}
+		list = append(list, Webcam{Name: name, Lat: lat, Lng: lng, URL: parts[2]})
+	}
+	return list
+}
+
+// nearestWebcam returns the closest webcam within webcamRadiusKm
+func nearestWebcam(lat, lng float64) (Webcam, float64, bool) {
+	var best Webcam
+	bestKm := math.Inf(1)
+	for _, cam := range webcams {
+		if d := haversineKm(lat, lng, cam.Lat, cam.Lng); d < bestKm {
+			best, bestKm = cam, d
+		}
+	}
+	return best, bestKm, bestKm <= webcamRadiusKm
+}
+
+// fetchWebcam downloads a snapshot and turns it into a dithered 1-bit PNG
+func fetchWebcam(cam Webcam, width int) (webcamImage, error) {
+	req, err := http.NewRequest(http.MethodGet, cam.URL, nil)
+	if err != nil {
+		return webcamImage{}, err
+	}
+	req.Header.Set("User-Agent", "currentcondition.tv")
+	resp, err := webcamClient.Do(req)
+	if err != nil {
+		return webcamImage{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return webcamImage{}, fmt.Errorf("%s: %s", cam.URL, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, webcamMaxBytes))
+	if err != nil {
+		return webcamImage{}, err
+	}
+
+	// Check the dimensions first: a small file can claim a huge image
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return webcamImage{}, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > webcamMaxPixels {
+		return webcamImage{}, fmt.Errorf("%s: image is %dx%d", cam.URL, cfg.Width, cfg.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		return webcamImage{}, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, ditherImage(src, width)); err != nil {
+		return webcamImage{}, err
+	}
+	return webcamImage{png: buf.Bytes(), fetched: time.Now()}, nil
+}
+
+// ditherImage scales src down to width (keeping its aspect ratio) and
+// Floyd-Steinberg dithers it to black and white
+func ditherImage(src image.Image, width int) *image.Paletted {
+	b := src.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black, color.White})
+	}
+	if width > b.Dx() {
+		width = b.Dx()
+	}
+	height := int(math.Max(1, math.Round(float64(b.Dy())*float64(width)/float64(b.Dx()))))
+
+	// Box-average the source pixels under each output pixel into a grey level
+	grey := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+(y+1)*b.Dy()/height
+		for x := 0; x < width; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+(x+1)*b.Dx()/width
+			var sum float64
+			var n int
+			for sy := y0; sy < y1 || sy == y0; sy++ {
+				for sx := x0; sx < x1 || sx == x0; sx++ {
+					sum += float64(color.GrayModel.Convert(src.At(sx, sy)).(color.Gray).Y)
+					n++
+				}
+			}
+			grey[y*width+x] = sum / float64(n)
+		}
+	}
+
+	out := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{color.Black, color.White})
+	spread := func(x, y int, e float64) {
+		if x >= 0 && x < width && y < height {
+			grey[y*width+x] += e
+		}
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			old := grey[y*width+x]
+			level := 0.0
+			if old >= 128 {
+				level = 255
+				out.SetColorIndex(x, y, 1)
+			}
+			e := old - level
+			spread(x+1, y, e*7/16)
+			spread(x-1, y+1, e*3/16)
+			spread(x, y+1, e*5/16)
+			spread(x+1, y+1, e*1/16)
+		}
+	}
+	return out
+}
+
+// webcamWidth picks the smallest served width that covers ?w=, 320 by default
+func webcamWidth(param string) int {
+	want, err := strconv.Atoi(param)
+	if err != nil || want <= 0 {
+		return 320
+	}
+	for _, w := range webcamWidths {
+		if w >= want {
+			return w
+		}
+	}
+	return webcamWidths[len(webcamWidths)-1]
+}
+
+func handleGetWebcam(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lat, lng, ok := parseLatLng(r)
+	if !ok {
+		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+		return
+	}
+	width := webcamWidth(r.URL.Query().Get("w"))
+
+	cam, km, ok := nearestWebcam(lat, lng)
+	if !ok {
+		http.Error(w, "No webcam nearby", http.StatusNotFound)
+		return
+	}
+
+	img, err := webcamCache.get(fmt.Sprintf("%s/%d", cam.Name, width), func() (webcamImage, error) {
+		return fetchWebcam(cam, width)
+	})
+	if err != nil {
+		log.Printf("Error fetching webcam %s: %v", cam.Name, err)
+		http.Error(w, "Upstream error", http.StatusBadGateway)
+		return
+	}
+
+	maxAge := int((webcamTTL - time.Since(img.fetched)).Seconds())
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	w.Header().Set("X-Webcam", cam.Name)
+	w.Header().Set("X-Webcam-Distance-Km", strconv.FormatFloat(math.Round(km*10)/10, 'f', 1, 64))
+	http.ServeContent(w, r, "", img.fetched, bytes.NewReader(img.png))
+}
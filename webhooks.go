@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// External services (a weather station, a CI pipeline) push events onto the
+// terminal with POST /api/ingest, naming themselves in the event's "source",
+// or POST /api/webhooks/<source>. Requests must be signed with HMAC-SHA256 of
+// the body using the site's WEBHOOK_SECRET (WEBHOOK_SECRET_<NAME> for a
+// tenant), in an X-Signature-256 (or X-Hub-Signature-256) header. An event
+// goes only to the site whose host it was posted to, as an "external"
+// message to everyone in its cursor room.
+var webhookSecret = secret("WEBHOOK_SECRET")
+
+// ExternalEvent is an event pushed in by an external service
+type ExternalEvent struct {
+	Source  string   `json:"source"`
+	Title   string   `json:"title"`
+	Message string   `json:"message,omitempty"`
+	Level   string   `json:"level,omitempty"`
+	Lat     *float64 `json:"lat,omitempty"`
+	Lng     *float64 `json:"lng,omitempty"`
+	Time    int64    `json:"time"`
+}
+
+// Each hub keeps the last few events for clients that connect later
+const maxRecentEvents = 20
+
+// validWebhookSignature checks a "sha256=<hex>" signature of body
+func validWebhookSignature(secret string, body []byte, signature string) bool {
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// handleIngest accepts an event naming its source in the body
+func handleIngest(w http.ResponseWriter, r *http.Request) {
+	ingestEvent(w, r, "")
+}
+
+// handleWebhook accepts an event from the source named in the path
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	source := sanitizeZone(strings.TrimPrefix(r.URL.Path, "/api/webhooks/"))
+	if source == "" {
+		http.Error(w, "Invalid source", http.StatusBadRequest)
+		return
+	}
+	ingestEvent(w, r, source)
+}
+
+// ingestEvent checks a signed event and broadcasts it. The source, if given,
+// overrides the one in the event.
+func ingestEvent(w http.ResponseWriter, r *http.Request, source string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	site := tenantFor(r)
+	if site.webhookSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	signature := r.Header.Get("X-Signature-256")
+	if signature == "" {
+		signature = r.Header.Get("X-Hub-Signature-256")
+	}
+	if !validWebhookSignature(site.webhookSecret, body, signature) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var ev ExternalEvent
+	if err := json.Unmarshal(body, &ev); err != nil || ev.Title == "" {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	if ev.Lat != nil && ev.Lng != nil && (*ev.Lat < -90 || *ev.Lat > 90 || *ev.Lng < -180 || *ev.Lng > 180) {
+		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+		return
+	}
+	if source != "" {
+		ev.Source = source
+	}
+	if ev.Source = sanitizeZone(ev.Source); ev.Source == "" {
+		http.Error(w, "Invalid source", http.StatusBadRequest)
+		return
+	}
+	ev.Title = cleanTextLine(ev.Title, 120)
+	ev.Message = cleanTextLine(ev.Message, 500)
+	ev.Level = sanitizeZone(ev.Level)
+	ev.Time = time.Now().Unix()
+
+	hub := site.hub
+	hub.mutex.Lock()
+	hub.external = append(hub.external, ev)
+	if len(hub.external) > maxRecentEvents {
+		hub.external = hub.external[len(hub.external)-maxRecentEvents:]
+	}
+	hub.mutex.Unlock()
+
+	data, _ := json.Marshal(CursorMessage{Type: "external", Event: &ev})
+	hub.broadcastToOthers("", data)
+	hub.logEvent("external", ev.Source, data)
+	log.Printf("External event from %s for site %q: %s", ev.Source, site.Name, ev.Title)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func handleGetEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hub := tenantFor(r).hub
+	hub.mutex.RLock()
+	events := make([]ExternalEvent, len(hub.external))
+	copy(events, hub.external)
+	hub.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Highscore and location writes that fail because the database is briefly
+// unavailable (locked, disk full, I/O errors) are queued in memory and retried
+// with backoff, in order, so a player's record isn't lost to a blip.
+const (
+	writeQueueSize  = 1000
+	writeRetryBase  = time.Second
+	writeRetryMax   = time.Minute
+	writeRetryCheck = time.Second
+)
+
+// pendingWrite is a write waiting to be retried
+type pendingWrite struct {
+	desc     string
+	apply    func() error
+	attempts int
+	next     time.Time
+}
+
+// WriteQueueStats is reported in /api/stats
+type WriteQueueStats struct {
+	Depth   int   `json:"depth"`
+	Flushed int64 `json:"flushed"`
+	Dropped int64 `json:"dropped"`
+}
+
+// writeQueue is only flushed by its run goroutine, so a write is never applied
+// twice; others wake it with retryNow
+type writeQueue struct {
+	sync.Mutex
+	items   []*pendingWrite
+	flushed atomic.Int64
+	dropped atomic.Int64
+	wake    chan struct{}
+}
+
+var pendingWrites = &writeQueue{wake: make(chan struct{}, 1)}
+
+// errNameReserved drops a queued highscore whose name was taken in the meantime
+var errNameReserved = errors.New("name reserved")
+
+// isTransientDBError reports whether a failed write is worth retrying later
+func isTransientDBError(err error) bool {
+	var serr sqlite3.Error
+	if errors.As(err, &serr) && serr.Code == sqlite3.ErrFull {
+		return true
+	}
+	return needsReopen(err)
+}
+
+// enqueue queues a write for retry, returning false if the queue is full
+func (q *writeQueue) enqueue(desc string, apply func() error) bool {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.items) >= writeQueueSize {
+		q.dropped.Add(1)
+		log.Printf("Write queue full, dropping %s", desc)
+		return false
+	}
+	q.items = append(q.items, &pendingWrite{desc: desc, apply: apply, next: time.Now().Add(writeRetryBase)})
+	log.Printf("Queued %s for retry (depth %d)", desc, len(q.items))
+	return true
+}
+
+// flush applies queued writes in order, stopping at the first one that still
+// fails; only run calls it
+func (q *writeQueue) flush() {
+	for {
+		q.Lock()
+		if len(q.items) == 0 || time.Now().Before(q.items[0].next) {
+			q.Unlock()
+			return
+		}
+		w := q.items[0]
+		q.Unlock()
+
+		err := w.apply()
+
+		q.Lock()
+		if err == nil || !isTransientDBError(err) {
+			q.items = q.items[1:]
+			q.Unlock()
+			if err != nil {
+				q.dropped.Add(1)
+				log.Printf("Dropping queued %s: %v", w.desc, err)
+			} else {
+				q.flushed.Add(1)
+			}
+			continue
+		}
+		w.attempts++
+		backoff := writeRetryBase << w.attempts
+		if backoff > writeRetryMax || backoff <= 0 {
+			backoff = writeRetryMax
+		}
+		w.next = time.Now().Add(backoff)
+		q.Unlock()
+		log.Printf("Retry of %s failed (attempt %d): %v", w.desc, w.attempts, err)
+		return
+	}
+}
+
+// retryNow makes the next queued write due immediately, e.g. after the database recovers
+func (q *writeQueue) retryNow() {
+	q.Lock()
+	if len(q.items) > 0 {
+		q.items[0].next = time.Now()
+	}
+	q.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *writeQueue) run() {
+	ticker := time.NewTicker(writeRetryCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-q.wake:
+		}
+		q.flush()
+	}
+}
+
+func (q *writeQueue) stats() WriteQueueStats {
+	q.Lock()
+	depth := len(q.items)
+	q.Unlock()
+	return WriteQueueStats{Depth: depth, Flushed: q.flushed.Load(), Dropped: q.dropped.Load()}
+}
+
+// provisionalBoard shows a queued score on the cached board until it is saved
+func provisionalBoard(site *Tenant, game, name string, score int, country string) []Highscore {
+	board := []Highscore{{Game: game, Name: sanitizeName(name), Score: score, Country: normalizeCountry(country), Flag: countryFlag(normalizeCountry(country))}}
+	if cached, ok := highscoreCache.peek(highscoreCacheKey(site, game)); ok {
+		board = append(board, cached...)
+	}
+	sort.SliceStable(board, func(i, j int) bool { return board[i].Score > board[j].Score })
+	if len(board) > 5 {
+		board = board[:5]
+	}
+	for len(board) < 5 {
+		board = append(board, Highscore{Game: game, Name: "CON", Score: 0})
+	}
+	return board
+}